@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// githubOutputEnv is the file of the outputs of the current GitHub Actions step
+const githubOutputEnv = "GITHUB_OUTPUT"
+
+// actionsJob is an entry of the matrix of the `github_actions` output
+type actionsJob struct {
+	Name     string            `json:"name"`
+	Label    string            `json:"label,omitempty"`
+	Key      string            `json:"key,omitempty"`
+	Pipeline string            `json:"pipeline,omitempty"`
+	Command  string            `json:"command,omitempty"`
+	Env      map[string]string `json:"env,omitempty"`
+}
+
+// actionsJobs returns the matrix entries of the steps
+func actionsJobs(steps []Step) []actionsJob {
+	jobs := []actionsJob{}
+
+	for _, s := range steps {
+		if s.Wait || s.Raw != nil {
+			continue
+		}
+
+		job := actionsJob{Name: exportName(s), Label: s.Label, Key: s.Key, Pipeline: s.Trigger, Command: s.Command, Env: s.Env}
+		if s.Trigger != "" {
+			job.Env = s.Build.Env
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs
+}
+
+// writeActionsOutputs writes the steps as the `matched`, `names` and `matrix`
+// outputs of the GitHub Actions step, or prints them without GITHUB_OUTPUT
+func writeActionsOutputs(steps []Step) error {
+	jobs := actionsJobs(steps)
+
+	names := []string{}
+	for _, j := range jobs {
+		names = append(names, j.Name)
+	}
+
+	encodedNames, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+
+	matrix, err := json.Marshal(map[string][]actionsJob{"include": jobs})
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "matched=%t\n", len(jobs) > 0)
+	fmt.Fprintf(&b, "names=%s\n", encodedNames)
+	fmt.Fprintf(&b, "matrix=%s\n", matrix)
+
+	var out io.Writer = pipelineOutput
+	if file := env(githubOutputEnv, ""); file != "" {
+		f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("could not write the GitHub Actions outputs: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if _, err := io.WriteString(out, b.String()); err != nil {
+		return fmt.Errorf("could not write the GitHub Actions outputs: %v", err)
+	}
+
+	log.Infof("Wrote %d matched %s to the GitHub Actions outputs", len(jobs), pluralize(len(jobs), "step"))
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadPipelineGitHubActionsOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "actions")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "output")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("previous=1\n"), 0644))
+	os.Setenv(githubOutputEnv, file)
+	defer os.Unsetenv(githubOutputEnv)
+
+	plugin := Plugin{
+		Diff:   "printf 'services/foo/main.go\\ndocs/README.md\\n'",
+		Shell:  []string{"sh", "-c"},
+		Output: outputGitHubActions,
+		Watch: []WatchConfig{
+			{Paths: []string{"services/foo/"}, Step: Step{Trigger: "foo", Build: Build{Env: map[string]string{"SVC": "foo"}}}},
+			{Paths: []string{"docs/"}, Step: Step{Label: "Docs", Command: "make docs"}},
+			{Paths: []string{"services/bar/"}, Step: Step{Trigger: "bar"}},
+		},
+	}
+
+	generator := func(steps []Step, plugin Plugin) (*os.File, error) {
+		t.Fatal("the pipeline shouldn't be written to a file")
+		return nil, nil
+	}
+
+	_, _, err = uploadPipeline(plugin, generator)
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "previous=1\n"+
+		"matched=true\n"+
+		`names=["foo","Docs"]`+"\n"+
+		`matrix={"include":[{"name":"foo","pipeline":"foo","env":{"SVC":"foo"}},{"name":"Docs","label":"Docs","command":"make docs"}]}`+"\n",
+		string(data))
+}
+
+func TestUploadPipelineGitHubActionsNoMatch(t *testing.T) {
+	var out bytes.Buffer
+	pipelineOutput = &out
+	defer func() { pipelineOutput = os.Stdout }()
+
+	plugin := Plugin{
+		Diff:   "echo docs/README.md",
+		Output: outputGitHubActions,
+		Watch:  []WatchConfig{{Paths: []string{"services/foo/"}, Step: Step{Trigger: "foo"}}},
+	}
+
+	_, _, err := uploadPipeline(plugin, mockGeneratePipeline)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "matched=false\nnames=[]\nmatrix={\"include\":[]}\n", out.String())
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// matchedFilesDir is the directory of the matched files artifacts, relative
+// to the temporary directory they are uploaded from so it is kept in the
+// artifact paths
+const matchedFilesDir = "monorepo-diff"
+
+// matchedFilesEnv is the variable of the path of the matched files artifact of a step
+const matchedFilesEnv = "MONOREPO_DIFF_FILES_ARTIFACT"
+
+// variables of the artifacts of the parent build the step of a watch downloads
+const (
+	artifactsEnv      = "MONOREPO_DIFF_ARTIFACTS"
+	artifactsBuildEnv = "MONOREPO_DIFF_ARTIFACTS_BUILD"
+)
+
+var unsafeArtifactChars = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// artifactName names the matched files artifact of a watch after the key of
+// its step, or its label or pipeline
+func artifactName(w WatchConfig) string {
+	name := w.Step.Key
+	for _, candidate := range []string{w.Label, w.Step.Label, w.Step.Trigger, w.Pipeline} {
+		if name == "" {
+			name = candidate
+		}
+	}
+
+	name = strings.Trim(unsafeArtifactChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if name == "" {
+		name = "step"
+	}
+
+	return name
+}
+
+// setArtifactHints sets the `artifacts` queries of the watch, separated by `;`,
+// and the build they belong to in the env of its step, or of the triggered
+// build, so it can download them with `buildkite-agent artifact download`
+func setArtifactHints(watch *WatchConfig) {
+	if len(watch.Artifacts) == 0 {
+		return
+	}
+
+	watch.Step = withEnv(watch.Step, map[string]string{
+		artifactsEnv:      strings.Join(watch.Artifacts, ";"),
+		artifactsBuildEnv: env("BUILDKITE_BUILD_ID", ""),
+	})
+}
+
+// uploadMatchedFiles writes the matched files of every watch to a file of its
+// own and uploads them as artifacts of the build, so the triggered builds can
+// download the files relevant to them. The artifact path is set in the
+// MONOREPO_DIFF_FILES_ARTIFACT variable of the step. The files are written to
+// a temporary directory of the job, so the checkout is left as it is and the
+// files of earlier jobs on the agent are never uploaded.
+func uploadMatchedFiles(plugin Plugin, watches []WatchConfig) ([]WatchConfig, error) {
+	root, err := ioutil.TempDir("", "monorepo-diff-artifacts-")
+	if err != nil {
+		return nil, fmt.Errorf("could not create the matched files directory: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := os.Mkdir(filepath.Join(root, matchedFilesDir), 0755); err != nil {
+		return nil, fmt.Errorf("could not create the matched files directory: %v", err)
+	}
+
+	result := make([]WatchConfig, len(watches))
+	seen := map[string]int{}
+	written := 0
+
+	for i, w := range watches {
+		result[i] = w
+
+		if len(w.Files) == 0 {
+			continue
+		}
+
+		name := artifactName(w)
+		seen[name]++
+		if seen[name] > 1 {
+			name = fmt.Sprintf("%s-%d", name, seen[name])
+		}
+
+		path := filepath.Join(matchedFilesDir, name+".txt")
+		if err := ioutil.WriteFile(filepath.Join(root, path), []byte(strings.Join(w.Files, "\n")+"\n"), 0644); err != nil {
+			return nil, fmt.Errorf("could not write the matched files of %s: %v", stepName(w.Step), err)
+		}
+
+		result[i].Step = withEnv(w.Step, map[string]string{matchedFilesEnv: filepath.ToSlash(path)})
+		written++
+	}
+
+	if written == 0 {
+		return result, nil
+	}
+
+	log.Infof("Uploading %d matched files %s", written, pluralize(written, "artifact"))
+
+	// the agent runs from the temporary directory, so a relative path to it
+	// is resolved from the checkout first
+	agent := agentBinary(plugin)
+	if strings.ContainsRune(agent, '/') || strings.ContainsRune(agent, filepath.Separator) {
+		if abs, err := filepath.Abs(agent); err == nil {
+			agent = abs
+		}
+	}
+
+	args := append(append([]string{}, plugin.AgentArgs...), "artifact", "upload", matchedFilesDir+"/*.txt")
+	cmd := exec.CommandContext(jobContext, agent, args...)
+	cmd.Dir = root
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := runProcess(cmd); err != nil {
+		log.Debugf("\ncommand = '%s', \nargs = '%s', \nerror = '%s'", agent, args, stderr.String())
+		return nil, fmt.Errorf("could not upload the matched files: command `%s` failed: %v", agent, err)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArtifactName(t *testing.T) {
+	testCases := map[string]struct {
+		watch    WatchConfig
+		expected string
+	}{
+		"key":     {WatchConfig{Label: "Foo", Step: Step{Key: "deploy-foo", Trigger: "foo"}}, "deploy-foo"},
+		"label":   {WatchConfig{Label: "Foo Service", Step: Step{Trigger: "foo"}}, "foo-service"},
+		"trigger": {WatchConfig{Step: Step{Trigger: "foo"}}, "foo"},
+		"command": {WatchConfig{Step: Step{Label: ":rocket: Deploy", Command: "make"}}, "rocket-deploy"},
+		"none":    {WatchConfig{Step: Step{Command: "make"}}, "step"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, artifactName(tc.watch))
+		})
+	}
+}
+
+// artifactAgent returns an agent binary copying the uploaded matched files to
+// dir, and recording the directory it ran from
+func artifactAgent(t *testing.T, dir string) string {
+	agent := filepath.Join(dir, "buildkite-agent")
+	script := "#!/bin/sh\n[ \"$1\" = artifact ] || exit 0\npwd > " + filepath.Join(dir, "pwd") + "\ncp -R monorepo-diff " + filepath.Join(dir, "uploaded") + "\n"
+	assert.NoError(t, ioutil.WriteFile(agent, []byte(script), 0755))
+
+	return agent
+}
+
+func TestUploadPipelineUploadsMatchedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	plugin := Plugin{
+		Diff:                  "printf services/foo/main.go\\nservices/foo/go.mod\\nservices/bar/main.go\\n",
+		MatchedFilesArtifacts: true,
+		AgentBinary:           artifactAgent(t, dir),
+		Watch: []WatchConfig{
+			{Paths: []string{"services/foo/"}, Step: Step{Trigger: "foo"}},
+			{Paths: []string{"services/bar/"}, Step: Step{Command: "make bar", Key: "bar"}},
+			{Paths: []string{"docs/"}, Step: Step{Trigger: "docs"}},
+		},
+	}
+
+	var generated []Step
+	generator := func(steps []Step, plugin Plugin) (*os.File, error) {
+		generated = steps
+		return mockGeneratePipeline(steps, plugin)
+	}
+
+	_, _, err = uploadPipeline(plugin, generator)
+	assert.NoError(t, err)
+
+	foo, err := ioutil.ReadFile(filepath.Join(dir, "uploaded", "foo.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "services/foo/go.mod\nservices/foo/main.go\n", string(foo))
+
+	bar, err := ioutil.ReadFile(filepath.Join(dir, "uploaded", "bar.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "services/bar/main.go\n", string(bar))
+
+	assert.Len(t, generated, 2)
+	assert.Equal(t, "monorepo-diff/foo.txt", generated[0].Build.Env[matchedFilesEnv])
+	assert.Equal(t, "monorepo-diff/bar.txt", generated[1].Env[matchedFilesEnv])
+
+	// the files are uploaded from a temporary directory of the job, removed after the upload
+	pwd, err := ioutil.ReadFile(filepath.Join(dir, "pwd"))
+	assert.NoError(t, err)
+	assert.NoDirExists(t, strings.TrimSpace(string(pwd)))
+	assert.NoDirExists(t, matchedFilesDir)
+}
+
+func TestUploadMatchedFilesNamesDuplicatesApart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	watches := []WatchConfig{
+		{Step: Step{Trigger: "deploy"}, Files: []string{"services/foo/main.go"}},
+		{Step: Step{Trigger: "deploy"}, Files: []string{"services/bar/main.go"}},
+		{Step: Step{Trigger: "docs"}},
+	}
+
+	got, err := uploadMatchedFiles(Plugin{AgentBinary: artifactAgent(t, dir)}, watches)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "monorepo-diff/deploy.txt", got[0].Step.Build.Env[matchedFilesEnv])
+	assert.Equal(t, "monorepo-diff/deploy-2.txt", got[1].Step.Build.Env[matchedFilesEnv])
+	assert.Nil(t, got[2].Step.Build.Env)
+
+	uploaded, err := ioutil.ReadDir(filepath.Join(dir, "uploaded"))
+	assert.NoError(t, err)
+	assert.Len(t, uploaded, 2)
+}
+
+func TestPluginWithArtifactHints(t *testing.T) {
+	os.Setenv("BUILDKITE_BUILD_ID", "parent-build")
+	defer os.Unsetenv("BUILDKITE_BUILD_ID")
+
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [
+				{ "path": "services/foo/", "artifacts": ["dist/foo/*.tar.gz", "coverage/foo.xml"], "config": { "trigger": "deploy-foo" } },
+				{ "path": "docs/", "artifacts": "site/**/*", "config": { "command": "make publish" } },
+				{ "path": "tools/", "config": { "trigger": "tools" } }
+			]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dist/foo/*.tar.gz", "coverage/foo.xml"}, got.Watch[0].Artifacts)
+	assert.Nil(t, got.Watch[0].RawArtifacts)
+	assert.Equal(t, "dist/foo/*.tar.gz;coverage/foo.xml", got.Watch[0].Step.Build.Env[artifactsEnv])
+	assert.Equal(t, "parent-build", got.Watch[0].Step.Build.Env[artifactsBuildEnv])
+	assert.Equal(t, map[string]string{artifactsEnv: "site/**/*", artifactsBuildEnv: "parent-build"}, got.Watch[1].Step.Env)
+	assert.NotContains(t, got.Watch[2].Step.Build.Env, artifactsEnv)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// auditRecord is the record of a run sent to the `audit_log`: who built what,
+// and what the plugin triggered because of it
+type auditRecord struct {
+	Time         string `json:"time"`
+	Organization string `json:"organization"`
+	Pipeline     string `json:"pipeline"`
+	BuildNumber  string `json:"build_number"`
+	BuildURL     string `json:"build_url"`
+	JobID        string `json:"job_id"`
+	Commit       string `json:"commit"`
+	Branch       string `json:"branch"`
+	Source       string `json:"source"`
+	Creator      string `json:"creator"`
+	CreatorEmail string `json:"creator_email"`
+	ChangedFiles int    `json:"changed_files"`
+	// ChangedFilesPartial is whether the diff was stopped early, so ChangedFiles is a lower bound
+	ChangedFilesPartial bool `json:"changed_files_partial,omitempty"`
+	// MatchedWatches and Steps are counts, Triggered the slugs of the triggered pipelines
+	MatchedWatches int      `json:"matched_watches"`
+	Steps          int      `json:"steps"`
+	Triggered      []string `json:"triggered_pipelines"`
+	Outcome        string   `json:"outcome"`
+	Error          string   `json:"error,omitempty"`
+}
+
+// newAuditRecord returns the record of the run with the counts of the metrics
+// and the generated steps
+func newAuditRecord(metrics runMetrics, steps []Step, failure error) auditRecord {
+	record := auditRecord{
+		Time:                now().UTC().Format(time.RFC3339),
+		Organization:        env("BUILDKITE_ORGANIZATION_SLUG", ""),
+		Pipeline:            env("BUILDKITE_PIPELINE_SLUG", ""),
+		BuildNumber:         env("BUILDKITE_BUILD_NUMBER", ""),
+		BuildURL:            env("BUILDKITE_BUILD_URL", ""),
+		JobID:               env("BUILDKITE_JOB_ID", ""),
+		Commit:              env("BUILDKITE_COMMIT", ""),
+		Branch:              env("BUILDKITE_BRANCH", ""),
+		Source:              env("BUILDKITE_SOURCE", ""),
+		Creator:             env("BUILDKITE_BUILD_CREATOR", ""),
+		CreatorEmail:        env("BUILDKITE_BUILD_CREATOR_EMAIL", ""),
+		ChangedFiles:        metrics.changedFiles,
+		ChangedFilesPartial: metrics.partial,
+		MatchedWatches:      metrics.matchedWatches,
+		Steps:               metrics.steps,
+		Triggered:           triggeredSlugs(steps),
+		Outcome:             "success",
+	}
+
+	if failure != nil {
+		record.Outcome = "failure"
+		record.Error = secrets.redact(failure.Error())
+	}
+
+	return record
+}
+
+// triggeredSlugs returns the sorted slugs of the pipelines triggered by the
+// steps, `<org>/<pipeline>` for pipelines of other organizations
+func triggeredSlugs(steps []Step) []string {
+	org := env("BUILDKITE_ORGANIZATION_SLUG", "")
+	seen := map[string]bool{}
+	slugs := []string{}
+
+	for _, s := range steps {
+		if s.Trigger == "" {
+			continue
+		}
+
+		slug := s.Trigger
+		if s.Organization != "" && s.Organization != org {
+			slug = s.Organization + "/" + s.Trigger
+		}
+
+		if !seen[slug] {
+			seen[slug] = true
+			slugs = append(slugs, slug)
+		}
+	}
+	sort.Strings(slugs)
+
+	return slugs
+}
+
+// writeAuditLog posts the record to the `audit_log` webhook, or copies it to
+// its S3 location, named after the build and the job
+func writeAuditLog(location string, record auditRecord) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Warnf("could not write the audit log: %v", err)
+		return
+	}
+
+	if strings.HasPrefix(location, "s3://") {
+		err = copyToS3(location, record, data)
+	} else {
+		err = postAuditRecord(location, data)
+	}
+
+	if err != nil {
+		log.Warnf("could not write the audit log: %v", err)
+		return
+	}
+
+	log.Debugf("Audit record written to %s", location)
+}
+
+func postAuditRecord(url string, data []byte) error {
+	req, err := http.NewRequestWithContext(jobContext, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("POST %s: %s", url, resp.Status)
+	}
+
+	return nil
+}
+
+// copyToS3 copies the record to `<location>/<org>/<pipeline>/<build number>/<job>.json` with the aws CLI
+func copyToS3(location string, record auditRecord, data []byte) error {
+	tmp, err := ioutil.TempFile(os.TempDir(), "monorepo-diff-audit-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	target := fmt.Sprintf(
+		"%s/%s/%s/%s/%s.json",
+		strings.TrimSuffix(location, "/"), record.Organization, record.Pipeline, record.BuildNumber, record.JobID,
+	)
+
+	_, err = executeCommand("aws", []string{"s3", "cp", tmp.Name(), target})
+
+	return err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadPipelineAuditLog(t *testing.T) {
+	var record auditRecord
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&record))
+	}))
+	defer server.Close()
+
+	plugin := Plugin{
+		Diff:     "printf 'services/foo/main.go\\nservices/bar/main.go\\ndocs/README.md\\n'",
+		Shell:    []string{"sh", "-c"},
+		AuditLog: server.URL,
+		Watch: []WatchConfig{
+			{Paths: []string{"services/foo/"}, Step: Step{Trigger: "foo-service"}},
+			{Paths: []string{"services/bar/"}, Step: Step{Trigger: "bar-service"}},
+			{Paths: []string{"infra/"}, Step: Step{Command: "make infra"}},
+		},
+	}
+
+	_, _, err := uploadPipeline(plugin, mockGeneratePipeline)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "123", record.Commit)
+	assert.Equal(t, "go-rewrite", record.Branch)
+	assert.Equal(t, 3, record.ChangedFiles)
+	assert.False(t, record.ChangedFilesPartial)
+	assert.Equal(t, 2, record.MatchedWatches)
+	assert.Equal(t, 2, record.Steps)
+	assert.Equal(t, []string{"bar-service", "foo-service"}, record.Triggered)
+	assert.Equal(t, "success", record.Outcome)
+	assert.Empty(t, record.Error)
+}
+
+func TestNewAuditRecordPartialDiff(t *testing.T) {
+	record := newAuditRecord(runMetrics{changedFiles: 40, partial: true}, nil, nil)
+
+	assert.Equal(t, 40, record.ChangedFiles)
+	assert.True(t, record.ChangedFilesPartial)
+}
+
+func TestNewAuditRecordFailure(t *testing.T) {
+	record := newAuditRecord(runMetrics{}, nil, errors.New("diff failed"))
+
+	assert.Equal(t, "failure", record.Outcome)
+	assert.Equal(t, "diff failed", record.Error)
+	assert.Equal(t, []string{}, record.Triggered)
+}
+
+func TestTriggeredSlugs(t *testing.T) {
+	os.Setenv("BUILDKITE_ORGANIZATION_SLUG", "acme")
+	defer os.Unsetenv("BUILDKITE_ORGANIZATION_SLUG")
+
+	steps := []Step{
+		{Trigger: "foo-service"},
+		{Command: "make docs"},
+		{Trigger: "foo-service", Organization: "acme"},
+		{Trigger: "deploy", Organization: "platform"},
+	}
+
+	assert.Equal(t, []string{"foo-service", "platform/deploy"}, triggeredSlugs(steps))
+}
+
+func TestWriteAuditLogS3(t *testing.T) {
+	bin, err := ioutil.TempDir("", "audit-bin")
+	assert.NoError(t, err)
+	defer os.RemoveAll(bin)
+
+	// aws s3 cp <file> <target> records its target and the record
+	out := filepath.Join(bin, "out")
+	script := "#!/bin/sh\necho \"$4\" > " + out + "\ncat \"$3\" >> " + out + "\n"
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(bin, "aws"), []byte(script), 0755))
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	defer os.Setenv("PATH", path)
+
+	record := auditRecord{Organization: "acme", Pipeline: "monorepo", BuildNumber: "42", JobID: "job-1", Outcome: "success"}
+	writeAuditLog("s3://audit/builds/", record)
+
+	written, err := ioutil.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Contains(t, string(written), "s3://audit/builds/acme/monorepo/42/job-1.json\n")
+	assert.Contains(t, string(written), `"outcome":"success"`)
+}
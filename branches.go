@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// BranchRule maps the branches matching Pattern to Branch
+type BranchRule struct {
+	Pattern string
+	Branch  string
+}
+
+// parseBranchMap parses rules in the format `pattern -> branch`
+func parseBranchMap(raw []string) ([]BranchRule, error) {
+	var rules []BranchRule
+
+	for _, r := range raw {
+		parts := strings.SplitN(r, "->", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid branch_map rule `%s`, expected `pattern -> branch`", r)
+		}
+
+		rule := BranchRule{Pattern: strings.TrimSpace(parts[0]), Branch: strings.TrimSpace(parts[1])}
+		if rule.Pattern == "" || rule.Branch == "" {
+			return nil, fmt.Errorf("invalid branch_map rule `%s`, expected `pattern -> branch`", r)
+		}
+
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid branch_map pattern `%s`: %v", rule.Pattern, err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// mapBranch returns the branch of the first rule matching the branch,
+// or the branch itself when no rule matches
+func mapBranch(rules []BranchRule, branch string) string {
+	for _, r := range rules {
+		if match, _ := path.Match(r.Pattern, branch); match {
+			return r.Branch
+		}
+	}
+
+	return branch
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBranchMap(t *testing.T) {
+	rules, err := parseBranchMap([]string{"release/* -> release", "*->main"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []BranchRule{
+		{Pattern: "release/*", Branch: "release"},
+		{Pattern: "*", Branch: "main"},
+	}, rules)
+
+	_, err = parseBranchMap([]string{"release/*"})
+	assert.EqualError(t, err, "invalid branch_map rule `release/*`, expected `pattern -> branch`")
+
+	_, err = parseBranchMap([]string{" -> main"})
+	assert.EqualError(t, err, "invalid branch_map rule ` -> main`, expected `pattern -> branch`")
+
+	_, err = parseBranchMap([]string{"[ -> main"})
+	assert.EqualError(t, err, "invalid branch_map pattern `[`: syntax error in pattern")
+}
+
+func TestMapBranch(t *testing.T) {
+	rules := []BranchRule{
+		{Pattern: "release/*", Branch: "release"},
+		{Pattern: "master", Branch: "main"},
+	}
+
+	assert.Equal(t, "release", mapBranch(rules, "release/1.2"))
+	assert.Equal(t, "main", mapBranch(rules, "master"))
+	assert.Equal(t, "feature/foo", mapBranch(rules, "feature/foo"))
+	assert.Equal(t, "feature/foo", mapBranch(nil, "feature/foo"))
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// httpClient is used for all requests to external APIs
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// agentPipelineUpload is the request body of the agent API pipeline upload
+type agentPipelineUpload struct {
+	UUID     string      `json:"uuid"`
+	Pipeline interface{} `json:"pipeline"`
+	Replace  bool        `json:"replace"`
+}
+
+// uploadPipelineAPI uploads the pipeline file to the current job through the
+// Buildkite agent API, which doesn't require the buildkite-agent binary. The
+// uuid identifies the upload, so a retried request doesn't upload it twice.
+// Without the agent, the pipeline is interpolated by the plugin.
+func uploadPipelineAPI(file string, uuid string, replace bool, interpolate bool) error {
+	token := env("BUILDKITE_AGENT_ACCESS_TOKEN", "")
+	job := env("BUILDKITE_JOB_ID", "")
+
+	if token == "" || job == "" {
+		return fmt.Errorf("BUILDKITE_AGENT_ACCESS_TOKEN and BUILDKITE_JOB_ID are required to upload via the API")
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("could not read pipeline file: %v", err)
+	}
+
+	var pipeline interface{}
+	if err := yaml.Unmarshal(data, &pipeline); err != nil {
+		return fmt.Errorf("could not parse pipeline file: %v", err)
+	}
+
+	pipeline = jsonCompatible(pipeline)
+	if interpolate {
+		if pipeline, err = interpolateValue(pipeline); err != nil {
+			return fmt.Errorf("could not interpolate pipeline file: %v", err)
+		}
+	}
+
+	upload := agentPipelineUpload{
+		UUID:     uuid,
+		Pipeline: pipeline,
+		Replace:  replace,
+	}
+
+	endpoint := strings.TrimSuffix(env("BUILDKITE_AGENT_ENDPOINT", "https://agent.buildkite.com/v3"), "/")
+	target := fmt.Sprintf("%s/jobs/%s/pipelines", endpoint, job)
+
+	if err := sendJSON(http.MethodPost, target, token, upload, nil); err != nil {
+		return fmt.Errorf("pipeline upload request failed: %v", err)
+	}
+
+	return nil
+}
+
+// buildkiteAPI is a client for the Buildkite REST API
+type buildkiteAPI struct {
+	endpoint string
+	token    string
+}
+
+// apiBuild is a build returned by the Buildkite REST API
+type apiBuild struct {
+	ID            string            `json:"id"`
+	Number        int               `json:"number"`
+	State         string            `json:"state"`
+	WebURL        string            `json:"web_url"`
+	Commit        string            `json:"commit"`
+	Branch        string            `json:"branch"`
+	Message       string            `json:"message"`
+	Env           map[string]string `json:"env"`
+	TriggeredFrom struct {
+		BuildID           string `json:"build_id"`
+		BuildPipelineSlug string `json:"build_pipeline_slug"`
+	} `json:"triggered_from"`
+	Jobs []apiJob `json:"jobs"`
+}
+
+// apiJob is a job of a build returned by the Buildkite REST API
+type apiJob struct {
+	ID       string `json:"id"`
+	StepKey  string `json:"step_key"`
+	Priority struct {
+		Number int `json:"number"`
+	} `json:"priority"`
+}
+
+func newBuildkiteAPI() (*buildkiteAPI, error) {
+	token := env("BUILDKITE_API_TOKEN", "")
+	if token == "" {
+		return nil, categorize(apiCategory, fmt.Errorf("BUILDKITE_API_TOKEN is required to use the Buildkite API"))
+	}
+
+	return &buildkiteAPI{
+		endpoint: strings.TrimSuffix(env("BUILDKITE_API_ENDPOINT", "https://api.buildkite.com/v2"), "/"),
+		token:    token,
+	}, nil
+}
+
+// builds lists the builds of a pipeline matching the query
+func (api *buildkiteAPI) builds(org string, pipeline string, query url.Values) ([]apiBuild, error) {
+	var builds []apiBuild
+
+	path := fmt.Sprintf("/organizations/%s/pipelines/%s/builds?%s", org, pipeline, query.Encode())
+	if err := sendJSON(http.MethodGet, api.endpoint+path, api.token, nil, &builds); err != nil {
+		return nil, categorize(apiCategory, fmt.Errorf("could not list builds of %s: %v", pipeline, err))
+	}
+
+	return builds, nil
+}
+
+// build gets a build of a pipeline by its number
+func (api *buildkiteAPI) build(org string, pipeline string, number string) (*apiBuild, error) {
+	var build apiBuild
+
+	path := fmt.Sprintf("/organizations/%s/pipelines/%s/builds/%s", org, pipeline, number)
+	if err := sendJSON(http.MethodGet, api.endpoint+path, api.token, nil, &build); err != nil {
+		return nil, categorize(apiCategory, fmt.Errorf("could not get build %s of %s: %v", number, pipeline, err))
+	}
+
+	return &build, nil
+}
+
+// rebuild starts a new build of a pipeline with the settings of an existing one
+func (api *buildkiteAPI) rebuild(org string, pipeline string, number int) (*apiBuild, error) {
+	var rebuilt apiBuild
+
+	path := fmt.Sprintf("/organizations/%s/pipelines/%s/builds/%d/rebuild", org, pipeline, number)
+	if err := sendJSON(http.MethodPut, api.endpoint+path, api.token, nil, &rebuilt); err != nil {
+		return nil, categorize(apiCategory, fmt.Errorf("could not rebuild build %d of %s: %v", number, pipeline, err))
+	}
+
+	return &rebuilt, nil
+}
+
+// cancel cancels a scheduled or running build of a pipeline
+func (api *buildkiteAPI) cancel(org string, pipeline string, number int) error {
+	path := fmt.Sprintf("/organizations/%s/pipelines/%s/builds/%d/cancel", org, pipeline, number)
+	if err := sendJSON(http.MethodPut, api.endpoint+path, api.token, nil, nil); err != nil {
+		return categorize(apiCategory, fmt.Errorf("could not cancel build %d of %s: %v", number, pipeline, err))
+	}
+
+	return nil
+}
+
+// apiCreateBuild is the request body to create a build with the Buildkite REST API
+type apiCreateBuild struct {
+	Commit   string            `json:"commit"`
+	Branch   string            `json:"branch"`
+	Message  string            `json:"message,omitempty"`
+	Env      map[string]string `json:"env,omitempty"`
+	MetaData map[string]string `json:"meta_data,omitempty"`
+}
+
+// createBuild creates a build of a pipeline
+func (api *buildkiteAPI) createBuild(org string, pipeline string, build Build) (*apiBuild, error) {
+	var created apiBuild
+
+	body := apiCreateBuild{
+		Commit:   build.Commit,
+		Branch:   build.Branch,
+		Message:  build.Message,
+		Env:      build.Env,
+		MetaData: build.MetaData,
+	}
+
+	path := fmt.Sprintf("/organizations/%s/pipelines/%s/builds", org, pipeline)
+	if err := sendJSON(http.MethodPost, api.endpoint+path, api.token, body, &created); err != nil {
+		return nil, categorize(apiCategory, fmt.Errorf("could not create a build of %s/%s: %v", org, pipeline, err))
+	}
+
+	return &created, nil
+}
+
+// apiPipeline is a pipeline returned by the Buildkite REST API
+type apiPipeline struct {
+	Slug       string  `json:"slug"`
+	ArchivedAt *string `json:"archived_at"`
+}
+
+// pipeline returns the pipeline of the organization, or nil when it doesn't exist
+func (api *buildkiteAPI) pipeline(org string, pipeline string) (*apiPipeline, error) {
+	var p apiPipeline
+
+	path := fmt.Sprintf("/organizations/%s/pipelines/%s", org, pipeline)
+
+	err := sendJSON(http.MethodGet, api.endpoint+path, api.token, nil, &p)
+	if apiErr, ok := err.(*apiError); ok && apiErr.status == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, categorize(apiCategory, fmt.Errorf("could not get pipeline %s: %v", pipeline, err))
+	}
+
+	return &p, nil
+}
+
+// apiError is an unsuccessful response from an API
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+// sendJSON sends a request with an optional JSON body and decodes the JSON response into out
+func sendJSON(method string, target string, token string, body interface{}, out interface{}) error {
+	var reader io.Reader
+
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("could not serialize the request: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(jobContext, method, target, reader)
+	if err != nil {
+		return err
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return &apiError{
+			status:  resp.StatusCode,
+			message: fmt.Sprintf("%s: %s", resp.Status, strings.TrimSpace(string(msg))),
+		}
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// annotate adds or replaces an annotation on the current build
+func annotate(plugin Plugin, style string, context string, body string) error {
+	args := append([]string{}, plugin.AgentArgs...)
+	args = append(args, "annotate", "--style", style, "--context", context, body)
+
+	_, err := executeCommand(agentBinary(plugin), args)
+
+	return err
+}
+
+// jsonCompatible converts the maps produced by yaml.Unmarshal,
+// which have interface{} keys, into maps that can be encoded as JSON.
+func jsonCompatible(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(value))
+		for k, item := range value {
+			result[fmt.Sprint(k)] = jsonCompatible(item)
+		}
+		return result
+	case []interface{}:
+		for i, item := range value {
+			value[i] = jsonCompatible(item)
+		}
+		return value
+	}
+
+	return v
+}
+
+// newUUID returns a random version 4 UUID
+func newUUID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
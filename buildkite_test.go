@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadPipelineAPI(t *testing.T) {
+	var got agentPipelineUpload
+	var auth, path string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		path = r.URL.Path
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	os.Setenv("BUILDKITE_AGENT_ENDPOINT", server.URL+"/v3")
+	os.Setenv("BUILDKITE_AGENT_ACCESS_TOKEN", "agent-token")
+	os.Setenv("BUILDKITE_JOB_ID", "job-1")
+	defer os.Unsetenv("BUILDKITE_AGENT_ENDPOINT")
+	defer os.Unsetenv("BUILDKITE_AGENT_ACCESS_TOKEN")
+	defer os.Unsetenv("BUILDKITE_JOB_ID")
+
+	file, _ := ioutil.TempFile("", "pipeline")
+	defer os.Remove(file.Name())
+	_, _ = file.WriteString("steps:\n- trigger: foo-service\n  build:\n    branch: $BUILDKITE_BRANCH\n    message: costs $$5\n- wait\n")
+
+	err := uploadPipelineAPI(file.Name(), "b7a5e9c4-0c6e-4b8e-9d8a-5f4a3c2b1a09", true, true)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "Token agent-token", auth)
+	assert.Equal(t, "/v3/jobs/job-1/pipelines", path)
+	assert.True(t, got.Replace)
+	assert.Equal(t, "b7a5e9c4-0c6e-4b8e-9d8a-5f4a3c2b1a09", got.UUID)
+	assert.Equal(t, map[string]interface{}{
+		"steps": []interface{}{
+			map[string]interface{}{
+				"trigger": "foo-service",
+				"build":   map[string]interface{}{"branch": "go-rewrite", "message": "costs $5"},
+			},
+			"wait",
+		},
+	}, got.Pipeline)
+
+	err = uploadPipelineAPI(file.Name(), "b7a5e9c4-0c6e-4b8e-9d8a-5f4a3c2b1a09", false, false)
+
+	assert.NoError(t, err)
+	assert.False(t, got.Replace)
+	assert.Equal(t, "$BUILDKITE_BRANCH", got.Pipeline.(map[string]interface{})["steps"].([]interface{})[0].(map[string]interface{})["build"].(map[string]interface{})["branch"])
+}
+
+func TestUploadPipelineAPIRetriesWithTheSameUUID(t *testing.T) {
+	uuids := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upload agentPipelineUpload
+		_ = json.NewDecoder(r.Body).Decode(&upload)
+		uuids = append(uuids, upload.UUID)
+
+		if len(uuids) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	os.Setenv("BUILDKITE_AGENT_ENDPOINT", server.URL)
+	os.Setenv("BUILDKITE_AGENT_ACCESS_TOKEN", "agent-token")
+	os.Setenv("BUILDKITE_JOB_ID", "job-1")
+	defer os.Unsetenv("BUILDKITE_AGENT_ENDPOINT")
+	defer os.Unsetenv("BUILDKITE_AGENT_ACCESS_TOKEN")
+	defer os.Unsetenv("BUILDKITE_JOB_ID")
+
+	plugin := Plugin{
+		Diff:          "echo services/foo/main.go",
+		UploadMethod:  "api",
+		UploadRetries: 2,
+		Watch:         []WatchConfig{{Paths: []string{"services/foo/"}, Step: Step{Trigger: "foo"}}},
+	}
+
+	_, _, err := uploadPipeline(plugin, generatePipeline)
+
+	assert.NoError(t, err)
+	assert.Len(t, uuids, 2)
+	assert.Equal(t, uuids[0], uuids[1])
+}
+
+func TestUploadPipelineAPIFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_, _ = w.Write([]byte(`{"message":"invalid pipeline"}`))
+	}))
+	defer server.Close()
+
+	os.Setenv("BUILDKITE_AGENT_ENDPOINT", server.URL)
+	os.Setenv("BUILDKITE_AGENT_ACCESS_TOKEN", "agent-token")
+	os.Setenv("BUILDKITE_JOB_ID", "job-1")
+	defer os.Unsetenv("BUILDKITE_AGENT_ENDPOINT")
+	defer os.Unsetenv("BUILDKITE_AGENT_ACCESS_TOKEN")
+	defer os.Unsetenv("BUILDKITE_JOB_ID")
+
+	file, _ := ioutil.TempFile("", "pipeline")
+	defer os.Remove(file.Name())
+
+	err := uploadPipelineAPI(file.Name(), newUUID(), false, false)
+
+	assert.EqualError(t, err, `pipeline upload request failed: 422 Unprocessable Entity: {"message":"invalid pipeline"}`)
+}
+
+func TestUploadPipelineAPIRequiresToken(t *testing.T) {
+	err := uploadPipelineAPI("pipeline.yml", newUUID(), false, false)
+
+	assert.EqualError(t, err, "BUILDKITE_AGENT_ACCESS_TOKEN and BUILDKITE_JOB_ID are required to upload via the API")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// matcherCache stores the files printed by matcher commands in `cache_dir`,
+// in a directory per base and head commit of the diff, so the steps of a
+// build and its retries reuse the output of slow graph tools
+type matcherCache struct {
+	dir string
+}
+
+// cacheMaxAge is how long the entries of commits that aren't routed again are kept
+const cacheMaxAge = 7 * 24 * time.Hour
+
+// newMatcherCache returns the cache of the commits of the diff, or nil
+// without a `cache_dir` or when the commits can't be resolved, since the
+// output of a command for other commits could differ for the same files.
+// Entries of commits that weren't used for cacheMaxAge are removed.
+func newMatcherCache(plugin Plugin) *matcherCache {
+	if plugin.CacheDir == "" {
+		return nil
+	}
+
+	base, head := "unknown", resolveCommit(env("BUILDKITE_COMMIT", "HEAD"))
+	if revision := knownDiffBase(plugin); revision != "" {
+		base = resolveCommit(revision)
+	}
+
+	if base == "unknown" || head == "unknown" {
+		log.Infof("Not caching the matcher commands, the commits of the diff are unknown")
+		return nil
+	}
+
+	cache := &matcherCache{dir: filepath.Join(plugin.CacheDir, base+".."+head)}
+	cache.prune(plugin.CacheDir)
+
+	return cache
+}
+
+// prune removes the entries of the commits not used for cacheMaxAge, and marks
+// the entry of the cache as used
+func (c *matcherCache) prune(root string) {
+	if err := os.Chtimes(c.dir, now(), now()); err != nil && !os.IsNotExist(err) {
+		log.Warnf("could not mark %s as used: %v", c.dir, err)
+	}
+
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.Contains(entry.Name(), "..") || now().Sub(entry.ModTime()) < cacheMaxAge {
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(root, entry.Name())); err != nil {
+			log.Warnf("could not remove %s from the cache: %v", entry.Name(), err)
+		}
+	}
+}
+
+// resolveCommit returns the SHA of a revision, or of the merge base of a
+// `base...head` range, and `unknown` when it can't be resolved, e.g. in a
+// shallow clone. Entries are also keyed by the changed files, so they are
+// still only reused for the same diff.
+func resolveCommit(revision string) string {
+	commit, err := mergeBase(revision)
+	if err == nil {
+		commit, err = executeCommand("git", []string{"rev-parse", "--verify", commit + "^{commit}"})
+	}
+
+	if err != nil {
+		log.Debugf("Could not resolve %s for the cache: %v", revision, err)
+		return "unknown"
+	}
+
+	return strings.TrimSpace(commit)
+}
+
+// path returns the file of the output of the command for the digest of the
+// changed files
+func (c *matcherCache) path(script string, digest string) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%x", sha256.Sum256([]byte(script+"\x00"+digest))))
+}
+
+// get returns the files the command printed for the changed files, and
+// whether they were cached
+func (c *matcherCache) get(script string, digest string) ([]string, bool) {
+	data, err := ioutil.ReadFile(c.path(script, digest))
+	if err != nil {
+		return nil, false
+	}
+
+	files := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			files = append(files, line)
+		}
+	}
+
+	return files, true
+}
+
+// put stores the files the command printed for the changed files. It is
+// written to a temporary file first, so concurrent steps never read a
+// partial entry. Failures only skip the cache.
+func (c *matcherCache) put(script string, digest string, files []string) {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		log.Warnf("could not create the cache directory %s: %v", c.dir, err)
+		return
+	}
+
+	tmp, err := ioutil.TempFile(c.dir, ".tmp-")
+	if err != nil {
+		log.Warnf("could not write to the cache: %v", err)
+		return
+	}
+
+	_, err = tmp.WriteString(strings.Join(files, "\n"))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path(script, digest))
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Warnf("could not write to the cache: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchCommandsWithCache(t *testing.T) {
+	os.Setenv("BUILDKITE_COMMIT", "HEAD")
+	defer os.Setenv("BUILDKITE_COMMIT", "123")
+
+	dir, err := ioutil.TempDir("", "cache")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	runs := filepath.Join(dir, "runs")
+	plugin := Plugin{Shell: []string{"sh", "-c"}, CacheDir: filepath.Join(dir, "cache"), DiffBase: "HEAD"}
+	watch := []WatchConfig{
+		{Matcher: matcherCommand, Script: "echo run >> " + runs + "; grep ^libs/ || true", Step: Step{Trigger: "shared"}},
+		{Matcher: matcherCommand, Script: "echo run >> " + runs + "; grep ^apps/ || true", Step: Step{Trigger: "apps"}},
+	}
+
+	match := func(files ...string) ([]bool, []WatchConfig) {
+		matched := make([]bool, len(watch))
+		got, err := matchCommands(plugin, watch, matched, sliceSource(files))
+		assert.NoError(t, err)
+		return matched, got
+	}
+
+	matched, got := match("libs/util.go", "docs/a.md")
+	assert.Equal(t, []bool{true, false}, matched)
+	assert.Equal(t, []string{"libs/util.go"}, got[0].Files)
+
+	matched, got = match("libs/util.go", "docs/a.md")
+	assert.Equal(t, []bool{true, false}, matched)
+	assert.Equal(t, []string{"libs/util.go"}, got[0].Files)
+
+	data, err := ioutil.ReadFile(runs)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(data), "run"), "the second match is cached")
+
+	matched, _ = match("apps/web/main.go")
+	assert.Equal(t, []bool{false, true}, matched)
+
+	data, err = ioutil.ReadFile(runs)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, strings.Count(string(data), "run"), "other changed files aren't cached")
+}
+
+func TestMatcherCacheIsKeyedByCommits(t *testing.T) {
+	os.Setenv("BUILDKITE_COMMIT", "HEAD")
+	defer os.Setenv("BUILDKITE_COMMIT", "123")
+
+	head := resolveCommit("HEAD")
+	assert.Len(t, head, 40)
+
+	cache := newMatcherCache(Plugin{CacheDir: "/cache", DiffBase: "HEAD"})
+	assert.Equal(t, "/cache/"+head+".."+head, cache.dir)
+
+	assert.Nil(t, newMatcherCache(Plugin{CacheDir: "/cache", DiffBase: "not-a-revision"}))
+	assert.Nil(t, newMatcherCache(Plugin{CacheDir: "/cache", Diff: "git diff --name-only HEAD~1"}))
+	assert.Nil(t, newMatcherCache(Plugin{}))
+
+	os.Setenv("BUILDKITE_COMMIT", "not-a-revision")
+	assert.Nil(t, newMatcherCache(Plugin{CacheDir: "/cache", DiffBase: "HEAD"}))
+}
+
+func TestMatcherCachePrunesOldEntries(t *testing.T) {
+	os.Setenv("BUILDKITE_COMMIT", "HEAD")
+	defer os.Setenv("BUILDKITE_COMMIT", "123")
+
+	dir, err := ioutil.TempDir("", "cache")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	old, recent, other := filepath.Join(dir, "a..b"), filepath.Join(dir, "c..d"), filepath.Join(dir, "notes")
+	for _, d := range []string{old, recent, other} {
+		assert.NoError(t, os.Mkdir(d, 0755))
+	}
+
+	stale := time.Now().Add(-cacheMaxAge - time.Hour)
+	assert.NoError(t, os.Chtimes(old, stale, stale))
+	assert.NoError(t, os.Chtimes(other, stale, stale))
+
+	cache := newMatcherCache(Plugin{CacheDir: dir, DiffBase: "HEAD"})
+	assert.NotNil(t, cache)
+
+	assert.NoDirExists(t, old)
+	assert.DirExists(t, recent)
+	assert.DirExists(t, other)
+}
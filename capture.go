@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// captureGroup starts a named capture group in a watch path
+const captureGroup = "(?P<"
+
+// hasCaptures returns whether the path has named capture groups
+func hasCaptures(p string) bool {
+	return strings.Contains(p, captureGroup)
+}
+
+// captureRegexp compiles a path with capture groups, e.g.
+// `services/(?P<svc>[^/]+)/**`. The groups are regular expressions and the
+// rest of the path is a glob. Like plain paths, it matches the start of files.
+func captureRegexp(p string) (*regexp.Regexp, error) {
+	expr, err := globExpr(p)
+	if err != nil {
+		return nil, err
+	}
+
+	re, err := regexp.Compile("^" + expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path `%s`: %v", p, err)
+	}
+
+	return re, nil
+}
+
+// globExpr translates the glob p to a regular expression, keeping its capture groups
+func globExpr(p string) (string, error) {
+	var b strings.Builder
+
+	for i := 0; i < len(p); {
+		switch {
+		case strings.HasPrefix(p[i:], captureGroup):
+			end, err := groupEnd(p, i)
+			if err != nil {
+				return "", fmt.Errorf("invalid path `%s`: %v", p, err)
+			}
+			b.WriteString(p[i:end])
+			i = end
+		case strings.HasPrefix(p[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 3
+		case strings.HasPrefix(p[i:], "**"):
+			b.WriteString(".*")
+			i += 2
+		case p[i] == '*':
+			b.WriteString("[^/]*")
+			i++
+		case p[i] == '?':
+			b.WriteString("[^/]")
+			i++
+		case p[i] == '\\' && i+1 < len(p):
+			b.WriteString(regexp.QuoteMeta(p[i+1 : i+2]))
+			i += 2
+		default:
+			b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+			i++
+		}
+	}
+
+	return b.String(), nil
+}
+
+// groupEnd returns the index after the parenthesis closing the group at start
+func groupEnd(p string, start int) (int, error) {
+	depth := 0
+
+	for i := start; i < len(p); i++ {
+		switch p[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i + 1, nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("unclosed capture group")
+}
+
+// fileCaptures returns the named captures of the first path of the watch
+// with capture groups that matches the file
+func fileCaptures(w WatchConfig, f string) map[string]string {
+	for _, p := range w.Paths {
+		if !hasCaptures(p) {
+			continue
+		}
+
+		re := compilePath(p).capture
+		if re == nil {
+			continue
+		}
+
+		match := re.FindStringSubmatch(f)
+		if match == nil {
+			continue
+		}
+
+		captures := map[string]string{}
+		for i, name := range re.SubexpNames() {
+			if name != "" {
+				captures[name] = match[i]
+			}
+		}
+
+		return captures
+	}
+
+	return nil
+}
+
+// captureWatches replaces every watch with capture groups in its paths with a
+// watch per distinct set of captured values, holding the files that captured
+// them. The captures are added to the env of the step, with upper case names.
+func captureWatches(watches []WatchConfig) []WatchConfig {
+	result := []WatchConfig{}
+
+	for _, w := range watches {
+		groups := map[string][]string{}
+		captures := map[string]map[string]string{}
+
+		for _, f := range w.Files {
+			c := fileCaptures(w, f)
+			if c == nil {
+				continue
+			}
+
+			key := captureKey(c)
+			groups[key] = append(groups[key], f)
+			captures[key] = c
+		}
+
+		if len(groups) == 0 {
+			result = append(result, w)
+			continue
+		}
+
+		keys := make([]string, 0, len(groups))
+		for key := range groups {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			captured := w
+			captured.Files = groups[key]
+			captured.Captures = captures[key]
+			captured.Step = withCaptureEnv(w.Step, captures[key])
+			result = append(result, captured)
+		}
+	}
+
+	return result
+}
+
+// captureKey identifies a set of captured values
+func captureKey(captures map[string]string) string {
+	pairs := []string{}
+	for name, value := range captures {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, "\x00")
+}
+
+// withCaptureEnv returns the step with the captures in its env
+func withCaptureEnv(step Step, captures map[string]string) Step {
+	vars := map[string]string{}
+	for name, value := range captures {
+		vars[strings.ToUpper(name)] = value
+	}
+
+	return withEnv(step, vars)
+}
+
+// withEnv returns the step with the variables in its env, or in the env of
+// the triggered build for trigger steps
+func withEnv(step Step, vars map[string]string) Step {
+	if step.Trigger != "" {
+		step.Build.Env = mergeEnv(step.Build.Env, vars)
+		return step
+	}
+
+	step.Env = mergeEnv(step.Env, vars)
+	return step
+}
+
+// mergeEnv returns a copy of env with vars added
+func mergeEnv(env map[string]string, vars map[string]string) map[string]string {
+	result := make(map[string]string, len(env)+len(vars))
+	for key, value := range env {
+		result[key] = value
+	}
+	for key, value := range vars {
+		result[key] = value
+	}
+
+	return result
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptureRegexp(t *testing.T) {
+	testCases := map[string]struct {
+		path    string
+		file    string
+		matched bool
+	}{
+		"group":              {"services/(?P<svc>[^/]+)/**", "services/foo/main.go", true},
+		"other directory":    {"services/(?P<svc>[^/]+)/**", "libs/foo/main.go", false},
+		"prefix":             {"services/(?P<svc>[^/]+)/", "services/foo/cmd/main.go", true},
+		"glob after group":   {"(?P<team>[a-z]+)/*.go", "payments/main.go", true},
+		"glob in directory":  {"(?P<team>[a-z]+)/*.go", "payments/cmd/main.go", false},
+		"any directory":      {"**/(?P<name>[^/]+)\\.proto", "api/v1/user.proto", true},
+		"literal dot":        {"docs/(?P<page>[^/]+).md", "docs/indexamd", false},
+		"nested parentheses": {"services/(?P<svc>(foo|bar))/", "services/bar/main.go", true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			re, err := captureRegexp(tc.path)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.matched, re.MatchString(tc.file))
+		})
+	}
+
+	_, err := captureRegexp("services/(?P<svc>[^/]+/**")
+	assert.EqualError(t, err, "invalid path `services/(?P<svc>[^/]+/**`: unclosed capture group")
+
+	_, err = captureRegexp("services/(?P<svc>[^/+)/**")
+	assert.Error(t, err)
+}
+
+func TestCaptureWatches(t *testing.T) {
+	watches := []WatchConfig{
+		{
+			Paths: []string{"services/(?P<svc>[^/]+)/**"},
+			Files: []string{"services/foo/main.go", "services/bar/main.go", "services/foo/go.mod"},
+			Step:  Step{Trigger: "deploy", Build: Build{Env: map[string]string{"REGION": "eu"}}},
+		},
+		{
+			Paths: []string{"docs/"},
+			Files: []string{"docs/README.md"},
+			Step:  Step{Command: "make docs"},
+		},
+	}
+
+	got := captureWatches(watches)
+
+	assert.Equal(t, []WatchConfig{
+		{
+			Paths:    watches[0].Paths,
+			Files:    []string{"services/bar/main.go"},
+			Captures: map[string]string{"svc": "bar"},
+			Step:     Step{Trigger: "deploy", Build: Build{Env: map[string]string{"REGION": "eu", "SVC": "bar"}}},
+		},
+		{
+			Paths:    watches[0].Paths,
+			Files:    []string{"services/foo/main.go", "services/foo/go.mod"},
+			Captures: map[string]string{"svc": "foo"},
+			Step:     Step{Trigger: "deploy", Build: Build{Env: map[string]string{"REGION": "eu", "SVC": "foo"}}},
+		},
+		watches[1],
+	}, got)
+	assert.Equal(t, map[string]string{"REGION": "eu"}, watches[0].Step.Build.Env)
+}
+
+func TestUploadPipelineWithCaptures(t *testing.T) {
+	var generated []Step
+	generator := func(steps []Step, plugin Plugin) (*os.File, error) {
+		generated = steps
+		return mockGeneratePipeline(steps, plugin)
+	}
+
+	plugin := Plugin{
+		Diff:      "printf 'services/foo/main.go\\nservices/bar/main.go\\nlibs/baz/main.go\\n'",
+		Shell:     []string{"sh", "-c"},
+		Templates: true,
+		Watch: []WatchConfig{
+			{
+				Paths: []string{"services/(?P<svc>[^/]+)/**"},
+				Step:  Step{Label: "Deploy {{ .Captures.svc }}", Command: "make deploy"},
+			},
+		},
+	}
+
+	_, _, err := uploadPipeline(plugin, generator)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Step{
+		{Label: "Deploy bar", Command: "make deploy", Env: map[string]string{"SVC": "bar"}},
+		{Label: "Deploy foo", Command: "make deploy", Env: map[string]string{"SVC": "foo"}},
+	}, generated)
+}
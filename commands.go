@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// matcherCommand is the `matcher` of watches matched by a command, e.g. a
+// query of a build graph tool like bazel or nx
+const matcherCommand = "command"
+
+// hasCommandMatchers reports whether any watch is matched by a command
+func hasCommandMatchers(watch []WatchConfig) bool {
+	for _, w := range watch {
+		if w.Matcher == matcherCommand {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchCommands runs the `script` of the watches matched by a command with the
+// changed files streamed on stdin, one per line, and marks the watches whose command
+// printed files as matched with them. The commands run concurrently, at most
+// `matcher_parallelism` at once, since graph tools are slow to start, and
+// their output is reused from the `cache_dir`.
+func matchCommands(plugin Plugin, watch []WatchConfig, matched []bool, files fileSource) ([]WatchConfig, error) {
+	parallelism := plugin.MatcherParallelism
+	if parallelism < 1 {
+		parallelism = matchWorkers
+	}
+
+	indexes := []int{}
+	for i, w := range watch {
+		if w.Matcher == matcherCommand {
+			indexes = append(indexes, i)
+		}
+	}
+
+	if len(indexes) == 0 {
+		return watch, nil
+	}
+
+	// the digest of the changed files keys the cache and tells an empty diff
+	digest := sha256.New()
+	empty := true
+	if err := files(func(f string) bool {
+		fmt.Fprintln(digest, f)
+		empty = false
+		return true
+	}); err != nil {
+		return nil, err
+	}
+
+	if empty {
+		return watch, nil
+	}
+
+	log.Infof("Running %d matcher %s, %d at once", len(indexes), pluralize(len(indexes), "command"), parallelism)
+
+	input := fmt.Sprintf("%x", digest.Sum(nil))
+	cache := newMatcherCache(plugin)
+	outputs := make([][]string, len(watch))
+	errs := make([]error, len(watch))
+	slots := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+
+	for _, i := range indexes {
+		wg.Add(1)
+		slots <- struct{}{}
+
+		go func(i int) {
+			defer func() { <-slots; wg.Done() }()
+			script := watch[i].Script
+
+			if cache != nil {
+				if cached, ok := cache.get(script, input); ok {
+					log.Debugf("Reusing the cached output of the matcher command `%s`", script)
+					outputs[i] = cached
+					return
+				}
+			}
+
+			outputs[i], errs[i] = runMatcherCommand(script, files, plugin.Shell)
+			if cache != nil && errs[i] == nil {
+				cache.put(script, input, outputs[i])
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	result := append([]WatchConfig{}, watch...)
+	for _, i := range indexes {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+
+		if len(outputs[i]) > 0 {
+			matched[i] = true
+			result[i].Files = outputs[i]
+		}
+	}
+
+	return result, nil
+}
+
+// runMatcherCommand runs the command of a watch with the files streamed on
+// its stdin and returns the files it printed
+func runMatcherCommand(script string, files fileSource, shell []string) ([]string, error) {
+	start := time.Now()
+
+	stdin, input := io.Pipe()
+	// unblocks the writer when the command exits without reading every file
+	defer stdin.Close()
+
+	go func() {
+		w := bufio.NewWriter(input)
+		err := files(func(f string) bool {
+			_, err := fmt.Fprintln(w, f)
+			return err == nil
+		})
+		if err == nil {
+			err = w.Flush()
+		}
+		input.CloseWithError(err)
+	}()
+
+	cmd := shellCommand(shell, script)
+	cmd.Stdin = stdin
+
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+
+	if err := runProcess(cmd); err != nil {
+		return nil, fmt.Errorf("matcher command `%s` failed: %v: %s", script, err, strings.TrimSpace(stderr.String()))
+	}
+
+	printed := []string{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if f := cleanFile(line); f != "" {
+			printed = append(printed, f)
+		}
+	}
+
+	log.Debugf("Matcher command `%s` printed %d %s in %s", script, len(printed), pluralize(len(printed), "file"), time.Since(start))
+
+	return printed, nil
+}
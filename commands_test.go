@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchCommands(t *testing.T) {
+	watch := []WatchConfig{
+		{Paths: []string{"docs/"}, Step: Step{Trigger: "docs"}},
+		{Matcher: matcherCommand, Script: "grep ^services/foo/", Step: Step{Trigger: "foo"}},
+		{Matcher: matcherCommand, Script: "grep ^services/bar/ || true", Step: Step{Trigger: "bar"}},
+	}
+	matched := []bool{true, false, false}
+
+	got, err := matchCommands(Plugin{Shell: []string{"sh", "-c"}, MatcherParallelism: 2}, watch, matched, sliceSource([]string{"docs/a.md", "services/foo/main.go", "services/foo/go.mod"}))
+
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{true, true, false}, matched)
+	assert.Equal(t, []string{"services/foo/main.go", "services/foo/go.mod"}, got[1].Files)
+	assert.Empty(t, watch[1].Files)
+}
+
+func TestMatchCommandsRunConcurrently(t *testing.T) {
+	dir, err := ioutil.TempDir("", "commands")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// every command waits for the others to start, so they only finish when
+	// they all run at once
+	barrier := "touch " + dir + "/$$; i=0; while [ $(ls " + dir + " | wc -l) -lt 3 ] && [ $i -lt 50 ]; do sleep 0.1; i=$((i+1)); done; " +
+		"[ $(ls " + dir + " | wc -l) -ge 3 ] && cat"
+
+	watch := []WatchConfig{
+		{Matcher: matcherCommand, Script: barrier, Step: Step{Trigger: "a"}},
+		{Matcher: matcherCommand, Script: barrier, Step: Step{Trigger: "b"}},
+		{Matcher: matcherCommand, Script: barrier, Step: Step{Trigger: "c"}},
+	}
+	matched := make([]bool, len(watch))
+
+	_, err = matchCommands(Plugin{Shell: []string{"sh", "-c"}, MatcherParallelism: 3}, watch, matched, sliceSource([]string{"foo"}))
+
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{true, true, true}, matched)
+}
+
+func TestMatchCommandsFailure(t *testing.T) {
+	watch := []WatchConfig{
+		{Matcher: matcherCommand, Script: "echo broken graph >&2; exit 2", Step: Step{Trigger: "foo"}},
+	}
+
+	_, err := matchCommands(Plugin{Shell: []string{"sh", "-c"}}, watch, []bool{false}, sliceSource([]string{"foo"}))
+
+	assert.EqualError(t, err, "matcher command `echo broken graph >&2; exit 2` failed: exit status 2: broken graph")
+}
+
+func TestUploadPipelineWithCommandMatcher(t *testing.T) {
+	var generated []Step
+	generator := func(steps []Step, plugin Plugin) (*os.File, error) {
+		generated = steps
+		return mockGeneratePipeline(steps, plugin)
+	}
+
+	plugin := Plugin{
+		Diff:  `printf "services/foo/main.go\nlibs/shared/util.go\n"`,
+		Shell: []string{"sh", "-c"},
+		Watch: []WatchConfig{
+			{Paths: []string{"services/foo/"}, Step: Step{Trigger: "foo"}},
+			{Matcher: matcherCommand, Script: "grep ^libs/", Step: Step{Trigger: "shared-consumers"}},
+			{Matcher: matcherCommand, Script: "grep ^apps/ || true", Step: Step{Trigger: "apps"}},
+		},
+	}
+
+	_, _, err := uploadPipeline(plugin, generator)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Step{{Trigger: "foo"}, {Trigger: "shared-consumers"}}, generated)
+}
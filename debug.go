@@ -0,0 +1,148 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// debugBundle is what is known of a failed run
+type debugBundle struct {
+	plugin  Plugin
+	report  *routingReport
+	steps   []Step
+	failure error
+}
+
+// files returns the files of the bundle by name, with secrets redacted
+func (d debugBundle) files() map[string]string {
+	files := map[string]string{
+		"error.txt": d.failure.Error() + "\n",
+		"env.txt":   redactedEnv(d.plugin.RedactedVars),
+	}
+
+	if data, err := yaml.Marshal(redactedConfig(d.plugin)); err == nil {
+		files["config.yml"] = string(data)
+	} else {
+		files["config.yml"] = fmt.Sprintf("# could not serialize the config: %v\n", err)
+	}
+
+	if d.report != nil && len(d.report.ChangedFiles) > 0 {
+		files["diff.txt"] = strings.Join(d.report.ChangedFiles, "\n") + "\n"
+	}
+
+	if len(d.steps) > 0 {
+		if data, err := marshalPipeline(d.steps, d.plugin); err == nil {
+			files["pipeline.yml"] = string(data)
+		}
+	}
+
+	// the config may be that of a run that failed before the redaction was set up
+	config := newRedactor(d.plugin.RedactedVars, d.plugin)
+	for name, content := range files {
+		files[name] = config.redact(secrets.redact(content))
+	}
+
+	return files
+}
+
+// redactedConfig returns a copy of the plugin with the webhook and the
+// credentials of the pushgateway url replaced
+func redactedConfig(plugin Plugin) Plugin {
+	if plugin.SlackWebhook != "" {
+		plugin.SlackWebhook = redacted
+	}
+
+	if plugin.Pushgateway != nil {
+		gateway := *plugin.Pushgateway
+		if u, err := url.Parse(gateway.URL); err != nil {
+			gateway.URL = redacted
+		} else if u.User != nil {
+			u.User = url.User(redacted)
+			gateway.URL = u.String()
+		}
+		plugin.Pushgateway = &gateway
+	}
+
+	return plugin
+}
+
+// redactedEnv returns the environment as sorted KEY=value lines, with the
+// values of the redacted vars replaced
+func redactedEnv(patterns []string) string {
+	vars := os.Environ()
+	sort.Strings(vars)
+
+	var b strings.Builder
+	for _, kv := range vars {
+		split := strings.SplitN(kv, "=", 2)
+		if len(split) == 2 && split[1] != "" && matchesAny(patterns, split[0]) {
+			kv = split[0] + "=" + redacted
+		}
+		fmt.Fprintln(&b, kv)
+	}
+
+	return b.String()
+}
+
+// writeDebugBundle writes the bundle of a failed run to a gzipped tarball in
+// the temporary directory, and uploads it as an artifact of the build
+func writeDebugBundle(bundle debugBundle) string {
+	out, err := ioutil.TempFile(os.TempDir(), "monorepo-diff-debug-*.tar.gz")
+	if err != nil {
+		log.Warnf("could not write the debug bundle: %v", err)
+		return ""
+	}
+	defer out.Close()
+
+	if err := writeTarball(out, bundle.files()); err != nil {
+		log.Warnf("could not write the debug bundle: %v", err)
+		return ""
+	}
+
+	log.Errorf("Debug bundle written to %s", out.Name())
+
+	args := append(append([]string{}, bundle.plugin.AgentArgs...), "artifact", "upload", out.Name())
+	if _, err := executeCommand(agentBinary(bundle.plugin), args); err != nil {
+		log.Warnf("could not upload the debug bundle: %v", err)
+	}
+
+	return out.Name()
+}
+
+// writeTarball writes the files, sorted by name, as a gzipped tarball
+func writeTarball(w io.Writer, files map[string]string) error {
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), ModTime: now()}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(archive, files[name]); err != nil {
+			return err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
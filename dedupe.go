@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// contentHashKey is the build meta-data key holding the content hash of a watch
+const contentHashKey = "monorepo-diff-content-hash"
+
+// contentHashEnv is the variable holding the content hash of a watch
+const contentHashEnv = "MONOREPO_DIFF_HASH"
+
+// trackedFiles lists the tracked files with their blob ids with `git ls-files -s`
+func trackedFiles() ([]string, error) {
+	output, err := executeCommand("git", []string{"ls-files", "-s"})
+	if err != nil {
+		return nil, fmt.Errorf("could not list files for content hashing: %v", err)
+	}
+
+	return strings.Split(strings.TrimSpace(output), "\n"), nil
+}
+
+// dedupeByContent skips trigger steps whose pipeline already has a passed build
+// for the current content of the watched files. The remaining trigger steps
+// carry the content hash as build meta-data so later runs can find them.
+func dedupeByContent(watches []WatchConfig) ([]WatchConfig, error) {
+	lsFiles, err := trackedFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	api, err := newBuildkiteAPI()
+	if err != nil {
+		return nil, err
+	}
+
+	org := env("BUILDKITE_ORGANIZATION_SLUG", "")
+	result := []WatchConfig{}
+
+	for _, w := range watches {
+		if w.Step.Trigger == "" {
+			result = append(result, w)
+			continue
+		}
+
+		hash, err := watchHash(lsFiles, w)
+		if err != nil {
+			return nil, err
+		}
+
+		builds, err := api.builds(org, w.Step.Trigger, url.Values{
+			"state":                             {"passed"},
+			"per_page":                          {"1"},
+			"meta_data[" + contentHashKey + "]": {hash},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if len(builds) > 0 {
+			log.Infof("Skipping %s, build #%d already passed for the same content", w.Step.Trigger, builds[0].Number)
+			continue
+		}
+
+		if w.Step.Build.MetaData == nil {
+			w.Step.Build.MetaData = map[string]string{}
+		}
+		w.Step.Build.MetaData[contentHashKey] = hash
+
+		result = append(result, w)
+	}
+
+	return result, nil
+}
+
+// addContentHashEnv sets the content hash of every watch in the
+// MONOREPO_DIFF_HASH variable of its step, or of the triggered build, for
+// downstream pipelines to use in cache keys
+func addContentHashEnv(watches []WatchConfig) ([]WatchConfig, error) {
+	lsFiles, err := trackedFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]WatchConfig, len(watches))
+
+	for i, w := range watches {
+		hash := w.Step.Build.MetaData[contentHashKey]
+		if hash == "" {
+			if hash, err = watchHash(lsFiles, w); err != nil {
+				return nil, err
+			}
+		}
+
+		w.Step = withEnv(w.Step, map[string]string{contentHashEnv: hash})
+		result[i] = w
+	}
+
+	return result, nil
+}
+
+// watchHash returns the content hash of the files of a watch. The watches
+// generated by fan out only hash the files in their directory.
+func watchHash(lsFiles []string, w WatchConfig) (string, error) {
+	if w.Dir == "" {
+		return contentHash(lsFiles, w.Paths)
+	}
+
+	inDir := []string{}
+	for _, line := range lsFiles {
+		if split := strings.SplitN(line, "\t", 2); len(split) == 2 && strings.HasPrefix(split[1], w.Dir+"/") {
+			inDir = append(inDir, line)
+		}
+	}
+
+	return contentHash(inDir, w.Paths)
+}
+
+// contentHash hashes the blob ids of the tracked files, as listed by
+// `git ls-files -s`, that match any of the paths.
+func contentHash(lsFiles []string, paths []string) (string, error) {
+	matchers := []pathMatcher{}
+	for _, p := range paths {
+		matchers = append(matchers, compilePath(p))
+	}
+
+	h := sha256.New()
+
+	for _, line := range lsFiles {
+		// <mode> <object> <stage>\t<file>
+		split := strings.SplitN(line, "\t", 2)
+		if len(split) != 2 {
+			continue
+		}
+
+		for _, m := range matchers {
+			match, err := m.match(split[1])
+			if err != nil {
+				return "", err
+			}
+
+			if match {
+				fmt.Fprintln(h, line)
+				break
+			}
+		}
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+const (
+	// dedupeRunningSkip skips triggers of pipelines already building the commit
+	dedupeRunningSkip = "skip"
+	// dedupeRunningReplace cancels the builds of the commit before triggering
+	dedupeRunningReplace = "replace"
+)
+
+// dedupeRunning finds the scheduled and running builds of the pipeline of
+// every trigger step that another build of this pipeline triggered for the
+// same commit, message and env, e.g. a build of the same commit on another
+// branch. With `skip` the trigger step is skipped, with `replace` those
+// builds are cancelled and the step triggers a new one. Builds started
+// manually or by webhooks are never considered.
+func dedupeRunning(watches []WatchConfig, policy string) ([]WatchConfig, error) {
+	api, err := newBuildkiteAPI()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]WatchConfig, len(watches))
+
+	for i, w := range watches {
+		result[i] = w
+
+		if w.Step.Trigger == "" || w.Step.Skip != "" {
+			continue
+		}
+
+		org := w.Step.Organization
+		if org == "" {
+			org = env("BUILDKITE_ORGANIZATION_SLUG", "")
+		}
+
+		commit := os.ExpandEnv(w.Step.Build.Commit)
+		if commit == "" {
+			commit = env("BUILDKITE_COMMIT", "")
+		}
+
+		builds, err := api.builds(org, w.Step.Trigger, url.Values{
+			"commit":  {commit},
+			"state[]": {"scheduled", "running"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		duplicates := []apiBuild{}
+		for _, b := range builds {
+			if duplicateTrigger(b, w.Step.Build) {
+				duplicates = append(duplicates, b)
+			}
+		}
+
+		if len(duplicates) == 0 {
+			continue
+		}
+
+		if policy == dedupeRunningSkip {
+			log.Infof("Skipping %s, build #%d is already running for %s", w.Step.Trigger, duplicates[0].Number, commit)
+			result[i].Step.Skip = fmt.Sprintf("build #%d of %s is already running for the commit", duplicates[0].Number, w.Step.Trigger)
+			continue
+		}
+
+		for _, b := range duplicates {
+			log.Infof("Cancelling build #%d of %s, replaced by a new build of %s", b.Number, w.Step.Trigger, commit)
+			if err := api.cancel(org, w.Step.Trigger, b.Number); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// duplicateTrigger reports whether the build was triggered by another build
+// of the current pipeline with the message and env of the trigger step
+func duplicateTrigger(b apiBuild, build Build) bool {
+	parent := env("BUILDKITE_BUILD_ID", "")
+	pipeline := env("BUILDKITE_PIPELINE_SLUG", "")
+
+	if b.TriggeredFrom.BuildID == "" || b.TriggeredFrom.BuildID == parent || pipeline == "" || b.TriggeredFrom.BuildPipelineSlug != pipeline {
+		return false
+	}
+
+	if message := os.ExpandEnv(build.Message); message != "" && b.Message != message {
+		return false
+	}
+
+	for key, value := range build.Env {
+		if b.Env[key] != os.ExpandEnv(value) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentHash(t *testing.T) {
+	lsFiles := []string{
+		"100644 aaaa 0\tservices/foo/main.go",
+		"100644 bbbb 0\tservices/bar/main.go",
+		"100644 cccc 0\tdocs/README.md",
+	}
+
+	foo, err := contentHash(lsFiles, []string{"services/foo/"})
+	assert.NoError(t, err)
+
+	changed := append([]string{}, lsFiles...)
+	changed[1] = "100644 dddd 0\tservices/bar/main.go"
+
+	fooAfterBarChange, _ := contentHash(changed, []string{"services/foo/"})
+	assert.Equal(t, foo, fooAfterBarChange)
+
+	docs, _ := contentHash(lsFiles, []string{"**/*.md"})
+	assert.NotEqual(t, foo, docs)
+	assert.Len(t, docs, 64)
+}
+
+func TestDedupeByContent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "passed", r.URL.Query().Get("state"))
+		assert.NotEmpty(t, r.URL.Query().Get("meta_data["+contentHashKey+"]"))
+
+		builds := []apiBuild{}
+		if r.URL.Path == "/organizations/org/pipelines/unchanged/builds" {
+			builds = append(builds, apiBuild{Number: 41, State: "passed"})
+		}
+
+		_ = json.NewEncoder(w).Encode(builds)
+	}))
+	defer server.Close()
+
+	os.Setenv("BUILDKITE_API_ENDPOINT", server.URL)
+	os.Setenv("BUILDKITE_API_TOKEN", "api-token")
+	os.Setenv("BUILDKITE_ORGANIZATION_SLUG", "org")
+	defer os.Unsetenv("BUILDKITE_API_ENDPOINT")
+	defer os.Unsetenv("BUILDKITE_API_TOKEN")
+	defer os.Unsetenv("BUILDKITE_ORGANIZATION_SLUG")
+
+	watches := []WatchConfig{
+		{Paths: []string{"plugin.go"}, Step: Step{Trigger: "unchanged"}},
+		{Paths: []string{"pipeline.go"}, Step: Step{Trigger: "changed"}},
+		{Paths: []string{"README.md"}, Step: Step{Command: "echo docs"}},
+	}
+
+	got, err := dedupeByContent(watches)
+
+	assert.NoError(t, err)
+	assert.Len(t, got, 2)
+	assert.Equal(t, "changed", got[0].Step.Trigger)
+	assert.Len(t, got[0].Step.Build.MetaData[contentHashKey], 64)
+	assert.Equal(t, Step{Command: "echo docs"}, got[1].Step)
+}
+
+func TestWatchHashOfFanOutWatch(t *testing.T) {
+	lsFiles := []string{
+		"100644 aaaa 0\tservices/foo/main.go",
+		"100644 bbbb 0\tservices/bar/main.go",
+	}
+
+	watch := WatchConfig{Paths: []string{"services/*/**"}, FanOut: "directory", Dir: "services/foo"}
+
+	foo, err := watchHash(lsFiles, watch)
+	assert.NoError(t, err)
+
+	changed := append([]string{}, lsFiles...)
+	changed[1] = "100644 cccc 0\tservices/bar/main.go"
+
+	fooAfterBarChange, _ := watchHash(changed, watch)
+	assert.Equal(t, foo, fooAfterBarChange)
+
+	onlyFoo, _ := contentHash(lsFiles[:1], watch.Paths)
+	assert.Equal(t, onlyFoo, foo)
+}
+
+func TestAddContentHashEnv(t *testing.T) {
+	watches := []WatchConfig{
+		{Paths: []string{"plugin.go"}, Step: Step{Trigger: "plugin"}},
+		{Paths: []string{"README.md"}, Step: Step{Command: "echo docs"}},
+		{Paths: []string{"pipeline.go"}, Step: Step{Trigger: "deduped", Build: Build{MetaData: map[string]string{contentHashKey: "known"}}}},
+	}
+
+	got, err := addContentHashEnv(watches)
+
+	assert.NoError(t, err)
+	assert.Len(t, got[0].Step.Build.Env[contentHashEnv], 64)
+	assert.Len(t, got[1].Step.Env[contentHashEnv], 64)
+	assert.NotEqual(t, got[0].Step.Build.Env[contentHashEnv], got[1].Step.Env[contentHashEnv])
+	assert.Equal(t, "known", got[2].Step.Build.Env[contentHashEnv])
+	assert.Nil(t, watches[0].Step.Build.Env)
+}
+
+func TestDedupeRunning(t *testing.T) {
+	var cancelled []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			cancelled = append(cancelled, r.URL.Path)
+			return
+		}
+
+		assert.Equal(t, []string{"scheduled", "running"}, r.URL.Query()["state[]"])
+		assert.Equal(t, "123", r.URL.Query().Get("commit"))
+
+		triggered := func(number int, parent string, pipeline string, env map[string]string) apiBuild {
+			b := apiBuild{Number: number, State: "running", Message: "Fix", Env: env}
+			b.TriggeredFrom.BuildID = parent
+			b.TriggeredFrom.BuildPipelineSlug = pipeline
+			return b
+		}
+
+		builds := []apiBuild{}
+		switch r.URL.Path {
+		case "/organizations/org/pipelines/busy/builds":
+			builds = append(builds,
+				triggered(7, "other-build", "monorepo", nil),
+				triggered(6, "", "", nil),
+				triggered(5, "other-build", "other-monorepo", nil))
+		case "/organizations/org/pipelines/ours/builds":
+			builds = append(builds, triggered(8, "parent-build", "monorepo", nil))
+		case "/organizations/org/pipelines/deploy/builds":
+			builds = append(builds, triggered(9, "other-build", "monorepo", map[string]string{environmentEnv: "staging"}))
+		}
+
+		_ = json.NewEncoder(w).Encode(builds)
+	}))
+	defer server.Close()
+
+	vars := map[string]string{
+		"BUILDKITE_API_ENDPOINT":      server.URL,
+		"BUILDKITE_API_TOKEN":         "api-token",
+		"BUILDKITE_ORGANIZATION_SLUG": "org",
+		"BUILDKITE_PIPELINE_SLUG":     "monorepo",
+		"BUILDKITE_BUILD_ID":          "parent-build",
+	}
+	for k, v := range vars {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	watches := []WatchConfig{
+		{Step: Step{Trigger: "busy", Key: "busy", Build: Build{Commit: "$BUILDKITE_COMMIT", Message: "Fix"}}},
+		{Step: Step{Trigger: "idle", Build: Build{Commit: "123"}}},
+		{Step: Step{Trigger: "ours", Build: Build{Commit: "123"}}},
+		{Step: Step{Trigger: "deploy", Build: Build{Commit: "123", Env: map[string]string{environmentEnv: "staging"}}}},
+		{Step: Step{Trigger: "deploy", Build: Build{Commit: "123", Env: map[string]string{environmentEnv: "prod"}}}},
+		{Step: Step{Command: "echo docs"}},
+	}
+
+	got, err := dedupeRunning(watches, dedupeRunningSkip)
+
+	assert.NoError(t, err)
+	assert.Len(t, got, len(watches))
+	assert.Equal(t, "build #7 of busy is already running for the commit", got[0].Step.Skip)
+	assert.Equal(t, "busy", got[0].Step.Key)
+	assert.Empty(t, got[1].Step.Skip)
+	assert.Empty(t, got[2].Step.Skip)
+	assert.Equal(t, "build #9 of deploy is already running for the commit", got[3].Step.Skip)
+	assert.Empty(t, got[4].Step.Skip)
+	assert.Empty(t, cancelled)
+
+	got, err = dedupeRunning(watches, dedupeRunningReplace)
+
+	assert.NoError(t, err)
+	assert.Equal(t, watches, got)
+	assert.Equal(t, []string{
+		"/organizations/org/pipelines/busy/builds/7/cancel",
+		"/organizations/org/pipelines/deploy/builds/9/cancel",
+	}, cancelled)
+
+	os.Unsetenv("BUILDKITE_BUILD_ID")
+	os.Unsetenv("BUILDKITE_PIPELINE_SLUG")
+	cancelled = nil
+
+	_, err = dedupeRunning(watches, dedupeRunningReplace)
+
+	assert.NoError(t, err)
+	assert.Empty(t, cancelled, "nothing is cancelled outside of a build")
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DiffProvider lists the files changed by the build
+type DiffProvider interface {
+	// Stream passes the changed files to fn in chunks as they are read, and
+	// stops reading once fn returns false. It returns the number of files read.
+	Stream(fn func(files []string) bool) (int, error)
+}
+
+// diffProviders is the registry of diff providers, selected by `diff_provider`
+var diffProviders = map[string]func(plugin Plugin) (DiffProvider, error){
+	"command": newCommandDiff,
+	"git":     newGitDiff,
+	"file":    newFileDiff,
+	"api":     newAPIDiff,
+}
+
+// diffProviderNames returns the sorted names of the registered diff providers
+func diffProviderNames() []string {
+	names := []string{}
+	for name := range diffProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// newDiffProvider returns the diff provider selected by the plugin, or the
+// merge of its `diff_sources`
+func newDiffProvider(plugin Plugin) (DiffProvider, error) {
+	if len(plugin.DiffSources) > 0 {
+		return newSourcesDiff(plugin)
+	}
+
+	name := plugin.DiffProvider
+	if name == "" {
+		name = "command"
+	}
+
+	factory, ok := diffProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown diff_provider `%s`, expected one of %s", name, strings.Join(diffProviderNames(), ", "))
+	}
+
+	return factory(plugin)
+}
+
+// commandDiff lists the changed files printed by the `diff` command
+type commandDiff struct {
+	plugin Plugin
+}
+
+func newCommandDiff(plugin Plugin) (DiffProvider, error) {
+	return &commandDiff{plugin: plugin}, nil
+}
+
+func (d *commandDiff) Stream(fn func(files []string) bool) (int, error) {
+	return streamDiff(d.plugin, fn)
+}
+
+// gitDiff lists the files changed since `diff_base` with git. Without a base,
+// pull request builds are compared with the merge base of their base branch,
+// and other builds with the previous commit.
+type gitDiff struct {
+	base string
+}
+
+func newGitDiff(plugin Plugin) (DiffProvider, error) {
+	return &gitDiff{base: diffBase(plugin)}, nil
+}
+
+// diffBase returns `diff_base`, or the default base of the build
+func diffBase(plugin Plugin) string {
+	if plugin.DiffBase != "" {
+		return plugin.DiffBase
+	}
+
+	if pr := env("BUILDKITE_PULL_REQUEST", "false"); pr != "false" && pr != "" {
+		if branch := env("BUILDKITE_PULL_REQUEST_BASE_BRANCH", ""); branch != "" {
+			return "origin/" + branch + "...HEAD"
+		}
+	}
+
+	return "HEAD~1"
+}
+
+// knownDiffBase returns the base the diff is compared with, which is only
+// known for `diff_base` or the `git` provider, since a diff command can
+// compare with anything
+func knownDiffBase(plugin Plugin) string {
+	if plugin.DiffBase != "" || (plugin.DiffProvider == "git" && len(plugin.DiffSources) == 0) {
+		return diffBase(plugin)
+	}
+
+	return ""
+}
+
+func (d *gitDiff) Stream(fn func(files []string) bool) (int, error) {
+	return streamDiff(Plugin{DiffArgs: []string{"git", "diff", "--name-only", d.base}, Diff: "git diff --name-only " + d.base}, fn)
+}
+
+// fileDiff lists the changed files written to `diff_file`, one per line
+type fileDiff struct {
+	path string
+}
+
+func newFileDiff(plugin Plugin) (DiffProvider, error) {
+	if plugin.DiffFile == "" {
+		return nil, fmt.Errorf("the file diff_provider needs a diff_file")
+	}
+
+	return &fileDiff{path: plugin.DiffFile}, nil
+}
+
+func (d *fileDiff) Stream(fn func(files []string) bool) (int, error) {
+	log.Infof("Reading changed files from %s", d.path)
+
+	f, err := os.Open(d.path)
+	if err != nil {
+		return 0, fmt.Errorf("could not read diff_file: %v", err)
+	}
+	defer f.Close()
+
+	count, _, err := streamLines(f, fn)
+	if err != nil {
+		return count, fmt.Errorf("could not read diff_file: %v", err)
+	}
+
+	return count, nil
+}
+
+// apiDiff lists the files changed by the pull request of the build with the
+// GitHub API, which doesn't need the history of the checkout
+type apiDiff struct {
+	api *githubAPI
+	pr  string
+}
+
+func newAPIDiff(plugin Plugin) (DiffProvider, error) {
+	pr := env("BUILDKITE_PULL_REQUEST", "false")
+	if pr == "false" || pr == "" {
+		return nil, fmt.Errorf("the api diff_provider needs a pull request build")
+	}
+
+	api, err := newGithubAPI()
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiDiff{api: api, pr: pr}, nil
+}
+
+func (d *apiDiff) Stream(fn func(files []string) bool) (int, error) {
+	log.Infof("Listing the files changed by pull request #%s", d.pr)
+
+	files, err := d.api.pullRequestFiles(d.pr)
+	if err != nil {
+		return 0, err
+	}
+
+	return streamFiles(files, fn), nil
+}
+
+// streamFiles passes the files to fn in chunks, until it returns false.
+// It returns the number of files passed.
+func streamFiles(files []string, fn func(files []string) bool) int {
+	for start := 0; start < len(files); start += matchChunkSize {
+		end := start + matchChunkSize
+		if end > len(files) {
+			end = len(files)
+		}
+
+		if !fn(files[start:end]) {
+			return end
+		}
+	}
+
+	return len(files)
+}
+
+// pullRequestFiles returns the files changed by the pull request, including
+// the previous path of renamed files
+func (api *githubAPI) pullRequestFiles(pr string) ([]string, error) {
+	files := []string{}
+
+	for page := 1; ; page++ {
+		var changes []struct {
+			Filename         string `json:"filename"`
+			PreviousFilename string `json:"previous_filename"`
+		}
+
+		path := fmt.Sprintf("/repos/%s/pulls/%s/files?per_page=100&page=%d", api.repo, pr, page)
+		if err := sendJSON(http.MethodGet, api.endpoint+path, api.token, nil, &changes); err != nil {
+			return nil, fmt.Errorf("could not get the files of pull request #%s: %v", pr, err)
+		}
+
+		for _, c := range changes {
+			files = append(files, c.Filename)
+			if c.PreviousFilename != "" {
+				files = append(files, c.PreviousFilename)
+			}
+		}
+
+		if len(changes) < 100 {
+			return files, nil
+		}
+	}
+}
+
+// cleanFile normalizes a changed file, e.g. `./services//foo/` to `services/foo`
+func cleanFile(f string) string {
+	if f == "" {
+		return ""
+	}
+
+	f = path.Clean(f)
+	if f == "." {
+		return ""
+	}
+
+	return f
+}
+
+// changedFiles normalizes the changed files read from the diff and drops the
+// files repeating the previous one. Only the files of several `diff_sources`
+// are remembered to drop those listed by more than one source, since a single
+// diff lists a file once and remembering every file would undo memory_budget.
+type changedFiles struct {
+	seen map[string]bool
+	last string
+}
+
+func newChangedFiles(plugin Plugin) *changedFiles {
+	if len(plugin.DiffSources) > 1 {
+		return &changedFiles{seen: map[string]bool{}}
+	}
+
+	return &changedFiles{}
+}
+
+// add returns the normalized files that weren't read before
+func (c *changedFiles) add(files []string) []string {
+	result := make([]string, 0, len(files))
+
+	for _, f := range files {
+		f = cleanFile(f)
+		if f == "" || f == c.last || c.seen[f] {
+			continue
+		}
+
+		if c.seen != nil {
+			c.seen[f] = true
+		}
+		c.last = f
+		result = append(result, f)
+	}
+
+	return result
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// collect returns every file streamed by the provider
+func collect(t *testing.T, provider DiffProvider) []string {
+	files := []string{}
+
+	count, err := provider.Stream(func(chunk []string) bool {
+		files = append(files, chunk...)
+		return true
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, len(files), count)
+
+	return files
+}
+
+func TestNewDiffProvider(t *testing.T) {
+	provider, err := newDiffProvider(Plugin{Diff: "echo foo"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, collect(t, provider))
+
+	_, err = newDiffProvider(Plugin{DiffProvider: "svn"})
+	assert.EqualError(t, err, "unknown diff_provider `svn`, expected one of api, command, file, git")
+}
+
+func TestGitDiffBase(t *testing.T) {
+	testCases := map[string]struct {
+		base     string
+		pr       string
+		branch   string
+		expected string
+	}{
+		"previous commit": {
+			expected: "HEAD~1",
+		},
+		"pull request": {
+			pr:       "42",
+			branch:   "main",
+			expected: "origin/main...HEAD",
+		},
+		"not a pull request": {
+			pr:       "false",
+			branch:   "main",
+			expected: "HEAD~1",
+		},
+		"configured base": {
+			base:     "origin/release",
+			pr:       "42",
+			branch:   "main",
+			expected: "origin/release",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			os.Setenv("BUILDKITE_PULL_REQUEST", tc.pr)
+			os.Setenv("BUILDKITE_PULL_REQUEST_BASE_BRANCH", tc.branch)
+			defer os.Unsetenv("BUILDKITE_PULL_REQUEST")
+			defer os.Unsetenv("BUILDKITE_PULL_REQUEST_BASE_BRANCH")
+
+			provider, err := newGitDiff(Plugin{DiffBase: tc.base})
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, provider.(*gitDiff).base)
+		})
+	}
+}
+
+func TestFileDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diff")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "changed.txt")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("services/foo/main.go\n\n  docs/README.md  \n"), 0644))
+
+	provider, err := newDiffProvider(Plugin{DiffProvider: "file", DiffFile: path})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"services/foo/main.go", "docs/README.md"}, collect(t, provider))
+
+	_, err = newDiffProvider(Plugin{DiffProvider: "file"})
+	assert.EqualError(t, err, "the file diff_provider needs a diff_file")
+
+	provider, _ = newDiffProvider(Plugin{DiffProvider: "file", DiffFile: filepath.Join(dir, "missing.txt")})
+	_, err = provider.Stream(func([]string) bool { return true })
+	assert.Contains(t, err.Error(), "could not read diff_file")
+}
+
+func TestAPIDiff(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/repos/org/monorepo/pulls/42/files", r.URL.Path)
+		assert.Equal(t, "Token gh-token", r.Header.Get("Authorization"))
+
+		type change struct {
+			Filename         string `json:"filename"`
+			PreviousFilename string `json:"previous_filename,omitempty"`
+		}
+
+		changes := []change{}
+		if page, _ := strconv.Atoi(r.URL.Query().Get("page")); page == 1 {
+			for i := 0; i < 99; i++ {
+				changes = append(changes, change{Filename: fmt.Sprintf("services/%d/main.go", i)})
+			}
+			changes = append(changes, change{Filename: "docs/new.md", PreviousFilename: "docs/old.md"})
+		} else if page == 2 {
+			changes = append(changes, change{Filename: "README.md"})
+		}
+
+		_ = json.NewEncoder(w).Encode(changes)
+	}))
+	defer server.Close()
+
+	os.Setenv("GITHUB_API_URL", server.URL)
+	os.Setenv("GITHUB_TOKEN", "gh-token")
+	os.Setenv("BUILDKITE_REPO", "git@github.com:org/monorepo.git")
+	os.Setenv("BUILDKITE_PULL_REQUEST", "42")
+	defer os.Unsetenv("GITHUB_API_URL")
+	defer os.Unsetenv("GITHUB_TOKEN")
+	defer os.Unsetenv("BUILDKITE_REPO")
+	defer os.Unsetenv("BUILDKITE_PULL_REQUEST")
+
+	provider, err := newDiffProvider(Plugin{DiffProvider: "api"})
+	assert.NoError(t, err)
+
+	files := collect(t, provider)
+	assert.Len(t, files, 102)
+	assert.Equal(t, []string{"docs/new.md", "docs/old.md", "README.md"}, files[99:])
+}
+
+func TestAPIDiffWithoutPullRequest(t *testing.T) {
+	_, err := newDiffProvider(Plugin{DiffProvider: "api"})
+
+	assert.EqualError(t, err, "the api diff_provider needs a pull request build")
+}
+
+func TestUploadPipelineWithDiffProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diff")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "changed.txt")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("services/bar/main.go\n"), 0644))
+
+	var generated []Step
+	generator := func(steps []Step, plugin Plugin) (*os.File, error) {
+		generated = steps
+		return mockGeneratePipeline(steps, plugin)
+	}
+
+	plugin := Plugin{
+		Diff:         "echo services/foo/main.go",
+		DiffProvider: "file",
+		DiffFile:     path,
+		Watch: []WatchConfig{
+			{Paths: []string{"services/foo/"}, Step: Step{Trigger: "foo"}},
+			{Paths: []string{"services/bar/"}, Step: Step{Trigger: "bar"}},
+		},
+	}
+
+	_, _, err = uploadPipeline(plugin, generator)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Step{{Trigger: "bar"}}, generated)
+}
+
+func TestCleanFile(t *testing.T) {
+	testCases := map[string]string{
+		"services/foo/main.go":    "services/foo/main.go",
+		"./services/foo/main.go":  "services/foo/main.go",
+		"services//foo/./main.go": "services/foo/main.go",
+		"services/foo/":           "services/foo",
+		"./":                      "",
+		"":                        "",
+	}
+
+	for file, expected := range testCases {
+		t.Run(file, func(t *testing.T) {
+			assert.Equal(t, expected, cleanFile(file))
+		})
+	}
+}
+
+func TestChangedFiles(t *testing.T) {
+	changed := newChangedFiles(Plugin{})
+
+	assert.Equal(t, []string{"a.go", "services/foo"}, changed.add([]string{"a.go", "./a.go", "services/foo/", "."}))
+	assert.Equal(t, []string{"b.go", "a.go"}, changed.add([]string{"services/foo", "b.go", "b.go", "a.go"}))
+	assert.Nil(t, changed.seen)
+
+	sources := newChangedFiles(Plugin{DiffSources: []string{"git", "api"}})
+
+	assert.Equal(t, []string{"a.go", "services/foo"}, sources.add([]string{"a.go", "./a.go", "services/foo/", "."}))
+	assert.Equal(t, []string{"b.go"}, sources.add([]string{"services/foo", "b.go", "b.go", "a.go"}))
+}
+
+func TestDiffAndMatchNormalizesFiles(t *testing.T) {
+	plugin := Plugin{
+		Diff:        "printf './services/foo/main.go\\nservices//foo/main.go\\nservices/bar/\\n'",
+		Shell:       []string{"sh", "-c"},
+		DebugBundle: true,
+		Watch: []WatchConfig{
+			{Paths: []string{"services/foo/"}, Step: Step{Trigger: "foo"}},
+			{Paths: []string{"services/bar/"}, Step: Step{Trigger: "bar"}},
+		},
+	}
+
+	count, _, files, watches, err := diffAndMatch(plugin)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, []string{"services/foo/main.go", "services/bar"}, files)
+	assert.Len(t, watches, 2)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// doctorCommand is the argument of the binary checking the agent environment
+const doctorCommand = "doctor"
+
+// doctorEnv are the variables of the job the plugin reads to route a build
+var doctorEnv = []string{
+	"BUILDKITE_COMMIT",
+	"BUILDKITE_BRANCH",
+	"BUILDKITE_ORGANIZATION_SLUG",
+	"BUILDKITE_PIPELINE_SLUG",
+	"BUILDKITE_BUILD_NUMBER",
+	"BUILDKITE_JOB_ID",
+}
+
+const (
+	doctorPass = "pass"
+	doctorFail = "fail"
+	doctorSkip = "skip"
+)
+
+// doctorCheck is the result of a check of the agent environment
+type doctorCheck struct {
+	name   string
+	status string
+	detail string
+}
+
+// runDoctor checks the environment of the agent and the configuration of the
+// pipeline file of args, or of the job, and prints a report. It returns
+// whether every check passed.
+func runDoctor(args []string, out io.Writer) bool {
+	plugin, config := doctorConfig(args)
+
+	checks := []doctorCheck{
+		config,
+		doctorAgent(plugin),
+		doctorGit(),
+		doctorEnvironment(),
+		doctorAPIToken(),
+	}
+
+	failed := 0
+	for _, c := range checks {
+		symbol := colorize(colorGreen, "✔")
+		switch c.status {
+		case doctorFail:
+			symbol = colorize(colorRed, "✖")
+			failed++
+		case doctorSkip:
+			symbol = colorize(colorGray, "-")
+		}
+
+		fmt.Fprintf(out, "%s %-16s %s\n", symbol, c.name, c.detail)
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(out, "%s\n", colorize(colorRed, fmt.Sprintf("%d of %d checks failed", failed, len(checks))))
+		return false
+	}
+
+	fmt.Fprintf(out, "%s\n", colorize(colorGreen, "All checks passed"))
+	return true
+}
+
+// doctorConfig parses the configuration of the job, or of the pipeline file of
+// args outside of a job
+func doctorConfig(args []string) (Plugin, doctorCheck) {
+	check := doctorCheck{name: "configuration", status: doctorPass}
+
+	var plugin Plugin
+	var err error
+	source := "the job"
+
+	if _, ok := os.LookupEnv("BUILDKITE_PLUGINS"); ok && len(args) == 0 {
+		var plugins []Plugin
+		if plugins, err = loadPlugins(); err == nil {
+			plugin = plugins[0]
+		}
+	} else {
+		source = tuiDefaultConfig
+		if len(args) > 0 {
+			source = args[0]
+		}
+		plugin, err = loadTUIConfig(source)
+	}
+
+	if err != nil {
+		check.status, check.detail = doctorFail, err.Error()
+		return Plugin{}, check
+	}
+
+	// pluralize only appends an s
+	watches := "watches"
+	if len(plugin.Watch) == 1 {
+		watches = "watch"
+	}
+	check.detail = fmt.Sprintf("%d %s in %s", len(plugin.Watch), watches, source)
+
+	return plugin, check
+}
+
+// doctorAgent checks that the agent binary uploading the pipeline runs
+func doctorAgent(plugin Plugin) doctorCheck {
+	check := doctorCheck{name: "buildkite-agent", status: doctorPass}
+	binary := agentBinary(plugin)
+
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		if plugin.UploadMethod == "api" {
+			check.status, check.detail = doctorSkip, "not needed with `upload_method: api`"
+			return check
+		}
+
+		check.status, check.detail = doctorFail, fmt.Sprintf("`%s` isn't in the PATH", binary)
+		return check
+	}
+
+	version, err := executeCommand(path, []string{"--version"})
+	if err != nil {
+		check.status, check.detail = doctorFail, err.Error()
+		return check
+	}
+
+	check.detail = path
+	if version = strings.TrimSpace(version); version != "" {
+		check.detail = version
+	}
+
+	return check
+}
+
+// doctorGit checks that git runs and reports its version
+func doctorGit() doctorCheck {
+	check := doctorCheck{name: "git", status: doctorPass}
+
+	version, err := executeCommand("git", []string{"--version"})
+	if err != nil {
+		check.status, check.detail = doctorFail, err.Error()
+		return check
+	}
+
+	check.detail = strings.TrimSpace(version)
+	return check
+}
+
+// doctorEnvironment checks that the variables of the job are set
+func doctorEnvironment() doctorCheck {
+	check := doctorCheck{name: "environment", status: doctorPass}
+
+	missing := []string{}
+	for _, name := range doctorEnv {
+		if env(name, "") == "" {
+			missing = append(missing, name)
+		}
+	}
+
+	if len(missing) > 0 {
+		check.status, check.detail = doctorFail, "missing "+strings.Join(missing, ", ")
+		return check
+	}
+
+	check.detail = fmt.Sprintf("%d variables set", len(doctorEnv))
+	return check
+}
+
+// doctorAPIToken checks that `BUILDKITE_API_TOKEN` is accepted by the
+// Buildkite API and reports its scopes
+func doctorAPIToken() doctorCheck {
+	check := doctorCheck{name: "api token", status: doctorPass}
+
+	if env("BUILDKITE_API_TOKEN", "") == "" {
+		check.status, check.detail = doctorSkip, "BUILDKITE_API_TOKEN isn't set, features using the Buildkite API are unavailable"
+		return check
+	}
+
+	api, err := newBuildkiteAPI()
+	if err != nil {
+		check.status, check.detail = doctorFail, err.Error()
+		return check
+	}
+
+	var token struct {
+		Scopes []string `json:"scopes"`
+	}
+	if err := sendJSON(http.MethodGet, api.endpoint+"/access-token", api.token, nil, &token); err != nil {
+		check.status, check.detail = doctorFail, fmt.Sprintf("the token was rejected: %v", err)
+		return check
+	}
+
+	check.detail = "scopes: " + strings.Join(token.Scopes, ", ")
+	return check
+}
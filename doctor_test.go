@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunDoctor(t *testing.T) {
+	os.Setenv("NO_COLOR", "1")
+	defer os.Unsetenv("NO_COLOR")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/access-token" || r.Header.Get("Authorization") != "Token valid" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"scopes": ["read_builds", "write_builds"]}`))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "doctor")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "pipeline.yml")
+	assert.NoError(t, ioutil.WriteFile(file, []byte(tuiPipeline), 0644))
+
+	vars := map[string]string{
+		"BUILDKITE_ORGANIZATION_SLUG": "org",
+		"BUILDKITE_PIPELINE_SLUG":     "monorepo",
+		"BUILDKITE_BUILD_NUMBER":      "42",
+		"BUILDKITE_JOB_ID":            "job",
+		"BUILDKITE_API_ENDPOINT":      server.URL,
+		"BUILDKITE_API_TOKEN":         "valid",
+	}
+	for k, v := range vars {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	out := &bytes.Buffer{}
+	assert.True(t, runDoctor([]string{file}, out), out.String())
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, "✔ configuration    2 watches in "+file, lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "✔ buildkite-agent"))
+	assert.True(t, strings.HasPrefix(lines[2], "✔ git              git version"))
+	assert.Equal(t, "✔ environment      6 variables set", lines[3])
+	assert.Equal(t, "✔ api token        scopes: read_builds, write_builds", lines[4])
+	assert.Equal(t, "All checks passed", lines[5])
+
+	os.Setenv("BUILDKITE_API_TOKEN", "revoked")
+	os.Unsetenv("BUILDKITE_JOB_ID")
+
+	out.Reset()
+	assert.False(t, runDoctor([]string{filepath.Join(dir, "missing.yml")}, out))
+	assert.Contains(t, out.String(), "✖ configuration")
+	assert.Contains(t, out.String(), "✖ environment      missing BUILDKITE_JOB_ID")
+	assert.Contains(t, out.String(), "✖ api token        the token was rejected: 401 Unauthorized")
+	assert.Contains(t, out.String(), "3 of 5 checks failed")
+}
+
+func TestDoctorAgentWithAPIUpload(t *testing.T) {
+	check := doctorAgent(Plugin{AgentBinary: "missing-agent", UploadMethod: "api"})
+	assert.Equal(t, doctorSkip, check.status)
+
+	check = doctorAgent(Plugin{AgentBinary: "missing-agent"})
+	assert.Equal(t, doctorFail, check.status)
+	assert.Equal(t, "`missing-agent` isn't in the PATH", check.detail)
+}
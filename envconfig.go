@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pluginEnvPrefix is the prefix of the env vars the agent flattens the
+// configuration of the plugin into, e.g. `BUILDKITE_PLUGIN_MONOREPO_DIFF_WATCH_0_PATH`
+const pluginEnvPrefix = "BUILDKITE_PLUGIN_MONOREPO_DIFF_"
+
+// hasPluginEnv returns whether the configuration is flattened into env vars
+func hasPluginEnv(environ []string) bool {
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, pluginEnvPrefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pluginFromEnv parses the configuration flattened into env vars, for agents
+// that set neither `BUILDKITE_PLUGINS` nor `BUILDKITE_PLUGIN_CONFIGURATION`
+func pluginFromEnv(environ []string) (Plugin, error) {
+	config, err := configurationFromEnv(environ)
+	if err != nil {
+		return Plugin{}, fmt.Errorf("failed to parse plugin configuration: %v", err)
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return Plugin{}, fmt.Errorf("failed to parse plugin configuration: %v", err)
+	}
+
+	return parsePlugin(data)
+}
+
+// configurationFromEnv rebuilds the configuration of the plugin from the env
+// vars the agent flattens it into. Names only keep upper case letters, digits
+// and `_`, so the keys are recovered from the fields of Plugin: the longest
+// run of segments naming a field is its key, and numbers are list indexes.
+// Below values the plugin doesn't know, like the attributes of the plugins of
+// a step, keys run up to the next index and are lower cased.
+func configurationFromEnv(environ []string) (map[string]interface{}, error) {
+	vars := []string{}
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, pluginEnvPrefix) {
+			vars = append(vars, strings.TrimPrefix(kv, pluginEnvPrefix))
+		}
+	}
+
+	// a value comes before the values nested in it, so lists and maps
+	// replace the scalar of the same name newer agents also set
+	sort.Strings(vars)
+
+	var config interface{} = map[string]interface{}{}
+	for _, kv := range vars {
+		split := strings.SplitN(kv, "=", 2)
+		if len(split) != 2 || split[0] == "" {
+			continue
+		}
+
+		var err error
+		if config, err = insertEnvValue(config, reflect.TypeOf(Plugin{}), strings.Split(split[0], "_"), split[1], len(vars)); err != nil {
+			return nil, fmt.Errorf("invalid %s%s: %v", pluginEnvPrefix, split[0], err)
+		}
+	}
+
+	result, ok := config.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected an object")
+	}
+
+	return result, nil
+}
+
+// insertEnvValue sets the value at the path of segments in node, which is
+// decoded into t. Indexes are bounded by the number of vars, so a name can't
+// allocate a list larger than the configuration.
+func insertEnvValue(node interface{}, t reflect.Type, segments []string, value string, limit int) (interface{}, error) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if len(segments) == 0 {
+		return envScalar(t, value), nil
+	}
+
+	if index, err := strconv.Atoi(segments[0]); err == nil && isEnvList(t) {
+		if index < 0 || index >= limit {
+			return nil, fmt.Errorf("index %d out of range", index)
+		}
+
+		list, _ := node.([]interface{})
+		for len(list) <= index {
+			list = append(list, nil)
+		}
+
+		var elem reflect.Type
+		if t != nil && t.Kind() != reflect.Interface {
+			elem = t.Elem()
+		}
+
+		if list[index], err = insertEnvValue(list[index], elem, segments[1:], value, limit); err != nil {
+			return nil, err
+		}
+
+		return list, nil
+	}
+
+	object, ok := node.(map[string]interface{})
+	if !ok {
+		object = map[string]interface{}{}
+	}
+
+	key, field, rest := envKey(t, segments)
+
+	// `env` is a list or a map of variables, whose names are kept as they are
+	if key == "env" && field != nil && field.Kind() == reflect.Interface && len(rest) > 0 {
+		if _, err := strconv.Atoi(rest[0]); err != nil {
+			field = reflect.TypeOf(map[string]string{})
+		}
+	}
+
+	var err error
+	if object[key], err = insertEnvValue(object[key], field, rest, value, limit); err != nil {
+		return nil, err
+	}
+
+	return object, nil
+}
+
+// isEnvList returns whether an index segment of a value of type t is a list index
+func isEnvList(t reflect.Type) bool {
+	return t == nil || t.Kind() == reflect.Interface || t.Kind() == reflect.Slice || t.Kind() == reflect.Array
+}
+
+// envKey returns the key the leading segments name in a value of type t, the
+// type of its value and the remaining segments
+func envKey(t reflect.Type, segments []string) (string, reflect.Type, []string) {
+	if t != nil && t.Kind() == reflect.Struct {
+		fields := jsonFields(t)
+
+		for n := len(segments); n > 0; n-- {
+			key := strings.ToLower(strings.Join(segments[:n], "_"))
+			if field, ok := fields[key]; ok {
+				return key, field, segments[n:]
+			}
+		}
+	}
+
+	n := 1
+	for n < len(segments) {
+		if _, err := strconv.Atoi(segments[n]); err == nil {
+			break
+		}
+		n++
+	}
+
+	key := strings.Join(segments[:n], "_")
+
+	// the keys of maps of strings, like env and meta_data, are user defined
+	if t != nil && t.Kind() == reflect.Map {
+		return key, t.Elem(), segments[n:]
+	}
+
+	return strings.ToLower(key), nil, segments[n:]
+}
+
+// jsonFields returns the types of the fields of a struct by their lower cased
+// JSON key, which is how encoding/json matches them. The fields of embedded
+// structs are promoted, unless the struct has a field of the same key.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	tagged := map[string]bool{}
+	embedded := []reflect.Type{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+
+		if field.Anonymous && tag == "" {
+			ft := field.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				embedded = append(embedded, ft)
+				continue
+			}
+		}
+
+		if field.PkgPath != "" {
+			continue
+		}
+
+		// a tagged field wins over an untagged field of the same name
+		if tag != "" {
+			fields[strings.ToLower(tag)] = field.Type
+			tagged[strings.ToLower(tag)] = true
+		} else if name := strings.ToLower(field.Name); !tagged[name] {
+			fields[name] = field.Type
+		}
+	}
+
+	for _, e := range embedded {
+		for key, field := range jsonFields(e) {
+			if _, ok := fields[key]; !ok {
+				fields[key] = field
+			}
+		}
+	}
+
+	return fields
+}
+
+// envScalar converts the value of an env var to the type it is decoded into.
+// Without a type only booleans are converted, since a number like a version
+// can be meant as a string.
+func envScalar(t reflect.Type, value string) interface{} {
+	kind := reflect.Interface
+	if t != nil {
+		kind = t.Kind()
+	}
+
+	switch kind {
+	case reflect.Bool, reflect.Interface:
+		if b, err := strconv.ParseBool(value); err == nil && (kind == reflect.Bool || value == "true" || value == "false") {
+			return b
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			return json.Number(value)
+		}
+	}
+
+	return value
+}
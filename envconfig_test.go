@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigurationFromEnv(t *testing.T) {
+	environ := []string{
+		"BUILDKITE_PLUGIN_MONOREPO_DIFF_DIFF=git diff --name-only HEAD~1",
+		"BUILDKITE_PLUGIN_MONOREPO_DIFF_WAIT=true",
+		"BUILDKITE_PLUGIN_MONOREPO_DIFF_MAX_STEPS_PER_UPLOAD=100",
+		"BUILDKITE_PLUGIN_MONOREPO_DIFF_ENV_0=DEPLOY_ENV=staging",
+		"BUILDKITE_PLUGIN_MONOREPO_DIFF_WATCH_0_PATH=services/foo/",
+		"BUILDKITE_PLUGIN_MONOREPO_DIFF_WATCH_0_CONFIG_TRIGGER=foo",
+		"BUILDKITE_PLUGIN_MONOREPO_DIFF_WATCH_0_CONFIG_BUILD_META_DATA_RELEASE_NAME=v1",
+		"BUILDKITE_PLUGIN_MONOREPO_DIFF_WATCH_0_CONFIG_SOFT_FAIL=true",
+		"BUILDKITE_PLUGIN_MONOREPO_DIFF_WATCH_1_PATH_0=services/bar/",
+		"BUILDKITE_PLUGIN_MONOREPO_DIFF_WATCH_1_PATH_1=libs/",
+		"BUILDKITE_PLUGIN_MONOREPO_DIFF_WATCH_1_CONFIG_COMMAND=make",
+		"BUILDKITE_PLUGIN_MONOREPO_DIFF_WATCH_1_CONFIG_PRIORITY=2",
+		"BUILDKITE_PLUGIN_MONOREPO_DIFF_WATCH_1_CONFIG_PLUGINS_0_DOCKER_V3_IMAGE=node",
+		"BUILDKITE_PLUGIN_MONOREPO_DIFF_HOOKS_0_COMMAND=notify",
+		"BUILDKITE_PLUGIN_MONOREPO_DIFF_HOOKS_0_AGENTS_QUEUE=big",
+		"BUILDKITE_PLUGIN_MONOREPO_DIFF_HOOKS_0_ENV_FOO_BAR=1",
+		"BUILDKITE_PLUGIN_CONFIGURATION_UNRELATED=1",
+		"HOME=/root",
+	}
+
+	got, err := configurationFromEnv(environ)
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"diff":                 "git diff --name-only HEAD~1",
+		"wait":                 true,
+		"max_steps_per_upload": json.Number("100"),
+		"env":                  []interface{}{"DEPLOY_ENV=staging"},
+		"watch": []interface{}{
+			map[string]interface{}{
+				"path": "services/foo/",
+				"config": map[string]interface{}{
+					"trigger":   "foo",
+					"build":     map[string]interface{}{"meta_data": map[string]interface{}{"RELEASE_NAME": "v1"}},
+					"soft_fail": true,
+				},
+			},
+			map[string]interface{}{
+				"path": []interface{}{"services/bar/", "libs/"},
+				"config": map[string]interface{}{
+					"command":  "make",
+					"priority": json.Number("2"),
+					"plugins":  []interface{}{map[string]interface{}{"docker_v3_image": "node"}},
+				},
+			},
+		},
+		"hooks": []interface{}{
+			map[string]interface{}{
+				"command": "notify",
+				"agents":  map[string]interface{}{"queue": "big"},
+				"env":     map[string]interface{}{"FOO_BAR": "1"},
+			},
+		},
+	}, got)
+}
+
+func TestConfigurationFromEnvWithInvalidIndex(t *testing.T) {
+	_, err := configurationFromEnv([]string{"BUILDKITE_PLUGIN_MONOREPO_DIFF_WATCH_99999999_PATH=services/"})
+
+	assert.EqualError(t, err, "invalid BUILDKITE_PLUGIN_MONOREPO_DIFF_WATCH_99999999_PATH: index 99999999 out of range")
+}
+
+func TestLoadPluginsFromEnv(t *testing.T) {
+	os.Setenv("BUILDKITE_PLUGIN_MONOREPO_DIFF_DIFF", "echo env")
+	defer os.Unsetenv("BUILDKITE_PLUGIN_MONOREPO_DIFF_DIFF")
+	os.Setenv("BUILDKITE_PLUGIN_MONOREPO_DIFF_WATCH_0_PATH_0", "services/foo/")
+	defer os.Unsetenv("BUILDKITE_PLUGIN_MONOREPO_DIFF_WATCH_0_PATH_0")
+	os.Setenv("BUILDKITE_PLUGIN_MONOREPO_DIFF_WATCH_0_CONFIG_BUILD_ENV_0", "DEPLOY_ENV=staging")
+	defer os.Unsetenv("BUILDKITE_PLUGIN_MONOREPO_DIFF_WATCH_0_CONFIG_BUILD_ENV_0")
+	os.Setenv("BUILDKITE_PLUGIN_MONOREPO_DIFF_WATCH_0_CONFIG_TRIGGER", "foo")
+	defer os.Unsetenv("BUILDKITE_PLUGIN_MONOREPO_DIFF_WATCH_0_CONFIG_TRIGGER")
+	os.Setenv("BUILDKITE_PLUGIN_MONOREPO_DIFF_HOOKS_0_COMMAND", "notify")
+	defer os.Unsetenv("BUILDKITE_PLUGIN_MONOREPO_DIFF_HOOKS_0_COMMAND")
+	os.Setenv("BUILDKITE_PLUGIN_MONOREPO_DIFF_HOOKS_0_AGENTS_QUEUE", "big")
+	defer os.Unsetenv("BUILDKITE_PLUGIN_MONOREPO_DIFF_HOOKS_0_AGENTS_QUEUE")
+	os.Setenv("BUILDKITE_PLUGIN_MONOREPO_DIFF_HOOKS_0_ENV_FOO", "bar")
+	defer os.Unsetenv("BUILDKITE_PLUGIN_MONOREPO_DIFF_HOOKS_0_ENV_FOO")
+
+	got, err := loadPlugins()
+
+	assert.NoError(t, err)
+	assert.Len(t, got, 1)
+	assert.Equal(t, "echo env", got[0].Diff)
+	assert.Equal(t, []string{"services/foo/"}, got[0].Watch[0].Paths)
+	assert.Equal(t, "foo", got[0].Watch[0].Step.Trigger)
+	assert.Equal(t, map[string]string{"DEPLOY_ENV": "staging"}, got[0].Watch[0].Step.Build.Env)
+	assert.Equal(t, "big", got[0].Hooks[0].Agents.Queue)
+	assert.Equal(t, map[string]string{"FOO": "bar"}, got[0].Hooks[0].Env)
+}
+
+// envDocument is a nested configuration of the keys the plugin knows, with
+// lists of watches and of their paths, env and dependencies, and of hooks
+type envDocument map[string]interface{}
+
+func (envDocument) Generate(r *rand.Rand, size int) reflect.Value {
+	word := func() string {
+		const letters = "abcdefghijklmnopqrstuvwxyz"
+		b := []byte{letters[r.Intn(len(letters))]}
+		for i := r.Intn(8); i > 0; i-- {
+			b = append(b, "abcxyz019/._-"[r.Intn(13)])
+		}
+		return string(b)
+	}
+
+	list := func(item func() interface{}) []interface{} {
+		items := []interface{}{}
+		for i := r.Intn(size%4 + 1); i >= 0; i-- {
+			items = append(items, item())
+		}
+		return items
+	}
+
+	env := func() interface{} { return strings.ToUpper(word()[:1]) + "_VAR=" + word() }
+
+	watch := func() interface{} {
+		build := map[string]interface{}{
+			"branch":    word(),
+			"env":       list(env),
+			"meta_data": map[string]interface{}{"RELEASE": word()},
+		}
+
+		return map[string]interface{}{
+			"path":  list(func() interface{} { return word() }),
+			"label": word(),
+			"config": map[string]interface{}{
+				"trigger":    word(),
+				"async":      r.Intn(2) == 0,
+				"priority":   json.Number(strconv.Itoa(r.Intn(100))),
+				"depends_on": list(func() interface{} { return word() }),
+				"build":      build,
+				"soft_fail":  r.Intn(2) == 0,
+			},
+		}
+	}
+
+	hook := func() interface{} {
+		return map[string]interface{}{
+			"command": word(),
+			"phase":   word(),
+			"agents":  map[string]interface{}{"queue": word()},
+			"env":     map[string]interface{}{"DEPLOY_" + strings.ToUpper(word()[:1]): word()},
+		}
+	}
+
+	return reflect.ValueOf(envDocument{
+		"diff":                 word() + " " + word(),
+		"log_level":            word(),
+		"max_steps_per_upload": json.Number(strconv.Itoa(r.Intn(1000))),
+		"env":                  list(env),
+		"watch":                list(watch),
+		"hooks":                list(hook),
+	})
+}
+
+// flattenEnv flattens the configuration into env vars like the agent does,
+// with upper cased names and every other character replaced with `_`
+func flattenEnv(name string, value interface{}) []string {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		vars := []string{}
+		for key, child := range v {
+			key = strings.Map(func(r rune) rune {
+				if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+					return r
+				}
+				return '_'
+			}, strings.ToUpper(key))
+			vars = append(vars, flattenEnv(name+"_"+key, child)...)
+		}
+		return vars
+	case []interface{}:
+		vars := []string{}
+		for i, child := range v {
+			vars = append(vars, flattenEnv(name+"_"+strconv.Itoa(i), child)...)
+		}
+		return vars
+	default:
+		return []string{fmt.Sprintf("%s=%v", name, v)}
+	}
+}
+
+func TestConfigurationFromEnvProperties(t *testing.T) {
+	roundTrip := func(document envDocument) bool {
+		environ := flattenEnv(strings.TrimSuffix(pluginEnvPrefix, "_"), map[string]interface{}(document))
+		rand.Shuffle(len(environ), func(i, j int) { environ[i], environ[j] = environ[j], environ[i] })
+
+		got, err := configurationFromEnv(environ)
+
+		return err == nil && reflect.DeepEqual(map[string]interface{}(document), got)
+	}
+
+	assert.NoError(t, quick.Check(roundTrip, nil))
+}
+
+func TestLoadPluginsWithoutConfiguration(t *testing.T) {
+	_, err := loadPlugins()
+
+	assert.EqualError(t, err, "failed to parse plugin configuration: unexpected end of JSON input")
+}
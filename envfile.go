@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// loadEnvFiles merges the `env_file` of the watches into the env of their
+// command step, or the build env of their trigger step. Variables set in the
+// configuration take precedence over the ones in the file.
+func loadEnvFiles(watches []WatchConfig) ([]WatchConfig, error) {
+	result := make([]WatchConfig, len(watches))
+
+	for i, w := range watches {
+		result[i] = w
+
+		if w.EnvFile == "" {
+			continue
+		}
+
+		vars, err := readEnvFile(w.EnvFile)
+		if err != nil {
+			return nil, err
+		}
+
+		env := &result[i].Step.Env
+		if w.Step.Trigger != "" {
+			env = &result[i].Step.Build.Env
+		}
+
+		merged := map[string]string{}
+		for key, value := range vars {
+			merged[key] = value
+		}
+		for key, value := range *env {
+			merged[key] = value
+		}
+		*env = merged
+	}
+
+	return result, nil
+}
+
+// readEnvFile reads the KEY=VALUE lines of an env file. Blank lines, comments
+// starting with `#` and `export` prefixes are ignored, and quotes around values
+// are removed.
+func readEnvFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read env_file: %v", err)
+	}
+	defer file.Close()
+
+	vars := map[string]string{}
+	scanner := bufio.NewScanner(file)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimPrefix(line, "export ")
+
+		split := strings.SplitN(line, "=", 2)
+		if len(split) != 2 || strings.TrimSpace(split[0]) == "" {
+			return nil, fmt.Errorf("invalid line %d of env_file %s: %s", n, path, line)
+		}
+
+		value := strings.TrimSpace(split[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		vars[strings.TrimSpace(split[0])] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read env_file: %v", err)
+	}
+
+	return vars, nil
+}
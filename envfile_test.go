@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadEnvFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "envfile")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, ".ci-env")
+	assert.NoError(t, ioutil.WriteFile(file, []byte(`# service configuration
+REGION=ap-southeast-2
+export SERVICE_NAME="foo service"
+URL=https://example.com/?a=b
+
+QUEUE='deploy'
+`), 0644))
+
+	watches := []WatchConfig{
+		{EnvFile: file, Step: Step{Command: "make", Env: map[string]string{"REGION": "us-east-1"}}},
+		{EnvFile: file, Step: Step{Trigger: "foo"}},
+		{Step: Step{Trigger: "bar"}},
+	}
+
+	got, err := loadEnvFiles(watches)
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"REGION":       "us-east-1",
+		"SERVICE_NAME": "foo service",
+		"URL":          "https://example.com/?a=b",
+		"QUEUE":        "deploy",
+	}, got[0].Step.Env)
+	assert.Nil(t, got[1].Step.Env)
+	assert.Equal(t, "ap-southeast-2", got[1].Step.Build.Env["REGION"])
+	assert.Equal(t, watches[2], got[2])
+	assert.Equal(t, "us-east-1", watches[0].Step.Env["REGION"])
+}
+
+func TestLoadEnvFilesWithInvalidLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "envfile")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, ".ci-env")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("REGION=ap-southeast-2\nDEBUG\n"), 0644))
+
+	_, err = loadEnvFiles([]WatchConfig{{EnvFile: file, Step: Step{Command: "make"}}})
+
+	assert.EqualError(t, err, "invalid line 2 of env_file "+file+": DEBUG")
+}
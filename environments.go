@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// environmentEnv is the variable of the environment of the steps of a watch with `environments`
+const environmentEnv = "MONOREPO_DIFF_ENVIRONMENT"
+
+// validateEnvironments checks that the watch only blocks its own environments
+func validateEnvironments(w WatchConfig) error {
+	for _, b := range w.BlockBefore {
+		found := false
+		for _, e := range w.Environments {
+			found = found || e == b
+		}
+
+		if !found {
+			return fmt.Errorf("block_before environment `%s` isn't in environments", b)
+		}
+	}
+
+	return nil
+}
+
+// environmentWatches replaces every watch with `environments` with a watch per
+// environment, in order, rendered with the environment like a fan out. The
+// environments of `block_before` are preceded by a block step depending on the
+// step of the previous environment, so it's only unblocked once it passed.
+func environmentWatches(watches []WatchConfig) ([]WatchConfig, error) {
+	result := []WatchConfig{}
+
+	for _, w := range watches {
+		if len(w.Environments) == 0 {
+			result = append(result, w)
+			continue
+		}
+
+		previous := ""
+		for _, e := range w.Environments {
+			expanded := w
+			expanded.Environment = e
+			expanded.Step = withEnv(w.Step, map[string]string{environmentEnv: e})
+
+			key, err := environmentKey(expanded)
+			if err != nil {
+				return nil, err
+			}
+			expanded.Step.Key = key
+
+			if blocks(w, e) {
+				name := w.Step.Label
+				if name == "" {
+					name = exportName(w.Step)
+				}
+
+				block := expanded
+				block.Files = nil
+				block.Step = Step{
+					Block:      fmt.Sprintf("Release to %s: %s", e, name),
+					Key:        expanded.Step.Key + "-block",
+					WatchLabel: w.Step.WatchLabel,
+				}
+				if previous != "" {
+					block.Step.DependsOn = previous
+				}
+
+				result = append(result, block)
+				if expanded.Step.DependsOn == nil {
+					expanded.Step.DependsOn = block.Step.Key
+				} else {
+					expanded.Step.DependsOn = append(append([]interface{}{}, dependencies(expanded.Step.DependsOn)...), block.Step.Key)
+				}
+			}
+
+			result = append(result, expanded)
+			previous = expanded.Step.Key
+		}
+	}
+
+	return result, nil
+}
+
+// environmentKey returns the key of the step of an environment watch: a
+// templated key is rendered, others get the environment appended. Steps
+// without a key only get one when they are blocked, so blocks can depend on
+// them, named after their pipeline since labels are usually templated.
+func environmentKey(w WatchConfig) (string, error) {
+	switch {
+	case strings.Contains(w.Step.Key, "{{"):
+		key, err := render(w.Step.Key, watchData(w))
+		if err != nil {
+			return "", fmt.Errorf("could not render the key of %s: %v", stepName(w.Step), err)
+		}
+		return key, nil
+	case w.Step.Key != "":
+		return w.Step.Key + "-" + w.Environment, nil
+	case len(w.BlockBefore) > 0 && w.Step.Trigger != "":
+		return artifactName(WatchConfig{Step: Step{Trigger: w.Step.Trigger}}) + "-" + w.Environment, nil
+	case len(w.BlockBefore) > 0:
+		return artifactName(w) + "-" + w.Environment, nil
+	default:
+		return "", nil
+	}
+}
+
+// blocks reports whether the environment of the watch is blocked
+func blocks(w WatchConfig, environment string) bool {
+	for _, b := range w.BlockBefore {
+		if b == environment {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadPipelineWithEnvironments(t *testing.T) {
+	var generated []Step
+	generator := func(steps []Step, plugin Plugin) (*os.File, error) {
+		generated = steps
+		return mockGeneratePipeline(steps, plugin)
+	}
+
+	plugin := Plugin{
+		Diff: "echo services/api/main.go",
+		Watch: []WatchConfig{
+			{
+				Paths:        []string{"services/api/"},
+				Environments: []string{"staging", "prod"},
+				BlockBefore:  []string{"prod"},
+				Step: Step{
+					Trigger: "deploy-api",
+					Label:   "Deploy API to {{ .Environment }}",
+					Build:   Build{Env: map[string]string{"STACK": "api-{{ .Environment }}"}},
+				},
+			},
+			{
+				Paths:        []string{"services/"},
+				Environments: []string{"dev", "qa"},
+				Step:         Step{Command: "make smoke", Key: "smoke"},
+			},
+		},
+	}
+
+	_, _, err := uploadPipeline(plugin, generator)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Step{
+		{
+			Trigger: "deploy-api",
+			Label:   "Deploy API to staging",
+			Key:     "deploy-api-staging",
+			Build:   Build{Env: map[string]string{"STACK": "api-staging", environmentEnv: "staging"}},
+		},
+		{
+			Block:     "Release to prod: Deploy API to prod",
+			Key:       "deploy-api-prod-block",
+			DependsOn: "deploy-api-staging",
+		},
+		{
+			Trigger:   "deploy-api",
+			Label:     "Deploy API to prod",
+			Key:       "deploy-api-prod",
+			Build:     Build{Env: map[string]string{"STACK": "api-prod", environmentEnv: "prod"}},
+			DependsOn: "deploy-api-prod-block",
+		},
+		{Command: "make smoke", Key: "smoke-dev", Env: map[string]string{environmentEnv: "dev"}},
+		{Command: "make smoke", Key: "smoke-qa", Env: map[string]string{environmentEnv: "qa"}},
+	}, generated)
+}
+
+func TestEnvironmentKey(t *testing.T) {
+	testCases := map[string]struct {
+		watch    WatchConfig
+		expected string
+	}{
+		"templated": {WatchConfig{Environment: "prod", Step: Step{Key: "deploy-{{ .Environment }}"}}, "deploy-prod"},
+		"key":       {WatchConfig{Environment: "prod", Step: Step{Key: "deploy"}}, "deploy-prod"},
+		"blocked":   {WatchConfig{Environment: "prod", BlockBefore: []string{"prod"}, Step: Step{Trigger: "Deploy"}}, "deploy-prod"},
+		"none":      {WatchConfig{Environment: "prod", Step: Step{Trigger: "deploy"}}, ""},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			key, err := environmentKey(tc.watch)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, key)
+		})
+	}
+}
+
+func TestPluginBlockBeforeUnknownEnvironment(t *testing.T) {
+	_, err := initializePluginConfiguration(`{
+		"watch": [{"path": "services/api/", "environments": ["staging"], "block_before": ["prod"], "config": {"trigger": "deploy-api"}}]
+	}`)
+
+	assert.EqualError(t, err, "failed to parse plugin configuration: block_before environment `prod` isn't in environments")
+	assert.EqualError(t, validateEnvironments(WatchConfig{Environments: []string{"staging"}, BlockBefore: []string{"prod"}}),
+		"block_before environment `prod` isn't in environments")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errorCategory is the kind of a failure of the plugin, which sets its exit
+// code and the hint logged to fix it
+type errorCategory string
+
+const (
+	configCategory errorCategory = "config"
+	diffCategory   errorCategory = "diff"
+	uploadCategory errorCategory = "upload"
+	apiCategory    errorCategory = "api"
+)
+
+// errorCategories are the title, exit code and remediation hint of each category
+var errorCategories = map[errorCategory]struct {
+	title string
+	code  int
+	hint  string
+}{
+	configCategory: {
+		"Configuration error", 2,
+		"Check the plugin configuration of the step, see the README for the options and their values",
+	},
+	diffCategory: {
+		"Diff error", 3,
+		"Check that the `diff` command runs in the checkout and its refs are fetched, e.g. with a deeper clone or `git fetch origin main`",
+	},
+	uploadCategory: {
+		"Upload error", 4,
+		"Check the generated pipeline with `log_level: debug`, and that the agent can upload it with `buildkite-agent pipeline upload`",
+	},
+	apiCategory: {
+		"API error", 5,
+		"Check that `BUILDKITE_API_TOKEN` is set and its token has the scopes of the feature and access to the pipelines",
+	},
+}
+
+// categorizedError is an error of a category
+type categorizedError struct {
+	category errorCategory
+	err      error
+}
+
+func (e *categorizedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *categorizedError) Unwrap() error {
+	return e.err
+}
+
+// categorize sets the category of the error, unless it already has one
+func categorize(category errorCategory, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var c *categorizedError
+	if errors.As(err, &c) {
+		return err
+	}
+
+	return &categorizedError{category: category, err: err}
+}
+
+// exitCode returns the exit code of the plugin failing with the error, 1 when
+// it has no category
+func exitCode(err error) int {
+	var c *categorizedError
+	if errors.As(err, &c) {
+		return errorCategories[c.category].code
+	}
+
+	return 1
+}
+
+// describeError returns the error with the title of its category, and the hint to fix it
+func describeError(err error) (string, string) {
+	var c *categorizedError
+	if !errors.As(err, &c) {
+		return err.Error(), ""
+	}
+
+	category := errorCategories[c.category]
+	return fmt.Sprintf("%s: %v", category.title, err), category.hint
+}
+
+// fail logs the error with its hint and exits with the exit code of its category
+func fail(err error) {
+	message, hint := describeError(err)
+
+	log.Error(message)
+	if hint != "" {
+		log.Errorf("Hint: %s", hint)
+	}
+
+	log.Exit(exitCode(err))
+}
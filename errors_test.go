@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitCode(t *testing.T) {
+	testCases := map[string]struct {
+		err      error
+		expected int
+	}{
+		"uncategorized":  {fmt.Errorf("boom"), 1},
+		"config":         {categorize(configCategory, fmt.Errorf("boom")), 2},
+		"diff":           {categorize(diffCategory, fmt.Errorf("boom")), 3},
+		"upload":         {categorize(uploadCategory, fmt.Errorf("boom")), 4},
+		"api":            {categorize(apiCategory, fmt.Errorf("boom")), 5},
+		"wrapped":        {fmt.Errorf("trigger failed: %w", categorize(apiCategory, fmt.Errorf("boom"))), 5},
+		"first category": {categorize(uploadCategory, categorize(apiCategory, fmt.Errorf("boom"))), 5},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, exitCode(tc.err))
+		})
+	}
+}
+
+func TestCategorizeKeepsTheMessage(t *testing.T) {
+	assert.Nil(t, categorize(configCategory, nil))
+	assert.EqualError(t, categorize(configCategory, fmt.Errorf("invalid mode `foo`")), "invalid mode `foo`")
+}
+
+func TestDescribeError(t *testing.T) {
+	message, hint := describeError(categorize(diffCategory, fmt.Errorf("exit status 128")))
+	assert.Equal(t, "Diff error: exit status 128", message)
+	assert.Contains(t, hint, "git fetch")
+
+	message, hint = describeError(fmt.Errorf("boom"))
+	assert.Equal(t, "boom", message)
+	assert.Empty(t, hint)
+}
+
+func TestBuildkiteAPIErrorsAreCategorized(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	os.Setenv("BUILDKITE_API_TOKEN", "token")
+	os.Setenv("BUILDKITE_API_ENDPOINT", server.URL)
+	defer os.Unsetenv("BUILDKITE_API_TOKEN")
+	defer os.Unsetenv("BUILDKITE_API_ENDPOINT")
+
+	api, err := newBuildkiteAPI()
+	assert.NoError(t, err)
+
+	_, err = api.build("org", "pipeline", "1")
+	assert.Error(t, err)
+	assert.Equal(t, 5, exitCode(err))
+}
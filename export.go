@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// formats of the printed steps
+const (
+	formatBuildkite   = "buildkite"
+	formatGenericJSON = "generic-json"
+)
+
+// genericTrigger is a matched step in the provider agnostic `generic-json` format
+type genericTrigger struct {
+	Pipeline string   `json:"pipeline"`
+	Reason   string   `json:"reason"`
+	Files    []string `json:"files"`
+}
+
+// exportName names a step outside of Buildkite: its key, pipeline, label or command
+func exportName(s Step) string {
+	switch {
+	case s.Key != "":
+		return s.Key
+	case s.Trigger != "":
+		return s.Trigger
+	case s.Label != "":
+		return s.Label
+	default:
+		return s.Command
+	}
+}
+
+// diffReason is the reason of the watches matched by the changed files
+func diffReason(w WatchConfig) string {
+	return "changed files match " + strings.Join(w.Paths, ", ")
+}
+
+// setReasons records on the step of every watch why it was triggered and the
+// files it matched, for the `generic-json` format
+func setReasons(watches []WatchConfig, reason func(w WatchConfig) string) []WatchConfig {
+	result := make([]WatchConfig, len(watches))
+
+	for i, w := range watches {
+		w.Step.Reason = reason(w)
+		w.Step.MatchedFiles = w.Files
+		result[i] = w
+	}
+
+	return result
+}
+
+// genericTriggers returns the steps in the `generic-json` format. Steps of the
+// same pipeline, e.g. from several watches, are listed once with the files and
+// reasons of all of them.
+func genericTriggers(steps []Step) []genericTrigger {
+	triggers := []genericTrigger{}
+	index := map[string]int{}
+
+	for _, s := range steps {
+		if s.Wait || s.Raw != nil {
+			continue
+		}
+
+		name := exportName(s)
+		i, ok := index[name]
+		if !ok {
+			index[name] = len(triggers)
+			triggers = append(triggers, genericTrigger{Pipeline: name, Reason: s.Reason, Files: []string{}})
+			i = len(triggers) - 1
+		} else if s.Reason != "" && !strings.Contains(triggers[i].Reason, s.Reason) {
+			triggers[i].Reason += "; " + s.Reason
+		}
+
+		triggers[i].Files = uniq(append(triggers[i].Files, s.MatchedFiles...))
+	}
+
+	return triggers
+}
+
+// printGenericJSON prints the steps in the `generic-json` format to pipelineOutput
+func printGenericJSON(steps []Step) error {
+	data, err := json.MarshalIndent(genericTriggers(steps), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if _, err := pipelineOutput.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("could not print the pipeline: %v", err)
+	}
+
+	return nil
+}
+
+// publishNothing writes the outputs of a run without matched steps. Only the
+// outputs read by other tools need to be written.
+func publishNothing(plugin Plugin) error {
+	if plugin.Format == formatGenericJSON {
+		return printGenericJSON(nil)
+	}
+
+	if plugin.Output == outputGitHubActions {
+		return writeActionsOutputs(nil)
+	}
+
+	return nil
+}
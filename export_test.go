@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadPipelinePrintsGenericJSON(t *testing.T) {
+	var out bytes.Buffer
+	pipelineOutput = &out
+	defer func() { pipelineOutput = os.Stdout }()
+
+	plugin := Plugin{
+		Diff:   "printf 'services/foo/main.go\\nservices/foo/go.mod\\nlib/util.go\\ndocs/README.md\\n'",
+		Shell:  []string{"sh", "-c"},
+		Output: outputStdout,
+		Format: formatGenericJSON,
+		Watch: []WatchConfig{
+			{Paths: []string{"services/foo/"}, Step: Step{Trigger: "foo"}},
+			{Paths: []string{"lib/", "go.mod"}, Step: Step{Trigger: "foo"}},
+			{Paths: []string{"docs/"}, Step: Step{Label: "Docs", Command: "make docs"}},
+			{Paths: []string{"services/bar/"}, Step: Step{Trigger: "bar"}},
+		},
+	}
+
+	_, _, err := uploadPipeline(plugin, mockGeneratePipeline)
+	assert.NoError(t, err)
+
+	var triggers []genericTrigger
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &triggers))
+	assert.Equal(t, []genericTrigger{
+		{
+			Pipeline: "foo",
+			Reason:   "changed files match services/foo/; changed files match lib/, go.mod",
+			Files:    []string{"lib/util.go", "services/foo/go.mod", "services/foo/main.go"},
+		},
+		{Pipeline: "Docs", Reason: "changed files match docs/", Files: []string{"docs/README.md"}},
+	}, triggers)
+}
+
+func TestUploadPipelinePrintsEmptyGenericJSON(t *testing.T) {
+	var out bytes.Buffer
+	pipelineOutput = &out
+	defer func() { pipelineOutput = os.Stdout }()
+
+	plugin := Plugin{
+		Diff:   "echo docs/README.md",
+		Output: outputStdout,
+		Format: formatGenericJSON,
+		Watch:  []WatchConfig{{Paths: []string{"services/foo/"}, Step: Step{Trigger: "foo"}}},
+	}
+
+	_, _, err := uploadPipeline(plugin, mockGeneratePipeline)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "[]\n", out.String())
+}
+
+func TestGenericJSONReasons(t *testing.T) {
+	os.Setenv("BUILDKITE_TAG", "v1.2.0")
+	defer os.Unsetenv("BUILDKITE_TAG")
+
+	var out bytes.Buffer
+	pipelineOutput = &out
+	defer func() { pipelineOutput = os.Stdout }()
+
+	plugin := Plugin{
+		Output: outputStdout,
+		Format: formatGenericJSON,
+		Watch:  []WatchConfig{{Tags: []string{"v*"}, Step: Step{Trigger: "release"}}},
+	}
+
+	_, _, err := uploadPipeline(plugin, mockGeneratePipeline)
+	assert.NoError(t, err)
+
+	var triggers []genericTrigger
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &triggers))
+	assert.Equal(t, []genericTrigger{{Pipeline: "release", Reason: "tag v1.2.0", Files: []string{}}}, triggers)
+}
+
+func TestPluginFormatNeedsStdout(t *testing.T) {
+	_, err := initializePluginConfiguration(`{"format": "generic-json", "watch": []}`)
+	assert.EqualError(t, err, "failed to parse plugin configuration: format `generic-json` needs output `stdout`")
+
+	plugin, err := initializePluginConfiguration(`{"format": "generic-json", "output": "stdout", "watch": []}`)
+	assert.NoError(t, err)
+	assert.Equal(t, formatGenericJSON, plugin.Format)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// extensionInput is the matched context written to the stdin of the extension
+type extensionInput struct {
+	Watches []extensionWatch `json:"watches"`
+	Steps   []interface{}    `json:"steps"`
+}
+
+// extensionWatch is a matched watch and the changed files it matched
+type extensionWatch struct {
+	Label string   `json:"label,omitempty"`
+	Paths []string `json:"paths"`
+	Files []string `json:"files"`
+}
+
+// extensionOutput is read from the stdout of the extension
+type extensionOutput struct {
+	Steps []json.RawMessage `json:"steps"`
+}
+
+// extensionSteps are the attributes of the steps passed as they are, since
+// Step doesn't model them
+var extensionSteps = []string{"group", "input"}
+
+// runExtension runs the `extension` executable with the matched watches and the
+// generated steps as JSON on its stdin, and returns the steps it writes as JSON
+// on its stdout, which replace the generated steps
+func runExtension(plugin Plugin, watches []WatchConfig, steps []Step) ([]Step, error) {
+	input := extensionInput{Watches: []extensionWatch{}, Steps: []interface{}{}}
+
+	for _, w := range watches {
+		files := w.Files
+		if files == nil {
+			files = []string{}
+		}
+		input.Watches = append(input.Watches, extensionWatch{Label: w.Label, Paths: w.Paths, Files: files})
+	}
+
+	for _, s := range steps {
+		step, err := jsonStep(s)
+		if err != nil {
+			return nil, err
+		}
+		input.Steps = append(input.Steps, step)
+	}
+
+	data, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout bytes.Buffer
+
+	cmd := shellCommand(plugin.Shell, plugin.Extension)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = logWriter
+
+	if err := runProcess(cmd); err != nil {
+		return nil, fmt.Errorf("extension `%s` failed: %v", plugin.Extension, err)
+	}
+
+	var output extensionOutput
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+		return nil, fmt.Errorf("invalid output of extension `%s`: %v", plugin.Extension, err)
+	}
+
+	result := []Step{}
+
+	for _, data := range output.Steps {
+		step, err := extensionStep(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid output of extension `%s`: %v", plugin.Extension, err)
+		}
+
+		result = append(result, withStepMetadata(step, steps))
+	}
+
+	return result, nil
+}
+
+// extensionStep parses a step written by the extension. Wait steps and the
+// steps Step doesn't model are kept as they are, the others are parsed like
+// the `config` of watches.
+func extensionStep(data json.RawMessage) (Step, error) {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return Step{}, err
+	}
+
+	attributes, ok := value.(map[string]interface{})
+	if !ok {
+		if value == "wait" {
+			return Step{Wait: true}, nil
+		}
+		return Step{}, fmt.Errorf("invalid step `%s`", data)
+	}
+
+	if _, ok := attributes["wait"]; ok {
+		step := Step{Wait: true}
+		for name, attribute := range attributes {
+			if name == "wait" {
+				continue
+			}
+			if step.WaitAttributes == nil {
+				step.WaitAttributes = map[string]interface{}{}
+			}
+			step.WaitAttributes[name] = attribute
+		}
+		return step, nil
+	}
+
+	for _, name := range extensionSteps {
+		if _, ok := attributes[name]; ok {
+			return Step{Raw: yamlValue(attributes)}, nil
+		}
+	}
+
+	var watch WatchConfig
+	if err := json.Unmarshal(data, &watch.Step); err != nil {
+		return Step{}, err
+	}
+	watch.Step.Extra = extraAttributes(attributes)
+
+	if err := appendEnv(&watch, nil); err != nil {
+		return Step{}, err
+	}
+
+	if err := setUpload(&watch.Step); err != nil {
+		return Step{}, err
+	}
+
+	return watch.Step, nil
+}
+
+// withStepMetadata copies the fields of the generated step with the same key,
+// or else the same label, that aren't written to the extension, e.g. the
+// owner of the watch and the organization a trigger step is sent to
+func withStepMetadata(step Step, generated []Step) Step {
+	if step.Wait || step.Raw != nil || (step.Key == "" && step.Label == "") {
+		return step
+	}
+
+	for _, g := range generated {
+		if g.Wait || g.Raw != nil {
+			continue
+		}
+
+		if (step.Key != "" && g.Key == step.Key) || (step.Key == "" && g.Label == step.Label) {
+			step.WatchLabel = g.WatchLabel
+			step.Reason = g.Reason
+			step.MatchedFiles = g.MatchedFiles
+			step.Owner = g.Owner
+			step.Team = g.Team
+			step.Organization = g.Organization
+			return step
+		}
+	}
+
+	return step
+}
+
+// jsonStep returns the step as it is written in the pipeline, as a value that
+// can be encoded to JSON
+func jsonStep(step Step) (interface{}, error) {
+	data, err := yaml.Marshal(step)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	if err := yaml.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+
+	return jsonValue(value), nil
+}
+
+// jsonValue converts the maps decoded from YAML to maps with string keys
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		result := map[string]interface{}{}
+		for key, item := range v {
+			result[fmt.Sprint(key)] = jsonValue(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = jsonValue(item)
+		}
+		return result
+	}
+
+	return value
+}
+
+// yamlValue converts the maps decoded from JSON to maps sorted by key, like
+// the steps of merged pipelines
+func yamlValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		result := yaml.MapSlice{}
+		for _, name := range names {
+			result = append(result, yaml.MapItem{Key: name, Value: yamlValue(v[name])})
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = yamlValue(item)
+		}
+		return result
+	}
+
+	return value
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestRunExtension(t *testing.T) {
+	dir, err := ioutil.TempDir("", "extension")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input.json")
+	output := `{"steps": [
+		{"trigger": "foo", "build": {"env": ["DEPLOY_ENV=production"]}},
+		{"command": "make audit", "env": {"STRICT": true}},
+		{"upload": ".buildkite/audit.yml"}
+	]}`
+
+	plugin := Plugin{Extension: "cat > " + input + " && echo '" + output + "'"}
+	watches := []WatchConfig{
+		{Label: "Foo", Paths: []string{"services/foo/"}, Files: []string{"services/foo/main.go"}, Step: Step{Trigger: "foo"}},
+	}
+
+	got, err := runExtension(plugin, watches, []Step{{Trigger: "foo", Build: Build{Branch: "main"}}})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Step{
+		{Trigger: "foo", Build: Build{Env: map[string]string{"DEPLOY_ENV": "production"}}},
+		{Command: "make audit", Env: map[string]string{"STRICT": "true"}},
+		{
+			Command: "buildkite-agent pipeline upload .buildkite/audit.yml",
+			Label:   ":pipeline: Upload .buildkite/audit.yml",
+			Upload:  ".buildkite/audit.yml",
+		},
+	}, got)
+
+	data, _ := ioutil.ReadFile(input)
+	var context map[string]interface{}
+	assert.NoError(t, json.Unmarshal(data, &context))
+	assert.Equal(t, map[string]interface{}{
+		"watches": []interface{}{
+			map[string]interface{}{
+				"label": "Foo",
+				"paths": []interface{}{"services/foo/"},
+				"files": []interface{}{"services/foo/main.go"},
+			},
+		},
+		"steps": []interface{}{
+			map[string]interface{}{"trigger": "foo", "build": map[string]interface{}{"branch": "main"}},
+		},
+	}, context)
+}
+
+func TestRunExtensionKeepsSteps(t *testing.T) {
+	generated := []Step{
+		{Trigger: "foo", Key: "foo", Owner: "@acme/foo", Team: "foo", Reason: "path", MatchedFiles: []string{"services/foo/main.go"}, WatchLabel: "Foo", Extra: map[string]interface{}{"skip_queue": true}},
+		{Wait: true, WaitAttributes: map[string]interface{}{"continue_on_failure": true}},
+		{Raw: map[interface{}]interface{}{"group": "Bar", "steps": []interface{}{map[interface{}]interface{}{"command": "make bar"}}}},
+	}
+
+	got, err := runExtension(Plugin{Extension: "cat"}, nil, generated)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Step{
+		{Trigger: "foo", Key: "foo", Owner: "@acme/foo", Team: "foo", Reason: "path", MatchedFiles: []string{"services/foo/main.go"}, WatchLabel: "Foo", Extra: map[string]interface{}{"skip_queue": true}},
+		{Wait: true, WaitAttributes: map[string]interface{}{"continue_on_failure": true}},
+		{Raw: yaml.MapSlice{{Key: "group", Value: "Bar"}, {Key: "steps", Value: []interface{}{yaml.MapSlice{{Key: "command", Value: "make bar"}}}}}},
+	}, got)
+
+	got, err = runExtension(Plugin{Extension: `echo '{"steps": ["wait", {"input": "Release?"}]}'`}, nil, nil)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Step{{Wait: true}, {Raw: yaml.MapSlice{{Key: "input", Value: "Release?"}}}}, got)
+}
+
+func TestRunExtensionErrors(t *testing.T) {
+	testCases := map[string]struct {
+		extension string
+		expected  string
+	}{
+		"failure": {
+			extension: "exit 3",
+			expected:  "extension `exit 3` failed: exit status 3",
+		},
+		"invalid output": {
+			extension: "echo steps",
+			expected:  "invalid output of extension `echo steps`: invalid character 's' looking for beginning of value",
+		},
+		"invalid step": {
+			extension: `echo '{"steps": [{"command": "echo", "env": "FOO"}]}'`,
+			expected:  "invalid output of extension `echo '{\"steps\": [{\"command\": \"echo\", \"env\": \"FOO\"}]}'`: invalid env `FOO`, expected a list or a map",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := runExtension(Plugin{Extension: tc.extension}, nil, nil)
+
+			assert.EqualError(t, err, tc.expected)
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// needsFiles reports whether the matched files of the watches have to be kept
+func needsFiles(plugin Plugin) bool {
+	for _, collect := range collectedWatches(plugin) {
+		if collect {
+			return true
+		}
+	}
+
+	return false
+}
+
+// collectedWatches reports for each watch whether its matched files have to be
+// kept. The other watches stop being matched once they have matched a file.
+func collectedWatches(plugin Plugin) []bool {
+	all := plugin.Templates || plugin.RoutingReport != "" || plugin.ReportUnmatched != "" || plugin.Extension != "" || plugin.MatchedFilesArtifacts ||
+		plugin.Format == formatGenericJSON
+
+	collect := make([]bool, len(plugin.Watch))
+	for i, w := range plugin.Watch {
+		collect[i] = all || watchNeedsFiles(w)
+	}
+
+	return collect
+}
+
+// watchNeedsFiles reports whether the watch uses every file it matched
+func watchNeedsFiles(w WatchConfig) bool {
+	if w.FanOut != "" || w.MinChangedLines > 0 || len(w.QueueRules) > 0 {
+		return true
+	}
+
+	for _, p := range w.Paths {
+		if hasCaptures(p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fanOutWatches replaces every fan out watch with a watch per matched
+// directory, holding the files matched in that directory.
+func fanOutWatches(watches []WatchConfig) []WatchConfig {
+	result := []WatchConfig{}
+
+	for _, w := range watches {
+		if w.FanOut == "" {
+			result = append(result, w)
+			continue
+		}
+
+		depth := fanOutDepth(w)
+		groups := map[string][]string{}
+
+		for _, f := range w.Files {
+			dir := truncateDir(path.Dir(f), depth)
+			groups[dir] = append(groups[dir], f)
+		}
+
+		dirs := make([]string, 0, len(groups))
+		for dir := range groups {
+			dirs = append(dirs, dir)
+		}
+		sort.Strings(dirs)
+
+		for _, dir := range dirs {
+			fanned := w
+			fanned.Dir = dir
+			fanned.Files = groups[dir]
+			result = append(result, fanned)
+		}
+	}
+
+	return result
+}
+
+// fanOutDepth returns the depth of the directories of the watch. By default it
+// is the directory right below the literal part of its first path, e.g.
+// `services/foo` for `services/*/**`.
+func fanOutDepth(w WatchConfig) int {
+	if w.Depth > 0 {
+		return w.Depth
+	}
+
+	if len(w.Paths) == 0 {
+		return 1
+	}
+
+	prefix := strings.Trim(literalPrefix(w.Paths[0]), "/")
+	if prefix == "" {
+		return 1
+	}
+
+	return strings.Count(prefix, "/") + 2
+}
+
+// truncateDir returns the first depth segments of the directory
+func truncateDir(dir string, depth int) string {
+	segments := strings.Split(dir, "/")
+	if len(segments) > depth {
+		segments = segments[:depth]
+	}
+
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFanOutWatches(t *testing.T) {
+	plain := WatchConfig{Paths: []string{"docs/"}, Step: Step{Command: "make docs"}}
+	fanOut := WatchConfig{
+		Paths:  []string{"services/*/**"},
+		FanOut: "directory",
+		Step:   Step{Trigger: "{{ .Name }}-deploy"},
+		Files: []string{
+			"services/bar/main.go",
+			"services/foo/api/handler.go",
+			"services/foo/main.go",
+			"services/go.mod",
+		},
+	}
+
+	got := fanOutWatches([]WatchConfig{plain, fanOut})
+
+	assert.Len(t, got, 4)
+	assert.Equal(t, plain, got[0])
+	assert.Equal(t, "services", got[1].Dir)
+	assert.Equal(t, []string{"services/go.mod"}, got[1].Files)
+	assert.Equal(t, "services/bar", got[2].Dir)
+	assert.Equal(t, []string{"services/bar/main.go"}, got[2].Files)
+	assert.Equal(t, "services/foo", got[3].Dir)
+	assert.Equal(t, []string{"services/foo/api/handler.go", "services/foo/main.go"}, got[3].Files)
+
+	rendered, err := renderWatches(got, false)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "bar-deploy", rendered[2].Step.Trigger)
+	assert.Equal(t, "foo-deploy", rendered[3].Step.Trigger)
+}
+
+func TestCollectedWatches(t *testing.T) {
+	plugin := Plugin{Watch: []WatchConfig{
+		{Paths: []string{"services/"}},
+		{Paths: []string{"services/"}, FanOut: "services/*"},
+		{Paths: []string{"services/(?P<svc>[^/]+)/**"}},
+		{Paths: []string{"services/"}, MinChangedLines: 10},
+	}}
+
+	assert.Equal(t, []bool{false, true, true, true}, collectedWatches(plugin))
+	assert.True(t, needsFiles(plugin))
+
+	plugin.RoutingReport = "report.json"
+	assert.Equal(t, []bool{true, true, true, true}, collectedWatches(plugin))
+
+	assert.False(t, needsFiles(Plugin{Watch: []WatchConfig{{Paths: []string{"services/"}}}}))
+}
+
+func TestFanOutDepth(t *testing.T) {
+	testCases := map[string]struct {
+		Watch    WatchConfig
+		Expected int
+	}{
+		"explicit":       {WatchConfig{Paths: []string{"services/*/**"}, Depth: 3}, 3},
+		"glob":           {WatchConfig{Paths: []string{"services/*/**"}}, 2},
+		"nested glob":    {WatchConfig{Paths: []string{"apps/web/*/**"}}, 3},
+		"directory":      {WatchConfig{Paths: []string{"services/"}}, 2},
+		"root glob":      {WatchConfig{Paths: []string{"**/*.go"}}, 1},
+		"without a path": {WatchConfig{}, 1},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.Expected, fanOutDepth(tc.Watch))
+		})
+	}
+}
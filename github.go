@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// githubRepoPattern extracts the owner and name from GitHub SSH and HTTPS remote URLs
+var githubRepoPattern = regexp.MustCompile(`github\.com[:/]([^/]+)/([^/]+?)(\.git)?/?$`)
+
+// githubAPI is a client for the GitHub REST API
+type githubAPI struct {
+	endpoint string
+	token    string
+	repo     string
+}
+
+// githubStatus is a GitHub commit status
+type githubStatus struct {
+	State       string `json:"state"`
+	TargetURL   string `json:"target_url,omitempty"`
+	Description string `json:"description"`
+	Context     string `json:"context"`
+}
+
+func newGithubAPI() (*githubAPI, error) {
+	token := env("GITHUB_TOKEN", "")
+	if token == "" {
+		return nil, fmt.Errorf("GITHUB_TOKEN is required to use the GitHub API")
+	}
+
+	repo := env("BUILDKITE_REPO", "")
+	match := githubRepoPattern.FindStringSubmatch(repo)
+	if match == nil {
+		return nil, fmt.Errorf("BUILDKITE_REPO `%s` is not a GitHub repository", repo)
+	}
+
+	return &githubAPI{
+		endpoint: strings.TrimSuffix(env("GITHUB_API_URL", "https://api.github.com"), "/"),
+		token:    token,
+		repo:     match[1] + "/" + match[2],
+	}, nil
+}
+
+// createStatus sets a commit status on the commit
+func (api *githubAPI) createStatus(commit string, status githubStatus) error {
+	path := fmt.Sprintf("/repos/%s/statuses/%s", api.repo, commit)
+	if err := sendJSON(http.MethodPost, api.endpoint+path, api.token, status, nil); err != nil {
+		return fmt.Errorf("could not set the %s commit status: %v", status.Context, err)
+	}
+
+	return nil
+}
+
+// labels returns the labels of the pull request
+func (api *githubAPI) labels(pr string) ([]string, error) {
+	var labels []struct {
+		Name string `json:"name"`
+	}
+
+	path := fmt.Sprintf("/repos/%s/issues/%s/labels?per_page=100", api.repo, pr)
+	if err := sendJSON(http.MethodGet, api.endpoint+path, api.token, nil, &labels); err != nil {
+		return nil, fmt.Errorf("could not get the labels of pull request #%s: %v", pr, err)
+	}
+
+	names := make([]string, len(labels))
+	for i, l := range labels {
+		names[i] = l.Name
+	}
+
+	return names, nil
+}
+
+// postCommitStatuses sets a GitHub commit status for every triggered pipeline,
+// so reviewers can see which pipelines a commit launched. Failures are only
+// logged since the statuses are informational.
+func postCommitStatuses(steps []Step) {
+	api, err := newGithubAPI()
+	if err != nil {
+		log.Warnf("could not set commit statuses: %v", err)
+		return
+	}
+
+	commit := env("BUILDKITE_COMMIT", "")
+	url := env("BUILDKITE_BUILD_URL", "")
+
+	for _, s := range steps {
+		if s.Trigger == "" {
+			continue
+		}
+
+		err := api.createStatus(commit, githubStatus{
+			State:       "success",
+			TargetURL:   url,
+			Description: "monorepo-diff: triggered " + s.Trigger,
+			Context:     "monorepo-diff/" + s.Trigger,
+		})
+
+		if err != nil {
+			log.Warn(err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewGithubAPI(t *testing.T) {
+	os.Setenv("GITHUB_TOKEN", "gh-token")
+	defer os.Unsetenv("GITHUB_TOKEN")
+	defer os.Unsetenv("BUILDKITE_REPO")
+
+	testCases := map[string]struct {
+		Repo     string
+		Expected string
+		Error    string
+	}{
+		"ssh": {
+			Repo:     "git@github.com:chronotc/monorepo-diff-buildkite-plugin.git",
+			Expected: "chronotc/monorepo-diff-buildkite-plugin",
+		},
+		"https": {
+			Repo:     "https://github.com/chronotc/monorepo-diff-buildkite-plugin.git",
+			Expected: "chronotc/monorepo-diff-buildkite-plugin",
+		},
+		"without .git": {
+			Repo:     "https://github.com/chronotc/monorepo",
+			Expected: "chronotc/monorepo",
+		},
+		"not github": {
+			Repo:  "git@gitlab.com:chronotc/monorepo.git",
+			Error: "BUILDKITE_REPO `git@gitlab.com:chronotc/monorepo.git` is not a GitHub repository",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			os.Setenv("BUILDKITE_REPO", tc.Repo)
+
+			api, err := newGithubAPI()
+
+			if tc.Error != "" {
+				assert.EqualError(t, err, tc.Error)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Expected, api.repo)
+			assert.Equal(t, "https://api.github.com", api.endpoint)
+		})
+	}
+}
+
+func TestPostCommitStatuses(t *testing.T) {
+	got := map[string]githubStatus{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Token gh-token", r.Header.Get("Authorization"))
+
+		var status githubStatus
+		_ = json.NewDecoder(r.Body).Decode(&status)
+		got[r.URL.Path] = status
+
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	os.Setenv("GITHUB_API_URL", server.URL)
+	os.Setenv("GITHUB_TOKEN", "gh-token")
+	os.Setenv("BUILDKITE_REPO", "git@github.com:org/monorepo.git")
+	os.Setenv("BUILDKITE_BUILD_URL", "https://buildkite.com/org/monorepo/builds/1")
+	defer os.Unsetenv("GITHUB_API_URL")
+	defer os.Unsetenv("GITHUB_TOKEN")
+	defer os.Unsetenv("BUILDKITE_REPO")
+	defer os.Unsetenv("BUILDKITE_BUILD_URL")
+
+	postCommitStatuses([]Step{{Trigger: "foo-service"}, {Command: "echo hello"}})
+
+	assert.Equal(t, map[string]githubStatus{
+		"/repos/org/monorepo/statuses/123": {
+			State:       "success",
+			TargetURL:   "https://buildkite.com/org/monorepo/builds/1",
+			Description: "monorepo-diff: triggered foo-service",
+			Context:     "monorepo-diff/foo-service",
+		},
+	}, got)
+}
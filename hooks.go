@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	// dependsOnSteps in the depends_on of a hook are the keys of the generated steps
+	dependsOnSteps = "@steps"
+	// dependsOnTriggered in the depends_on of a hook are the keys of the generated trigger steps
+	dependsOnTriggered = "@triggered"
+)
+
+const (
+	// hookPhaseBefore hooks are added to the generated pipeline before the generated steps
+	hookPhaseBefore = "before"
+	// hookPhaseAfter hooks are added to the generated pipeline after the generated steps
+	hookPhaseAfter = "after"
+	// hookPhasePreDiff hooks run on the agent before the diff command
+	hookPhasePreDiff = "pre_diff"
+	// hookPhasePostUpload hooks run on the agent after the pipeline is uploaded
+	hookPhasePostUpload = "post_upload"
+)
+
+// checkHookPhases fails on a hook with an unknown phase, which no phase would run
+func checkHookPhases(hooks []HookConfig) error {
+	for _, h := range hooks {
+		switch h.Phase {
+		case "", hookPhaseBefore, hookPhaseAfter, hookPhasePreDiff, hookPhasePostUpload:
+		default:
+			return fmt.Errorf("unknown hook phase `%s`, expected one of before, after, pre_diff, post_upload", h.Phase)
+		}
+	}
+
+	return nil
+}
+
+// phase returns the phase of the hook, hooks without a phase run after the generated steps
+func (h HookConfig) phase() string {
+	if h.Phase == "" {
+		return hookPhaseAfter
+	}
+
+	return h.Phase
+}
+
+// hooksInPhase returns the hooks configured for the given phase
+func hooksInPhase(hooks []HookConfig, phase string) []HookConfig {
+	result := []HookConfig{}
+
+	for _, h := range hooks {
+		if h.phase() == phase {
+			result = append(result, h)
+		}
+	}
+
+	return result
+}
+
+// positionHooks applies `hooks_position` to the hooks that don't set a phase.
+// With `both` each of those hooks is added before and after the generated
+// steps, with `-before` and `-after` appended to its key so they stay unique.
+func positionHooks(hooks []HookConfig, position string) ([]HookConfig, error) {
+	switch position {
+	case "", hookPhaseAfter:
+		return hooks, nil
+	case hookPhaseBefore, "both":
+	default:
+		return nil, fmt.Errorf("unknown hooks_position `%s`", position)
+	}
+
+	result := []HookConfig{}
+
+	for _, h := range hooks {
+		if h.Phase != "" {
+			result = append(result, h)
+			continue
+		}
+
+		before := h
+		before.Phase = hookPhaseBefore
+
+		if position == "both" {
+			after := h
+			after.Phase = hookPhaseAfter
+
+			if h.Key != "" {
+				before.Key = h.Key + "-" + hookPhaseBefore
+				after.Key = h.Key + "-" + hookPhaseAfter
+			}
+
+			result = append(result, before, after)
+			continue
+		}
+
+		result = append(result, before)
+	}
+
+	return result, nil
+}
+
+// chunkHooks returns the pipeline hooks for the i-th of n pipeline chunks:
+// hooks placed before the generated steps belong to the first chunk, the rest to the last.
+func chunkHooks(hooks []HookConfig, i int, n int) []HookConfig {
+	result := []HookConfig{}
+
+	for _, h := range hooks {
+		if (h.phase() == hookPhaseBefore && i == 0) || (h.phase() == hookPhaseAfter && i == n-1) {
+			result = append(result, h)
+		}
+	}
+
+	return result
+}
+
+// hookSteps returns the steps of the hooks
+func hookSteps(hooks []HookConfig) []Step {
+	steps := make([]Step, len(hooks))
+	for i, h := range hooks {
+		steps[i] = h.Step
+	}
+
+	return steps
+}
+
+// keyHookedSteps gives the generated steps a key when they don't have one and
+// the depends_on of a hook refers to them with `@steps` or `@triggered`. The
+// keys are prefixed with the key_namespace, or else the job of the plugin, so
+// they don't collide with the steps of other uploads of the build.
+func keyHookedSteps(plugin Plugin, steps []Step) []Step {
+	if !hooksReferenceSteps(plugin.Hooks) {
+		return steps
+	}
+
+	prefix := "monorepo-diff"
+	if plugin.KeyNamespace != "" {
+		prefix = plugin.KeyNamespace + "-" + prefix
+	} else if job := env("BUILDKITE_JOB_ID", ""); job != "" {
+		prefix = prefix + "-" + job
+	}
+
+	keyed := make([]Step, len(steps))
+
+	for i, s := range steps {
+		keyed[i] = s
+
+		if !s.Wait && s.Raw == nil && s.Key == "" {
+			keyed[i].Key = fmt.Sprintf("%s-step-%d", prefix, i+1)
+		}
+	}
+
+	return keyed
+}
+
+// hooksReferenceSteps returns whether the depends_on of a hook refers to the
+// generated steps
+func hooksReferenceSteps(hooks []HookConfig) bool {
+	for _, h := range hooks {
+		for _, d := range dependencies(h.DependsOn) {
+			if d == dependsOnSteps || d == dependsOnTriggered {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// resolveHookDependencies replaces `@steps` and `@triggered` in the depends_on
+// of the hooks with the keys of the generated steps, given by keyHookedSteps
+func resolveHookDependencies(steps []Step, hooks []HookConfig) []HookConfig {
+	if !hooksReferenceSteps(hooks) {
+		return hooks
+	}
+
+	all := []interface{}{}
+	triggered := []interface{}{}
+
+	for _, s := range steps {
+		if s.Wait {
+			continue
+		}
+
+		for _, key := range stepKeys(s) {
+			all = append(all, key)
+			if s.Trigger != "" {
+				triggered = append(triggered, key)
+			}
+		}
+	}
+
+	result := make([]HookConfig, len(hooks))
+
+	for i, h := range hooks {
+		result[i] = h
+
+		if h.DependsOn == nil {
+			continue
+		}
+
+		resolved := []interface{}{}
+		for _, d := range dependencies(h.DependsOn) {
+			switch d {
+			case dependsOnSteps:
+				resolved = append(resolved, all...)
+			case dependsOnTriggered:
+				resolved = append(resolved, triggered...)
+			default:
+				resolved = append(resolved, d)
+			}
+		}
+		result[i].DependsOn = resolved
+	}
+
+	return result
+}
+
+// dependencies returns the entries of a depends_on given as a key or a list
+func dependencies(dependsOn interface{}) []interface{} {
+	switch d := dependsOn.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return d
+	default:
+		return []interface{}{d}
+	}
+}
+
+// runHooks executes the hook commands on the agent with the shell
+func runHooks(hooks []HookConfig, phase string, shell []string) error {
+	for _, h := range hooks {
+		logGroup(":hook: Running %s hook: %s", phase, h.Command)
+
+		cmd := shellCommand(shell, h.Command)
+		cmd.Stdout = logWriter
+		cmd.Stderr = logWriter
+
+		if err := runProcess(cmd); err != nil {
+			return fmt.Errorf("%s hook `%s` failed: %v", phase, h.Command, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,35 @@
+$ErrorActionPreference = "Stop"
+
+$plugin = if ($env:BUILDKITE_PLUGINS) { $env:BUILDKITE_PLUGINS } else { "" }
+$version = ($plugin -replace '.*monorepo-diff-buildkite-plugin', '') -replace '".*', ''
+$repo = "https://github.com/chronotc/monorepo-diff-buildkite-plugin"
+$executable = "monorepo-diff-buildkite-plugin-windows.exe"
+$test_mode = if ($env:BUILDKITE_PLUGIN_MONOREPO_DIFF_BUILDKITE_PLUGIN_TEST_MODE) { $env:BUILDKITE_PLUGIN_MONOREPO_DIFF_BUILDKITE_PLUGIN_TEST_MODE } else { "false" }
+
+if ($version -eq "") {
+  $url = "$repo/releases/latest/download/$executable"
+} else {
+  $url = "$repo/releases/download/$($version.Substring(1))/$executable"
+}
+
+$dir = "."
+
+# the binary is downloaded into a directory of its own, so concurrent jobs
+# sharing a checkout can't overwrite each other's download
+if ($test_mode -eq "false") {
+  $dir = Join-Path ([System.IO.Path]::GetTempPath()) ([System.Guid]::NewGuid().ToString())
+  New-Item -ItemType Directory -Path $dir | Out-Null
+
+  Write-Output $url
+  Invoke-WebRequest -Uri $url -OutFile (Join-Path $dir $executable)
+}
+
+try {
+  & (Join-Path $dir $executable)
+  $status = $LASTEXITCODE
+} finally {
+  if ($dir -ne ".") {
+    Remove-Item -Recurse -Force $dir
+  }
+}
+exit $status
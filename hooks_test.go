@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHooksInPhase(t *testing.T) {
+	hooks := []HookConfig{
+		{Step: Step{Command: "git fetch"}, Phase: "pre_diff"},
+		{Step: Step{Command: "echo done"}},
+		{Step: Step{Command: "./notify.sh"}, Phase: "post_upload"},
+	}
+
+	assert.Equal(t, []HookConfig{{Step: Step{Command: "echo done"}}}, hooksInPhase(hooks, hookPhaseAfter))
+	assert.Equal(t, []HookConfig{{Step: Step{Command: "git fetch"}, Phase: "pre_diff"}}, hooksInPhase(hooks, hookPhasePreDiff))
+	assert.Equal(t, []HookConfig{{Step: Step{Command: "./notify.sh"}, Phase: "post_upload"}}, hooksInPhase(hooks, hookPhasePostUpload))
+}
+
+func TestRunHooks(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "hooks")
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out.txt")
+
+	err := runHooks([]HookConfig{
+		{Step: Step{Command: "echo first > " + out}},
+		{Step: Step{Command: "echo second >> " + out}},
+	}, hookPhasePreDiff, nil)
+
+	assert.NoError(t, err)
+
+	got, _ := ioutil.ReadFile(out)
+	assert.Equal(t, "first\nsecond\n", string(got))
+}
+
+func TestRunHooksFailure(t *testing.T) {
+	err := runHooks([]HookConfig{{Step: Step{Command: "exit 3"}}}, hookPhasePostUpload, nil)
+
+	assert.EqualError(t, err, "post_upload hook `exit 3` failed: exit status 3")
+}
+
+func TestPositionHooks(t *testing.T) {
+	hooks := []HookConfig{
+		{Step: Step{Command: "setup"}, Phase: "before"},
+		{Step: Step{Command: "notify"}},
+		{Step: Step{Command: "report", Key: "report"}},
+		{Step: Step{Command: "git fetch"}, Phase: "pre_diff"},
+	}
+
+	got, err := positionHooks(hooks, "")
+	assert.NoError(t, err)
+	assert.Equal(t, hooks, got)
+
+	got, err = positionHooks(hooks, "before")
+	assert.NoError(t, err)
+	assert.Equal(t, []HookConfig{
+		{Step: Step{Command: "setup"}, Phase: "before"},
+		{Step: Step{Command: "notify"}, Phase: "before"},
+		{Step: Step{Command: "report", Key: "report"}, Phase: "before"},
+		{Step: Step{Command: "git fetch"}, Phase: "pre_diff"},
+	}, got)
+
+	got, err = positionHooks(hooks, "both")
+	assert.NoError(t, err)
+	assert.Equal(t, []HookConfig{
+		{Step: Step{Command: "setup"}, Phase: "before"},
+		{Step: Step{Command: "notify"}, Phase: "before"},
+		{Step: Step{Command: "notify"}, Phase: "after"},
+		{Step: Step{Command: "report", Key: "report-before"}, Phase: "before"},
+		{Step: Step{Command: "report", Key: "report-after"}, Phase: "after"},
+		{Step: Step{Command: "git fetch"}, Phase: "pre_diff"},
+	}, got)
+
+	_, err = positionHooks(hooks, "sideways")
+	assert.EqualError(t, err, "unknown hooks_position `sideways`")
+}
+
+func TestChunkHooks(t *testing.T) {
+	before := HookConfig{Step: Step{Command: "setup"}, Phase: "before"}
+	after := HookConfig{Step: Step{Command: "notify"}}
+	hooks := []HookConfig{before, after}
+
+	assert.Equal(t, []HookConfig{before, after}, chunkHooks(hooks, 0, 1))
+	assert.Equal(t, []HookConfig{before}, chunkHooks(hooks, 0, 3))
+	assert.Equal(t, []HookConfig{}, chunkHooks(hooks, 1, 3))
+	assert.Equal(t, []HookConfig{after}, chunkHooks(hooks, 2, 3))
+}
+
+func TestKeyHookedSteps(t *testing.T) {
+	steps := []Step{
+		{Trigger: "foo", Key: "deploy-foo"},
+		{Trigger: "bar"},
+		{Wait: true},
+		{Command: "make lint"},
+	}
+	hooks := []HookConfig{{Step: Step{Command: "aggregate", DependsOn: "@triggered"}}}
+
+	os.Setenv("BUILDKITE_JOB_ID", "job-1")
+	defer os.Unsetenv("BUILDKITE_JOB_ID")
+
+	assert.Equal(t, []Step{
+		{Trigger: "foo", Key: "deploy-foo"},
+		{Trigger: "bar", Key: "monorepo-diff-job-1-step-2"},
+		{Wait: true},
+		{Command: "make lint", Key: "monorepo-diff-job-1-step-4"},
+	}, keyHookedSteps(Plugin{Hooks: hooks}, steps))
+
+	got := keyHookedSteps(Plugin{Hooks: hooks, KeyNamespace: "services"}, steps)
+	assert.Equal(t, "services-monorepo-diff-step-2", got[1].Key)
+
+	hooks = []HookConfig{{Step: Step{Command: "aggregate", DependsOn: "setup"}}}
+	assert.Equal(t, steps, keyHookedSteps(Plugin{Hooks: hooks}, steps))
+}
+
+func TestResolveHookDependencies(t *testing.T) {
+	steps := []Step{
+		{Trigger: "foo", Key: "deploy-foo"},
+		{Trigger: "bar", Key: "monorepo-diff-step-2"},
+		{Wait: true},
+		{Command: "make lint", Key: "monorepo-diff-step-4"},
+		{Command: "echo no key"},
+	}
+	hooks := []HookConfig{
+		{Step: Step{Command: "aggregate", DependsOn: "@triggered", Priority: 5}},
+		{Step: Step{Command: "report", DependsOn: []interface{}{"setup", "@steps"}}},
+		{Step: Step{Command: "notify"}},
+	}
+
+	gotHooks := resolveHookDependencies(steps, hooks)
+
+	assert.Equal(t, []HookConfig{
+		{Step: Step{Command: "aggregate", DependsOn: []interface{}{"deploy-foo", "monorepo-diff-step-2"}, Priority: 5}},
+		{Step: Step{Command: "report", DependsOn: []interface{}{"setup", "deploy-foo", "monorepo-diff-step-2", "monorepo-diff-step-4"}}},
+		{Step: Step{Command: "notify"}},
+	}, gotHooks)
+
+	hooks = []HookConfig{{Step: Step{Command: "aggregate", DependsOn: "setup"}}}
+	assert.Equal(t, hooks, resolveHookDependencies(steps, hooks))
+}
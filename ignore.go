@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// monorepoDiffIgnore is the file, in gitignore syntax, of changed files that
+// are never matched
+const monorepoDiffIgnore = ".monorepo-diff-ignore"
+
+// filterIgnored removes the files ignored by the .gitignore files of the
+// repository or by .monorepo-diff-ignore, even when they are committed.
+// `git check-ignore` is used so the rules behave exactly as they do in git.
+func filterIgnored(files []string) ([]string, error) {
+	cmd := exec.CommandContext(
+		jobContext, "git", "-c", "core.excludesFile="+monorepoDiffIgnore,
+		"check-ignore", "--no-index", "--stdin", "-z",
+	)
+	cmd.Stdin = strings.NewReader(strings.Join(files, "\x00") + "\x00")
+
+	var out bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+
+	if err := runProcess(cmd); err != nil {
+		// exit status 1 means none of the files are ignored
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return files, nil
+		}
+
+		return nil, fmt.Errorf("could not check ignored files: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	ignored := map[string]bool{}
+	for _, f := range strings.Split(out.String(), "\x00") {
+		if f != "" {
+			ignored[f] = true
+		}
+	}
+
+	kept := []string{}
+	for _, f := range files {
+		if ignored[f] {
+			log.Debugf("Ignoring %s", f)
+			continue
+		}
+		kept = append(kept, f)
+	}
+
+	return kept, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterIgnored(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ignore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, exec.Command("git", "init", "-q", dir).Run())
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, ".gitignore"), []byte("*.gen.go\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, monorepoDiffIgnore), []byte("**/__snapshots__/\n"), 0644))
+
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	got, err := filterIgnored([]string{
+		"services/foo/main.go",
+		"services/foo/api.gen.go",
+		"services/foo/__snapshots__/api.snap",
+		"services/bar/main.go",
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"services/foo/main.go", "services/bar/main.go"}, got)
+
+	got, err = filterIgnored([]string{"services/foo/main.go"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"services/foo/main.go"}, got)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// deferredPipelineVar holds the pipeline of a step uploaded by its own command step
+const deferredPipelineVar = "MONOREPO_DIFF_PIPELINE"
+
+// applyInterpolation applies the `interpolation` of the watches that override
+// the top level one. Uploads of pipeline files get their own flag. Other steps
+// are escaped when the generated pipeline is interpolated, or are uploaded by
+// a command step of their own when it isn't.
+func applyInterpolation(watches []WatchConfig, plugin Plugin) ([]WatchConfig, error) {
+	result := make([]WatchConfig, len(watches))
+
+	for i, w := range watches {
+		result[i] = w
+
+		if w.Interpolation == nil {
+			if w.Step.Upload != "" && plugin.Interpolation {
+				result[i].Step.Command += " --no-interpolation"
+			}
+			continue
+		}
+
+		switch {
+		case w.Step.Upload != "":
+			if *w.Interpolation {
+				result[i].Step.Command += " --no-interpolation"
+			}
+		case *w.Interpolation == plugin.Interpolation:
+		case *w.Interpolation:
+			result[i].Step.Literal = true
+		default:
+			step, err := deferUpload(w.Step)
+			if err != nil {
+				return nil, err
+			}
+			result[i].Step = step
+		}
+	}
+
+	return result, nil
+}
+
+// deferUpload returns a command step uploading the step, so it's interpolated
+// even though the generated pipeline is uploaded with `--no-interpolation`
+func deferUpload(step Step) (Step, error) {
+	data, err := yaml.Marshal(map[string][]Step{"steps": {step}})
+	if err != nil {
+		return Step{}, fmt.Errorf("could not serialize the pipeline: %v", err)
+	}
+
+	return Step{
+		Label:   ":pipeline: Upload " + stepName(step),
+		Command: fmt.Sprintf("printenv %s | buildkite-agent pipeline upload", deferredPipelineVar),
+		Env:     map[string]string{deferredPipelineVar: string(data)},
+	}, nil
+}
+
+// escapeDollars escapes `$` in the strings of a YAML value, so the agent
+// doesn't interpolate them on upload
+func escapeDollars(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return strings.ReplaceAll(v, "$", "$$")
+	case yaml.MapSlice:
+		result := make(yaml.MapSlice, len(v))
+		for i, item := range v {
+			result[i] = yaml.MapItem{Key: item.Key, Value: escapeDollars(item.Value)}
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = escapeDollars(item)
+		}
+		return result
+	}
+
+	return value
+}
+
+// interpolateValue expands the environment variables in the strings of a
+// pipeline decoded from JSON, like `buildkite-agent pipeline upload` does
+func interpolateValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return interpolateString(v)
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			interpolated, err := interpolateValue(item)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = interpolated
+		}
+		return result, nil
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			interpolated, err := interpolateValue(item)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = interpolated
+		}
+		return result, nil
+	}
+
+	return value, nil
+}
+
+// interpolateString expands `$VAR`, `${VAR}`, `${VAR:-default}`,
+// `${VAR-default}`, `${VAR:?message}` and `${VAR?message}` with the
+// environment, and `$$` to `$`
+func interpolateString(s string) (string, error) {
+	var out strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i == len(s)-1 {
+			out.WriteByte(s[i])
+			continue
+		}
+
+		switch next := s[i+1]; {
+		case next == '$':
+			out.WriteByte('$')
+			i++
+		case next == '{':
+			end := closingBrace(s, i+1)
+			if end < 0 {
+				return "", fmt.Errorf("unterminated variable in `%s`", s)
+			}
+
+			expanded, err := expandVariable(s[i+2 : end])
+			if err != nil {
+				return "", err
+			}
+
+			out.WriteString(expanded)
+			i = end
+		case next == '_' || isLetter(next):
+			end := i + 1
+			for end < len(s) && (s[end] == '_' || isLetter(s[end]) || (s[end] >= '0' && s[end] <= '9')) {
+				end++
+			}
+
+			out.WriteString(os.Getenv(s[i+1 : end]))
+			i = end - 1
+		default:
+			out.WriteByte('$')
+		}
+	}
+
+	return out.String(), nil
+}
+
+// expandVariable expands the expression between the braces of a variable
+func expandVariable(expression string) (string, error) {
+	name, operator, argument := expression, "", ""
+
+	if i := strings.IndexAny(expression, ":-?"); i >= 0 {
+		name = expression[:i]
+		for _, o := range []string{":-", ":?", "-", "?"} {
+			if strings.HasPrefix(expression[i:], o) {
+				operator, argument = o, expression[i+len(o):]
+				break
+			}
+		}
+
+		if operator == "" {
+			return "", fmt.Errorf("unsupported variable `${%s}`", expression)
+		}
+	}
+
+	value, set := os.LookupEnv(name)
+
+	switch {
+	case operator == ":-" && value == "", operator == "-" && !set:
+		return interpolateString(argument)
+	case operator == ":?" && value == "", operator == "?" && !set:
+		return "", fmt.Errorf("%s: %s", name, argument)
+	}
+
+	return value, nil
+}
+
+// closingBrace returns the index of the brace closing the one at start
+func closingBrace(s string, start int) int {
+	depth := 0
+
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
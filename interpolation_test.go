@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestApplyInterpolation(t *testing.T) {
+	yes, no := true, false
+	command := Step{Command: "echo $FOO"}
+	upload := Step{Upload: "pipeline.yml", Command: "buildkite-agent pipeline upload pipeline.yml"}
+
+	testCases := map[string]struct {
+		global   bool
+		watch    WatchConfig
+		expected Step
+	}{
+		"inherited": {false, WatchConfig{Step: command}, command},
+		"same":      {true, WatchConfig{Step: command, Interpolation: &yes}, command},
+		"literal":   {false, WatchConfig{Step: command, Interpolation: &yes}, Step{Command: "echo $FOO", Literal: true}},
+		"deferred": {true, WatchConfig{Step: command, Interpolation: &no}, Step{
+			Label:   ":pipeline: Upload command: echo $FOO",
+			Command: "printenv MONOREPO_DIFF_PIPELINE | buildkite-agent pipeline upload",
+			Env:     map[string]string{"MONOREPO_DIFF_PIPELINE": "steps:\n- command: echo $FOO\n"},
+		}},
+		"upload inherited": {true, WatchConfig{Step: upload}, Step{
+			Upload:  "pipeline.yml",
+			Command: "buildkite-agent pipeline upload pipeline.yml --no-interpolation",
+		}},
+		"upload interpolated": {true, WatchConfig{Step: upload, Interpolation: &no}, upload},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := applyInterpolation([]WatchConfig{tc.watch}, Plugin{Interpolation: tc.global})
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, got[0].Step)
+		})
+	}
+}
+
+func TestLiteralStepEscapesDollars(t *testing.T) {
+	step := Step{
+		Command: "echo $FOO",
+		Env:     map[string]string{"BAR": "${BAZ}"},
+		Literal: true,
+	}
+
+	out, err := yaml.Marshal([]Step{step})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "- command: echo $$FOO\n  env:\n    BAR: $${BAZ}\n", string(out))
+}
+
+func TestInterpolateString(t *testing.T) {
+	os.Setenv("MONOREPO_DIFF_SERVICE", "payments")
+	os.Setenv("MONOREPO_DIFF_EMPTY", "")
+	defer os.Unsetenv("MONOREPO_DIFF_SERVICE")
+	defer os.Unsetenv("MONOREPO_DIFF_EMPTY")
+
+	for input, expected := range map[string]string{
+		"deploy $MONOREPO_DIFF_SERVICE":                    "deploy payments",
+		"deploy-${MONOREPO_DIFF_SERVICE}-api":              "deploy-payments-api",
+		"${MONOREPO_DIFF_EMPTY:-default}":                  "default",
+		"${MONOREPO_DIFF_EMPTY-default}":                   "",
+		"${MONOREPO_DIFF_UNSET-$MONOREPO_DIFF_SERVICE}":    "payments",
+		"${MONOREPO_DIFF_UNSET:-${MONOREPO_DIFF_SERVICE}}": "payments",
+		"costs $$5 and $":                                  "costs $5 and $",
+		"$1 stays":                                         "$1 stays",
+	} {
+		got, err := interpolateString(input)
+
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, got, input)
+	}
+
+	for input, expected := range map[string]string{
+		"${MONOREPO_DIFF_UNSET?is required}":  "MONOREPO_DIFF_UNSET: is required",
+		"${MONOREPO_DIFF_EMPTY:?is required}": "MONOREPO_DIFF_EMPTY: is required",
+		"${MONOREPO_DIFF_SERVICE":             "unterminated variable in `${MONOREPO_DIFF_SERVICE`",
+		"${MONOREPO_DIFF_SERVICE:0:3}":        "unsupported variable `${MONOREPO_DIFF_SERVICE:0:3}`",
+	} {
+		_, err := interpolateString(input)
+
+		assert.EqualError(t, err, expected, input)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// invocationMarker is the file counting the invocations of the plugin run in the job
+func invocationMarker() string {
+	job := env("BUILDKITE_JOB_ID", "")
+	if job == "" {
+		return ""
+	}
+
+	return filepath.Join(os.TempDir(), "monorepo-diff-"+job)
+}
+
+// claimInvocation returns whether this is the first of the invocations of the
+// plugin in the job. The agent runs the command of every invocation in turn,
+// and the first one uploads the steps of all of them, so the others have
+// nothing to do. The marker counts the invocations, and the last one removes it.
+func claimInvocation(invocations int) bool {
+	marker := invocationMarker()
+	if marker == "" {
+		return true
+	}
+
+	count := 0
+	if data, err := ioutil.ReadFile(marker); err == nil {
+		count, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	} else if !os.IsNotExist(err) {
+		log.Warnf("could not read %s: %v", marker, err)
+		return true
+	}
+	count++
+
+	if count >= invocations {
+		releaseInvocation()
+	} else if err := ioutil.WriteFile(marker, []byte(strconv.Itoa(count)), 0644); err != nil {
+		log.Warnf("could not write %s: %v", marker, err)
+	}
+
+	return count == 1
+}
+
+// releaseInvocation removes the marker of the job, when the first invocation
+// fails and the others won't run
+func releaseInvocation() {
+	marker := invocationMarker()
+	if marker == "" {
+		return
+	}
+
+	if err := os.Remove(marker); err != nil && !os.IsNotExist(err) {
+		log.Warnf("could not remove %s: %v", marker, err)
+	}
+}
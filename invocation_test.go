@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaimInvocation(t *testing.T) {
+	os.Setenv("BUILDKITE_JOB_ID", "claim-invocation-test")
+	defer os.Unsetenv("BUILDKITE_JOB_ID")
+	marker := filepath.Join(os.TempDir(), "monorepo-diff-claim-invocation-test")
+	defer os.Remove(marker)
+
+	assert.True(t, claimInvocation(3))
+	assert.FileExists(t, marker)
+	assert.False(t, claimInvocation(3))
+	assert.False(t, claimInvocation(3))
+	assert.NoFileExists(t, marker)
+}
+
+func TestReleaseInvocation(t *testing.T) {
+	os.Setenv("BUILDKITE_JOB_ID", "release-invocation-test")
+	defer os.Unsetenv("BUILDKITE_JOB_ID")
+	marker := filepath.Join(os.TempDir(), "monorepo-diff-release-invocation-test")
+	defer os.Remove(marker)
+
+	assert.True(t, claimInvocation(2))
+	releaseInvocation()
+	assert.NoFileExists(t, marker)
+}
+
+func TestClaimInvocationWithoutJob(t *testing.T) {
+	assert.True(t, claimInvocation(2))
+	assert.True(t, claimInvocation(2))
+}
+
+func TestUploadPipelinesMergesInvocations(t *testing.T) {
+	var generated []Step
+	var hooks []HookConfig
+	uploads := 0
+
+	generator := func(steps []Step, plugin Plugin) (*os.File, error) {
+		generated = steps
+		hooks = plugin.Hooks
+		uploads++
+		return mockGeneratePipeline(steps, plugin)
+	}
+
+	done := HookConfig{Step: Step{Command: "echo done"}}
+
+	plugins := []Plugin{
+		{
+			Diff:  "echo services/foo/main.go",
+			Hooks: []HookConfig{done},
+			Watch: []WatchConfig{
+				{Paths: []string{"services/foo/"}, Step: Step{Trigger: "foo"}},
+				{Paths: []string{"services/"}, Step: Step{Trigger: "services"}},
+			},
+		},
+		{
+			Diff:  "echo docs/README.md",
+			Hooks: []HookConfig{done},
+			Watch: []WatchConfig{
+				{Paths: []string{"docs/"}, Step: Step{Trigger: "docs"}},
+				{Paths: []string{"docs/"}, Step: Step{Trigger: "services"}},
+			},
+		},
+		{
+			Diff:  "echo",
+			Watch: []WatchConfig{{Paths: []string{"other/"}, Step: Step{Trigger: "other"}}},
+		},
+	}
+
+	_, _, err := uploadPipelines(plugins, generator)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, uploads)
+	assert.Equal(t, []Step{{Trigger: "foo"}, {Trigger: "services"}, {Trigger: "docs"}}, generated)
+	assert.Equal(t, []HookConfig{done}, hooks)
+}
+
+func TestUploadPipelinesDetectsKeyCollisions(t *testing.T) {
+	plugins := []Plugin{
+		{Diff: "echo foo/", Watch: []WatchConfig{{Paths: []string{"foo/"}, Step: Step{Key: "deploy", Trigger: "foo"}}}},
+		{Diff: "echo bar/", Watch: []WatchConfig{{Paths: []string{"bar/"}, Step: Step{Key: "deploy", Trigger: "bar"}}}},
+	}
+
+	_, _, err := uploadPipelines(plugins, mockGeneratePipeline)
+
+	assert.EqualError(t, err, "duplicate keys in the generated steps: deploy")
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// namespaceKeys prefixes the keys of the steps, and of merged steps the keys
+// they depend on, with the namespace. The depends_on of the other steps is
+// only prefixed for the keys of the steps, keys of steps already in the build
+// are kept.
+func namespaceKeys(steps []Step, namespace string) []Step {
+	if namespace == "" {
+		return steps
+	}
+
+	generated := map[string]bool{}
+	for _, s := range steps {
+		for _, key := range stepKeys(s) {
+			generated[key] = true
+		}
+	}
+
+	result := make([]Step, len(steps))
+
+	for i, s := range steps {
+		result[i] = s
+
+		if s.Key != "" {
+			result[i].Key = namespace + "-" + s.Key
+		}
+
+		if s.Raw != nil {
+			result[i].Raw = prefixKeys(s.Raw, namespace)
+		} else if s.DependsOn != nil {
+			result[i].DependsOn = namespaceDependencies(s.DependsOn, generated, namespace)
+		}
+	}
+
+	return result
+}
+
+// namespaceDependencies prefixes the entries of a depends_on given as a key,
+// a list of keys or a list of `step` objects that are generated keys
+func namespaceDependencies(value interface{}, generated map[string]bool, namespace string) interface{} {
+	switch dependency := value.(type) {
+	case string:
+		if generated[dependency] {
+			return namespace + "-" + dependency
+		}
+	case []interface{}:
+		result := make([]interface{}, len(dependency))
+		for i, d := range dependency {
+			result[i] = namespaceDependencies(d, generated, namespace)
+		}
+		return result
+	case map[string]interface{}:
+		result := map[string]interface{}{}
+		for name, item := range dependency {
+			if name == "step" {
+				item = namespaceDependencies(item, generated, namespace)
+			}
+			result[name] = item
+		}
+		return result
+	case yaml.MapSlice:
+		result := yaml.MapSlice{}
+		for _, item := range dependency {
+			if item.Key == "step" {
+				item.Value = namespaceDependencies(item.Value, generated, namespace)
+			}
+			result = append(result, item)
+		}
+		return result
+	}
+
+	return value
+}
+
+// stepKeys returns the keys of a step, including the keys of the steps of a
+// merged group
+func stepKeys(step Step) []string {
+	if step.Raw == nil {
+		if step.Key == "" {
+			return nil
+		}
+		return []string{step.Key}
+	}
+
+	return rawStepKeys(step.Raw)
+}
+
+func rawStepKeys(step interface{}) []string {
+	attributes, ok := step.(yaml.MapSlice)
+	if !ok {
+		return nil
+	}
+
+	keys := []string{}
+
+	for _, item := range attributes {
+		name := fmt.Sprint(item.Key)
+
+		if keyAttributes[name] {
+			keys = append(keys, fmt.Sprint(item.Value))
+		}
+
+		if nested, ok := item.Value.([]interface{}); ok && name == "steps" {
+			for _, s := range nested {
+				keys = append(keys, rawStepKeys(s)...)
+			}
+		}
+	}
+
+	return keys
+}
+
+// checkKeyCollisions fails when a key is used by more than one generated step,
+// or with `check_key_collisions` by a step already in the build, which would
+// otherwise fail the pipeline upload with a duplicate key error
+func checkKeyCollisions(plugin Plugin, steps []Step) error {
+	seen := map[string]bool{}
+	duplicates := map[string]bool{}
+
+	generated := append([]Step{}, steps...)
+	for _, h := range plugin.Hooks {
+		generated = append(generated, h.Step)
+	}
+
+	for _, s := range generated {
+		for _, key := range stepKeys(s) {
+			if seen[key] {
+				duplicates[key] = true
+			}
+			seen[key] = true
+		}
+	}
+
+	if len(duplicates) > 0 {
+		return fmt.Errorf("duplicate keys in the generated steps: %s", sortedKeys(duplicates))
+	}
+
+	if !plugin.CheckKeyCollisions || len(seen) == 0 {
+		return nil
+	}
+
+	api, err := newBuildkiteAPI()
+	if err != nil {
+		return err
+	}
+
+	build, err := api.build(
+		env("BUILDKITE_ORGANIZATION_SLUG", ""),
+		env("BUILDKITE_PIPELINE_SLUG", ""),
+		env("BUILDKITE_BUILD_NUMBER", ""),
+	)
+	if err != nil {
+		return err
+	}
+
+	collisions := map[string]bool{}
+	for _, job := range build.Jobs {
+		if seen[job.StepKey] {
+			collisions[job.StepKey] = true
+		}
+	}
+
+	if len(collisions) > 0 {
+		return fmt.Errorf("generated step keys already used in the build: %s", sortedKeys(collisions))
+	}
+
+	return nil
+}
+
+func sortedKeys(set map[string]bool) string {
+	keys := []string{}
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return strings.Join(keys, ", ")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestNamespaceKeys(t *testing.T) {
+	steps := []Step{
+		{Key: "build", Command: "make"},
+		{Command: "echo no key"},
+		{Raw: yaml.MapSlice{
+			{Key: "group", Value: "foo"},
+			{Key: "key", Value: "foo"},
+			{Key: "steps", Value: []interface{}{
+				yaml.MapSlice{{Key: "key", Value: "foo-test"}, {Key: "depends_on", Value: "foo-build"}},
+			}},
+		}},
+	}
+
+	got := namespaceKeys(steps, "services")
+
+	assert.Equal(t, "services-build", got[0].Key)
+	assert.Equal(t, "", got[1].Key)
+	assert.Equal(t, []string{"services-foo", "services-foo-test"}, stepKeys(got[2]))
+	assert.Equal(t, "build", steps[0].Key)
+
+	assert.Equal(t, steps, namespaceKeys(steps, ""))
+}
+
+func TestNamespaceKeysDependencies(t *testing.T) {
+	steps := []Step{
+		{Key: "deploy-staging", Block: "Deploy to staging?"},
+		{Key: "deploy", Trigger: "deploy", DependsOn: []interface{}{"deploy-staging", "bootstrap"}},
+		{Trigger: "audit", DependsOn: "deploy"},
+		{Trigger: "smoke", DependsOn: []interface{}{map[string]interface{}{"step": "deploy", "allow_failure": true}}},
+	}
+
+	got := namespaceKeys(steps, "services")
+
+	assert.Equal(t, []interface{}{"services-deploy-staging", "bootstrap"}, got[1].DependsOn)
+	assert.Equal(t, "services-deploy", got[2].DependsOn)
+	assert.Equal(t, []interface{}{map[string]interface{}{"step": "services-deploy", "allow_failure": true}}, got[3].DependsOn)
+	assert.Equal(t, "deploy", steps[2].DependsOn)
+}
+
+func TestCheckKeyCollisionsDuplicates(t *testing.T) {
+	plugin := Plugin{Hooks: []HookConfig{{Step: Step{Key: "notify"}}}}
+
+	err := checkKeyCollisions(plugin, []Step{{Key: "build"}, {Key: "test"}})
+	assert.NoError(t, err)
+
+	err = checkKeyCollisions(plugin, []Step{{Key: "build"}, {Key: "build"}, {Key: "notify"}})
+	assert.EqualError(t, err, "duplicate keys in the generated steps: build, notify")
+}
+
+func TestCheckKeyCollisionsWithBuild(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/organizations/org/pipelines/monorepo/builds/42", r.URL.Path)
+
+		build := apiBuild{Number: 42, Jobs: []apiJob{{StepKey: "diff"}, {StepKey: "build"}, {}}}
+		_ = json.NewEncoder(w).Encode(build)
+	}))
+	defer server.Close()
+
+	os.Setenv("BUILDKITE_API_ENDPOINT", server.URL)
+	os.Setenv("BUILDKITE_API_TOKEN", "api-token")
+	os.Setenv("BUILDKITE_ORGANIZATION_SLUG", "org")
+	os.Setenv("BUILDKITE_PIPELINE_SLUG", "monorepo")
+	os.Setenv("BUILDKITE_BUILD_NUMBER", "42")
+	defer os.Unsetenv("BUILDKITE_API_ENDPOINT")
+	defer os.Unsetenv("BUILDKITE_API_TOKEN")
+	defer os.Unsetenv("BUILDKITE_ORGANIZATION_SLUG")
+	defer os.Unsetenv("BUILDKITE_PIPELINE_SLUG")
+	defer os.Unsetenv("BUILDKITE_BUILD_NUMBER")
+
+	plugin := Plugin{CheckKeyCollisions: true}
+
+	err := checkKeyCollisions(plugin, []Step{{Key: "test"}, {Command: "echo"}})
+	assert.NoError(t, err)
+
+	err = checkKeyCollisions(plugin, []Step{{Key: "build"}, {Key: "test"}})
+	assert.EqualError(t, err, "generated step keys already used in the build: build")
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// hasMinChangedLines reports whether any watch has a `min_changed_lines` threshold
+func hasMinChangedLines(watches []WatchConfig) bool {
+	for _, w := range watches {
+		if w.MinChangedLines > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// binaryLines are the changed lines of a binary file, which always meets
+// `min_changed_lines` since its lines can't be counted
+const binaryLines = -1
+
+// numstatCommand returns the command listing the changed lines of every file:
+// `numstat`, `git diff --numstat -z` against the base of the `git` provider, or
+// otherwise the diff command with `--numstat -z` instead of `--name-only`
+func numstatCommand(plugin Plugin) (Plugin, error) {
+	if plugin.Numstat != "" {
+		return Plugin{Diff: plugin.Numstat, Shell: plugin.Shell}, nil
+	}
+
+	if plugin.DiffProvider == "git" && len(plugin.DiffSources) == 0 {
+		base := diffBase(plugin)
+		return Plugin{Diff: "git diff --numstat -z " + base, DiffArgs: []string{"git", "diff", "--numstat", "-z", base}}, nil
+	}
+
+	if plugin.DiffProvider != "" && plugin.DiffProvider != "command" || len(plugin.DiffSources) > 0 {
+		return Plugin{}, fmt.Errorf("`numstat` is required for min_changed_lines with the %s diff_provider", diffProviderName(plugin))
+	}
+
+	if len(plugin.DiffArgs) > 0 {
+		args := []string{}
+		for _, arg := range plugin.DiffArgs {
+			if arg == "--name-only" {
+				args = append(args, "--numstat", "-z")
+			} else {
+				args = append(args, arg)
+			}
+		}
+
+		if len(args) > len(plugin.DiffArgs) {
+			return Plugin{Diff: strings.Join(args, " "), DiffArgs: args}, nil
+		}
+	} else if strings.Contains(plugin.Diff, "--name-only") {
+		return Plugin{Diff: strings.Replace(plugin.Diff, "--name-only", "--numstat -z", 1), Shell: plugin.Shell}, nil
+	}
+
+	return Plugin{}, fmt.Errorf("`numstat` is required for min_changed_lines with the diff `%s`", plugin.Diff)
+}
+
+// diffProviderName returns the name of the provider of the changed files
+func diffProviderName(plugin Plugin) string {
+	if len(plugin.DiffSources) > 0 {
+		return "sources"
+	}
+
+	return plugin.DiffProvider
+}
+
+// changedLines returns the number of added and deleted lines of every changed
+// file, and binaryLines for binary files. Renamed files are counted under their
+// new path.
+func changedLines(plugin Plugin) (map[string]int, error) {
+	command, err := numstatCommand(plugin)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := diffCommand(command)
+
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+
+	if err := runProcess(cmd); err != nil {
+		log.Debugf("\ncommand = '%s', \nerror = '%s'", command.Diff, stderr.String())
+		return nil, fmt.Errorf("numstat command failed: %v", err)
+	}
+
+	if bytes.IndexByte(out.Bytes(), 0) >= 0 {
+		return parseNumstatZ(out.String()), nil
+	}
+
+	return parseNumstat(out.String()), nil
+}
+
+// parseNumstatZ parses the `--numstat -z` format, where paths are as they are
+// and a rename is an empty path followed by the old and the new path
+func parseNumstatZ(output string) map[string]int {
+	lines := map[string]int{}
+	records := strings.Split(output, "\x00")
+
+	for i := 0; i < len(records); i++ {
+		fields := strings.SplitN(records[i], "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		file := fields[2]
+		if file == "" && i+2 < len(records) {
+			file = records[i+2]
+			i += 2
+		}
+
+		addLines(lines, fields[0], fields[1], file)
+	}
+
+	return lines
+}
+
+// parseNumstat parses the `--numstat` format, where paths with special
+// characters are quoted and renames are `old => new` or `dir/{old => new}/file`
+func parseNumstat(output string) map[string]int {
+	lines := map[string]int{}
+
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		addLines(lines, fields[0], fields[1], renamedPath(unquotePath(fields[2])))
+	}
+
+	return lines
+}
+
+// addLines adds the added and deleted lines of a file, where `-` marks a binary file
+func addLines(lines map[string]int, added string, deleted string, file string) {
+	file = normalizePath(file)
+
+	if added == "-" || deleted == "-" || lines[file] == binaryLines {
+		lines[file] = binaryLines
+		return
+	}
+
+	a, _ := strconv.Atoi(added)
+	d, _ := strconv.Atoi(deleted)
+	lines[file] += a + d
+}
+
+// unquotePath returns the path git quoted for its special characters
+func unquotePath(file string) string {
+	if len(file) < 2 || file[0] != '"' || file[len(file)-1] != '"' {
+		return file
+	}
+
+	if unquoted, err := strconv.Unquote(file); err == nil {
+		return unquoted
+	}
+
+	return file
+}
+
+// renamedPath returns the new path of a rename, `old => new` or `dir/{old => new}/file`
+func renamedPath(file string) string {
+	start := strings.Index(file, "{")
+	end := strings.LastIndex(file, "}")
+
+	// either side of a rename in braces can be empty, e.g. `{ => dir}/file`
+	if start >= 0 && end > start && strings.Contains(file[start:end], " => ") {
+		split := strings.SplitN(file[start+1:end], " => ", 2)
+		return path.Clean(file[:start] + split[1] + file[end+1:])
+	}
+
+	if split := strings.SplitN(file, " => ", 2); len(split) == 2 {
+		return split[1]
+	}
+
+	return file
+}
+
+// applyMinChangedLines removes the watches whose matched files have fewer
+// changed lines than their `min_changed_lines`
+func applyMinChangedLines(plugin Plugin, watches []WatchConfig) ([]WatchConfig, error) {
+	lines, err := changedLines(plugin)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []WatchConfig{}
+
+	for _, w := range watches {
+		total, binary := 0, false
+		for _, f := range w.Files {
+			if lines[f] == binaryLines {
+				binary = true
+			} else {
+				total += lines[f]
+			}
+		}
+
+		if !binary && total < w.MinChangedLines {
+			log.Infof("Skipping %s: %d changed lines, less than %d", stepName(w.Step), total, w.MinChangedLines)
+			continue
+		}
+
+		result = append(result, w)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNumstatCommand(t *testing.T) {
+	got, err := numstatCommand(Plugin{Diff: "git diff --name-only HEAD~1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "git diff --numstat -z HEAD~1", got.Diff)
+
+	got, err = numstatCommand(Plugin{DiffArgs: []string{"git", "diff", "--name-only", "origin/main...HEAD"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"git", "diff", "--numstat", "-z", "origin/main...HEAD"}, got.DiffArgs)
+
+	got, err = numstatCommand(Plugin{DiffProvider: "git", DiffBase: "origin/main...HEAD", Diff: "git diff --name-only HEAD~1"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"git", "diff", "--numstat", "-z", "origin/main...HEAD"}, got.DiffArgs)
+
+	got, err = numstatCommand(Plugin{Diff: "./diff.sh", Numstat: "./numstat.sh"})
+	assert.NoError(t, err)
+	assert.Equal(t, "./numstat.sh", got.Diff)
+
+	_, err = numstatCommand(Plugin{Diff: "./diff.sh"})
+	assert.EqualError(t, err, "`numstat` is required for min_changed_lines with the diff `./diff.sh`")
+
+	_, err = numstatCommand(Plugin{DiffProvider: "file", Diff: "git diff --name-only HEAD~1"})
+	assert.EqualError(t, err, "`numstat` is required for min_changed_lines with the file diff_provider")
+}
+
+func TestParseNumstat(t *testing.T) {
+	testCases := map[string]struct {
+		output   string
+		expected map[string]int
+	}{
+		"plain": {
+			output: "1\t2\tREADME.md\n-\t-\tlogo.png\n3\t0\told.go => new.go\n4\t1\tservices/{foo => bar}/main.go\n" +
+				"1\t1\tlibs/{ => shared}/util.go\n2\t0\t\"docs/caf\\303\\251 \\\"menu\\\".md\"\n",
+			expected: map[string]int{
+				"README.md":             3,
+				"logo.png":              binaryLines,
+				"new.go":                3,
+				"services/bar/main.go":  5,
+				"libs/shared/util.go":   2,
+				"docs/café \"menu\".md": 2,
+			},
+		},
+		"nul separated": {
+			output: "1\t2\tREADME.md\x00-\t-\tlogo.png\x003\t0\t\x00old.go\x00new.go\x002\t0\tdocs/a => b.md\x00",
+			expected: map[string]int{
+				"README.md":      3,
+				"logo.png":       binaryLines,
+				"new.go":         3,
+				"docs/a => b.md": 2,
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if strings.Contains(tc.output, "\x00") {
+				assert.Equal(t, tc.expected, parseNumstatZ(tc.output))
+			} else {
+				assert.Equal(t, tc.expected, parseNumstat(tc.output))
+			}
+		})
+	}
+}
+
+func TestApplyMinChangedLines(t *testing.T) {
+	plugin := Plugin{
+		Numstat: `printf '1\t1\tpackage-lock.json\n40\t2\tservices/foo/main.go\n-\t-\tservices/foo/logo.png\n'`,
+		Shell:   []string{"sh", "-c"},
+	}
+
+	watches := []WatchConfig{
+		{Step: Step{Trigger: "lockfile"}, MinChangedLines: 10, Files: []string{"package-lock.json"}},
+		{Step: Step{Trigger: "foo"}, MinChangedLines: 10, Files: []string{"services/foo/logo.png", "services/foo/main.go"}},
+		{Step: Step{Trigger: "logo"}, MinChangedLines: 10, Files: []string{"services/foo/logo.png"}},
+		{Step: Step{Trigger: "any"}, Files: []string{"package-lock.json"}},
+	}
+
+	got, err := applyMinChangedLines(plugin, watches)
+
+	assert.NoError(t, err)
+	assert.Equal(t, watches[1:], got)
+}
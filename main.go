@@ -1,13 +1,21 @@
 package main
 
 import (
+	"os"
+
 	log "github.com/sirupsen/logrus"
 )
 
-func setupLogger(logLevel string) {
-	log.SetFormatter(&log.TextFormatter{
-		FullTimestamp: true,
-	})
+func setupLogger(logLevel string, logFormat string) {
+	prettyLogs = logFormat == logFormatPretty
+
+	if prettyLogs {
+		log.SetFormatter(prettyFormatter{})
+	} else {
+		log.SetFormatter(&log.TextFormatter{
+			FullTimestamp: true,
+		})
+	}
 
 	ll, err := log.ParseLevel(logLevel)
 
@@ -22,15 +30,60 @@ func setupLogger(logLevel string) {
 var Version string
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == tuiCommand {
+		if err := runTUI(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			fail(categorize(configCategory, err))
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == doctorCommand {
+		if !runDoctor(os.Args[2:], os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	log.Infof("--- :one: monorepo-diff %s", Version)
 
-	plugin, err := initializePlugin(env("BUILDKITE_PLUGINS", ""))
+	plugins, err := loadPlugins()
 
 	if err != nil {
-		log.Fatal(err)
+		fail(categorize(configCategory, err))
 	}
 
-	setupLogger(plugin.LogLevel)
+	plugin := plugins[0]
 
-	uploadPipeline(plugin, generatePipeline)
+	setupLogger(plugin.LogLevel, plugin.LogFormat)
+	setupRedaction(plugin)
+	matcherEngine = plugin.MatcherEngine
+
+	root, err := enterWorkdir(plugin.Workdir)
+	if err != nil {
+		fail(categorize(configCategory, err))
+	}
+	log.Debugf("Running from %s", root)
+
+	if plugin.Output == outputStdout || plugin.Output == outputGitHubActions {
+		// stdout is reserved for the pipeline, or the outputs
+		logWriter = os.Stderr
+	}
+
+	if len(plugins) > 1 && !claimInvocation(len(plugins)) {
+		log.Infof("The pipeline of all %d invocations was uploaded by the first one", len(plugins))
+		return
+	}
+
+	stop := setupCancellation()
+	defer stop()
+
+	if _, _, err := uploadPipelines(plugins, generatePipeline); err != nil {
+		if len(plugins) > 1 {
+			releaseInvocation()
+		}
+		if cancelled() {
+			log.Fatalf("Cancelled by the agent: %v", err)
+		}
+		fail(err)
+	}
 }
@@ -8,8 +8,14 @@ import (
 )
 
 func TestSetupLogger(t *testing.T) {
-	setupLogger("debug")
+	setupLogger("debug", "text")
 	assert.Equal(t, log.GetLevel(), log.DebugLevel)
-	setupLogger("weird level")
+	setupLogger("weird level", "text")
 	assert.Equal(t, log.GetLevel(), log.InfoLevel)
+	assert.False(t, prettyLogs)
+
+	setupLogger("info", "pretty")
+	defer setupLogger("info", "text")
+	assert.True(t, prettyLogs)
+	assert.Equal(t, prettyFormatter{}, log.StandardLogger().Formatter)
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// triggerManifest maps a commit to the pipelines triggered for it, so release
+// tooling can tell which pipelines validated the commit
+type triggerManifest struct {
+	Commit      string             `json:"commit"`
+	Branch      string             `json:"branch"`
+	Pipeline    string             `json:"pipeline"`
+	BuildNumber string             `json:"build_number"`
+	BuildURL    string             `json:"build_url"`
+	GeneratedAt string             `json:"generated_at"`
+	Triggered   []manifestPipeline `json:"triggered_pipelines"`
+}
+
+// manifestPipeline is a triggered pipeline and the hash of the configuration
+// of its trigger step
+type manifestPipeline struct {
+	Organization string `json:"organization,omitempty"`
+	Pipeline     string `json:"pipeline"`
+	Label        string `json:"label,omitempty"`
+	ConfigHash   string `json:"config_hash"`
+}
+
+// newTriggerManifest returns the manifest of the trigger steps, sorted by pipeline
+func newTriggerManifest(steps []Step) triggerManifest {
+	manifest := triggerManifest{
+		Commit:      env("BUILDKITE_COMMIT", ""),
+		Branch:      env("BUILDKITE_BRANCH", ""),
+		Pipeline:    env("BUILDKITE_PIPELINE_SLUG", ""),
+		BuildNumber: env("BUILDKITE_BUILD_NUMBER", ""),
+		BuildURL:    env("BUILDKITE_BUILD_URL", ""),
+		GeneratedAt: now().UTC().Format(time.RFC3339),
+		Triggered:   []manifestPipeline{},
+	}
+
+	for _, s := range steps {
+		if s.Trigger == "" {
+			continue
+		}
+
+		manifest.Triggered = append(manifest.Triggered, manifestPipeline{
+			Organization: s.Organization,
+			Pipeline:     s.Trigger,
+			Label:        s.Label,
+			ConfigHash:   configHash(s),
+		})
+	}
+
+	sort.SliceStable(manifest.Triggered, func(i, j int) bool {
+		a, b := manifest.Triggered[i], manifest.Triggered[j]
+		if a.Organization != b.Organization {
+			return a.Organization < b.Organization
+		}
+		return a.Pipeline < b.Pipeline
+	})
+
+	return manifest
+}
+
+// configHash returns the sha256 of the YAML of the step, as it is uploaded
+func configHash(step Step) string {
+	data, _ := yaml.Marshal(step)
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+// writeManifest writes the manifest of the steps to the `manifest` file and
+// uploads it as an artifact of the build
+func writeManifest(plugin Plugin, steps []Step) {
+	manifest := newTriggerManifest(steps)
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		log.Warnf("could not write the manifest: %v", err)
+		return
+	}
+
+	if err := ioutil.WriteFile(plugin.Manifest, append(data, '\n'), 0644); err != nil {
+		log.Warnf("could not write the manifest: %v", err)
+		return
+	}
+
+	log.Infof("Manifest of %d triggered %s written to %s", len(manifest.Triggered), pluralize(len(manifest.Triggered), "pipeline"), plugin.Manifest)
+
+	args := append(append([]string{}, plugin.AgentArgs...), "artifact", "upload", plugin.Manifest)
+	if _, err := executeCommand(agentBinary(plugin), args); err != nil {
+		log.Warnf("could not upload the manifest: %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadPipelineManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	plugin := Plugin{
+		Diff:     "printf 'services/foo/main.go\\nservices/bar/main.go\\n'",
+		Shell:    []string{"sh", "-c"},
+		Manifest: filepath.Join(dir, "manifest.json"),
+		Watch: []WatchConfig{
+			{Paths: []string{"services/foo/"}, Step: Step{Trigger: "foo-service", Label: "Foo"}},
+			{Paths: []string{"services/bar/"}, Step: Step{Trigger: "bar-service"}},
+			{Paths: []string{"services/"}, Step: Step{Command: "make lint"}},
+		},
+	}
+
+	_, _, err = uploadPipeline(plugin, mockGeneratePipeline)
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(plugin.Manifest)
+	assert.NoError(t, err)
+
+	var manifest triggerManifest
+	assert.NoError(t, json.Unmarshal(data, &manifest))
+
+	assert.Equal(t, "123", manifest.Commit)
+	assert.Equal(t, "go-rewrite", manifest.Branch)
+	assert.Equal(t, []manifestPipeline{
+		{Pipeline: "bar-service", ConfigHash: configHash(Step{Trigger: "bar-service"})},
+		{Pipeline: "foo-service", Label: "Foo", ConfigHash: configHash(Step{Trigger: "foo-service", Label: "Foo"})},
+	}, manifest.Triggered)
+}
+
+func TestConfigHash(t *testing.T) {
+	step := Step{Trigger: "foo-service", Build: Build{Env: map[string]string{"A": "1", "B": "2"}}}
+	same := Step{Trigger: "foo-service", Build: Build{Env: map[string]string{"B": "2", "A": "1"}}}
+	changed := Step{Trigger: "foo-service", Build: Build{Env: map[string]string{"A": "1", "B": "3"}}}
+
+	assert.Regexp(t, "^sha256:[0-9a-f]{64}$", configHash(step))
+	assert.Equal(t, configHash(step), configHash(same))
+	assert.NotEqual(t, configHash(step), configHash(changed))
+}
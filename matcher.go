@@ -0,0 +1,512 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bmatcuk/doublestar/v2"
+)
+
+// matchWorkers is the number of goroutines used to match changed files against watches
+var matchWorkers = runtime.NumCPU()
+
+// matchChunkSize is the number of changed files handed to a worker at a time
+const matchChunkSize = 256
+
+// matcher engines
+const (
+	// matcherAuto keeps the legacy semantics, matching each glob with the
+	// engine that is the fastest for its shape
+	matcherAuto = "auto"
+	// matcherLegacy matches globs with doublestar, falling back to a prefix match
+	matcherLegacy = "legacy"
+	// matcherDoublestar and matcherRegex only match globs as a whole
+	matcherDoublestar = "doublestar"
+	matcherRegex      = "regex"
+)
+
+// matcherEngine is the engine watch paths are compiled with, set with `matcher_engine`
+var matcherEngine = matcherAuto
+
+// pathMatcher is a watch path compiled once before matching
+type pathMatcher struct {
+	pattern string
+	glob    bool
+	// capture matches paths with capture groups
+	capture *regexp.Regexp
+	// regex matches the glob instead of doublestar
+	regex *regexp.Regexp
+	// prefix falls back to a prefix match when the glob doesn't match
+	prefix bool
+	err    error
+}
+
+// compiledPaths caches the compiled watch paths by engine and pattern, so a
+// pattern shared by many watches is only compiled once
+var compiledPaths sync.Map
+
+// compilePath compiles the watch path p with the matcher engine, or returns it from the cache
+func compilePath(p string) pathMatcher {
+	key := matcherEngine + "\x00" + p
+
+	if m, ok := compiledPaths.Load(key); ok {
+		return m.(pathMatcher)
+	}
+
+	m := compileWith(matcherEngine, p)
+	compiledPaths.Store(key, m)
+
+	return m
+}
+
+func compileWith(engine string, p string) pathMatcher {
+	p = normalizePath(p)
+
+	if hasCaptures(p) {
+		re, err := captureRegexp(p)
+		return pathMatcher{pattern: p, glob: true, capture: re, err: err}
+	}
+
+	m := pathMatcher{pattern: p, glob: strings.Contains(p, "*"), prefix: true}
+	if !m.glob {
+		return m
+	}
+
+	switch engine {
+	case matcherDoublestar:
+		m.prefix = false
+	case matcherRegex:
+		m.prefix = false
+		m.regex, m.err = globRegexp(p)
+	case matcherAuto:
+		if preferRegex(p) {
+			m.regex, _ = globRegexp(p)
+		}
+	}
+
+	return m
+}
+
+// preferRegex reports whether the glob is faster to match as a regular
+// expression. doublestar backtracks on every `**`, which gets slower than the
+// linear time of a regular expression from three of them, see BenchmarkMatcherEngines.
+// A `**` within a segment, e.g. `x**`, matches across directories as a regular
+// expression but not with doublestar, so those globs keep doublestar.
+func preferRegex(p string) bool {
+	if strings.Count(p, "**") <= 2 {
+		return false
+	}
+
+	for _, segment := range strings.Split(p, "/") {
+		if segment != "**" && strings.Contains(segment, "**") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// globRegexp compiles the glob to a regular expression matching whole files.
+// Character classes and alternatives aren't supported.
+func globRegexp(p string) (*regexp.Regexp, error) {
+	if strings.ContainsAny(p, "[{") {
+		return nil, fmt.Errorf("path `%s` isn't supported by the regex matcher engine", p)
+	}
+
+	expr, err := globExpr(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return regexp.Compile("^" + expr + "$")
+}
+
+// match checks if the file f matches the compiled path. Globs are matched with
+// `doublestar.Match` or their regular expression, otherwise
+// (or when the glob does not match, with the legacy semantics) `strings.HasPrefix` is used.
+// A path ending with a slash also matches the directory itself.
+func (m pathMatcher) match(f string) (bool, error) {
+	if m.err != nil {
+		return false, m.err
+	}
+
+	if m.capture != nil {
+		return m.capture.MatchString(f), nil
+	}
+
+	if m.glob {
+		match := false
+		if m.regex != nil {
+			match = m.regex.MatchString(f)
+		} else {
+			var err error
+			if match, err = doublestar.Match(m.pattern, f); err != nil {
+				return false, fmt.Errorf("path matching failed: %v", err)
+			}
+		}
+
+		if match || !m.prefix {
+			return match, nil
+		}
+	}
+
+	return strings.HasPrefix(f, m.pattern) || f+"/" == m.pattern, nil
+}
+
+// pathIndex is a prefix trie over the watch paths. Plain paths are stored at the
+// node for their full text, globs at the node for their literal prefix, so a
+// changed file only needs to be compared with the paths along its own prefix
+// instead of with every watch.
+type pathIndex struct {
+	root *trieNode
+	// watches matched by a script, which is evaluated for every file
+	scripts []indexedScript
+}
+
+type indexedScript struct {
+	watch  int
+	script *script
+}
+
+type trieNode struct {
+	children map[byte]*trieNode
+	// watches with a plain path ending at this node
+	prefixes []int
+	// globs whose literal prefix ends at this node, each distinct glob once
+	globs []indexedGlob
+}
+
+// indexedGlob is a glob with the watches sharing it, so it is only matched
+// once per file whatever the number of watches
+type indexedGlob struct {
+	watches []int
+	matcher pathMatcher
+}
+
+// addGlob adds the watch to the glob at the node, adding the glob if needed
+func (n *trieNode) addGlob(watch int, m pathMatcher) {
+	for i := range n.globs {
+		if n.globs[i].matcher.pattern == m.pattern {
+			n.globs[i].watches = append(n.globs[i].watches, watch)
+			return
+		}
+	}
+
+	n.globs = append(n.globs, indexedGlob{watches: []int{watch}, matcher: m})
+}
+
+func newTrieNode() *trieNode {
+	return &trieNode{children: map[byte]*trieNode{}}
+}
+
+func buildIndex(watch []WatchConfig) *pathIndex {
+	index := &pathIndex{root: newTrieNode()}
+
+	for i, w := range watch {
+		if w.script != nil {
+			index.scripts = append(index.scripts, indexedScript{watch: i, script: w.script})
+			continue
+		}
+
+		for _, p := range w.Paths {
+			m := compilePath(p)
+
+			if m.glob {
+				index.insert(literalPrefix(m.pattern)).addGlob(i, m)
+				continue
+			}
+
+			node := index.insert(m.pattern)
+			node.prefixes = append(node.prefixes, i)
+		}
+	}
+
+	return index
+}
+
+func (idx *pathIndex) insert(key string) *trieNode {
+	node := idx.root
+
+	for i := 0; i < len(key); i++ {
+		child, ok := node.children[key[i]]
+		if !ok {
+			child = newTrieNode()
+			node.children[key[i]] = child
+		}
+		node = child
+	}
+
+	return node
+}
+
+// match calls hit with the index of every watch that matches the file f,
+// changed with status when it is known. Watches for which skip returns true
+// are not evaluated, a glob is only evaluated when any of its watches is not skipped.
+func (idx *pathIndex) match(f string, status string, skip func(watch int) bool, hit func(watch int)) error {
+	for _, s := range idx.scripts {
+		if skip(s.watch) {
+			continue
+		}
+
+		match, err := s.script.match(fileContext{path: f, status: status})
+		if err != nil {
+			return err
+		}
+		if match {
+			hit(s.watch)
+		}
+	}
+
+	node := idx.root
+
+	for i := 0; ; i++ {
+		for _, w := range node.prefixes {
+			if !skip(w) {
+				hit(w)
+			}
+		}
+
+		for _, g := range node.globs {
+			if skipAll(g.watches, skip) {
+				continue
+			}
+
+			match, err := g.matcher.match(f)
+			if err != nil {
+				return err
+			}
+			if match {
+				for _, w := range g.watches {
+					if !skip(w) {
+						hit(w)
+					}
+				}
+			}
+		}
+
+		if i == len(f) {
+			// a directory path matches the directory itself, e.g. a submodule
+			if dir, ok := node.children['/']; ok {
+				for _, w := range dir.prefixes {
+					if !skip(w) {
+						hit(w)
+					}
+				}
+			}
+			return nil
+		}
+
+		next, ok := node.children[f[i]]
+		if !ok {
+			return nil
+		}
+		node = next
+	}
+}
+
+// skipAll reports whether every watch is skipped
+func skipAll(watches []int, skip func(watch int) bool) bool {
+	for _, w := range watches {
+		if !skip(w) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// literalPrefix returns the part of a glob before its first special character
+func literalPrefix(pattern string) string {
+	if i := strings.Index(pattern, captureGroup); i >= 0 {
+		pattern = pattern[:i]
+	}
+
+	if i := strings.IndexAny(pattern, "*?[{\\"); i >= 0 {
+		return pattern[:i]
+	}
+
+	return pattern
+}
+
+// matchEngine matches chunks of changed files against the watches
+// concurrently using a pool of workers.
+// The matched files of the collected watches are kept as well, the other
+// watches are skipped for the remaining files once they have matched.
+type matchEngine struct {
+	index     *pathIndex
+	hits      []int32
+	remaining int32
+	chunks    chan matchChunk
+	wg        sync.WaitGroup
+	errOnce   sync.Once
+	err       error
+	collect   []bool
+	// collecting is set when any watch is collected
+	collecting bool
+	// files are the matched files of the collected watches, within the memory budget
+	files []*spillList
+}
+
+// matchChunk is a chunk of changed files, with the statuses of those listed
+// by `--name-status`. Statuses are passed along with their chunk, so they are
+// never held for the whole diff.
+type matchChunk struct {
+	files    []string
+	statuses map[string]string
+}
+
+// newMatchEngine starts a match engine, keeping the matched files of the
+// watches for which collect is true within the memory budget.
+// collect may be nil when none is collected.
+func newMatchEngine(watch []WatchConfig, workers int, collect []bool, budget *memoryBudget) *matchEngine {
+	if collect == nil {
+		collect = make([]bool, len(watch))
+	}
+
+	e := &matchEngine{
+		index:     buildIndex(watch),
+		hits:      make([]int32, len(watch)),
+		remaining: int32(len(watch)),
+		chunks:    make(chan matchChunk),
+		collect:   collect,
+		files:     make([]*spillList, len(watch)),
+	}
+
+	for i, c := range collect {
+		e.collecting = e.collecting || c
+		if c {
+			e.files[i] = budget.list()
+		}
+	}
+
+	for i := 0; i < workers; i++ {
+		e.wg.Add(1)
+		go e.work()
+	}
+
+	return e
+}
+
+func (e *matchEngine) work() {
+	defer e.wg.Done()
+
+	for chunk := range e.chunks {
+		for _, f := range chunk.files {
+			file := f
+
+			err := e.index.match(f, chunk.statuses[f], e.done, func(w int) {
+				e.hit(w)
+				if e.collect[w] {
+					e.files[w].add(file)
+				}
+			})
+			if err != nil {
+				e.errOnce.Do(func() { e.err = err })
+			}
+		}
+	}
+}
+
+func (e *matchEngine) hit(w int) {
+	if atomic.CompareAndSwapInt32(&e.hits[w], 0, 1) {
+		atomic.AddInt32(&e.remaining, -1)
+	}
+}
+
+// done reports whether the watch has matched and doesn't need further files
+func (e *matchEngine) done(w int) bool {
+	return !e.collect[w] && atomic.LoadInt32(&e.hits[w]) == 1
+}
+
+// usesStatuses reports whether any watch is matched by a script, the only
+// matcher using the statuses of the changed files
+func (e *matchEngine) usesStatuses() bool {
+	return len(e.index.scripts) > 0
+}
+
+// feed hands a chunk of changed files to the workers
+func (e *matchEngine) feed(chunk []string) {
+	e.feedStatuses(chunk, nil)
+}
+
+// feedStatuses hands a chunk of changed files and their statuses to the workers
+func (e *matchEngine) feedStatuses(chunk []string, statuses map[string]string) {
+	e.chunks <- matchChunk{files: chunk, statuses: statuses}
+}
+
+// complete reports whether every watch has already matched,
+// in which case no further files need to be fed. It never is
+// when collecting files, since every matched file is needed.
+func (e *matchEngine) complete() bool {
+	return !e.collecting && atomic.LoadInt32(&e.remaining) <= 0
+}
+
+// wait stops the workers and reports for each watch whether it matched
+func (e *matchEngine) wait() ([]bool, error) {
+	close(e.chunks)
+	e.wg.Wait()
+
+	if e.err != nil {
+		return nil, e.err
+	}
+
+	matched := make([]bool, len(e.hits))
+	for i := range e.hits {
+		matched[i] = e.hits[i] == 1
+	}
+
+	return matched, nil
+}
+
+// matchedFiles returns the sorted files matched by each collected watch, once
+// the engine has stopped. A file matching several paths of a watch is only kept once.
+func (e *matchEngine) matchedFiles() ([][]string, error) {
+	result := make([][]string, len(e.files))
+	for i, list := range e.files {
+		if list == nil {
+			continue
+		}
+
+		files, err := list.all()
+		if err != nil {
+			return nil, err
+		}
+		result[i] = uniq(files)
+	}
+
+	return result, nil
+}
+
+// matchWatches reports for each watch whether any of the files matches one of its paths.
+func matchWatches(files []string, watch []WatchConfig) ([]bool, error) {
+	engine := newMatchEngine(watch, workerCount(len(files)), nil, newMemoryBudget(0))
+
+	for start := 0; start < len(files) && !engine.complete(); start += matchChunkSize {
+		end := start + matchChunkSize
+		if end > len(files) {
+			end = len(files)
+		}
+		engine.feed(files[start:end])
+	}
+
+	return engine.wait()
+}
+
+// workerCount returns the number of workers worth starting for n files
+func workerCount(n int) int {
+	chunks := (n + matchChunkSize - 1) / matchChunkSize
+
+	if chunks < 1 {
+		return 1
+	}
+
+	if chunks < matchWorkers {
+		return chunks
+	}
+
+	return matchWorkers
+}
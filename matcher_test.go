@@ -0,0 +1,376 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/bmatcuk/doublestar/v2"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathMatcher(t *testing.T) {
+	testCases := map[string]struct {
+		Pattern string
+		File    string
+		Match   bool
+	}{
+		"prefix":               {"services/foo", "services/foo/main.go", true},
+		"prefix miss":          {"services/foo", "services/bar/main.go", false},
+		"glob":                 {"**/*.md", "docs/README.md", true},
+		"glob miss":            {"**/*.md", "docs/README.txt", false},
+		"glob no prefix":       {"docs/*", "docs/a/b.txt", false},
+		"glob prefix fallback": {"docs/*", "docs/*/b.txt", true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := compilePath(tc.Pattern).match(tc.File)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Match, got)
+		})
+	}
+}
+
+func TestPathIndexMatch(t *testing.T) {
+	index := buildIndex([]WatchConfig{
+		{Paths: []string{"services/foo"}},
+		{Paths: []string{"services/"}},
+		{Paths: []string{"services/*/main.go"}},
+		{Paths: []string{"**/*.md"}},
+		{Paths: []string{"services/foobar/"}},
+	})
+
+	testCases := map[string][]int{
+		"services/foo/main.go":  {0, 1, 2},
+		"services/foobar/x.go":  {0, 1, 4},
+		"services/bar/main.go":  {1, 2},
+		"services/bar/doc.md":   {1, 3},
+		"README.md":             {3},
+		"services/foobar":       {0, 1, 4},
+		"other/services/foo.go": nil,
+	}
+
+	for file, want := range testCases {
+		t.Run(file, func(t *testing.T) {
+			var got []int
+			err := index.match(file, "", func(int) bool { return false }, func(w int) { got = append(got, w) })
+
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, want, got)
+		})
+	}
+}
+
+func TestPathIndexMatchWindowsPaths(t *testing.T) {
+	goos = "windows"
+	defer func() { goos = runtime.GOOS }()
+
+	index := buildIndex([]WatchConfig{
+		{Paths: []string{`services\windows\`}},
+		{Paths: []string{`services\*\main.go`}},
+	})
+
+	var got []int
+	err := index.match("services/windows/main.go", "", func(int) bool { return false }, func(w int) { got = append(got, w) })
+
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []int{0, 1}, got)
+}
+
+func TestPathIndexSharedGlobs(t *testing.T) {
+	index := buildIndex([]WatchConfig{
+		{Paths: []string{"libs/shared/**/*.go", "services/foo/"}},
+		{Paths: []string{"libs/shared/**/*.go", "services/bar/"}},
+		{Paths: []string{"libs/shared/**/*.go"}},
+	})
+
+	node := index.insert("libs/shared/")
+	assert.Len(t, node.globs, 1)
+	assert.Equal(t, []int{0, 1, 2}, node.globs[0].watches)
+
+	var got []int
+	err := index.match("libs/shared/log/log.go", "", func(int) bool { return false }, func(w int) { got = append(got, w) })
+
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2}, got)
+}
+
+func TestPathIndexSkip(t *testing.T) {
+	index := buildIndex([]WatchConfig{
+		{Paths: []string{"services/"}},
+		{Paths: []string{"services/*/main.go"}},
+		{Paths: []string{"services/*/main.go", "docs/"}},
+	})
+	skipped := map[int]bool{0: true, 1: true}
+
+	var got []int
+	err := index.match("services/foo/main.go", "", func(w int) bool { return skipped[w] }, func(w int) { got = append(got, w) })
+
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2}, got)
+}
+
+func TestMatchEngineCollectsOnlyCollectedWatches(t *testing.T) {
+	watch := []WatchConfig{
+		{Paths: []string{"services/"}},
+		{Paths: []string{"services/"}},
+	}
+	engine := newMatchEngine(watch, 1, []bool{false, true}, newMemoryBudget(16))
+
+	engine.feed([]string{"services/a.go", "services/b.go"})
+	engine.feed([]string{"services/c.go"})
+	assert.False(t, engine.complete())
+
+	matched, err := engine.wait()
+
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{true, true}, matched)
+	files, err := engine.matchedFiles()
+	assert.NoError(t, err)
+	assert.Empty(t, files[0])
+	assert.Equal(t, []string{"services/a.go", "services/b.go", "services/c.go"}, files[1])
+}
+
+func TestMatchEngineStatusesPerChunk(t *testing.T) {
+	deleted, err := compileScript(`status == "D"`)
+	assert.NoError(t, err)
+
+	engine := newMatchEngine([]WatchConfig{{Matcher: matcherScript, script: deleted}}, 1, []bool{true}, newMemoryBudget(0))
+	assert.True(t, engine.usesStatuses())
+
+	engine.feedStatuses([]string{"a.go", "b.go"}, map[string]string{"a.go": "M", "b.go": "D"})
+	// the statuses of a chunk don't apply to the later chunks
+	engine.feed([]string{"b.go"})
+
+	_, err = engine.wait()
+	assert.NoError(t, err)
+	files, err := engine.matchedFiles()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b.go"}, files[0])
+
+	paths := newMatchEngine([]WatchConfig{{Paths: []string{"a/"}}}, 1, nil, newMemoryBudget(0))
+	assert.False(t, paths.usesStatuses())
+	_, err = paths.wait()
+	assert.NoError(t, err)
+}
+
+func TestMatcherEngines(t *testing.T) {
+	patterns := []string{"services/foo", "**/*.md", "docs/*", "libs/**/*.go", "**/a/**/b/**/*.go", "services/*/main.go"}
+	files := []string{
+		"services/foo/main.go", "services/bar/main.go", "docs/README.md", "docs/a/b.txt", "docs/*/b.txt",
+		"libs/x/y/z.go", "libs/z.go", "x/a/y/b/z.go", "a/b/c.go", "README.md",
+	}
+
+	for _, p := range patterns {
+		for _, f := range files {
+			legacy, err := compileWith(matcherLegacy, p).match(f)
+			assert.NoError(t, err)
+
+			for _, engine := range []string{matcherAuto, matcherDoublestar, matcherRegex} {
+				got, err := compileWith(engine, p).match(f)
+				assert.NoError(t, err)
+
+				// only the legacy prefix fallback of globs can differ
+				want := legacy
+				if engine != matcherAuto && legacy && strings.Contains(p, "*") {
+					want, _ = doublestar.Match(p, f)
+				}
+				assert.Equal(t, want, got, "%s %s %s", engine, p, f)
+			}
+		}
+	}
+}
+
+func TestMatcherEnginePrefixFallback(t *testing.T) {
+	testCases := map[string]bool{
+		matcherAuto:       true,
+		matcherLegacy:     true,
+		matcherDoublestar: false,
+		matcherRegex:      false,
+	}
+
+	for engine, want := range testCases {
+		t.Run(engine, func(t *testing.T) {
+			got, err := compileWith(engine, "docs/*").match("docs/*/b.txt")
+			assert.NoError(t, err)
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+func TestMatcherEngineRegexUnsupported(t *testing.T) {
+	_, err := compileWith(matcherRegex, "docs/{a,b}/*.md").match("docs/a/x.md")
+	assert.EqualError(t, err, "path `docs/{a,b}/*.md` isn't supported by the regex matcher engine")
+
+	got, err := compileWith(matcherAuto, "**/{a,b}/**/c/**/*.md").match("x/a/y/c/z.md")
+	assert.NoError(t, err)
+	assert.True(t, got)
+}
+
+func TestPreferRegex(t *testing.T) {
+	assert.False(t, preferRegex("**/*.md"))
+	assert.False(t, preferRegex("libs/**/*.go"))
+	assert.False(t, preferRegex("**/test/**/*_test.go"))
+	assert.True(t, preferRegex("**/a/**/b/**/*.go"))
+	assert.False(t, preferRegex("x**/y/**/z/**/w"))
+	assert.False(t, preferRegex("**/a/**/b/**.go"))
+
+	// auto matches like doublestar when a `**` isn't a whole segment
+	got, err := compileWith(matcherAuto, "x**/y/**/z/**/w").match("xq/r/y/z/w")
+	assert.NoError(t, err)
+	assert.False(t, got)
+}
+
+func TestCompilePathCache(t *testing.T) {
+	first := compilePath("services/(?P<svc>[^/]+)/**")
+	second := compilePath("services/(?P<svc>[^/]+)/**")
+
+	assert.NotNil(t, first.capture)
+	assert.Same(t, first.capture, second.capture)
+}
+
+func TestLiteralPrefix(t *testing.T) {
+	assert.Equal(t, "services/", literalPrefix("services/*/main.go"))
+	assert.Equal(t, "", literalPrefix("**/*.md"))
+	assert.Equal(t, "docs/file", literalPrefix("docs/file?.txt"))
+	assert.Equal(t, "docs/", literalPrefix("docs/{a,b}"))
+	assert.Equal(t, "plain/path", literalPrefix("plain/path"))
+}
+
+func TestMatchWatchesInvalidPattern(t *testing.T) {
+	watch := []WatchConfig{{Paths: []string{"[*"}}}
+
+	_, err := matchWatches([]string{"foo"}, watch)
+
+	assert.EqualError(t, err, "path matching failed: syntax error in pattern")
+}
+
+func TestMatchWatchesLargeDiff(t *testing.T) {
+	files := make([]string, 0, 10000)
+	for i := 0; i < 10000; i++ {
+		files = append(files, fmt.Sprintf("services/svc-%d/src/file.go", i%500))
+	}
+
+	watch := []WatchConfig{
+		{Paths: []string{"services/svc-1/"}},
+		{Paths: []string{"services/svc-999/"}},
+		{Paths: []string{"**/*.md", "services/svc-499/**"}},
+	}
+
+	got, err := matchWatches(files, watch)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{true, false, true}, got)
+}
+
+func TestWorkerCount(t *testing.T) {
+	defer func(n int) { matchWorkers = n }(matchWorkers)
+	matchWorkers = 4
+
+	assert.Equal(t, 1, workerCount(0))
+	assert.Equal(t, 1, workerCount(matchChunkSize))
+	assert.Equal(t, 2, workerCount(matchChunkSize+1))
+	assert.Equal(t, 4, workerCount(100*matchChunkSize))
+}
+
+func BenchmarkMatchWatches(b *testing.B) {
+	files := make([]string, 0, 100000)
+	for i := 0; i < 100000; i++ {
+		files = append(files, fmt.Sprintf("services/svc-%d/src/pkg/file-%d.go", i%1000, i))
+	}
+
+	watch := make([]WatchConfig, 0, 200)
+	for i := 0; i < 200; i++ {
+		watch = append(watch, WatchConfig{Paths: []string{fmt.Sprintf("services/svc-%d/", i*7), fmt.Sprintf("protos/svc-%d/**/*.proto", i)}})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := matchWatches(files, watch); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkMatchWatchesSharedPatterns matches many watches repeating the same
+// shared library patterns, each compiled and matched once per file
+func BenchmarkMatchWatchesSharedPatterns(b *testing.B) {
+	files := make([]string, 0, 100000)
+	for i := 0; i < 100000; i++ {
+		if i%2 == 0 {
+			files = append(files, fmt.Sprintf("libs/shared/pkg-%d/file-%d.go", i%100, i))
+			continue
+		}
+		files = append(files, fmt.Sprintf("services/svc-%d/src/pkg/file-%d.go", i%1000, i))
+	}
+
+	watch := make([]WatchConfig, 0, 500)
+	for i := 0; i < 500; i++ {
+		watch = append(watch, WatchConfig{Paths: []string{
+			fmt.Sprintf("services/svc-%d/", i*7),
+			"libs/shared/**/*.go",
+			"libs/proto/**/*.proto",
+			"**/BUILD.bazel",
+		}})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := matchWatches(files, watch); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCaptureWatches(b *testing.B) {
+	files := make([]string, 0, 10000)
+	for i := 0; i < 10000; i++ {
+		files = append(files, fmt.Sprintf("services/svc-%d/src/file-%d.go", i%100, i))
+	}
+
+	watch := []WatchConfig{{Paths: []string{"services/(?P<svc>[^/]+)/**"}, Files: files}}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		captureWatches(watch)
+	}
+}
+
+// BenchmarkMatcherEngines compares the matcher engines on globs of different
+// shapes, to decide which engine `auto` picks for each
+func BenchmarkMatcherEngines(b *testing.B) {
+	files := []string{
+		"services/foo/src/pkg/deep/nested/file.go",
+		"docs/README.md",
+		"libs/shared/a/b/c/d/e.go",
+		strings.Repeat("a/b/", 12) + "x.txt",
+	}
+
+	shapes := map[string]string{
+		"extension":   "**/*.md",
+		"directory":   "libs/**/*.go",
+		"single":      "docs/*.md",
+		"two-stars":   "**/test/**/*_test.go",
+		"three-stars": "**/a/**/b/**/*.go",
+		"four-stars":  "**/a/**/b/**/c/**/*.go",
+	}
+
+	for shape, p := range shapes {
+		for _, engine := range []string{matcherLegacy, matcherRegex, matcherAuto} {
+			m := compileWith(engine, p)
+
+			b.Run(shape+"/"+engine, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					for _, f := range files {
+						if _, err := m.match(f); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+			})
+		}
+	}
+}
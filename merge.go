@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// keyAttributes are the step attributes holding the key of the step
+var keyAttributes = map[string]bool{"key": true, "id": true, "identifier": true}
+
+// unsafeKeyChars are replaced when deriving a key prefix from a path
+var unsafeKeyChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// mergeSteps returns the steps of the watches. In `merge` mode, the steps of the
+// pipeline file of a watch are used instead of its step, with their keys
+// prefixed to avoid collisions between the merged pipelines.
+func mergeSteps(watches []WatchConfig, mode string) ([]Step, error) {
+	if mode != "merge" {
+		return watchSteps(watches), nil
+	}
+
+	steps := []Step{}
+
+	for _, w := range watches {
+		if w.Pipeline == "" {
+			steps = append(steps, w.Step)
+			continue
+		}
+
+		merged, err := readPipelineSteps(w.Pipeline, mergePrefix(w))
+		if err != nil {
+			return nil, err
+		}
+
+		steps = append(steps, merged...)
+	}
+
+	return dedupSteps(steps), nil
+}
+
+// mergePrefix returns the prefix of the merged keys of the watch, its key or
+// otherwise its pipeline directory, e.g. `services-foo` for
+// `services/foo/.buildkite/pipeline.yml`.
+func mergePrefix(w WatchConfig) string {
+	if w.Step.Key != "" {
+		return w.Step.Key
+	}
+
+	dir := strings.TrimSuffix(path.Dir(w.Pipeline), "/.buildkite")
+	return strings.Trim(unsafeKeyChars.ReplaceAllString(dir, "-"), "-")
+}
+
+// pipelineDefaults are the top level attributes of a merged pipeline that
+// apply to its command steps
+var pipelineDefaults = map[string]bool{"env": true, "agents": true}
+
+// nonCommandSteps are the attributes of the steps other than command steps
+var nonCommandSteps = []string{"wait", "block", "input", "trigger", "group"}
+
+// readPipelineSteps reads the steps of a pipeline file with their keys
+// prefixed, and its top level `env` and `agents` set on its command steps
+func readPipelineSteps(file string, prefix string) ([]Step, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read pipeline to merge: %v", err)
+	}
+
+	// decoding into a MapSlice keeps the order of the nested attributes too
+	var pipeline yaml.MapSlice
+
+	if err := yaml.Unmarshal(data, &pipeline); err != nil {
+		return nil, fmt.Errorf("could not parse pipeline %s: %v", file, err)
+	}
+
+	defaults := yaml.MapSlice{}
+	for _, item := range pipeline {
+		if pipelineDefaults[fmt.Sprint(item.Key)] {
+			defaults = append(defaults, item)
+		}
+	}
+
+	steps := []Step{}
+
+	for _, item := range pipeline {
+		if item.Key != "steps" {
+			continue
+		}
+
+		list, ok := item.Value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("could not parse pipeline %s: steps is not a list", file)
+		}
+
+		for _, s := range list {
+			steps = append(steps, Step{Raw: withPipelineDefaults(prefixKeys(s, prefix), defaults)})
+		}
+	}
+
+	return steps, nil
+}
+
+// withPipelineDefaults adds the top level `env` and `agents` of a merged
+// pipeline to its command steps and those of its groups, the values of the
+// step taking precedence, since they don't apply to the other pipelines.
+func withPipelineDefaults(step interface{}, defaults yaml.MapSlice) interface{} {
+	attributes, ok := step.(yaml.MapSlice)
+	if !ok || len(defaults) == 0 {
+		return step
+	}
+
+	result := yaml.MapSlice{}
+	for _, item := range attributes {
+		if item.Key == "steps" {
+			if nested, ok := item.Value.([]interface{}); ok {
+				steps := make([]interface{}, len(nested))
+				for i, s := range nested {
+					steps[i] = withPipelineDefaults(s, defaults)
+				}
+				item.Value = steps
+			}
+		}
+		result = append(result, item)
+	}
+
+	for _, name := range nonCommandSteps {
+		if _, ok := mapSliceValue(result, name); ok {
+			return result
+		}
+	}
+
+	for _, d := range defaults {
+		value, ok := mapSliceValue(result, fmt.Sprint(d.Key))
+		if !ok {
+			result = append(result, d)
+			continue
+		}
+
+		own, ok := value.(yaml.MapSlice)
+		inherited, inheritedOk := d.Value.(yaml.MapSlice)
+		if !ok || !inheritedOk {
+			continue
+		}
+
+		merged := append(yaml.MapSlice{}, inherited...)
+		for _, item := range own {
+			merged = setMapSliceValue(merged, item.Key, item.Value)
+		}
+		result = setMapSliceValue(result, d.Key, merged)
+	}
+
+	return result
+}
+
+// mapSliceValue returns the value of the attribute
+func mapSliceValue(attributes yaml.MapSlice, name string) (interface{}, bool) {
+	for _, item := range attributes {
+		if fmt.Sprint(item.Key) == name {
+			return item.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// setMapSliceValue sets the attribute in place, or appends it
+func setMapSliceValue(attributes yaml.MapSlice, key interface{}, value interface{}) yaml.MapSlice {
+	for i, item := range attributes {
+		if fmt.Sprint(item.Key) == fmt.Sprint(key) {
+			attributes[i].Value = value
+			return attributes
+		}
+	}
+
+	return append(attributes, yaml.MapItem{Key: key, Value: value})
+}
+
+// prefixKeys prefixes the keys of the step, the keys it depends on and the
+// keys of the steps of a group.
+func prefixKeys(step interface{}, prefix string) interface{} {
+	attributes, ok := step.(yaml.MapSlice)
+	if !ok {
+		// wait steps and the like
+		return step
+	}
+
+	result := yaml.MapSlice{}
+
+	for _, item := range attributes {
+		name := fmt.Sprint(item.Key)
+
+		switch {
+		case keyAttributes[name]:
+			item.Value = prefix + "-" + fmt.Sprint(item.Value)
+		case name == "depends_on":
+			item.Value = prefixDependencies(item.Value, prefix)
+		case name == "steps":
+			if nested, ok := item.Value.([]interface{}); ok {
+				steps := make([]interface{}, len(nested))
+				for i, s := range nested {
+					steps[i] = prefixKeys(s, prefix)
+				}
+				item.Value = steps
+			}
+		}
+
+		result = append(result, item)
+	}
+
+	return result
+}
+
+// prefixDependencies prefixes `depends_on` given as a key, a list of keys or a
+// list of `step` objects
+func prefixDependencies(value interface{}, prefix string) interface{} {
+	switch dependency := value.(type) {
+	case string:
+		return prefix + "-" + dependency
+	case []interface{}:
+		result := make([]interface{}, len(dependency))
+		for i, d := range dependency {
+			result[i] = prefixDependencies(d, prefix)
+		}
+		return result
+	case yaml.MapSlice:
+		result := yaml.MapSlice{}
+		for _, item := range dependency {
+			if item.Key == "step" {
+				item.Value = prefix + "-" + fmt.Sprint(item.Value)
+			}
+			result = append(result, item)
+		}
+		return result
+	}
+
+	return value
+}
+
+// rawStepName returns the label, key or type of a merged step
+func rawStepName(step interface{}) string {
+	attributes, ok := step.(yaml.MapSlice)
+	if !ok {
+		return fmt.Sprint(step)
+	}
+
+	for _, name := range []string{"label", "group", "key", "trigger", "command"} {
+		for _, item := range attributes {
+			if item.Key == name {
+				return fmt.Sprint(item.Value)
+			}
+		}
+	}
+
+	return "step"
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestMergeSteps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "merge")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	pipeline := filepath.Join(dir, "services", "foo", ".buildkite", "pipeline.yml")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(pipeline), 0755))
+	assert.NoError(t, ioutil.WriteFile(pipeline, []byte(`steps:
+  - label: test
+    key: test
+    command: make test
+  - wait
+  - group: deploy
+    steps:
+      - key: deploy
+        command: make deploy
+        depends_on:
+          - test
+          - step: lint
+            allow_failure: true
+`), 0644))
+
+	watches := []WatchConfig{
+		{Pipeline: pipeline, Step: Step{Key: "foo"}},
+		{Step: Step{Command: "make docs"}},
+	}
+
+	steps, err := mergeSteps(watches, "merge")
+	assert.NoError(t, err)
+
+	out, err := yaml.Marshal(steps)
+	assert.NoError(t, err)
+	assert.Equal(t, `- label: test
+  key: foo-test
+  command: make test
+- wait
+- group: deploy
+  steps:
+  - key: foo-deploy
+    command: make deploy
+    depends_on:
+    - foo-test
+    - step: foo-lint
+      allow_failure: true
+- command: make docs
+`, string(out))
+	assert.Equal(t, "merged: test", stepName(steps[0]))
+
+	steps, err = mergeSteps(watches, "trigger")
+	assert.NoError(t, err)
+	assert.Equal(t, []Step{{Key: "foo"}, {Command: "make docs"}}, steps)
+
+	_, err = mergeSteps([]WatchConfig{{Pipeline: filepath.Join(dir, "missing.yml")}}, "merge")
+	assert.Error(t, err)
+}
+
+func TestMergeStepsKeepsEveryPipeline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "merge")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	foo := filepath.Join(dir, "foo.yml")
+	assert.NoError(t, ioutil.WriteFile(foo, []byte(`env:
+  SERVICE: foo
+agents:
+  queue: foo
+steps:
+  - command: make test
+    env:
+      SERVICE: foo-test
+  - wait
+  - group: deploy
+    steps:
+      - command: make deploy
+        agents:
+          queue: deploy
+  - trigger: foo-release
+`), 0644))
+
+	bar := filepath.Join(dir, "bar.yml")
+	assert.NoError(t, ioutil.WriteFile(bar, []byte(`steps:
+  - command: make test
+  - wait
+  - command: make deploy
+`), 0644))
+
+	steps, err := mergeSteps([]WatchConfig{{Pipeline: foo}, {Pipeline: bar}}, "merge")
+	assert.NoError(t, err)
+
+	out, err := yaml.Marshal(steps)
+	assert.NoError(t, err)
+	assert.Equal(t, `- command: make test
+  env:
+    SERVICE: foo-test
+  agents:
+    queue: foo
+- wait
+- group: deploy
+  steps:
+  - command: make deploy
+    agents:
+      queue: deploy
+    env:
+      SERVICE: foo
+- trigger: foo-release
+- command: make test
+- wait
+- command: make deploy
+`, string(out))
+}
+
+func TestMergePrefix(t *testing.T) {
+	testCases := map[string]struct {
+		watch    WatchConfig
+		expected string
+	}{
+		"key":       {WatchConfig{Pipeline: "services/foo/pipeline.yml", Step: Step{Key: "api"}}, "api"},
+		"buildkite": {WatchConfig{Pipeline: "services/foo/.buildkite/pipeline.yml"}, "services-foo"},
+		"directory": {WatchConfig{Pipeline: "./services/foo.bar/pipeline.yml"}, "services-foo-bar"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, mergePrefix(tc.watch))
+		})
+	}
+}
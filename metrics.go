@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Pushgateway is the Prometheus Pushgateway the metrics of a run are pushed to
+type Pushgateway struct {
+	URL string `json:"url"`
+	// Job is the job grouping key of the metrics, `monorepo-diff` by default
+	Job string `json:"job"`
+	// Labels are added to the grouping key, e.g. the team or repository
+	Labels map[string]string `json:"labels"`
+}
+
+// runMetrics are the metrics of a run of the plugin
+type runMetrics struct {
+	changedFiles int
+	// partial is whether the diff was stopped early, so changedFiles is a lower bound
+	partial        bool
+	matchedWatches int
+	// watches are the label of each matched watch, or the name of its step
+	watches []string
+	steps   int
+	failed  bool
+	timer   *Timer
+}
+
+// add sums the counts of the metrics of another invocation
+func (m *runMetrics) add(other *routingReport) {
+	m.changedFiles += other.changed
+	m.partial = m.partial || other.partial
+	m.matchedWatches += len(other.Watches)
+	for _, w := range other.Watches {
+		name := w.Label
+		if name == "" {
+			name = w.Step
+		}
+		m.watches = append(m.watches, name)
+	}
+	m.steps += len(other.Steps)
+}
+
+// format renders the metrics in the Prometheus text exposition format
+func (m runMetrics) format() string {
+	var b strings.Builder
+
+	gauge := func(name string, help string, value interface{}) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", name, help, name, name, value)
+	}
+
+	failed, partial := 0, 0
+	if m.failed {
+		failed = 1
+	}
+	if m.partial {
+		partial = 1
+	}
+
+	gauge("monorepo_diff_changed_files", "Number of changed files read from the diff.", m.changedFiles)
+	gauge("monorepo_diff_changed_files_partial", "Whether the diff was stopped early, so the changed files are a lower bound.", partial)
+	gauge("monorepo_diff_matched_watches", "Number of watches matched by the changed files.", m.matchedWatches)
+	gauge("monorepo_diff_steps", "Number of generated steps.", m.steps)
+	gauge("monorepo_diff_failed", "Whether the run failed.", failed)
+	gauge("monorepo_diff_last_run_timestamp_seconds", "Time of the run.", now().Unix())
+
+	matched := map[string]int{}
+	for _, w := range m.watches {
+		matched[w]++
+	}
+	watches := make([]string, 0, len(matched))
+	for w := range matched {
+		watches = append(watches, w)
+	}
+	sort.Strings(watches)
+
+	name := "monorepo_diff_watch_matched"
+	fmt.Fprintf(&b, "# HELP %s Number of matched watches by label.\n# TYPE %s gauge\n", name, name)
+	for _, w := range watches {
+		fmt.Fprintf(&b, "%s{watch=%q} %d\n", name, w, matched[w])
+	}
+
+	name = "monorepo_diff_phase_duration_seconds"
+	fmt.Fprintf(&b, "# HELP %s Duration of the phases of the run.\n# TYPE %s gauge\n", name, name)
+
+	var total time.Duration
+	for _, p := range m.timer.phases {
+		fmt.Fprintf(&b, "%s{phase=%q} %g\n", name, p.name, p.duration.Seconds())
+		total += p.duration
+	}
+	fmt.Fprintf(&b, "%s{phase=\"total\"} %g\n", name, total.Seconds())
+
+	return b.String()
+}
+
+// groupingPath returns the path of the metrics group of the job and labels.
+// Values that can't be path segments are base64 encoded as the Pushgateway expects.
+func (p Pushgateway) groupingPath() string {
+	job := p.Job
+	if job == "" {
+		job = "monorepo-diff"
+	}
+
+	path := "/metrics" + groupingSegment("job", job)
+
+	names := make([]string, 0, len(p.Labels))
+	for name := range p.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path += groupingSegment(name, p.Labels[name])
+	}
+
+	return path
+}
+
+func groupingSegment(name string, value string) string {
+	if value == "" || strings.Contains(value, "/") {
+		return fmt.Sprintf("/%s@base64/%s", name, base64.URLEncoding.EncodeToString([]byte(value)))
+	}
+
+	return fmt.Sprintf("/%s/%s", name, url.PathEscape(value))
+}
+
+// pushMetrics replaces the metrics of the group in the Pushgateway
+func pushMetrics(gateway *Pushgateway, metrics runMetrics) {
+	target := strings.TrimSuffix(gateway.URL, "/") + gateway.groupingPath()
+
+	req, err := http.NewRequestWithContext(jobContext, http.MethodPut, target, bytes.NewBufferString(metrics.format()))
+	if err != nil {
+		log.Warnf("could not push metrics: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Warnf("could not push metrics: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Warnf("could not push metrics: %s", resp.Status)
+		return
+	}
+
+	log.Debugf("Metrics pushed to %s", target)
+}
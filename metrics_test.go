@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPushgatewayGroupingPath(t *testing.T) {
+	testCases := map[string]struct {
+		gateway  Pushgateway
+		expected string
+	}{
+		"default job": {Pushgateway{}, "/metrics/job/monorepo-diff"},
+		"labels":      {Pushgateway{Job: "ci", Labels: map[string]string{"team": "platform", "repo": "mono"}}, "/metrics/job/ci/repo/mono/team/platform"},
+		"slash":       {Pushgateway{Labels: map[string]string{"repo": "org/mono"}}, "/metrics/job/monorepo-diff/repo@base64/b3JnL21vbm8="},
+		"empty":       {Pushgateway{Labels: map[string]string{"repo": ""}}, "/metrics/job/monorepo-diff/repo@base64/"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.gateway.groupingPath())
+		})
+	}
+}
+
+func TestRunMetricsFormat(t *testing.T) {
+	now = func() time.Time { return time.Unix(1700000000, 0) }
+	defer func() { now = time.Now }()
+
+	metrics := runMetrics{
+		changedFiles:   12,
+		partial:        true,
+		matchedWatches: 2,
+		watches:        []string{"payments", "payments", "trigger: docs"},
+		steps:          3,
+		failed:         true,
+		timer:          &Timer{phases: []phase{{"diff", 1500 * time.Millisecond}, {"upload", 500 * time.Millisecond}}},
+	}
+
+	want := `# HELP monorepo_diff_changed_files Number of changed files read from the diff.
+# TYPE monorepo_diff_changed_files gauge
+monorepo_diff_changed_files 12
+# HELP monorepo_diff_changed_files_partial Whether the diff was stopped early, so the changed files are a lower bound.
+# TYPE monorepo_diff_changed_files_partial gauge
+monorepo_diff_changed_files_partial 1
+# HELP monorepo_diff_matched_watches Number of watches matched by the changed files.
+# TYPE monorepo_diff_matched_watches gauge
+monorepo_diff_matched_watches 2
+# HELP monorepo_diff_steps Number of generated steps.
+# TYPE monorepo_diff_steps gauge
+monorepo_diff_steps 3
+# HELP monorepo_diff_failed Whether the run failed.
+# TYPE monorepo_diff_failed gauge
+monorepo_diff_failed 1
+# HELP monorepo_diff_last_run_timestamp_seconds Time of the run.
+# TYPE monorepo_diff_last_run_timestamp_seconds gauge
+monorepo_diff_last_run_timestamp_seconds 1700000000
+# HELP monorepo_diff_watch_matched Number of matched watches by label.
+# TYPE monorepo_diff_watch_matched gauge
+monorepo_diff_watch_matched{watch="payments"} 2
+monorepo_diff_watch_matched{watch="trigger: docs"} 1
+# HELP monorepo_diff_phase_duration_seconds Duration of the phases of the run.
+# TYPE monorepo_diff_phase_duration_seconds gauge
+monorepo_diff_phase_duration_seconds{phase="diff"} 1.5
+monorepo_diff_phase_duration_seconds{phase="upload"} 0.5
+monorepo_diff_phase_duration_seconds{phase="total"} 2
+`
+
+	assert.Equal(t, want, metrics.format())
+}
+
+func TestUploadPipelinePushesMetrics(t *testing.T) {
+	var path, body string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		data, _ := ioutil.ReadAll(r.Body)
+		path, body = r.URL.Path, string(data)
+	}))
+	defer server.Close()
+
+	plugin := Plugin{
+		Diff:        "printf services/foo/main.go\\ndocs/README.md\\n",
+		Pushgateway: &Pushgateway{URL: server.URL, Labels: map[string]string{"team": "platform"}},
+		Watch: []WatchConfig{
+			{Label: "foo", Paths: []string{"services/foo/"}, Step: Step{Trigger: "foo"}},
+			{Label: "bar", Paths: []string{"services/bar/"}, Step: Step{Trigger: "bar"}},
+		},
+	}
+
+	_, _, err := uploadPipeline(plugin, mockGeneratePipeline)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "/metrics/job/monorepo-diff/team/platform", path)
+	assert.Contains(t, body, "monorepo_diff_changed_files 2\n")
+	assert.Contains(t, body, "monorepo_diff_matched_watches 1\n")
+	assert.Contains(t, body, "monorepo_diff_steps 1\n")
+	assert.Contains(t, body, `monorepo_diff_watch_matched{watch="foo"} 1`)
+	assert.NotContains(t, body, `watch="bar"`)
+	assert.Contains(t, body, "monorepo_diff_failed 0\n")
+	assert.Contains(t, body, `monorepo_diff_phase_duration_seconds{phase="diff"}`)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Plugins are the plugins of a step. Their configuration is decoded with the
+// keys of objects kept in order, so the generated pipeline has the same order
+// as the plugin configuration and is stable across runs.
+type Plugins []interface{}
+
+// UnmarshalJSON decodes plugins given as an array or as an object
+func (p *Plugins) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	value, err := decodeOrdered(dec)
+	if err != nil {
+		return err
+	}
+
+	switch plugins := value.(type) {
+	case nil:
+		*p = nil
+	case []interface{}:
+		*p = plugins
+	case yaml.MapSlice:
+		// `plugins: { name: config }` is the same as a list of single plugins
+		*p = Plugins{}
+		for _, item := range plugins {
+			*p = append(*p, yaml.MapSlice{item})
+		}
+	default:
+		return fmt.Errorf("invalid plugins: %v", value)
+	}
+
+	return nil
+}
+
+// decodeOrdered decodes the next JSON value, with objects as yaml.MapSlice
+func decodeOrdered(dec *json.Decoder) (interface{}, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := token.(type) {
+	case json.Delim:
+		if t == '[' {
+			list := []interface{}{}
+			for dec.More() {
+				item, err := decodeOrdered(dec)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, item)
+			}
+			_, err := dec.Token()
+			return list, err
+		}
+
+		object := yaml.MapSlice{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			object = append(object, yaml.MapItem{Key: key, Value: value})
+		}
+		_, err := dec.Token()
+		return object, err
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i, nil
+		}
+		return t.Float64()
+	}
+
+	return token, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestPluginsKeepKeyOrder(t *testing.T) {
+	var step Step
+
+	err := json.Unmarshal([]byte(`{
+		"command": "make test",
+		"plugins": [
+			{ "docker-compose#v3.7.0": { "run": "app", "config": ["b.yml", "a.yml"], "workdir": "/app", "env": { "Z": "1", "A": 2.5 } } },
+			{ "artifacts#v1.3.0": { "upload": "coverage/*" } }
+		]
+	}`), &step)
+	assert.NoError(t, err)
+
+	data, err := yaml.Marshal(step)
+	assert.NoError(t, err)
+
+	assert.Equal(t, `command: make test
+plugins:
+- docker-compose#v3.7.0:
+    run: app
+    config:
+    - b.yml
+    - a.yml
+    workdir: /app
+    env:
+      Z: "1"
+      A: 2.5
+- artifacts#v1.3.0:
+    upload: coverage/*
+`, string(data))
+}
+
+func TestPluginsAsObject(t *testing.T) {
+	var plugins Plugins
+
+	err := json.Unmarshal([]byte(`{ "docker#v3.8.0": { "image": "node", "always-pull": true }, "artifacts#v1.3.0": null }`), &plugins)
+
+	assert.NoError(t, err)
+	assert.Equal(t, Plugins{
+		yaml.MapSlice{{Key: "docker#v3.8.0", Value: yaml.MapSlice{{Key: "image", Value: "node"}, {Key: "always-pull", Value: true}}}},
+		yaml.MapSlice{{Key: "artifacts#v1.3.0", Value: nil}},
+	}, plugins)
+}
+
+func TestPluginsWithIntegers(t *testing.T) {
+	var plugins Plugins
+
+	err := json.Unmarshal([]byte(`[{ "retry#v1": { "limit": 3 } }]`), &plugins)
+
+	assert.NoError(t, err)
+	assert.Equal(t, Plugins{
+		yaml.MapSlice{{Key: "retry#v1", Value: yaml.MapSlice{{Key: "limit", Value: int64(3)}}}},
+	}, plugins)
+}
+
+func TestInvalidPlugins(t *testing.T) {
+	var plugins Plugins
+
+	err := json.Unmarshal([]byte(`"docker"`), &plugins)
+
+	assert.EqualError(t, err, "invalid plugins: docker")
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// selectionKey is the meta-data key of the pipelines selected by the `select` overflow policy
+const selectionKey = "monorepo-diff-selection"
+
+// applyOverflow enforces `max_triggered` on the matched steps
+// according to the configured `overflow` policy.
+func applyOverflow(steps []Step, plugin Plugin) ([]Step, error) {
+	if plugin.MaxTriggered <= 0 || len(steps) <= plugin.MaxTriggered {
+		return steps, nil
+	}
+
+	log.Warnf("%d steps matched, exceeding max_triggered of %d", len(steps), plugin.MaxTriggered)
+
+	switch plugin.Overflow {
+	case "", "fail":
+		return nil, fmt.Errorf(
+			"%d steps matched which exceeds max_triggered of %d", len(steps), plugin.MaxTriggered,
+		)
+	case "block":
+		block := Step{
+			Block:  fmt.Sprintf(":warning: Trigger %d pipelines?", len(steps)),
+			Prompt: fmt.Sprintf("This change matched %d watches, more than the limit of %d", len(steps), plugin.MaxTriggered),
+		}
+		return append([]Step{block}, steps...), nil
+	case "truncate":
+		return steps[:plugin.MaxTriggered], nil
+	case "trigger_all_step":
+		if plugin.OverflowStep == nil {
+			return nil, fmt.Errorf("overflow `trigger_all_step` requires `overflow_step` to be configured")
+		}
+		return []Step{*plugin.OverflowStep}, nil
+	case "select":
+		return selectSteps(steps, plugin)
+	}
+
+	return nil, fmt.Errorf("unknown overflow policy `%s`", plugin.Overflow)
+}
+
+// checkOverflow fails on an `overflow` policy that couldn't be applied, when
+// the configuration is parsed rather than on the build that overflows
+func checkOverflow(plugin Plugin) error {
+	switch plugin.Overflow {
+	case "", "fail", "block", "truncate", "select":
+	case "trigger_all_step":
+		if plugin.OverflowStep == nil {
+			return fmt.Errorf("overflow `trigger_all_step` requires `overflow_step` to be configured")
+		}
+	default:
+		return fmt.Errorf("unknown overflow policy `%s`", plugin.Overflow)
+	}
+
+	return nil
+}
+
+// selectSteps replaces the steps with a block step to select the pipelines to
+// trigger and a step that uploads the selected ones. Every candidate step is
+// passed to that step as a pipeline in an environment variable.
+func selectSteps(steps []Step, plugin Plugin) ([]Step, error) {
+	options := make([]FieldOption, len(steps))
+	env := make(map[string]string, len(steps))
+
+	for i, s := range steps {
+		data, err := yaml.Marshal(map[string][]Step{"steps": {s}})
+		if err != nil {
+			return nil, fmt.Errorf("could not serialize the pipeline: %v", err)
+		}
+
+		value := strconv.Itoa(i)
+		options[i] = FieldOption{Label: stepName(s), Value: value}
+		env["MONOREPO_DIFF_STEP_"+value] = string(data)
+	}
+
+	// `$` has to be escaped unless the pipeline is uploaded without interpolation
+	dollar := "$$"
+	if plugin.Interpolation {
+		dollar = "$"
+	}
+
+	command := fmt.Sprintf(
+		"for i in %[1]s(buildkite-agent meta-data get %[2]s); do printenv \"MONOREPO_DIFF_STEP_%[1]s{i}\" | buildkite-agent pipeline upload; done",
+		dollar, selectionKey,
+	)
+
+	return []Step{
+		{
+			Block:  ":point_right: Select the pipelines to trigger",
+			Prompt: fmt.Sprintf("This change matched %d watches, more than the limit of %d", len(steps), plugin.MaxTriggered),
+			Fields: []Field{{
+				Select:   "Pipelines",
+				Key:      selectionKey,
+				Multiple: true,
+				Options:  options,
+			}},
+		},
+		{
+			Label:   ":pipeline: Trigger selected pipelines",
+			Command: command,
+			Env:     env,
+		},
+	}, nil
+}
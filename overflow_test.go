@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyOverflow(t *testing.T) {
+	steps := []Step{{Trigger: "a"}, {Trigger: "b"}, {Trigger: "c"}}
+
+	testCases := map[string]struct {
+		Plugin   Plugin
+		Expected []Step
+		Error    string
+	}{
+		"under the limit": {
+			Plugin:   Plugin{MaxTriggered: 3},
+			Expected: steps,
+		},
+		"no limit": {
+			Plugin:   Plugin{},
+			Expected: steps,
+		},
+		"fail by default": {
+			Plugin: Plugin{MaxTriggered: 2},
+			Error:  "3 steps matched which exceeds max_triggered of 2",
+		},
+		"block": {
+			Plugin: Plugin{MaxTriggered: 2, Overflow: "block"},
+			Expected: append([]Step{{
+				Block:  ":warning: Trigger 3 pipelines?",
+				Prompt: "This change matched 3 watches, more than the limit of 2",
+			}}, steps...),
+		},
+		"truncate": {
+			Plugin:   Plugin{MaxTriggered: 2, Overflow: "truncate"},
+			Expected: steps[:2],
+		},
+		"trigger_all_step": {
+			Plugin:   Plugin{MaxTriggered: 2, Overflow: "trigger_all_step", OverflowStep: &Step{Trigger: "everything"}},
+			Expected: []Step{{Trigger: "everything"}},
+		},
+		"trigger_all_step without step": {
+			Plugin: Plugin{MaxTriggered: 2, Overflow: "trigger_all_step"},
+			Error:  "overflow `trigger_all_step` requires `overflow_step` to be configured",
+		},
+		"select": {
+			Plugin: Plugin{MaxTriggered: 2, Overflow: "select"},
+			Expected: []Step{
+				{
+					Block:  ":point_right: Select the pipelines to trigger",
+					Prompt: "This change matched 3 watches, more than the limit of 2",
+					Fields: []Field{{
+						Select:   "Pipelines",
+						Key:      "monorepo-diff-selection",
+						Multiple: true,
+						Options: []FieldOption{
+							{Label: "trigger: a", Value: "0"},
+							{Label: "trigger: b", Value: "1"},
+							{Label: "trigger: c", Value: "2"},
+						},
+					}},
+				},
+				{
+					Label:   ":pipeline: Trigger selected pipelines",
+					Command: `for i in $$(buildkite-agent meta-data get monorepo-diff-selection); do printenv "MONOREPO_DIFF_STEP_$${i}" | buildkite-agent pipeline upload; done`,
+					Env: map[string]string{
+						"MONOREPO_DIFF_STEP_0": "steps:\n- trigger: a\n",
+						"MONOREPO_DIFF_STEP_1": "steps:\n- trigger: b\n",
+						"MONOREPO_DIFF_STEP_2": "steps:\n- trigger: c\n",
+					},
+				},
+			},
+		},
+		"unknown policy": {
+			Plugin: Plugin{MaxTriggered: 2, Overflow: "explode"},
+			Error:  "unknown overflow policy `explode`",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := applyOverflow(steps, tc.Plugin)
+
+			if tc.Error != "" {
+				assert.EqualError(t, err, tc.Error)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Expected, got)
+		})
+	}
+}
+
+func TestSelectStepsWithoutInterpolation(t *testing.T) {
+	got, err := selectSteps([]Step{{Trigger: "a"}}, Plugin{Interpolation: true})
+
+	assert.NoError(t, err)
+	assert.Equal(t,
+		`for i in $(buildkite-agent meta-data get monorepo-diff-selection); do printenv "MONOREPO_DIFF_STEP_${i}" | buildkite-agent pipeline upload; done`,
+		got[1].Command,
+	)
+}
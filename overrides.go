@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LabelOverride forces or skips watches when a pull request has a label.
+// Watches are referred to by their trigger pipeline, or label for command steps.
+type LabelOverride struct {
+	Force []string
+	Skip  []string
+}
+
+// MetaDataOverrides names the build meta-data keys holding the watches to force
+// or skip, separated by commas, e.g. `force_pipelines=service-a,service-b`.
+type MetaDataOverrides struct {
+	Force string
+	Skip  string
+}
+
+// watchName returns the name of the watch used by overrides
+func watchName(watch WatchConfig) string {
+	if watch.Step.Trigger != "" {
+		return watch.Step.Trigger
+	}
+
+	return watch.Step.Label
+}
+
+// forceWatches adds the watches whose name matches one of the patterns to the matched watches
+func forceWatches(all []WatchConfig, matched []WatchConfig, patterns []string) []WatchConfig {
+	result := append([]WatchConfig{}, matched...)
+
+	for _, w := range all {
+		if !matchesAny(patterns, watchName(w)) || containsWatch(result, w) {
+			continue
+		}
+
+		result = append(result, w)
+	}
+
+	return result
+}
+
+// skipWatches removes the watches whose name matches one of the patterns
+func skipWatches(matched []WatchConfig, patterns []string) []WatchConfig {
+	result := []WatchConfig{}
+
+	for _, w := range matched {
+		if !matchesAny(patterns, watchName(w)) {
+			result = append(result, w)
+		}
+	}
+
+	return result
+}
+
+// containsWatch returns whether the watches include the configured watch. The
+// files collected while matching are ignored, since the configured watches
+// don't have them.
+func containsWatch(watches []WatchConfig, watch WatchConfig) bool {
+	watch.Files = nil
+
+	for _, w := range watches {
+		w.Files = nil
+		if reflect.DeepEqual(w, watch) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyLabelOverrides forces and skips the watches configured for the labels
+// of the pull request. Skipping takes precedence over forcing.
+func applyLabelOverrides(plugin Plugin, matched []WatchConfig) ([]WatchConfig, error) {
+	pr := env("BUILDKITE_PULL_REQUEST", "false")
+	if pr == "false" || pr == "" {
+		return matched, nil
+	}
+
+	api, err := newGithubAPI()
+	if err != nil {
+		return nil, err
+	}
+
+	labels, err := api.labels(pr)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(labels)
+
+	force := []string{}
+	skip := []string{}
+
+	for _, label := range labels {
+		override, ok := plugin.LabelOverrides[label]
+		if !ok {
+			continue
+		}
+
+		log.Infof("Applying overrides of pull request label `%s`", label)
+		force = append(force, override.Force...)
+		skip = append(skip, override.Skip...)
+	}
+
+	return skipWatches(forceWatches(plugin.Watch, matched, force), skip), nil
+}
+
+// applyMetaDataOverrides forces and skips the watches listed in the build
+// meta-data, so specific pipelines can be rerun on an existing build.
+func applyMetaDataOverrides(plugin Plugin, matched []WatchConfig) ([]WatchConfig, error) {
+	force, err := metaDataList(plugin, plugin.MetaDataOverrides.Force)
+	if err != nil {
+		return nil, err
+	}
+
+	skip, err := metaDataList(plugin, plugin.MetaDataOverrides.Skip)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(force) > 0 {
+		log.Infof("Forcing watches from meta-data: %s", strings.Join(force, ", "))
+	}
+
+	if len(skip) > 0 {
+		log.Infof("Skipping watches from meta-data: %s", strings.Join(skip, ", "))
+	}
+
+	return skipWatches(forceWatches(plugin.Watch, matched, force), skip), nil
+}
+
+// metaDataList reads a comma separated list from the build meta-data
+func metaDataList(plugin Plugin, key string) ([]string, error) {
+	if key == "" {
+		return []string{}, nil
+	}
+
+	args := append([]string{}, plugin.AgentArgs...)
+	args = append(args, "meta-data", "get", key, "--default", "")
+
+	output, err := executeCommand(agentBinary(plugin), args)
+	if err != nil {
+		return nil, fmt.Errorf("could not read meta-data `%s`: %v", key, err)
+	}
+
+	return strings.FieldsFunc(output, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	}), nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var overrideWatches = []WatchConfig{
+	{Paths: []string{"frontend/"}, Step: Step{Trigger: "frontend-web"}},
+	{Paths: []string{"frontend/admin/"}, Step: Step{Trigger: "frontend-admin"}},
+	{Paths: []string{"services/api/"}, Step: Step{Trigger: "api"}},
+	{Paths: []string{"docs/"}, Step: Step{Command: "make docs", Label: "docs"}},
+}
+
+func TestForceWatches(t *testing.T) {
+	matched := []WatchConfig{overrideWatches[2]}
+
+	assert.Equal(t, matched, forceWatches(overrideWatches, matched, []string{}))
+	assert.Equal(t,
+		[]WatchConfig{overrideWatches[2], overrideWatches[3]},
+		forceWatches(overrideWatches, matched, []string{"api", "docs"}),
+	)
+	assert.Equal(t,
+		[]WatchConfig{overrideWatches[2], overrideWatches[0], overrideWatches[1], overrideWatches[3]},
+		forceWatches(overrideWatches, matched, []string{"*"}),
+	)
+
+	// a matched watch has the files it matched
+	withFiles := overrideWatches[2]
+	withFiles.Files = []string{"services/api/main.go"}
+	assert.Equal(t,
+		[]WatchConfig{withFiles, overrideWatches[3]},
+		forceWatches(overrideWatches, []WatchConfig{withFiles}, []string{"api", "docs"}),
+	)
+}
+
+func TestSkipWatches(t *testing.T) {
+	assert.Equal(t,
+		[]WatchConfig{overrideWatches[2], overrideWatches[3]},
+		skipWatches(overrideWatches, []string{"frontend-*"}),
+	)
+	assert.Equal(t, []WatchConfig{}, skipWatches(overrideWatches, []string{"*"}))
+}
+
+func TestApplyLabelOverrides(t *testing.T) {
+	var path string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		_, _ = w.Write([]byte(`[{"name":"ci:skip-frontend"},{"name":"ci:full"},{"name":"bug"}]`))
+	}))
+	defer server.Close()
+
+	os.Setenv("GITHUB_API_URL", server.URL)
+	os.Setenv("GITHUB_TOKEN", "gh-token")
+	os.Setenv("BUILDKITE_REPO", "git@github.com:org/monorepo.git")
+	os.Setenv("BUILDKITE_PULL_REQUEST", "12")
+	defer os.Unsetenv("GITHUB_API_URL")
+	defer os.Unsetenv("GITHUB_TOKEN")
+	defer os.Unsetenv("BUILDKITE_REPO")
+	defer os.Unsetenv("BUILDKITE_PULL_REQUEST")
+
+	plugin := Plugin{
+		Watch: overrideWatches,
+		LabelOverrides: map[string]LabelOverride{
+			"ci:full":          {Force: []string{"*"}},
+			"ci:skip-frontend": {Skip: []string{"frontend-*"}},
+		},
+	}
+
+	got, err := applyLabelOverrides(plugin, []WatchConfig{overrideWatches[0]})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "/repos/org/monorepo/issues/12/labels", path)
+	assert.Equal(t, []WatchConfig{overrideWatches[2], overrideWatches[3]}, got)
+}
+
+func TestApplyLabelOverridesNotPullRequest(t *testing.T) {
+	os.Setenv("BUILDKITE_PULL_REQUEST", "false")
+	defer os.Unsetenv("BUILDKITE_PULL_REQUEST")
+
+	matched := []WatchConfig{overrideWatches[0]}
+	got, err := applyLabelOverrides(Plugin{Watch: overrideWatches}, matched)
+
+	assert.NoError(t, err)
+	assert.Equal(t, matched, got)
+}
+
+func TestApplyMetaDataOverrides(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "agent")
+	defer os.RemoveAll(dir)
+
+	agent := filepath.Join(dir, "buildkite-agent")
+	script := `#!/bin/sh
+case "$3" in
+  force_pipelines) echo "api, docs" ;;
+  skip_pipelines) echo "frontend-*" ;;
+esac
+`
+	_ = ioutil.WriteFile(agent, []byte(script), 0755)
+
+	plugin := Plugin{
+		Watch:             overrideWatches,
+		AgentBinary:       agent,
+		MetaDataOverrides: &MetaDataOverrides{Force: "force_pipelines", Skip: "skip_pipelines"},
+	}
+
+	got, err := applyMetaDataOverrides(plugin, []WatchConfig{overrideWatches[0]})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []WatchConfig{overrideWatches[2], overrideWatches[3]}, got)
+}
+
+func TestApplyMetaDataOverridesUnset(t *testing.T) {
+	matched := []WatchConfig{overrideWatches[0]}
+	got, err := applyMetaDataOverrides(Plugin{Watch: overrideWatches, MetaDataOverrides: &MetaDataOverrides{Force: "force_pipelines"}}, matched)
+
+	assert.NoError(t, err)
+	assert.Equal(t, matched, got)
+}
+
+func TestApplyMetaDataOverridesFailure(t *testing.T) {
+	plugin := Plugin{AgentBinary: "false", MetaDataOverrides: &MetaDataOverrides{Force: "force_pipelines"}}
+
+	_, err := applyMetaDataOverrides(plugin, nil)
+
+	assert.EqualError(t, err, "could not read meta-data `force_pipelines`: command `false` failed: exit status 1")
+}
@@ -1,126 +1,981 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"reflect"
 	"strings"
+	"time"
 
-	"github.com/bmatcuk/doublestar/v2"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
 
-// Pipeline is Buildkite pipeline definition
-type Pipeline struct {
-	Steps []Step
+// maxUploadSize is the maximum size in bytes of the steps in a single pipeline upload
+const maxUploadSize = 1024 * 1024
+
+// outputs of the generated pipeline
+const (
+	outputUpload = "upload"
+	outputStdout = "stdout"
+	// outputGitHubActions writes the matched steps as GitHub Actions outputs
+	outputGitHubActions = "github_actions"
+)
+
+// pipelineOutput is where the pipeline is written with `output: stdout`
+var pipelineOutput io.Writer = os.Stdout
+
+// pipelineDefinition is the generated pipeline
+type pipelineDefinition struct {
+	Env    map[string]string `yaml:"env,omitempty"`
+	Agents map[string]string `yaml:"agents,omitempty"`
+	Steps  []Step            `yaml:"steps"`
 }
 
 // PipelineGenerator generates pipeline file
 type PipelineGenerator func(steps []Step, plugin Plugin) (*os.File, error)
 
-func uploadPipeline(plugin Plugin, generatePipeline PipelineGenerator) (string, []string, error) {
-	diffOutput, err := diff(plugin.Diff)
+func uploadPipeline(plugin Plugin, generatePipeline PipelineGenerator) (cmd string, args []string, err error) {
+	timer := &Timer{}
+	defer func() {
+		logGroup(":stopwatch: Timing")
+		fmt.Fprint(logWriter, timer.summary())
+	}()
+
+	report := &routingReport{timer: timer}
+	if plugin.RoutingReport != "" {
+		defer writeRoutingReport(report, plugin)
+	}
+
+	if plugin.Pushgateway != nil {
+		defer func() {
+			metrics := runMetrics{timer: timer, failed: err != nil}
+			metrics.add(report)
+			pushMetrics(plugin.Pushgateway, metrics)
+		}()
+	}
+
+	var steps []Step
+	if plugin.DebugBundle {
+		defer func() {
+			if err != nil {
+				writeDebugBundle(debugBundle{plugin: plugin, report: report, steps: steps, failure: err})
+			}
+		}()
+	}
+
+	if plugin.AuditLog != "" {
+		defer func() {
+			metrics := runMetrics{}
+			metrics.add(report)
+			writeAuditLog(plugin.AuditLog, newAuditRecord(metrics, steps, err))
+		}()
+	}
+
+	if plugin.Manifest != "" {
+		defer func() {
+			if err == nil {
+				writeManifest(plugin, steps)
+			}
+		}()
+	}
+
+	steps, matched, err := matchSteps(plugin, timer, report)
 	if err != nil {
-		log.Fatal(err)
 		return "", []string{}, err
 	}
 
-	if len(diffOutput) < 1 {
-		log.Info("No changes detected. Skipping pipeline upload.")
-		return "", []string{}, nil
+	if !matched {
+		return "", []string{}, publishNothing(plugin)
 	}
 
-	log.Debug("Output from diff: \n" + strings.Join(diffOutput, "\n"))
+	return publishSteps(plugin, steps, generatePipeline, timer)
+}
 
-	steps, err := stepsToTrigger(diffOutput, plugin.Watch)
-	if err != nil {
+// uploadPipelines uploads the steps of every invocation of the plugin in the
+// step as a single pipeline, so they are deduplicated and checked for key
+// collisions together. The upload settings are those of the first invocation.
+func uploadPipelines(plugins []Plugin, generatePipeline PipelineGenerator) (cmd string, args []string, err error) {
+	if len(plugins) == 1 {
+		return uploadPipeline(plugins[0], generatePipeline)
+	}
+
+	timer := &Timer{}
+	defer func() {
+		logGroup(":stopwatch: Timing")
+		fmt.Fprint(logWriter, timer.summary())
+	}()
+
+	metrics := runMetrics{timer: timer}
+	if gateway := plugins[0].Pushgateway; gateway != nil {
+		defer func() {
+			metrics.failed = err != nil
+			pushMetrics(gateway, metrics)
+		}()
+	}
+
+	combined := plugins[0]
+	combined.Hooks = []HookConfig{}
+
+	steps := []Step{}
+	matched := false
+
+	changed := &routingReport{}
+	if combined.DebugBundle {
+		defer func() {
+			if err != nil {
+				writeDebugBundle(debugBundle{plugin: combined, report: changed, steps: steps, failure: err})
+			}
+		}()
+	}
+
+	if combined.AuditLog != "" {
+		defer func() {
+			writeAuditLog(combined.AuditLog, newAuditRecord(metrics, steps, err))
+		}()
+	}
+
+	if combined.Manifest != "" {
+		defer func() {
+			if err == nil {
+				writeManifest(combined, steps)
+			}
+		}()
+	}
+
+	for i, plugin := range plugins {
+		logExpandedGroup(":jigsaw: Invocation %d of %d", i+1, len(plugins))
+
+		report := &routingReport{timer: timer}
+		s, ok, err := matchSteps(plugin, timer, report)
+		metrics.add(report)
+		changed.ChangedFiles = append(changed.ChangedFiles, report.ChangedFiles...)
+
+		if plugin.RoutingReport != "" {
+			writeRoutingReport(report, plugin)
+		}
+
+		if err != nil {
+			return "", []string{}, err
+		}
+
+		if ok {
+			matched = true
+			steps = append(steps, s...)
+		}
+
+		combined.Hooks = append(combined.Hooks, plugin.Hooks...)
+	}
+
+	if !matched {
+		return "", []string{}, publishNothing(combined)
+	}
+
+	steps = dedupSteps(steps)
+	combined.Hooks = dedupHooks(combined.Hooks)
+
+	if err := checkKeyCollisions(combined, steps); err != nil {
 		return "", []string{}, err
 	}
 
-	pipeline, err := generatePipeline(steps, plugin)
-	defer os.Remove(pipeline.Name())
+	logExpandedGroup(":pipeline: Merged %d %s of %d invocations", len(steps), pluralize(len(steps), "step"), len(plugins))
+
+	return publishSteps(combined, steps, generatePipeline, timer)
+}
+
+// matchSteps returns the steps of the watches of the plugin that matched, and
+// false when nothing matched and there is nothing to upload
+func matchSteps(plugin Plugin, timer *Timer, report *routingReport) ([]Step, bool, error) {
+	if hooks := hooksInPhase(plugin.Hooks, hookPhasePreDiff); len(hooks) > 0 {
+		start := time.Now()
+		if err := runHooks(hooks, hookPhasePreDiff, plugin.Shell); err != nil {
+			return nil, false, err
+		}
+		timer.track(hookPhasePreDiff, start)
+	}
+
+	// scheduled builds run the `on_schedule` watches and tag builds are routed
+	// by the tag when watches have `tags`, instead of by the diff
+	scheduled := env("BUILDKITE_SOURCE", "") == "schedule" && plugin.OnSchedule != nil
+	tag := env("BUILDKITE_TAG", "")
+	tagged := tag != "" && hasTagWatches(plugin.Watch)
+
+	var count int
+	var watches []WatchConfig
+	var err error
+	// reason is why a watch is triggered, for the `generic-json` format
+	reason := diffReason
+
+	switch {
+	case scheduled:
+		logGroup(":calendar: Running the scheduled watches")
+		watches = scheduledWatches(plugin.Watch, plugin.OnSchedule)
+		reason = func(WatchConfig) string { return "on_schedule" }
+	case tagged:
+		logGroup(":label: Matching tag %s against %d watches", tag, len(plugin.Watch))
+		watches, err = tagWatches(plugin.Watch, tag)
+		reason = func(WatchConfig) string { return "tag " + tag }
+	default:
+		count, watches, err = diffWatches(plugin, timer, report)
+		report.changed = count
+		if count < 1 {
+			reason = func(WatchConfig) string { return "on_empty_diff " + plugin.OnEmptyDiff }
+		}
+	}
 
 	if err != nil {
-		log.Error(err)
-		return "", []string{}, err
+		return nil, false, err
+	}
+
+	if len(plugin.LabelOverrides) > 0 {
+		watches, err = applyLabelOverrides(plugin, watches)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	if plugin.MetaDataOverrides != nil {
+		watches, err = applyMetaDataOverrides(plugin, watches)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	watches = applyRollouts(watches)
+
+	report.setWatches(watches)
+
+	if count < 1 && len(watches) == 0 {
+		if scheduled {
+			log.Info("No watches run on schedule. Skipping pipeline upload.")
+		} else if tagged {
+			log.Infof("No watches match the tag %s. Skipping pipeline upload.", tag)
+		} else {
+			log.Info("No changes detected. Skipping pipeline upload.")
+		}
+		if plugin.SlackWebhook != "" {
+			notifySlack(plugin, nil)
+		}
+		return nil, false, nil
+	}
+
+	if !scheduled && !tagged && report.partial {
+		log.Infof("Read %d changed %s before the diff was stopped early, every watch had matched", count, pluralize(count, "file"))
+	} else if !scheduled && !tagged {
+		log.Infof("Read %d changed %s", count, pluralize(count, "file"))
+	}
+
+	watches, err = loadEnvFiles(watches)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if needsFiles(plugin) {
+		watches = captureWatches(fanOutWatches(watches))
+	}
+
+	watches, err = environmentWatches(watches)
+	if err != nil {
+		return nil, false, err
+	}
+
+	watches, err = renderWatches(watches, plugin.Templates)
+	if err != nil {
+		return nil, false, err
+	}
+
+	watches = applyQueueRules(watches)
+
+	if plugin.DedupeByContent {
+		watches, err = dedupeByContent(watches)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	if plugin.DedupeRunning != "" {
+		watches, err = dedupeRunning(watches, plugin.DedupeRunning)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	if plugin.ContentHashEnv {
+		watches, err = addContentHashEnv(watches)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	watches, err = applyInterpolation(watches, plugin)
+	if err != nil {
+		return nil, false, err
+	}
+
+	watches, err = skipStaleWatches(plugin, watches)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// scheduled builds are meant to run, whatever the time
+	if !scheduled {
+		watches = skipInactiveWatches(watches)
+	}
+
+	if plugin.MatchedFilesArtifacts {
+		watches, err = uploadMatchedFiles(plugin, watches)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	if plugin.Format == formatGenericJSON {
+		watches = setReasons(watches, reason)
+	}
+
+	steps, err := mergeSteps(watches, plugin.Mode)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if plugin.Extension != "" {
+		logGroup(":electric_plug: Running extension %s", plugin.Extension)
+		start := time.Now()
+		steps, err = runExtension(plugin, watches, steps)
+		if err != nil {
+			return nil, false, err
+		}
+		timer.track("extension", start)
+	}
+
+	steps = namespaceKeys(steps, plugin.KeyNamespace)
+
+	if plugin.InheritPriority {
+		steps = inheritPriority(steps, parentPriority(plugin.PriorityFromAPI))
+	}
+
+	steps, err = applyOverflow(steps, plugin)
+	if err != nil {
+		return nil, false, err
+	}
+
+	steps = keyHookedSteps(plugin, steps)
+
+	if err := checkKeyCollisions(plugin, steps); err != nil {
+		return nil, false, err
+	}
+
+	if err := checkAllowedTriggers(plugin, steps); err != nil {
+		return nil, false, err
+	}
+
+	if plugin.ValidateTriggers || plugin.ValidateTriggerPermissions {
+		if err := validateTriggers(steps, plugin.ValidateTriggerPermissions); err != nil {
+			return nil, false, err
+		}
+	}
+
+	report.setSteps(steps)
+
+	logExpandedGroup(":pipeline: Matched %d %s", len(steps), pluralize(len(steps), "pipeline"))
+	if prettyLogs {
+		fmt.Fprint(logWriter, matchTable(steps, report.Watches))
+	} else {
+		for _, s := range steps {
+			log.Info(stepName(s))
+		}
+	}
+
+	return steps, true, nil
+}
+
+// publishSteps generates and uploads the pipeline of the matched steps, then
+// triggers, notifies and waits for the triggered builds
+func publishSteps(plugin Plugin, steps []Step, generatePipeline PipelineGenerator, timer *Timer) (string, []string, error) {
+	if plugin.Format == formatGenericJSON {
+		return "", []string{}, printGenericJSON(steps)
+	}
+
+	if plugin.Output == outputGitHubActions {
+		return "", []string{}, writeActionsOutputs(steps)
+	}
+
+	steps, crossOrg := splitCrossOrgTriggers(steps)
+	plugin.Hooks = resolveHookDependencies(steps, plugin.Hooks)
+	steps = staggerSteps(steps, plugin)
+
+	if plugin.Output == outputStdout {
+		return "", []string{}, printPipeline(plugin, steps, crossOrg, timer)
+	}
+
+	first, batches := staggerBatches(steps, plugin)
+
+	cmd, args, err := uploadSteps(plugin, first, generatePipeline, timer)
+	if err != nil {
+		return cmd, args, err
+	}
+
+	if len(batches) > 0 {
+		start := time.Now()
+		if err := uploadBatches(plugin, batches, generatePipeline); err != nil {
+			return cmd, args, err
+		}
+		timer.track("stagger", start)
+	}
+
+	if len(crossOrg) > 0 {
+		logGroup(":buildkite: Triggering %d %s in other organizations", len(crossOrg), pluralize(len(crossOrg), "pipeline"))
+		start := time.Now()
+		if err := triggerCrossOrg(crossOrg); err != nil {
+			return cmd, args, err
+		}
+		timer.track("cross_org", start)
+	}
+
+	triggered := append(append([]Step{}, steps...), crossOrg...)
+
+	if plugin.GithubStatus {
+		postCommitStatuses(triggered)
+	}
+
+	if plugin.SlackWebhook != "" {
+		notifySlack(plugin, triggered)
+	}
+
+	if hooks := hooksInPhase(plugin.Hooks, hookPhasePostUpload); len(hooks) > 0 {
+		start := time.Now()
+		if err := runHooks(hooks, hookPhasePostUpload, plugin.Shell); err != nil {
+			return cmd, args, err
+		}
+		timer.track(hookPhasePostUpload, start)
+	}
+
+	if plugin.WaitForResults {
+		logGroup(":hourglass: Waiting for triggered builds")
+		start := time.Now()
+		if err := waitForResults(plugin, steps); err != nil {
+			return cmd, args, err
+		}
+		timer.track("results", start)
+	}
+
+	return cmd, args, nil
+}
+
+// uploadBatches uploads the batches `stagger` apart, without the hooks and the
+// wait of the pipeline uploaded before them
+func uploadBatches(plugin Plugin, batches [][]Step, generatePipeline PipelineGenerator) error {
+	part := plugin
+	part.Hooks = nil
+	part.Wait = false
+	part.Replace = false
+
+	for i, batch := range batches {
+		logGroup(":hourglass: Uploading batch %d of %d in %s", i+2, len(batches)+1, plugin.Stagger)
+		sleep(plugin.Stagger)
+
+		if cancelled() {
+			return fmt.Errorf("cancelled before uploading batch %d of %d", i+2, len(batches)+1)
+		}
+
+		if _, _, err := uploadSteps(part, batch, generatePipeline, &Timer{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// uploadSteps generates the pipeline of the steps and uploads it, split into
+// chunks within the Buildkite limits
+func uploadSteps(plugin Plugin, steps []Step, generatePipeline PipelineGenerator, timer *Timer) (string, []string, error) {
+	logGroup(":yaml: Generating pipeline")
+	start := time.Now()
+	chunks := chunkSteps(steps, plugin.MaxStepsPerUpload, maxUploadSize)
+	files := make([]*os.File, len(chunks))
+
+	for i, chunk := range chunks {
+		part := plugin
+
+		part.Hooks = chunkHooks(plugin.Hooks, i, len(chunks))
+
+		// wait belongs after all the generated steps
+		if i < len(chunks)-1 {
+			part.Wait = false
+		}
+
+		pipeline, err := generatePipeline(chunk, part)
+		if err != nil {
+			log.Error(err)
+			return "", []string{}, err
+		}
+
+		defer os.Remove(pipeline.Name())
+		files[i] = pipeline
+	}
+	timer.track("generate", start)
+
+	if len(chunks) > 1 {
+		log.Infof("Pipeline split into %d uploads", len(chunks))
+	}
+
+	cmd := agentBinary(plugin)
+	var args []string
+
+	logGroup(":buildkite: Uploading pipeline")
+	start = time.Now()
+
+	// every upload is inserted directly after the current step, so the chunks
+	// are uploaded last to first to keep the generated order in the build
+	for i := len(files) - 1; i >= 0; i-- {
+		first := i == len(files)-1
+		args = uploadArgs(plugin, files[i].Name(), first)
+		uuid := newUUID()
+
+		err := retry(plugin.UploadRetries, plugin.UploadRetryBackoff, func() error {
+			if plugin.UploadMethod == "api" {
+				return uploadPipelineAPI(files[i].Name(), uuid, plugin.Replace && first, !plugin.Interpolation)
+			}
+
+			_, err := executeCommand(cmd, args)
+			return err
+		})
+
+		if err != nil {
+			return cmd, args, categorize(uploadCategory, fmt.Errorf("pipeline upload failed: %v", err))
+		}
 	}
+	timer.track("upload", start)
+
+	return cmd, args, nil
+}
+
+// agentBinary returns the configured buildkite-agent binary
+func agentBinary(plugin Plugin) string {
+	if plugin.AgentBinary == "" {
+		return "buildkite-agent"
+	}
+
+	return plugin.AgentBinary
+}
 
-	cmd := "buildkite-agent"
-	args := []string{"pipeline", "upload", pipeline.Name()}
+// uploadArgs returns the `buildkite-agent` arguments to upload the pipeline file.
+// `--replace` is only passed to the first upload, otherwise each chunk would
+// replace the chunks uploaded before it.
+func uploadArgs(plugin Plugin, file string, first bool) []string {
+	args := append([]string{}, plugin.AgentArgs...)
+	args = append(args, "pipeline", "upload", file)
 
 	if plugin.Interpolation {
 		args = append(args, "--no-interpolation")
 	}
 
-	executeCommand("buildkite-agent", args)
+	if plugin.Replace && first {
+		args = append(args, "--replace")
+	}
 
-	return cmd, args, nil
+	return append(args, plugin.UploadArgs...)
+}
+
+// chunkSteps splits the steps into chunks that respect the Buildkite limits on
+// the number of steps and the size of a single pipeline upload.
+func chunkSteps(steps []Step, maxSteps int, maxBytes int) [][]Step {
+	chunks := [][]Step{}
+	current := []Step{}
+	size := 0
+
+	for _, step := range steps {
+		data, _ := yaml.Marshal(&step)
+
+		full := (maxSteps > 0 && len(current) >= maxSteps) ||
+			(maxBytes > 0 && size+len(data) > maxBytes)
+
+		if full && len(current) > 0 {
+			chunks = append(chunks, current)
+			current = []Step{}
+			size = 0
+		}
+
+		current = append(current, step)
+		size += len(data)
+	}
+
+	return append(chunks, current)
+}
+
+// stepName returns a short description of the step for logging
+func stepName(step Step) string {
+	if step.WatchLabel != "" {
+		plain := step
+		plain.WatchLabel = ""
+		return fmt.Sprintf("%s (%s)", step.WatchLabel, stepName(plain))
+	}
+
+	if step.Wait {
+		return "wait"
+	}
+
+	if step.Raw != nil {
+		return "merged: " + rawStepName(step.Raw)
+	}
+
+	if step.Trigger != "" {
+		return "trigger: " + step.Trigger
+	}
+
+	if step.Label != "" {
+		return "label: " + step.Label
+	}
+
+	return "command: " + step.Command
 }
 
 func diff(command string) ([]string, error) {
-	log.Infof("Running diff command: %s", command)
+	files := []string{}
+
+	_, err := streamDiff(Plugin{Diff: command}, func(chunk []string) bool {
+		files = append(files, chunk...)
+		return true
+	})
 
-	split := strings.Split(command, " ")
-	cmd, args := split[0], split[1:]
+	return files, err
+}
 
-	output, err := executeCommand(cmd, args)
+// diffCommand returns the command running the diff. Diff arguments are executed
+// directly. Otherwise, without a configured shell, the diff command is split on
+// spaces and executed directly.
+func diffCommand(plugin Plugin) *exec.Cmd {
+	if len(plugin.DiffArgs) > 0 {
+		return exec.CommandContext(jobContext, plugin.DiffArgs[0], plugin.DiffArgs[1:]...)
+	}
+
+	if plugin.Shell == nil {
+		split := strings.Split(plugin.Diff, " ")
+		return exec.CommandContext(jobContext, split[0], split[1:]...)
+	}
+
+	return shellCommand(plugin.Shell, plugin.Diff)
+}
+
+// streamDiff runs the diff command and passes the changed files to fn in chunks
+// as they are read, without buffering the whole output. Reading stops and the
+// command is killed as soon as fn returns false. It returns the number of files read.
+func streamDiff(plugin Plugin, fn func(files []string) bool) (int, error) {
+	log.Infof("Running diff command: %s", plugin.Diff)
+
+	cmd := diffCommand(plugin)
+	name, args := cmd.Args[0], cmd.Args[1:]
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return nil, fmt.Errorf("diff command failed: %v", err)
+		return 0, fmt.Errorf("diff command failed: %v", err)
 	}
 
-	f := func(c rune) bool {
-		return c == '\n'
+	p, err := startProcess(cmd)
+	if err != nil {
+		return 0, fmt.Errorf("diff command failed: command `%s` failed: %v", name, err)
 	}
 
-	return strings.FieldsFunc(strings.TrimSpace(output), f), nil
+	count, stopped, scanErr := streamLines(stdout, fn)
+
+	if stopped {
+		log.Debugf("Stopped reading diff output after %d files", count)
+		p.kill()
+	}
+
+	if err := p.wait(); err != nil && !stopped {
+		log.Debugf(
+			"\ncommand = '%s', \nargs = '%s', \nerror = '%s'",
+			name, args, stderr.String(),
+		)
+
+		return count, &diffError{
+			err:    fmt.Errorf("diff command failed: command `%s` failed: %v", name, err),
+			stderr: stderr.String(),
+		}
+	}
+
+	if scanErr != nil && !stopped {
+		return count, fmt.Errorf("diff command failed: %v", scanErr)
+	}
+
+	return count, nil
 }
 
-func stepsToTrigger(files []string, watch []WatchConfig) ([]Step, error) {
-	steps := []Step{}
+// streamLines passes the non-empty lines of r to fn in chunks, until fn
+// returns false. It returns the number of lines read and whether fn stopped
+// the reading.
+func streamLines(r io.Reader, fn func(files []string) bool) (int, bool, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
 
-	for _, w := range watch {
-		for _, p := range w.Paths {
-			for _, f := range files {
-				match, err := matchPath(p, f)
-				if err != nil {
-					return nil, err
-				}
-				if match {
-					steps = append(steps, w.Step)
-					break
-				}
+	count := 0
+	chunk := make([]string, 0, matchChunkSize)
+
+	for scanner.Scan() {
+		line := normalizePath(strings.TrimSpace(scanner.Text()))
+		if line == "" {
+			continue
+		}
+
+		chunk = append(chunk, line)
+		count++
+
+		if len(chunk) == matchChunkSize {
+			if !fn(chunk) {
+				return count, true, nil
 			}
+			chunk = make([]string, 0, matchChunkSize)
 		}
 	}
 
-	return dedupSteps(steps), nil
+	if len(chunk) > 0 {
+		fn(chunk)
+	}
+
+	return count, false, scanner.Err()
 }
 
-// matchPath checks if the file f matches the path p.
-func matchPath(p string, f string) (bool, error) {
-	// If the path contains a glob, the `doublestar.Match`
-	// method is used to determine the match,
-	// otherwise `strings.HasPrefix` is used.
-	if strings.Contains(p, "*") {
-		match, err := doublestar.Match(p, f)
+// diffAndMatch streams the diff output into the match engine, stopping the
+// diff early once every watch has matched. It returns the number of changed
+// files read, whether the diff was stopped early so the count is partial, and
+// the matched watches, with their matched files when they are needed.
+// The kept files spill to disk beyond the memory budget while the diff is read.
+func diffAndMatch(plugin Plugin) (int, bool, []string, []WatchConfig, error) {
+	budget := newMemoryBudget(plugin.MemoryBudget)
+	defer budget.close()
+
+	collect := collectedWatches(plugin)
+	engine := newMatchEngine(plugin.Watch, matchWorkers, collect, budget)
+	debug := log.IsLevelEnabled(log.DebugLevel)
+	// the changed files are only kept when they are logged or reported
+	keep := debug || plugin.RoutingReport != "" || plugin.ReportUnmatched != "" || plugin.DebugBundle || hasCommandMatchers(plugin.Watch)
+	kept := budget.list()
+	changed := newChangedFiles(plugin)
+	var ignoreErr error
+	count := 0
+	stopped := false
+
+	provider, err := newDiffProvider(plugin)
+	if err != nil {
+		return 0, false, nil, nil, err
+	}
+
+	_, err = provider.Stream(func(files []string) bool {
+		var statuses map[string]string
+		files = splitStatuses(files, func(f string, status string) {
+			if !engine.usesStatuses() {
+				return
+			}
+			if statuses == nil {
+				statuses = map[string]string{}
+			}
+			statuses[cleanFile(f)] = status
+		})
+		files = changed.add(files)
+
+		if plugin.UseIgnoreFiles {
+			files, ignoreErr = filterIgnored(files)
+			if ignoreErr != nil {
+				return false
+			}
+		}
+
+		count += len(files)
+
+		if keep {
+			kept.add(files...)
+		}
+
+		engine.feedStatuses(files, statuses)
+		stopped = engine.complete()
+
+		return !stopped
+	})
+
+	matched, matchErr := engine.wait()
+
+	if err != nil {
+		return count, stopped, nil, nil, err
+	}
+
+	if ignoreErr != nil {
+		return count, stopped, nil, nil, ignoreErr
+	}
+
+	if matchErr != nil {
+		return count, stopped, nil, nil, matchErr
+	}
+
+	// the changed files are streamed from the spilled files, they are only
+	// read into memory for the reports listing them
+	var output []string
+	if plugin.RoutingReport != "" || plugin.ReportUnmatched != "" || plugin.DebugBundle {
+		if output, err = kept.all(); err != nil {
+			return count, stopped, nil, nil, err
+		}
+	}
+
+	if debug && count > 0 {
+		log.Debug("Output from diff:")
+		if err := kept.each(func(f string) bool { log.Debug(f); return true }); err != nil {
+			return count, stopped, nil, nil, err
+		}
+	}
+
+	watch := plugin.Watch
+
+	if engine.collecting {
+		watch = append([]WatchConfig{}, plugin.Watch...)
+		matchedFiles, err := engine.matchedFiles()
 		if err != nil {
-			return false, fmt.Errorf("path matching failed: %v", err)
+			return count, stopped, nil, nil, err
 		}
-		if match {
-			return true, nil
+
+		for i, files := range matchedFiles {
+			if collect[i] {
+				watch[i].Files = files
+			}
 		}
 	}
-	if strings.HasPrefix(f, p) {
-		return true, nil
+
+	watch, err = matchCommands(plugin, watch, matched, kept.each)
+	if err != nil {
+		return count, stopped, nil, nil, err
+	}
+
+	return count, stopped, output, matchedWatches(watch, matched), nil
+}
+
+func stepsToTrigger(files []string, watch []WatchConfig) ([]Step, error) {
+	matched, err := matchWatches(files, watch)
+	if err != nil {
+		return nil, err
+	}
+
+	return watchSteps(matchedWatches(watch, matched)), nil
+}
+
+// diffWatches runs the diff and returns the number of changed files and the
+// watches they matched, or the watches triggered by an empty diff
+func diffWatches(plugin Plugin, timer *Timer, report *routingReport) (int, []WatchConfig, error) {
+	logGroup(":git: Computing diff and matching %d watches", len(plugin.Watch))
+	start := time.Now()
+	count, partial, changed, watches, err := retryDiffAndMatch(plugin)
+	timer.track("diff", start)
+	if err != nil {
+		if cancelled() {
+			return count, nil, err
+		}
+		return count, nil, categorize(diffCategory, err)
+	}
+	report.partial = partial
+
+	if plugin.RoutingReport != "" || plugin.DebugBundle {
+		report.ChangedFiles = changed
+	}
+	if plugin.RoutingReport != "" {
+		report.UnmatchedFiles = unmatchedFiles(changed, watches)
+	}
+
+	if count < 1 {
+		watches = emptyDiffWatches(plugin)
+		if len(watches) > 0 {
+			log.Infof("The diff is empty, triggering %d %s watches", len(watches), plugin.OnEmptyDiff)
+		}
+	}
+
+	if plugin.ReportUnmatched != "" && count > 0 {
+		reportUnmatched(plugin, changed, watches)
+	}
+
+	if count > 0 && hasMinChangedLines(watches) {
+		watches, err = applyMinChangedLines(plugin, watches)
+		if err != nil {
+			return count, nil, err
+		}
+	}
+
+	return count, watches, nil
+}
+
+// emptyDiffWatches returns the watches triggered when the diff is empty:
+// every watch with `on_empty_diff: all`, the `default` ones with
+// `on_empty_diff: default` and none otherwise
+func emptyDiffWatches(plugin Plugin) []WatchConfig {
+	watches := []WatchConfig{}
+
+	for _, w := range plugin.Watch {
+		if plugin.OnEmptyDiff == "all" || plugin.OnEmptyDiff == "default" && w.Default {
+			watches = append(watches, w)
+		}
+	}
+
+	return watches
+}
+
+// matchedWatches returns the watches that matched
+func matchedWatches(watch []WatchConfig, matched []bool) []WatchConfig {
+	result := []WatchConfig{}
+
+	for i, w := range watch {
+		if matched[i] {
+			result = append(result, w)
+		}
+	}
+
+	return result
+}
+
+// watchSteps returns the deduplicated steps of the watches
+func watchSteps(watch []WatchConfig) []Step {
+	steps := []Step{}
+
+	for _, w := range watch {
+		steps = append(steps, w.Step)
+	}
+
+	return dedupSteps(steps)
+}
+
+// dedupHooks removes the hooks that are repeated by several invocations
+func dedupHooks(hooks []HookConfig) []HookConfig {
+	unique := []HookConfig{}
+	for _, h := range hooks {
+		duplicate := false
+		for _, u := range unique {
+			if reflect.DeepEqual(h, u) {
+				duplicate = true
+				break
+			}
+		}
+
+		if !duplicate {
+			unique = append(unique, h)
+		}
 	}
-	return false, nil
+
+	return unique
 }
 
+// dedupSteps removes the steps generated by several watches. Merged steps are
+// kept as they are, their repeated `wait` steps are part of their pipeline.
 func dedupSteps(steps []Step) []Step {
 	unique := []Step{}
 	for _, p := range steps {
+		if p.Raw != nil {
+			unique = append(unique, p)
+			continue
+		}
+
 		duplicate := false
 		for _, t := range unique {
 			if reflect.DeepEqual(p, t) {
@@ -138,34 +993,95 @@ func dedupSteps(steps []Step) []Step {
 }
 
 func generatePipeline(steps []Step, plugin Plugin) (*os.File, error) {
-	tmp, err := ioutil.TempFile(os.TempDir(), "bmrd-")
-	pipeline := Pipeline{Steps: steps}
+	data, err := marshalPipeline(steps, plugin)
+	if err != nil {
+		return nil, err
+	}
+
+	// Disable logging in context of go tests.
+	if env("TEST_MODE", "") != "true" {
+		fmt.Printf("Generated Pipeline:\n%s\n", secrets.redact(string(data)))
+	}
 
+	// every upload gets a file of its own, so concurrent jobs on the same
+	// agent host can't overwrite each other's pipeline
+	tmp, err := ioutil.TempFile(os.TempDir(), pipelineFilePattern())
 	if err != nil {
 		return nil, fmt.Errorf("could not create temporary pipeline file: %v", err)
 	}
 
-	data, err := yaml.Marshal(&pipeline)
+	// the file is written by name, and Windows can't remove files that are still open
+	tmp.Close()
+
+	if err = ioutil.WriteFile(tmp.Name(), data, 0644); err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("could not write step to temporary file: %v", err)
+	}
+
+	return tmp, nil
+}
+
+// printPipeline writes the pipeline of the steps to pipelineOutput, for the
+// command step to upload it. The step uploads it after the plugin is done,
+// so nothing that needs the uploaded steps can be done.
+func printPipeline(plugin Plugin, steps []Step, crossOrg []Step, timer *Timer) error {
+	if len(crossOrg) > 0 {
+		return fmt.Errorf("triggers of other organizations can't be printed with output `stdout`")
+	}
+
+	logGroup(":yaml: Printing pipeline")
+	start := time.Now()
+
+	data, err := marshalPipeline(steps, plugin)
 	if err != nil {
-		return nil, fmt.Errorf("could not serialize the pipeline: %v", err)
+		return err
 	}
 
-	if plugin.Wait {
-		data = append(data, "- wait"...)
+	if _, err := pipelineOutput.Write(data); err != nil {
+		return fmt.Errorf("could not print the pipeline: %v", err)
 	}
+	timer.track("generate", start)
+
+	return nil
+}
 
-	for _, cmd := range plugin.Hooks {
-		data = append(data, "\n- command: "+cmd.Command...)
+// marshalPipeline returns the YAML of the pipeline of the steps, with the hooks
+// and wait step of the plugin
+func marshalPipeline(steps []Step, plugin Plugin) ([]byte, error) {
+	pipeline := []Step{}
+
+	if before := hooksInPhase(plugin.Hooks, hookPhaseBefore); len(before) > 0 {
+		// setup hooks need to finish before the generated steps start
+		pipeline = append(pipeline, hookSteps(before)...)
+		pipeline = append(pipeline, Step{Wait: true})
 	}
 
-	// Disable logging in context of go tests.
-	if env("TEST_MODE", "") != "true" {
-		fmt.Printf("Generated Pipeline:\n%s\n", string(data))
+	pipeline = append(pipeline, steps...)
+
+	if plugin.Wait {
+		pipeline = append(pipeline, Step{Wait: true, WaitAttributes: plugin.WaitAttributes})
 	}
 
-	if err = ioutil.WriteFile(tmp.Name(), data, 0644); err != nil {
-		return nil, fmt.Errorf("could not write step to temporary file: %v", err)
+	pipeline = append(pipeline, hookSteps(hooksInPhase(plugin.Hooks, hookPhaseAfter))...)
+
+	data, err := yaml.Marshal(pipelineDefinition{
+		Env:    plugin.PipelineEnv,
+		Agents: plugin.PipelineAgents,
+		Steps:  pipeline,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not serialize the pipeline: %v", err)
 	}
 
-	return tmp, nil
+	return data, nil
+}
+
+// pipelineFilePattern names the generated pipeline files after the job, so
+// leftovers of a killed job can be traced back to it
+func pipelineFilePattern() string {
+	if job := env("BUILDKITE_JOB_ID", ""); job != "" {
+		return "monorepo-diff-" + job + "-*.yml"
+	}
+
+	return "monorepo-diff-*.yml"
 }
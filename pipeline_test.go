@@ -1,17 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
 )
 
 func TestMain(m *testing.M) {
 	// disable logs in test
 	log.SetOutput(ioutil.Discard)
+	logWriter = ioutil.Discard
 
 	// set some env variables for using in tests
 	os.Setenv("BUILDKITE_COMMIT", "123")
@@ -21,8 +26,16 @@ func TestMain(m *testing.M) {
 	os.Setenv("env4", "env-4")
 	os.Setenv("TEST_MODE", "true")
 
+	// stub buildkite-agent so that pipeline uploads succeed
+	bin, _ := ioutil.TempDir("", "bin")
+	_ = ioutil.WriteFile(filepath.Join(bin, "buildkite-agent"), []byte("#!/bin/sh\nexit 0\n"), 0755)
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	sleep = func(time.Duration) {}
+
 	run := m.Run()
 
+	os.RemoveAll(bin)
 	os.Exit(run)
 }
 
@@ -51,6 +64,51 @@ func TestUploadPipelineCallsBuildkiteAgentCommandWithInterpolation(t *testing.T)
 	assert.Equal(t, err, nil)
 }
 
+func TestUploadPipelineCallsBuildkiteAgentCommandWithReplace(t *testing.T) {
+	plugin := Plugin{Diff: "echo ./foo-service", Replace: true, UploadArgs: []string{"--job", "job-id"}}
+	cmd, args, err := uploadPipeline(plugin, mockGeneratePipeline)
+
+	assert.Equal(t, "buildkite-agent", cmd)
+	assert.Equal(t, []string{"pipeline", "upload", "pipeline.txt", "--replace", "--job", "job-id"}, args)
+	assert.Equal(t, err, nil)
+}
+
+func TestUploadPipelineFailsWhenUploadFails(t *testing.T) {
+	plugin := Plugin{Diff: "echo ./foo-service", UploadRetries: 2}
+
+	bin, _ := ioutil.TempDir("", "bin")
+	defer os.RemoveAll(bin)
+	_ = ioutil.WriteFile(filepath.Join(bin, "buildkite-agent"), []byte("#!/bin/sh\nexit 1\n"), 0755)
+
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	_, _, err := uploadPipeline(plugin, mockGeneratePipeline)
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "pipeline upload failed: command `buildkite-agent` failed")
+}
+
+func TestUploadPipelineWithCustomAgentBinary(t *testing.T) {
+	plugin := Plugin{
+		Diff:        "echo ./foo-service",
+		AgentBinary: "env",
+		AgentArgs:   []string{"BUILDKITE_AGENT_ENDPOINT=http://localhost", "buildkite-agent"},
+	}
+	cmd, args, err := uploadPipeline(plugin, mockGeneratePipeline)
+
+	assert.Equal(t, "env", cmd)
+	assert.Equal(t, []string{"BUILDKITE_AGENT_ENDPOINT=http://localhost", "buildkite-agent", "pipeline", "upload", "pipeline.txt"}, args)
+	assert.NoError(t, err)
+}
+
+func TestUploadArgsOnlyReplacesOnFirstUpload(t *testing.T) {
+	plugin := Plugin{Replace: true}
+
+	assert.Equal(t, []string{"pipeline", "upload", "a.yml", "--replace"}, uploadArgs(plugin, "a.yml", true))
+	assert.Equal(t, []string{"pipeline", "upload", "b.yml"}, uploadArgs(plugin, "b.yml", false))
+}
+
 func TestUploadPipelineCancelsIfThereIsNoDiffOutput(t *testing.T) {
 	plugin := Plugin{Diff: "echo"}
 	cmd, args, err := uploadPipeline(plugin, mockGeneratePipeline)
@@ -60,6 +118,118 @@ func TestUploadPipelineCancelsIfThereIsNoDiffOutput(t *testing.T) {
 	assert.Equal(t, err, nil)
 }
 
+func TestUploadPipelinePrintsToStdout(t *testing.T) {
+	var out bytes.Buffer
+	pipelineOutput = &out
+	defer func() { pipelineOutput = os.Stdout }()
+
+	plugin := Plugin{
+		Diff:   "echo services/foo/main.go",
+		Output: "stdout",
+		Watch:  []WatchConfig{{Paths: []string{"services/foo/"}, Step: Step{Trigger: "foo"}}},
+	}
+
+	generator := func(steps []Step, plugin Plugin) (*os.File, error) {
+		t.Fatal("the pipeline shouldn't be written to a file")
+		return nil, nil
+	}
+
+	cmd, args, err := uploadPipeline(plugin, generator)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "", cmd)
+	assert.Equal(t, []string{}, args)
+	assert.Equal(t, "steps:\n- trigger: foo\n", out.String())
+}
+
+func TestUploadPipelineCantPrintCrossOrgTriggers(t *testing.T) {
+	pipelineOutput = ioutil.Discard
+	defer func() { pipelineOutput = os.Stdout }()
+
+	plugin := Plugin{
+		Diff:   "echo services/foo/main.go",
+		Output: "stdout",
+		Watch:  []WatchConfig{{Paths: []string{"services/foo/"}, Step: Step{Trigger: "foo", Organization: "other"}}},
+	}
+
+	_, _, err := uploadPipeline(plugin, mockGeneratePipeline)
+
+	assert.EqualError(t, err, "triggers of other organizations can't be printed with output `stdout`")
+}
+
+func TestUploadPipelineOnEmptyDiff(t *testing.T) {
+	watches := []WatchConfig{
+		{Paths: []string{"services/foo/"}, Step: Step{Trigger: "foo"}, Default: true},
+		{Paths: []string{"services/bar/"}, Step: Step{Trigger: "bar"}},
+	}
+
+	testCases := map[string]struct {
+		onEmptyDiff string
+		expected    []Step
+	}{
+		"none":    {"none", nil},
+		"default": {"default", []Step{{Trigger: "foo"}}},
+		"all":     {"all", []Step{{Trigger: "foo"}, {Trigger: "bar"}}},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var generated []Step
+			generator := func(steps []Step, plugin Plugin) (*os.File, error) {
+				generated = steps
+				return mockGeneratePipeline(steps, plugin)
+			}
+
+			plugin := Plugin{Diff: "echo", OnEmptyDiff: tc.onEmptyDiff, Watch: watches}
+			_, _, err := uploadPipeline(plugin, generator)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, generated)
+		})
+	}
+}
+
+func TestUploadPipelineSplitsLargePipelines(t *testing.T) {
+	var generated [][]Step
+	var hooks [][]HookConfig
+
+	generator := func(steps []Step, plugin Plugin) (*os.File, error) {
+		generated = append(generated, steps)
+		hooks = append(hooks, plugin.Hooks)
+		return mockGeneratePipeline(steps, plugin)
+	}
+
+	plugin := Plugin{
+		Diff:              "echo foo-service/",
+		MaxStepsPerUpload: 2,
+		Hooks:             []HookConfig{{Step: Step{Command: "echo done"}}},
+		Watch: []WatchConfig{
+			{Paths: []string{"foo-service/"}, Step: Step{Trigger: "foo-1"}},
+			{Paths: []string{"foo-service/"}, Step: Step{Trigger: "foo-2"}},
+			{Paths: []string{"foo-service/"}, Step: Step{Trigger: "foo-3"}},
+		},
+	}
+
+	_, _, err := uploadPipeline(plugin, generator)
+
+	assert.NoError(t, err)
+	assert.Equal(t, [][]Step{
+		{{Trigger: "foo-1"}, {Trigger: "foo-2"}},
+		{{Trigger: "foo-3"}},
+	}, generated)
+	assert.Equal(t, [][]HookConfig{{}, {{Step: Step{Command: "echo done"}}}}, hooks)
+}
+
+func TestChunkSteps(t *testing.T) {
+	steps := []Step{{Trigger: "a"}, {Trigger: "b"}, {Trigger: "c"}}
+
+	assert.Equal(t, [][]Step{{}}, chunkSteps([]Step{}, 2, 0))
+	assert.Equal(t, [][]Step{steps}, chunkSteps(steps, 0, 0))
+	assert.Equal(t, [][]Step{{{Trigger: "a"}, {Trigger: "b"}}, {{Trigger: "c"}}}, chunkSteps(steps, 2, 0))
+	// each step serializes to "trigger: x\n", 11 bytes
+	assert.Equal(t, [][]Step{{{Trigger: "a"}}, {{Trigger: "b"}}, {{Trigger: "c"}}}, chunkSteps(steps, 0, 20))
+}
+
 func TestDiff(t *testing.T) {
 	want := []string{
 		"services/foo/serverless.yml",
@@ -78,6 +248,121 @@ README.md`)
 	assert.Equal(t, want, got)
 }
 
+func TestStreamDiffStopsEarly(t *testing.T) {
+	chunks := 0
+
+	// `yes` never terminates on its own, so the stream must be stopped
+	count, err := streamDiff(Plugin{Diff: "yes services/foo/main.go"}, func(files []string) bool {
+		chunks++
+		return chunks < 3
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, chunks)
+	assert.Equal(t, 3*matchChunkSize, count)
+}
+
+func TestStreamDiffStopsEarlyWithShell(t *testing.T) {
+	start := time.Now()
+
+	// the diff started by the shell is stopped with it
+	count, err := streamDiff(Plugin{Diff: "yes services/foo/main.go; sleep 10", Shell: []string{"sh", "-c"}}, func(files []string) bool {
+		return false
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, matchChunkSize, count)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestStreamDiffWithShell(t *testing.T) {
+	files := []string{}
+
+	_, err := streamDiff(Plugin{Diff: "printf 'a.go\\nb.go\\n' | grep b", Shell: []string{"sh", "-c"}}, func(chunk []string) bool {
+		files = append(files, chunk...)
+		return true
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b.go"}, files)
+}
+
+func TestStreamDiffWithArgs(t *testing.T) {
+	files := []string{}
+
+	// the argument is passed as is, without splitting or shell interpolation
+	_, err := streamDiff(Plugin{DiffArgs: []string{"echo", "$(services) foo/main.go"}}, func(chunk []string) bool {
+		files = append(files, chunk...)
+		return true
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"$(services) foo/main.go"}, files)
+}
+
+func TestStreamDiffFailure(t *testing.T) {
+	_, err := streamDiff(Plugin{Diff: "false"}, func(files []string) bool { return true })
+
+	assert.EqualError(t, err, "diff command failed: command `false` failed: exit status 1")
+}
+
+func TestDiffAndMatch(t *testing.T) {
+	plugin := Plugin{
+		Diff: "yes services/foo/main.go",
+		Watch: []WatchConfig{
+			{Paths: []string{"services/foo/"}, Step: Step{Trigger: "foo"}},
+		},
+	}
+
+	count, partial, _, watches, err := diffAndMatch(plugin)
+
+	assert.NoError(t, err)
+	assert.True(t, count > 0)
+	assert.True(t, partial)
+	assert.Equal(t, plugin.Watch, watches)
+}
+
+func TestDiffAndMatchCollectsFiles(t *testing.T) {
+	plugin := Plugin{
+		Diff:      "printf services/foo/main.go\\nservices/bar/main.go\\nservices/foo/go.mod\\n",
+		Templates: true,
+		Watch: []WatchConfig{
+			{Paths: []string{"services/foo/", "**/*.go"}, Step: Step{Trigger: "foo"}},
+			{Paths: []string{"services/baz/"}, Step: Step{Trigger: "baz"}},
+		},
+	}
+
+	_, partial, _, watches, err := diffAndMatch(plugin)
+
+	assert.NoError(t, err)
+	assert.False(t, partial)
+	assert.Equal(t, []WatchConfig{{
+		Paths: []string{"services/foo/", "**/*.go"},
+		Step:  Step{Trigger: "foo"},
+		Files: []string{"services/bar/main.go", "services/foo/go.mod", "services/foo/main.go"},
+	}}, watches)
+	assert.Nil(t, plugin.Watch[0].Files)
+}
+
+func TestStepName(t *testing.T) {
+	testCases := map[string]struct {
+		step     Step
+		expected string
+	}{
+		"wait":    {Step{Wait: true}, "wait"},
+		"trigger": {Step{Trigger: "foo", Label: "Foo"}, "trigger: foo"},
+		"label":   {Step{Label: "Foo", Command: "make"}, "label: Foo"},
+		"command": {Step{Command: "make"}, "command: make"},
+		"watch":   {Step{Trigger: "foo", WatchLabel: "Foo service"}, "Foo service (trigger: foo)"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, stepName(tc.step))
+		})
+	}
+}
+
 func TestPipelinesToTriggerGetsListOfPipelines(t *testing.T) {
 	want := []string{"service-1", "service-2", "service-4"}
 
@@ -254,13 +539,15 @@ func TestGeneratePipeline(t *testing.T) {
     message: build message
 - wait
 - command: echo "hello world"
-- command: cat ./file.txt`
+- command: cat ./file.txt
+`
 
 	plugin := Plugin{
 		Wait: true,
 		Hooks: []HookConfig{
-			{Command: "echo \"hello world\""},
-			{Command: "cat ./file.txt"},
+			{Step: Step{Command: "git fetch origin"}, Phase: "pre_diff"},
+			{Step: Step{Command: "echo \"hello world\""}},
+			{Step: Step{Command: "cat ./file.txt"}},
 		},
 	}
 
@@ -275,3 +562,220 @@ func TestGeneratePipeline(t *testing.T) {
 
 	assert.Equal(t, want, string(got))
 }
+
+func TestGeneratePipelineUsesUniqueFiles(t *testing.T) {
+	os.Setenv("BUILDKITE_JOB_ID", "job-1")
+	defer os.Unsetenv("BUILDKITE_JOB_ID")
+
+	steps := []Step{{Trigger: "foo-service-pipeline"}}
+
+	first, err := generatePipeline(steps, Plugin{})
+	assert.NoError(t, err)
+	defer os.Remove(first.Name())
+
+	second, err := generatePipeline(steps, Plugin{})
+	assert.NoError(t, err)
+	defer os.Remove(second.Name())
+
+	assert.NotEqual(t, first.Name(), second.Name())
+	assert.Regexp(t, `monorepo-diff-job-1-\d+\.yml$`, first.Name())
+}
+
+func TestGeneratePipelineWithNotify(t *testing.T) {
+	want :=
+		`steps:
+- command: make deploy
+  notify:
+  - slack: '#payments'
+`
+
+	steps := []Step{{Command: "make deploy", Notify: []interface{}{map[string]interface{}{"slack": "#payments"}}}}
+
+	pipeline, err := generatePipeline(steps, Plugin{})
+	assert.NoError(t, err)
+	defer os.Remove(pipeline.Name())
+
+	got, _ := ioutil.ReadFile(pipeline.Name())
+
+	assert.Equal(t, want, string(got))
+}
+
+func TestGeneratePipelineWithConcurrencyGroup(t *testing.T) {
+	want :=
+		`steps:
+- trigger: deploy-payments
+  concurrency_group: deploy-payments
+  concurrency: 1
+`
+
+	steps := []Step{{Trigger: "deploy-payments", ConcurrencyGroup: "deploy-payments", Concurrency: 1}}
+
+	pipeline, err := generatePipeline(steps, Plugin{})
+	assert.NoError(t, err)
+	defer os.Remove(pipeline.Name())
+
+	got, _ := ioutil.ReadFile(pipeline.Name())
+
+	assert.Equal(t, want, string(got))
+}
+
+func TestGeneratePipelineWithExtraAttributes(t *testing.T) {
+	want :=
+		`steps:
+- trigger: deploy
+  skip_queue: true
+  timeout_in_minutes: 10
+`
+
+	steps := []Step{{Trigger: "deploy", Extra: map[string]interface{}{"timeout_in_minutes": float64(10), "skip_queue": true}}}
+
+	pipeline, err := generatePipeline(steps, Plugin{})
+	assert.NoError(t, err)
+	defer os.Remove(pipeline.Name())
+
+	got, _ := ioutil.ReadFile(pipeline.Name())
+
+	assert.Equal(t, want, string(got))
+}
+
+func TestGeneratePipelineWithWaitAttributes(t *testing.T) {
+	want :=
+		`steps:
+- trigger: foo-service-pipeline
+- wait: null
+  continue_on_failure: true
+  label: Fan-in
+`
+
+	plugin := Plugin{
+		Wait:           true,
+		WaitAttributes: map[string]interface{}{"label": "Fan-in", "continue_on_failure": true},
+	}
+
+	pipeline, err := generatePipeline([]Step{{Trigger: "foo-service-pipeline"}}, plugin)
+	assert.NoError(t, err)
+	defer os.Remove(pipeline.Name())
+
+	got, _ := ioutil.ReadFile(pipeline.Name())
+
+	assert.Equal(t, want, string(got))
+}
+
+func TestGeneratePipelineEscapesValues(t *testing.T) {
+	steps := []Step{{
+		Trigger: "foo-service-pipeline",
+		Label:   ":rocket: deploy: \"foo\"",
+		Build: Build{
+			Message: "fix: handle 'quotes' # and colons\n\n- with a list",
+		},
+	}}
+
+	pipeline, err := generatePipeline(steps, Plugin{})
+	assert.NoError(t, err)
+	defer os.Remove(pipeline.Name())
+
+	data, _ := ioutil.ReadFile(pipeline.Name())
+
+	var got map[string][]Step
+	assert.NoError(t, yaml.Unmarshal(data, &got))
+	assert.Equal(t, steps, got["steps"])
+}
+
+func TestGeneratePipelineWithEnvAndAgents(t *testing.T) {
+	want :=
+		`env:
+  DEPLOY: "true"
+agents:
+  queue: deploy
+steps:
+- trigger: foo-service-pipeline
+`
+
+	plugin := Plugin{
+		PipelineEnv:    map[string]string{"DEPLOY": "true"},
+		PipelineAgents: map[string]string{"queue": "deploy"},
+	}
+
+	pipeline, err := generatePipeline([]Step{{Trigger: "foo-service-pipeline"}}, plugin)
+	assert.NoError(t, err)
+	defer os.Remove(pipeline.Name())
+
+	got, _ := ioutil.ReadFile(pipeline.Name())
+
+	assert.Equal(t, want, string(got))
+}
+
+func TestGeneratePipelineWithHookSteps(t *testing.T) {
+	steps := []Step{{Trigger: "foo-service-pipeline"}}
+
+	want :=
+		`steps:
+- trigger: foo-service-pipeline
+- wait
+- label: Aggregate reports
+  key: aggregate
+  command: ./aggregate-reports.sh
+  agents:
+    queue: reports
+  env:
+    FOO: bar
+  plugins:
+  - artifacts#v1.3.0:
+      download: reports/*
+`
+
+	plugin := Plugin{
+		Wait: true,
+		Hooks: []HookConfig{{
+			Step: Step{
+				Command: "./aggregate-reports.sh",
+				Label:   "Aggregate reports",
+				Key:     "aggregate",
+				Agents:  Agent{Queue: "reports"},
+				Env:     map[string]string{"FOO": "bar"},
+				Plugins: []interface{}{
+					map[string]interface{}{
+						"artifacts#v1.3.0": map[string]interface{}{"download": "reports/*"},
+					},
+				},
+			},
+		}},
+	}
+
+	pipeline, err := generatePipeline(steps, plugin)
+	assert.NoError(t, err)
+	defer os.Remove(pipeline.Name())
+
+	got, _ := ioutil.ReadFile(pipeline.Name())
+
+	assert.Equal(t, want, string(got))
+}
+
+func TestGeneratePipelineWithHooksBeforeSteps(t *testing.T) {
+	steps := []Step{{Trigger: "foo-service-pipeline"}}
+
+	want :=
+		`steps:
+- command: ./setup.sh
+- wait
+- trigger: foo-service-pipeline
+- wait
+- command: ./teardown.sh
+`
+
+	plugin := Plugin{
+		Wait: true,
+		Hooks: []HookConfig{
+			{Step: Step{Command: "./setup.sh"}, Phase: "before"},
+			{Step: Step{Command: "./teardown.sh"}},
+		},
+	}
+
+	pipeline, err := generatePipeline(steps, plugin)
+	assert.NoError(t, err)
+	defer os.Remove(pipeline.Name())
+
+	got, _ := ioutil.ReadFile(pipeline.Name())
+
+	assert.Equal(t, want, string(got))
+}
@@ -3,41 +3,269 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
 	"strings"
+	"time"
 
-	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
 )
 
 const pluginName = "github.com/chronotc/monorepo-diff"
 
 // Plugin buildkite monorepo diff plugin structure
 type Plugin struct {
-	Diff          string
-	Wait          bool
-	LogLevel      string `json:"log_level"`
+	// RawDiff is the diff command, or its arguments to execute it directly
+	RawDiff  interface{} `json:"diff"`
+	Diff     string
+	DiffArgs []string
+	// DiffProvider is the source of the changed files, one of `command`, `git`, `file` or `api`
+	DiffProvider string `json:"diff_provider"`
+	// RawExtends is a preset or a list of presets of the PresetRegistry, e.g. `org://standard-routing`,
+	// whose watches are added before the watches of the configuration
+	RawExtends     interface{} `json:"extends"`
+	Extends        []string
+	PresetRegistry string `json:"preset_registry"`
+	// ConfigSignature verifies the signatures of the presets and policy files before they are used
+	ConfigSignature *ConfigSignature `json:"config_signature"`
+	// DiffSources are several diff providers whose changed files are merged as DiffSourcesMerge, `union` or `intersection`
+	DiffSources      []string `json:"diff_sources"`
+	DiffSourcesMerge string   `json:"diff_sources_merge"`
+	// DiffBase is the ref the `git` provider compares with, and the base `stale_after` is measured from
+	DiffBase string `json:"diff_base"`
+	// DiffFile lists the changed files read by the `file` provider
+	DiffFile string `json:"diff_file"`
+	// Workdir is the directory the plugin runs from, before changing to the root of its git repository
+	Workdir string `json:"workdir"`
+	// RawWait is a boolean, or the attributes of the wait step added after the generated steps
+	RawWait        interface{} `json:"wait"`
+	Wait           bool
+	WaitAttributes map[string]interface{}
+	LogLevel       string `json:"log_level"`
+	// LogFormat is `text`, or `pretty` for colored output with aligned tables
+	LogFormat     string `json:"log_format"`
 	Interpolation bool
-	Hooks         []HookConfig
-	Watch         []WatchConfig
-	RawEnv        interface{} `json:"env"`
-	Env           map[string]string
+	Replace       bool
+	UploadArgs    []string `json:"upload_args"`
+	AgentBinary   string   `json:"agent_binary"`
+	AgentArgs     []string `json:"agent_args"`
+	UploadRetries int      `json:"upload_retries"`
+	// UploadMethod is `agent` to upload with buildkite-agent or `api` to use the agent API directly
+	UploadMethod string `json:"upload_method"`
+	// Format is `buildkite` to print the pipeline, or `generic-json` to print
+	// the matched pipelines, the reason and the files in a provider agnostic format
+	Format string `json:"format"`
+	// Output is `upload` to upload the pipeline, `stdout` to print it for `buildkite-agent pipeline upload`,
+	// or `github_actions` to write the matched steps as GitHub Actions outputs
+	Output string `json:"output"`
+	// RawUploadRetryBackoff is the initial delay between upload retries, e.g. "2s"
+	RawUploadRetryBackoff string `json:"upload_retry_backoff"`
+	UploadRetryBackoff    time.Duration
+	// RawOnSchedule is `all` or `watches:` with the names of the watches run by scheduled builds
+	RawOnSchedule interface{} `json:"on_schedule"`
+	OnSchedule    *ScheduleRun
+	// Numstat lists the changed lines of every file for `min_changed_lines`, e.g. "git diff --numstat HEAD~1"
+	Numstat string `json:"numstat"`
+	// UseIgnoreFiles skips the changed files ignored by .gitignore or .monorepo-diff-ignore
+	UseIgnoreFiles bool `json:"use_ignore_files"`
+	// OnEmptyDiff is `none`, `default` or `all`, the watches triggered when the diff is empty
+	OnEmptyDiff string `json:"on_empty_diff"`
+	// DiffRetries is the number of times a diff failing with a transient git error is retried
+	DiffRetries int `json:"diff_retries"`
+	// RawDiffRetryBackoff is the initial delay between diff retries, e.g. "2s"
+	RawDiffRetryBackoff string `json:"diff_retry_backoff"`
+	DiffRetryBackoff    time.Duration
+	// WaitForResults polls the builds started by trigger steps and fails the step based on ResultsPolicy
+	WaitForResults bool `json:"wait_for_results"`
+	// DedupeByContent skips triggers whose watched files haven't changed since their last passed build
+	DedupeByContent bool `json:"dedupe_by_content"`
+	// DedupeRunning is `skip` or `replace`, what to do when the triggered pipeline is already building the commit
+	DedupeRunning string `json:"dedupe_running"`
+	// ValidateTriggers checks the trigger pipelines exist with the Buildkite API before uploading
+	ValidateTriggers bool `json:"validate_triggers"`
+	// AllowedTriggers are the patterns of the pipelines that can be triggered, `<org>/<pipeline>` for other organizations.
+	// AllowedTriggersPolicy is a file listing more of them, shared by the repositories of an organization.
+	AllowedTriggers       []string `json:"allowed_triggers"`
+	AllowedTriggersPolicy string   `json:"allowed_triggers_policy"`
+	// ValidateTriggerPermissions also checks the creator of the build can build the trigger pipelines
+	ValidateTriggerPermissions bool `json:"validate_trigger_permissions"`
+	// GithubStatus sets a GitHub commit status for every triggered pipeline
+	GithubStatus bool `json:"github_status"`
+	// SlackWebhook is a Slack incoming webhook notified of the triggered pipelines
+	SlackWebhook string `json:"slack_webhook"`
+	// LabelOverrides forces or skips watches based on the labels of the pull request
+	LabelOverrides map[string]LabelOverride `json:"label_overrides"`
+	// MetaDataOverrides forces or skips watches listed in build meta-data
+	MetaDataOverrides *MetaDataOverrides `json:"meta_data_overrides"`
+	// RawShell is the shell running the diff and hook commands, or `none` to run them directly
+	RawShell interface{} `json:"shell"`
+	Shell    []string
+	// RawBranchMap maps the branch of the build to the branch of triggered builds, e.g. `release/* -> release`
+	RawBranchMap []string `json:"branch_map"`
+	BranchMap    []BranchRule
+	// TriggerDefaults are merged into the build of every trigger step
+	TriggerDefaults *TriggerDefaults `json:"trigger_defaults"`
+	// EnvPassthrough copies the matching environment variables into the build env of trigger steps
+	EnvPassthrough []string `json:"env_passthrough"`
+	// InheritPriority sets the priority of the job on the generated command steps and triggered builds
+	InheritPriority bool `json:"inherit_priority"`
+	// PriorityFromAPI reads the priority of the job from the Buildkite API when MONOREPO_DIFF_PRIORITY isn't set
+	PriorityFromAPI bool `json:"priority_from_api"`
+	// PropagateTag and PropagateCreator pass the tag, and the creator and author of the build to triggered builds
+	PropagateTag     bool `json:"propagate_tag"`
+	PropagateCreator bool `json:"propagate_creator"`
+	// RawPipelineEnv and PipelineAgents are added as the top level `env` and `agents` of the generated pipeline
+	RawPipelineEnv interface{} `json:"pipeline_env"`
+	PipelineEnv    map[string]string
+	PipelineAgents map[string]string `json:"pipeline_agents"`
+	// Templates renders the step fields of matched watches as Go templates
+	Templates bool
+	// Mode is `trigger` to generate the steps of the watches, or `merge` to merge their pipeline files
+	Mode string
+	// TriggerRate splits the generated steps into batches separated by wait steps
+	TriggerRate int `json:"trigger_rate"`
+	// RawStagger uploads the batches this long apart instead, e.g. "30s"
+	RawStagger             string `json:"stagger"`
+	Stagger                time.Duration
+	ResultsPolicy          string `json:"results_policy"`
+	RawResultsTimeout      string `json:"results_timeout"`
+	ResultsTimeout         time.Duration
+	RawResultsPollInterval string `json:"results_poll_interval"`
+	ResultsPollInterval    time.Duration
+	// MatcherEngine is `auto`, `legacy`, `doublestar` or `regex`, the engine matching the globs of watch paths
+	MatcherEngine string `json:"matcher_engine"`
+	// MatcherParallelism is how many commands of `matcher: command` watches run at once, the number of CPUs by default
+	MatcherParallelism int `json:"matcher_parallelism"`
+	// CacheDir stores the output of matcher commands by the commits of the diff, reused by the steps and retries of a build
+	CacheDir string `json:"cache_dir"`
+	// RawMemoryBudget bounds the changed and matched files kept in memory while the diff is read, e.g. "64MB"
+	RawMemoryBudget string `json:"memory_budget"`
+	MemoryBudget    int64
+	// RetryFailedTriggers rebuilds failed triggered builds up to this many times while waiting for results
+	RetryFailedTriggers int `json:"retry_failed_triggers"`
+	Hooks               []HookConfig
+	HooksPosition       string `json:"hooks_position"`
+	Watch               []WatchConfig
+	RawEnv              interface{} `json:"env"`
+	Env                 map[string]string
+	RedactedVars        []string `json:"redacted_vars"`
+	// Extension is an executable returning the steps to upload from the matched watches and generated steps
+	Extension string `json:"extension"`
+	// KeyNamespace prefixes the keys of the generated steps
+	KeyNamespace string `json:"key_namespace"`
+	// CheckKeyCollisions checks the generated keys against the keys of the steps of the build
+	CheckKeyCollisions bool `json:"check_key_collisions"`
+	// RoutingReport is the file the routing report is written to
+	RoutingReport string `json:"routing_report"`
+	// RoutingReportArtifact uploads the routing report as a build artifact
+	RoutingReportArtifact bool `json:"routing_report_artifact"`
+	// Manifest is the file of the triggered pipelines and the hashes of their
+	// configurations, uploaded as a build artifact
+	Manifest string `json:"manifest"`
+	// MatchedFilesArtifacts uploads the matched files of every watch as an artifact of its own
+	MatchedFilesArtifacts bool `json:"matched_files_artifacts"`
+	// DebugBundle writes and uploads a bundle of diagnostics when the plugin fails
+	DebugBundle bool `json:"debug_bundle"`
+	// AuditLog is a webhook the record of every run is posted to, or an `s3://` location it is copied to
+	AuditLog string `json:"audit_log"`
+	// Pushgateway is the Prometheus Pushgateway the metrics of the run are pushed to
+	Pushgateway *Pushgateway `json:"pushgateway"`
+	// ContentHashEnv sets the content hash of the files of every watch in MONOREPO_DIFF_HASH
+	ContentHashEnv bool `json:"content_hash_env"`
+	// ReportUnmatched is `log` or `annotate` to report the changed files that matched no watch
+	ReportUnmatched string `json:"report_unmatched"`
+	// MaxStepsPerUpload splits the generated pipeline into multiple uploads
+	MaxStepsPerUpload int `json:"max_steps_per_upload"`
+	MaxTriggered      int `json:"max_triggered"`
+	Overflow          string
+	OverflowStep      *Step `json:"overflow_step"`
 }
 
-// HookConfig Plugin hook configuration
+// HookConfig Plugin hook configuration. Hooks added to the generated
+// pipeline can be complete step definitions.
 type HookConfig struct {
-	Command string
+	Step `yaml:",inline"`
+	// Phase is `before` or `after` (default) for hooks added to the generated
+	// pipeline, or one of `pre_diff` and `post_upload` for hooks run on the agent
+	Phase string `yaml:"-"`
+}
+
+// TriggerDefaults are the defaults of trigger steps
+type TriggerDefaults struct {
+	Build Build
 }
 
 // WatchConfig Plugin watch configuration
 type WatchConfig struct {
 	RawPath interface{} `json:"path"`
 	Paths   []string
+	// RawTags are the tag globs routing tag builds to the watch
+	RawTags interface{} `json:"tags"`
+	Tags    []string
 	Step    Step `json:"config"`
+	// Environments expands the step into a step per environment, rendered with
+	// `{{ .Environment }}`, with a block step before those of BlockBefore
+	Environments []string `json:"environments"`
+	BlockBefore  []string `json:"block_before"`
+	Environment  string   `json:"-"`
+	// QueueRules pick the queue of the command step by the number and size of the matched files
+	QueueRules []QueueRule `json:"queue_rules"`
+	// Rollout only triggers the watch for a percentage of the commits or behind a flag
+	Rollout *Rollout `json:"rollout"`
+	// RawArtifacts are the artifact queries of the parent build the step of the watch downloads
+	RawArtifacts interface{} `json:"artifacts"`
+	Artifacts    []string
+	// Label is a human friendly name of the watch used in logs and summaries
+	Label string `json:"label"`
+	// Notify are the notifications added to the step, e.g. to ping the owning team
+	Notify []interface{} `json:"notify"`
+	// Owner and Team attribute the CI load and failures of the watch, set in
+	// the env of its step, the results annotation and the routing report
+	Owner string `json:"owner"`
+	Team  string `json:"team"`
+	// TriggerConcurrencyGroup serializes the trigger step of the watch with those of the same group in other builds
+	TriggerConcurrencyGroup string `json:"trigger_concurrency_group"`
+	// TriggerConcurrency is how many trigger steps of the group run at once, 1 by default
+	TriggerConcurrency int `json:"trigger_concurrency"`
+	// RawStaleAfter skips the step when the diff base is older, e.g. "720h"
+	RawStaleAfter string `json:"stale_after"`
+	StaleAfter    time.Duration
+	// RawActiveHours skips the step outside of a cron window, e.g. "* 8-17 * * 1-5"
+	RawActiveHours interface{} `json:"active_hours"`
+	ActiveHours    *ActiveHours
+	// EnvFile is a file of KEY=VALUE lines merged into the env of the step
+	EnvFile string `json:"env_file"`
+	// MinChangedLines is the number of changed lines of the matched files the watch needs to trigger
+	MinChangedLines int `json:"min_changed_lines"`
+	// Default watches are triggered when the diff is empty with `on_empty_diff: default`
+	Default bool `json:"default"`
+	// FanOut `directory` generates a step per matched directory at Depth
+	FanOut string `json:"fan_out"`
+	Depth  int
+	// Matcher is `script` to match the changed files with the Script expression
+	// instead of the paths, or `command` to match them with the Script command
+	Matcher string `json:"matcher"`
+	Script  string `json:"script"`
+	script  *script
+	// Pipeline is the pipeline file merged in place of the step in `merge` mode
+	Pipeline string
+	// Interpolation overrides the top level `interpolation` for the step of the watch
+	Interpolation *bool
+	// Files are the changed files matched by the watch, only kept to render templates
+	Files []string `json:"-"`
+	// Dir is the directory of a watch generated by fan out
+	Dir string `json:"-"`
+	// Captures are the values captured by the capture groups of the paths
+	Captures map[string]string `json:"-"`
 }
 
 // Step is buildkite pipeline definition
 type Step struct {
 	Trigger   string            `yaml:"trigger,omitempty"`
 	Label     string            `yaml:"label,omitempty"`
+	Key       string            `yaml:"key,omitempty"`
 	Build     Build             `yaml:"build,omitempty"`
 	Command   string            `yaml:"command,omitempty"`
 	Agents    Agent             `yaml:"agents,omitempty"`
@@ -45,6 +273,109 @@ type Step struct {
 	RawEnv    interface{}       `json:"env" yaml:",omitempty"`
 	Env       map[string]string `yaml:"env,omitempty"`
 	Async     bool              `yaml:"async,omitempty"`
+	Plugins   Plugins           `yaml:"plugins,omitempty"`
+	Block     string            `yaml:"block,omitempty"`
+	Prompt    string            `yaml:"prompt,omitempty"`
+	Fields    []Field           `yaml:"fields,omitempty"`
+	Notify    []interface{}     `yaml:"notify,omitempty"`
+	// Skip is a reason to skip the step, set on the steps of stale watches
+	Skip string `yaml:"skip,omitempty"`
+	// DependsOn is a key or a list of keys. The depends_on of hooks can refer to
+	// the generated steps with `@steps` and `@triggered`.
+	DependsOn interface{} `json:"depends_on" yaml:"depends_on,omitempty"`
+	Priority  int         `yaml:"priority,omitempty"`
+	// ConcurrencyGroup limits the steps of the group running at once across builds to Concurrency
+	ConcurrencyGroup string `json:"concurrency_group" yaml:"concurrency_group,omitempty"`
+	Concurrency      int    `yaml:"concurrency,omitempty"`
+	// Extra are the scalar attributes of the config of a watch the plugin doesn't
+	// know, emitted as they are so new step attributes can be used right away
+	Extra map[string]interface{} `json:"-" yaml:",inline"`
+	// Upload is a pipeline file uploaded by the generated command step
+	Upload string `yaml:"-"`
+	// WatchLabel is the label of the watch the step belongs to
+	WatchLabel string `yaml:"-"`
+	// Reason and MatchedFiles are why the watch of the step was triggered and
+	// the files it matched, only kept for the `generic-json` format
+	Reason       string   `json:"-" yaml:"-"`
+	MatchedFiles []string `json:"-" yaml:"-"`
+	// Owner and Team are the ownership of the watch the step belongs to
+	Owner string `json:"-" yaml:"-"`
+	Team  string `json:"-" yaml:"-"`
+	// Organization triggers the pipeline of another organization through the API
+	Organization string `yaml:"-"`
+	// Wait marks a wait step between generated steps
+	Wait bool `yaml:"-"`
+	// WaitAttributes are the attributes of a wait step, e.g. `continue_on_failure`
+	WaitAttributes map[string]interface{} `yaml:"-"`
+	// Raw is a step merged from another pipeline, emitted as is
+	Raw interface{} `yaml:"-"`
+	// Literal escapes `$` so the step isn't interpolated on upload
+	Literal bool `yaml:"-"`
+}
+
+// MarshalYAML emits wait steps in their short form and merged steps as is
+func (s Step) MarshalYAML() (interface{}, error) {
+	if s.Wait {
+		return waitStep(s.WaitAttributes), nil
+	}
+
+	if s.Raw != nil {
+		return s.Raw, nil
+	}
+
+	if s.Literal {
+		s.Literal = false
+
+		data, err := yaml.Marshal(s)
+		if err != nil {
+			return nil, err
+		}
+
+		var step yaml.MapSlice
+		if err := yaml.Unmarshal(data, &step); err != nil {
+			return nil, err
+		}
+
+		return escapeDollars(step), nil
+	}
+
+	type plain Step
+	return plain(s), nil
+}
+
+// waitStep returns a wait step in its short form, or with its attributes
+// sorted by name so the generated pipeline is stable
+func waitStep(attributes map[string]interface{}) interface{} {
+	if len(attributes) == 0 {
+		return "wait"
+	}
+
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	step := yaml.MapSlice{{Key: "wait", Value: nil}}
+	for _, name := range names {
+		step = append(step, yaml.MapItem{Key: name, Value: attributes[name]})
+	}
+
+	return step
+}
+
+// Field is an input field of a block step
+type Field struct {
+	Select   string        `yaml:"select"`
+	Key      string        `yaml:"key"`
+	Multiple bool          `yaml:"multiple,omitempty"`
+	Options  []FieldOption `yaml:"options"`
+}
+
+// FieldOption is an option of a select field
+type FieldOption struct {
+	Label string `yaml:"label"`
+	Value string `yaml:"value"`
 }
 
 // Agent is Buildkite agent definition
@@ -54,32 +385,111 @@ type Agent struct {
 
 // Build is buildkite build definition
 type Build struct {
-	Message string            `yaml:"message,omitempty"`
-	Branch  string            `yaml:"branch,omitempty"`
-	Commit  string            `yaml:"commit,omitempty"`
-	RawEnv  interface{}       `json:"env" yaml:",omitempty"`
-	Env     map[string]string `yaml:"env,omitempty"`
+	Message  string            `yaml:"message,omitempty"`
+	Branch   string            `yaml:"branch,omitempty"`
+	Commit   string            `yaml:"commit,omitempty"`
+	MetaData map[string]string `json:"meta_data" yaml:"meta_data,omitempty"`
+	RawEnv   interface{}       `json:"env" yaml:",omitempty"`
+	Env      map[string]string `yaml:"env,omitempty"`
+	// configured is whether the message is set by the configuration, so it's
+	// a template, rather than the message of the commit
+	configured bool
+}
+
+// loadPlugins reads the configuration of the plugin from the
+// `BUILDKITE_PLUGIN_CONFIGURATION` JSON document newer agents set for the
+// running invocation, or otherwise from `BUILDKITE_PLUGINS`. Multiple
+// invocations are always read from `BUILDKITE_PLUGINS`, which lists them all.
+// Without either, it is read from the env vars the configuration is flattened into.
+func loadPlugins() ([]Plugin, error) {
+	_, listed := os.LookupEnv("BUILDKITE_PLUGINS")
+	configuration, ok := os.LookupEnv("BUILDKITE_PLUGIN_CONFIGURATION")
+
+	if !listed && !ok && hasPluginEnv(os.Environ()) {
+		plugin, err := pluginFromEnv(os.Environ())
+		if err != nil {
+			return nil, err
+		}
+
+		return []Plugin{plugin}, nil
+	}
+
+	plugins, err := initializePlugins(env("BUILDKITE_PLUGINS", ""))
+	if !ok || err == nil && len(plugins) > 1 {
+		return plugins, err
+	}
+
+	plugin, err := initializePluginConfiguration(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	return []Plugin{plugin}, nil
+}
+
+// initializePluginConfiguration parses the configuration of a single invocation
+func initializePluginConfiguration(data string) (Plugin, error) {
+	return parsePlugin([]byte(data))
+}
+
+// parsePlugin resolves the `extends` of the configuration of an invocation,
+// then parses it
+func parsePlugin(data []byte) (Plugin, error) {
+	var plugin Plugin
+
+	data, err := extendPlugin(data)
+	if err != nil {
+		return Plugin{}, fmt.Errorf("failed to parse plugin configuration: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &plugin); err != nil {
+		return Plugin{}, fmt.Errorf("failed to parse plugin configuration: %v", err)
+	}
+
+	return plugin, nil
 }
 
 func initializePlugin(data string) (Plugin, error) {
-	var plugins []map[string]Plugin
+	plugins, err := initializePlugins(data)
+	if err != nil {
+		return Plugin{}, err
+	}
+
+	return plugins[0], nil
+}
+
+// initializePlugins returns the configuration of every invocation of the
+// plugin in the step, in the order they are listed
+func initializePlugins(data string) ([]Plugin, error) {
+	var plugins []map[string]json.RawMessage
 
 	err := json.Unmarshal([]byte(data), &plugins)
 
 	if err != nil {
-		log.Debug(err)
-		return Plugin{}, errors.New("failed to parse plugin configuration")
+		return nil, fmt.Errorf("failed to parse plugin configuration: %v", err)
 	}
 
+	result := []Plugin{}
+
 	for _, p := range plugins {
-		for key, plugin := range p {
-			if strings.HasPrefix(key, pluginName) {
-				return plugin, nil
+		for key, config := range p {
+			if !strings.HasPrefix(key, pluginName) {
+				continue
 			}
+
+			plugin, err := parsePlugin(config)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, plugin)
 		}
 	}
 
-	return Plugin{}, errors.New("could not initialize plugin")
+	if len(result) == 0 {
+		return nil, errors.New("could not initialize plugin")
+	}
+
+	return result, nil
 }
 
 // UnmarshalJSON set defaults properties
@@ -87,22 +497,247 @@ func (plugin *Plugin) UnmarshalJSON(data []byte) error {
 	type plain Plugin
 
 	def := &plain{
-		Diff:          "git diff --name-only HEAD~1",
-		Wait:          false,
-		LogLevel:      "info",
-		Interpolation: false,
+		RawDiff:                "git diff --name-only HEAD~1",
+		DiffProvider:           "command",
+		DiffSourcesMerge:       sourcesUnion,
+		RawWait:                false,
+		LogLevel:               "info",
+		LogFormat:              logFormatText,
+		Format:                 formatBuildkite,
+		MatcherEngine:          matcherAuto,
+		Interpolation:          false,
+		RedactedVars:           append([]string{}, defaultRedactedVars...),
+		MaxStepsPerUpload:      500,
+		UploadRetries:          2,
+		UploadMethod:           "agent",
+		Output:                 outputUpload,
+		RawUploadRetryBackoff:  "1s",
+		OnEmptyDiff:            "none",
+		DiffRetries:            2,
+		RawDiffRetryBackoff:    "1s",
+		ResultsPolicy:          "all_passed",
+		RawResultsTimeout:      "1h",
+		RawResultsPollInterval: "30s",
+		RawStagger:             "0s",
+		Mode:                   "trigger",
 	}
 
 	_ = json.Unmarshal(data, def)
 
 	*plugin = Plugin(*def)
 
-	plugin.Env = parseEnv(plugin.RawEnv)
+	// the watches of the presets are already part of the configuration
+	var err error
+	if plugin.Extends, err = presetNames(plugin.RawExtends); err != nil {
+		return err
+	}
+	plugin.RawExtends = nil
+
+	durations := []struct {
+		name  string
+		raw   *string
+		value *time.Duration
+	}{
+		{"upload_retry_backoff", &plugin.RawUploadRetryBackoff, &plugin.UploadRetryBackoff},
+		{"diff_retry_backoff", &plugin.RawDiffRetryBackoff, &plugin.DiffRetryBackoff},
+		{"results_timeout", &plugin.RawResultsTimeout, &plugin.ResultsTimeout},
+		{"results_poll_interval", &plugin.RawResultsPollInterval, &plugin.ResultsPollInterval},
+		{"stagger", &plugin.RawStagger, &plugin.Stagger},
+	}
+
+	for _, d := range durations {
+		value, err := time.ParseDuration(*d.raw)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", d.name, err)
+		}
+		*d.value = value
+		*d.raw = ""
+	}
+
+	if plugin.RawMemoryBudget != "" {
+		size, err := parseSize(plugin.RawMemoryBudget)
+		if err != nil {
+			return fmt.Errorf("invalid memory_budget: %v", err)
+		}
+		plugin.MemoryBudget = size
+		plugin.RawMemoryBudget = ""
+	}
+
+	if plugin.ResultsPolicy != "all_passed" && plugin.ResultsPolicy != "any_passed" {
+		return fmt.Errorf("unknown results_policy `%s`", plugin.ResultsPolicy)
+	}
+
+	if plugin.ConfigSignature != nil {
+		if err := plugin.ConfigSignature.validate(); err != nil {
+			return err
+		}
+	}
+
+	if plugin.Pushgateway != nil && plugin.Pushgateway.URL == "" {
+		return fmt.Errorf("pushgateway needs a url")
+	}
+
+	if plugin.RetryFailedTriggers < 0 {
+		return fmt.Errorf("invalid retry_failed_triggers `%d`", plugin.RetryFailedTriggers)
+	}
+
+	if plugin.UploadMethod != "agent" && plugin.UploadMethod != "api" {
+		return fmt.Errorf("unknown upload_method `%s`", plugin.UploadMethod)
+	}
+
+	if plugin.UploadMethod == "api" && len(plugin.UploadArgs) > 0 {
+		return fmt.Errorf("upload_args can't be used with upload_method `api`")
+	}
+
+	if plugin.LogFormat != logFormatText && plugin.LogFormat != logFormatPretty {
+		return fmt.Errorf("unknown log_format `%s`", plugin.LogFormat)
+	}
+
+	switch plugin.MatcherEngine {
+	case matcherAuto, matcherLegacy, matcherDoublestar, matcherRegex:
+	default:
+		return fmt.Errorf("unknown matcher_engine `%s`", plugin.MatcherEngine)
+	}
+
+	switch plugin.Output {
+	case outputUpload, outputStdout, outputGitHubActions:
+	default:
+		return fmt.Errorf("unknown output `%s`", plugin.Output)
+	}
+
+	// the plugin is done before a printed pipeline is uploaded
+	if plugin.Output != outputUpload {
+		switch {
+		case plugin.WaitForResults:
+			return fmt.Errorf("wait_for_results can't be used with output `%s`", plugin.Output)
+		case plugin.GithubStatus:
+			return fmt.Errorf("github_status can't be used with output `%s`", plugin.Output)
+		case plugin.SlackWebhook != "":
+			return fmt.Errorf("slack_webhook can't be used with output `%s`", plugin.Output)
+		case len(hooksInPhase(plugin.Hooks, hookPhasePostUpload)) > 0:
+			return fmt.Errorf("post_upload hooks can't be used with output `%s`", plugin.Output)
+		}
+	}
+
+	switch plugin.Format {
+	case formatBuildkite:
+	case formatGenericJSON:
+		if plugin.Output != outputStdout {
+			return fmt.Errorf("format `%s` needs output `%s`", plugin.Format, outputStdout)
+		}
+	default:
+		return fmt.Errorf("unknown format `%s`", plugin.Format)
+	}
+
+	if _, ok := diffProviders[plugin.DiffProvider]; !ok {
+		return fmt.Errorf("unknown diff_provider `%s`", plugin.DiffProvider)
+	}
+
+	for _, name := range plugin.DiffSources {
+		if _, ok := diffProviders[name]; !ok {
+			return fmt.Errorf("unknown diff source `%s`", name)
+		}
+	}
+
+	if plugin.DiffSourcesMerge != sourcesUnion && plugin.DiffSourcesMerge != sourcesIntersection {
+		return fmt.Errorf("unknown diff_sources_merge `%s`", plugin.DiffSourcesMerge)
+	}
+
+	if plugin.DedupeRunning != "" && plugin.DedupeRunning != dedupeRunningSkip && plugin.DedupeRunning != dedupeRunningReplace {
+		return fmt.Errorf("unknown dedupe_running `%s`", plugin.DedupeRunning)
+	}
+
+	if plugin.Mode != "trigger" && plugin.Mode != "merge" {
+		return fmt.Errorf("unknown mode `%s`", plugin.Mode)
+	}
+
+	onSchedule, err := parseOnSchedule(plugin.RawOnSchedule)
+	if err != nil {
+		return err
+	}
+	plugin.OnSchedule = onSchedule
+	plugin.RawOnSchedule = nil
+
+	if o := plugin.OnEmptyDiff; o != "none" && o != "default" && o != "all" {
+		return fmt.Errorf("unknown on_empty_diff `%s`", o)
+	}
+
+	if r := plugin.ReportUnmatched; r != "" && r != "log" && r != "annotate" {
+		return fmt.Errorf("unknown report_unmatched `%s`", r)
+	}
+
+	switch wait := plugin.RawWait.(type) {
+	case nil:
+	case bool:
+		plugin.Wait = wait
+	case map[string]interface{}:
+		plugin.Wait = true
+		plugin.WaitAttributes = wait
+	default:
+		return fmt.Errorf("invalid wait `%v`", wait)
+	}
+	plugin.RawWait = nil
+
+	if plugin.Env, err = parseEnv(plugin.RawEnv); err != nil {
+		return err
+	}
 	plugin.RawEnv = nil
 
+	if plugin.PipelineEnv, err = parseEnv(plugin.RawPipelineEnv); err != nil {
+		return err
+	}
+	plugin.RawPipelineEnv = nil
+
+	switch diff := plugin.RawDiff.(type) {
+	case string:
+		plugin.Diff = diff
+	case []interface{}:
+		for _, v := range diff {
+			plugin.DiffArgs = append(plugin.DiffArgs, fmt.Sprint(v))
+		}
+		plugin.Diff = strings.Join(plugin.DiffArgs, " ")
+	}
+	plugin.RawDiff = nil
+
+	shell, err := parseShell(plugin.RawShell)
+	if err != nil {
+		return err
+	}
+	plugin.Shell = shell
+	plugin.RawShell = nil
+
+	branchMap, err := parseBranchMap(plugin.RawBranchMap)
+	if err != nil {
+		return err
+	}
+	plugin.BranchMap = branchMap
+	plugin.RawBranchMap = nil
+
+	if plugin.TriggerDefaults != nil {
+		if plugin.TriggerDefaults.Build.Env, err = parseEnv(plugin.TriggerDefaults.Build.RawEnv); err != nil {
+			return err
+		}
+		plugin.TriggerDefaults.Build.RawEnv = nil
+	}
+
+	branch := mapBranch(plugin.BranchMap, env("BUILDKITE_BRANCH", ""))
+	passthrough := passthroughEnv(plugin.EnvPassthrough)
+	propagated := propagatedVars(*plugin)
+
+	var configs struct {
+		Watch []struct {
+			Config map[string]interface{} `json:"config"`
+		} `json:"watch"`
+	}
+	_ = json.Unmarshal(data, &configs)
+
 	// Path can be string or an array of strings,
 	// handle both cases and create an array of paths.
 	for i, p := range plugin.Watch {
+		if i < len(configs.Watch) {
+			plugin.Watch[i].Step.Extra = extraAttributes(configs.Watch[i].Config)
+		}
+
 		switch p.RawPath.(type) {
 		case string:
 			plugin.Watch[i].Paths = []string{plugin.Watch[i].RawPath.(string)}
@@ -112,25 +747,172 @@ func (plugin *Plugin) UnmarshalJSON(data []byte) error {
 			}
 		}
 
+		for _, p := range plugin.Watch[i].Paths {
+			if hasCaptures(p) {
+				if _, err := captureRegexp(p); err != nil {
+					return err
+				}
+			}
+		}
+
+		switch tags := plugin.Watch[i].RawTags.(type) {
+		case string:
+			plugin.Watch[i].Tags = []string{tags}
+		case []interface{}:
+			for _, v := range tags {
+				plugin.Watch[i].Tags = append(plugin.Watch[i].Tags, fmt.Sprint(v))
+			}
+		}
+		plugin.Watch[i].RawTags = nil
+
+		switch artifacts := plugin.Watch[i].RawArtifacts.(type) {
+		case string:
+			plugin.Watch[i].Artifacts = []string{artifacts}
+		case []interface{}:
+			for _, v := range artifacts {
+				plugin.Watch[i].Artifacts = append(plugin.Watch[i].Artifacts, fmt.Sprint(v))
+			}
+		}
+		plugin.Watch[i].RawArtifacts = nil
+
+		plugin.Watch[i].Step.WatchLabel = plugin.Watch[i].Label
+
+		if err := addNotify(&plugin.Watch[i].Step, plugin.Watch[i].Notify); err != nil {
+			return err
+		}
+
+		if raw := plugin.Watch[i].RawStaleAfter; raw != "" {
+			if plugin.Watch[i].StaleAfter, err = time.ParseDuration(raw); err != nil {
+				return fmt.Errorf("invalid stale_after: %v", err)
+			}
+			if knownDiffBase(*plugin) == "" {
+				return fmt.Errorf("stale_after needs a diff_base or the git diff_provider")
+			}
+			plugin.Watch[i].RawStaleAfter = ""
+		}
+
+		if plugin.Watch[i].ActiveHours, err = parseActiveHours(plugin.Watch[i].RawActiveHours); err != nil {
+			return err
+		}
+		plugin.Watch[i].RawActiveHours = nil
+
+		if err := setTriggerConcurrency(&plugin.Watch[i]); err != nil {
+			return err
+		}
+
+		if err := setUpload(&plugin.Watch[i].Step); err != nil {
+			return err
+		}
+
+		if err := appendEnv(&plugin.Watch[i], plugin.Env); err != nil {
+			return err
+		}
+
 		if plugin.Watch[i].Step.Trigger != "" {
-			setBuild(&plugin.Watch[i].Step.Build)
+			applyTriggerDefaults(&plugin.Watch[i].Step.Build, plugin.TriggerDefaults)
+			setBuild(&plugin.Watch[i].Step.Build, branch)
+			propagateBuild(&plugin.Watch[i].Step.Build, propagated)
+		}
+
+		passEnv(&plugin.Watch[i].Step, passthrough)
+		setOwnership(&plugin.Watch[i])
+		setArtifactHints(&plugin.Watch[i])
+
+		if err := validateEnvironments(plugin.Watch[i]); err != nil {
+			return err
+		}
+
+		if err := parseQueueRules(&plugin.Watch[i]); err != nil {
+			return err
 		}
 
-		appendEnv(&plugin.Watch[i], plugin.Env)
+		if r := plugin.Watch[i].Rollout; r != nil {
+			if err := r.validate(); err != nil {
+				return err
+			}
+		}
+
+		if fanOut := plugin.Watch[i].FanOut; fanOut != "" && fanOut != "directory" {
+			return fmt.Errorf("unknown fan_out `%s`", fanOut)
+		}
+
+		switch plugin.Watch[i].Matcher {
+		case "", "path":
+		case matcherScript:
+			s, err := compileScript(plugin.Watch[i].Script)
+			if err != nil {
+				return err
+			}
+			plugin.Watch[i].script = s
+		case matcherCommand:
+			if plugin.Watch[i].Script == "" {
+				return fmt.Errorf("matcher `command` needs a script")
+			}
+		default:
+			return fmt.Errorf("unknown matcher `%s`", plugin.Watch[i].Matcher)
+		}
 
 		p.RawPath = nil
 	}
 
+	for i := range plugin.Hooks {
+		if plugin.Hooks[i].Env, err = parseEnv(plugin.Hooks[i].RawEnv); err != nil {
+			return err
+		}
+		plugin.Hooks[i].RawEnv = nil
+	}
+
+	if err := checkHookPhases(plugin.Hooks); err != nil {
+		return err
+	}
+
+	hooks, err := positionHooks(plugin.Hooks, plugin.HooksPosition)
+	if err != nil {
+		return err
+	}
+	plugin.Hooks = hooks
+
+	if err := checkWaitForResults(*plugin); err != nil {
+		return err
+	}
+
+	if err := checkStagger(*plugin); err != nil {
+		return err
+	}
+
+	if err := checkOverflow(*plugin); err != nil {
+		return err
+	}
+
+	if plugin.OverflowStep != nil {
+		overflow := WatchConfig{Step: *plugin.OverflowStep}
+
+		if err := appendEnv(&overflow, plugin.Env); err != nil {
+			return err
+		}
+
+		if overflow.Step.Trigger != "" {
+			applyTriggerDefaults(&overflow.Step.Build, plugin.TriggerDefaults)
+			setBuild(&overflow.Step.Build, branch)
+			propagateBuild(&overflow.Step.Build, propagated)
+		}
+
+		passEnv(&overflow.Step, passthrough)
+		plugin.OverflowStep = &overflow.Step
+	}
+
 	return nil
 }
 
-func setBuild(build *Build) {
+func setBuild(build *Build, branch string) {
+	build.configured = build.Message != ""
+
 	if build.Message == "" {
 		build.Message = env("BUILDKITE_MESSAGE", "")
 	}
 
 	if build.Branch == "" {
-		build.Branch = env("BUILDKITE_BRANCH", "")
+		build.Branch = branch
 	}
 
 	if build.Commit == "" {
@@ -138,10 +920,187 @@ func setBuild(build *Build) {
 	}
 }
 
+// applyTriggerDefaults fills the build of a trigger step with the defaults it doesn't set
+func applyTriggerDefaults(build *Build, defaults *TriggerDefaults) {
+	if defaults == nil {
+		return
+	}
+
+	if build.Message == "" {
+		build.Message = defaults.Build.Message
+	}
+
+	if build.Branch == "" {
+		build.Branch = defaults.Build.Branch
+	}
+
+	if build.Commit == "" {
+		build.Commit = defaults.Build.Commit
+	}
+
+	for key, value := range defaults.Build.MetaData {
+		if build.MetaData == nil {
+			build.MetaData = make(map[string]string)
+		}
+		if _, ok := build.MetaData[key]; !ok {
+			build.MetaData[key] = value
+		}
+	}
+
+	for key, value := range defaults.Build.Env {
+		if build.Env == nil {
+			build.Env = make(map[string]string)
+		}
+		if _, ok := build.Env[key]; !ok {
+			build.Env[key] = value
+		}
+	}
+}
+
+// addNotify adds the notifications of a watch to its step. Only notifications
+// supported by steps are allowed, emails can only be sent for whole builds.
+func addNotify(step *Step, notify []interface{}) error {
+	for _, n := range append(append([]interface{}{}, step.Notify...), notify...) {
+		attributes, ok := n.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid notify `%v`", n)
+		}
+
+		if _, ok := attributes["email"]; ok {
+			return fmt.Errorf("notify `email` isn't supported on steps")
+		}
+	}
+
+	if len(notify) > 0 {
+		step.Notify = append(step.Notify, notify...)
+	}
+
+	return nil
+}
+
+// ownership variables set in the env of the steps of owned watches
+const (
+	ownerEnv = "MONOREPO_DIFF_OWNER"
+	teamEnv  = "MONOREPO_DIFF_TEAM"
+)
+
+// setOwnership sets the owner and team of the watch on its step and in its env
+func setOwnership(watch *WatchConfig) {
+	vars := map[string]string{}
+	if watch.Owner != "" {
+		vars[ownerEnv] = watch.Owner
+	}
+	if watch.Team != "" {
+		vars[teamEnv] = watch.Team
+	}
+
+	if len(vars) == 0 {
+		return
+	}
+
+	watch.Step.Owner = watch.Owner
+	watch.Step.Team = watch.Team
+	watch.Step = withEnv(watch.Step, vars)
+}
+
+// stepAttributes are the lowercase names of the attributes of steps the plugin knows
+var stepAttributes = func() map[string]bool {
+	names := map[string]bool{}
+
+	t := reflect.TypeOf(Step{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			name = t.Field(i).Name
+		}
+		names[strings.ToLower(name)] = true
+	}
+
+	return names
+}()
+
+// extraAttributes returns the scalar attributes of the config of a watch
+// that aren't attributes of Step, e.g. `skip_queue` of newer trigger steps
+func extraAttributes(config map[string]interface{}) map[string]interface{} {
+	var extra map[string]interface{}
+
+	for name, value := range config {
+		if stepAttributes[strings.ToLower(name)] {
+			continue
+		}
+
+		switch value.(type) {
+		case string, bool, float64:
+		default:
+			continue
+		}
+
+		if extra == nil {
+			extra = map[string]interface{}{}
+		}
+		extra[name] = value
+	}
+
+	return extra
+}
+
+// setTriggerConcurrency adds the concurrency group of the watch to its trigger
+// step, so only Concurrency of the builds of the group are triggered at once
+func setTriggerConcurrency(watch *WatchConfig) error {
+	if watch.TriggerConcurrencyGroup == "" {
+		if watch.TriggerConcurrency != 0 {
+			return fmt.Errorf("trigger_concurrency needs a trigger_concurrency_group")
+		}
+		return nil
+	}
+
+	if watch.Step.Trigger == "" {
+		return fmt.Errorf("trigger_concurrency_group `%s` needs a trigger step", watch.TriggerConcurrencyGroup)
+	}
+
+	if watch.TriggerConcurrency < 0 {
+		return fmt.Errorf("invalid trigger_concurrency `%d`", watch.TriggerConcurrency)
+	}
+
+	watch.Step.ConcurrencyGroup = watch.TriggerConcurrencyGroup
+	watch.Step.Concurrency = watch.TriggerConcurrency
+	if watch.Step.Concurrency == 0 {
+		watch.Step.Concurrency = 1
+	}
+
+	return nil
+}
+
+// setUpload turns a step with an `upload` into the command step uploading it
+func setUpload(step *Step) error {
+	if step.Upload == "" {
+		return nil
+	}
+
+	if step.Command != "" || step.Trigger != "" {
+		return fmt.Errorf("`upload` can't be combined with `command` or `trigger`")
+	}
+
+	step.Command = "buildkite-agent pipeline upload " + step.Upload
+
+	if step.Label == "" {
+		step.Label = ":pipeline: Upload " + step.Upload
+	}
+
+	return nil
+}
+
 // appends top level env to Step.Env and Step.Build.Env
-func appendEnv(watch *WatchConfig, env map[string]string) {
-	watch.Step.Env = parseEnv(watch.Step.RawEnv)
-	watch.Step.Build.Env = parseEnv(watch.Step.Build.RawEnv)
+func appendEnv(watch *WatchConfig, env map[string]string) error {
+	var err error
+
+	if watch.Step.Env, err = parseEnv(watch.Step.RawEnv); err != nil {
+		return err
+	}
+
+	if watch.Step.Build.Env, err = parseEnv(watch.Step.Build.RawEnv); err != nil {
+		return err
+	}
 
 	for key, value := range env {
 		if watch.Step.Env == nil {
@@ -164,28 +1123,174 @@ func appendEnv(watch *WatchConfig, env map[string]string) {
 	watch.Step.RawEnv = nil
 	watch.Step.Build.RawEnv = nil
 	watch.RawPath = nil
+
+	return nil
 }
 
-// parse env in format from env=env-value to map[env] = env-value
-func parseEnv(raw interface{}) map[string]string {
-	if raw == nil {
-		return nil
+// passthroughEnv returns the environment variables matching the patterns
+func passthroughEnv(patterns []string) map[string]string {
+	result := map[string]string{}
+
+	if len(patterns) == 0 {
+		return result
+	}
+
+	for _, e := range os.Environ() {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) == 2 && matchesAny(patterns, parts[0]) {
+			result[parts[0]] = parts[1]
+		}
 	}
 
-	result := make(map[string]string)
-	for _, v := range raw.([]interface{}) {
-		split := strings.Split(v.(string), "=")
-		key, value := strings.TrimSpace(split[0]), split[1:]
+	return result
+}
 
-		// only key exists. set value from env
-		if len(key) > 0 && len(value) == 0 {
-			result[key] = env(key, "")
+// passEnv adds the environment variables to the build env of a trigger step,
+// without overriding the variables it already has
+func passEnv(step *Step, vars map[string]string) {
+	if step.Trigger == "" || len(vars) == 0 {
+		return
+	}
+
+	if step.Build.Env == nil {
+		step.Build.Env = make(map[string]string)
+	}
+
+	for key, value := range vars {
+		if _, ok := step.Build.Env[key]; !ok {
+			step.Build.Env[key] = value
 		}
+	}
+}
 
-		if len(value) > 0 {
-			result[key] = strings.TrimSpace(value[0])
+// creatorVars are the variables of the creator and author of the build
+var creatorVars = []string{
+	"BUILDKITE_BUILD_CREATOR",
+	"BUILDKITE_BUILD_CREATOR_EMAIL",
+	"BUILDKITE_BUILD_CREATOR_TEAMS",
+	"BUILDKITE_BUILD_AUTHOR",
+	"BUILDKITE_BUILD_AUTHOR_EMAIL",
+}
+
+// propagatedVars returns the set build variables propagated to triggered
+// builds. The agent sets the BUILDKITE_ variables of every job, so they are
+// renamed with a PARENT_ prefix.
+func propagatedVars(plugin Plugin) map[string]string {
+	names := []string{}
+	if plugin.PropagateTag {
+		names = append(names, "BUILDKITE_TAG")
+	}
+	if plugin.PropagateCreator {
+		names = append(names, creatorVars...)
+	}
+
+	result := map[string]string{}
+	for _, name := range names {
+		if value := env(name, ""); value != "" {
+			result["PARENT_"+name] = value
 		}
 	}
 
 	return result
 }
+
+// propagateBuild adds the propagated variables to the env of the build, and
+// to its meta-data as lowercase keys with dashes, e.g. `parent-buildkite-tag`
+func propagateBuild(build *Build, vars map[string]string) {
+	for name, value := range vars {
+		if build.Env == nil {
+			build.Env = make(map[string]string)
+		}
+		if _, ok := build.Env[name]; !ok {
+			build.Env[name] = value
+		}
+
+		key := strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+		if build.MetaData == nil {
+			build.MetaData = make(map[string]string)
+		}
+		if _, ok := build.MetaData[key]; !ok {
+			build.MetaData[key] = value
+		}
+	}
+}
+
+// parseEnv parses env given as a list of `KEY=value`, or as a map of keys to
+// values. Keys without a value take the value of the variable in the build.
+func parseEnv(raw interface{}) (map[string]string, error) {
+	switch vars := raw.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		result := make(map[string]string)
+
+		for _, v := range vars {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid env `%v`, expected KEY=value", v)
+			}
+
+			// only the first `=` separates the key, values can contain more
+			split := strings.SplitN(s, "=", 2)
+			key := strings.TrimSpace(split[0])
+
+			if key == "" {
+				return nil, fmt.Errorf("invalid env `%s`, expected KEY=value", s)
+			}
+
+			if len(split) == 1 {
+				result[key] = env(key, "")
+			} else {
+				result[key] = strings.TrimSpace(split[1])
+			}
+		}
+
+		return result, nil
+	case map[string]interface{}:
+		result := make(map[string]string)
+
+		for key, v := range vars {
+			switch value := v.(type) {
+			case nil:
+				result[key] = env(key, "")
+			case string:
+				result[key] = value
+			case bool, float64, json.Number:
+				result[key] = fmt.Sprint(value)
+			default:
+				return nil, fmt.Errorf("invalid value of env %s, expected a string", key)
+			}
+		}
+
+		return result, nil
+	default:
+		return nil, fmt.Errorf("invalid env `%v`, expected a list or a map", raw)
+	}
+}
+
+// parseShell parses the shell as a string or an array of strings
+func parseShell(raw interface{}) ([]string, error) {
+	switch value := raw.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if shell := strings.Fields(value); len(shell) > 0 {
+			return shell, nil
+		}
+	case []interface{}:
+		shell := []string{}
+		for _, v := range value {
+			arg, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid shell: %v is not a string", v)
+			}
+			shell = append(shell, arg)
+		}
+
+		if len(shell) > 0 {
+			return shell, nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid shell: %v", raw)
+}
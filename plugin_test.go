@@ -1,7 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"math/rand"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"testing/quick"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -15,7 +22,7 @@ func TestPluginWithEmptyParameter(t *testing.T) {
 func TestPluginWithInvalidParameter(t *testing.T) {
 	_, err := initializePlugin("invalid")
 
-	assert.EqualError(t, err, "failed to parse plugin configuration")
+	assert.EqualError(t, err, "failed to parse plugin configuration: invalid character 'i' looking for beginning of value")
 }
 
 func TestPluginShouldHaveDefaultValues(t *testing.T) {
@@ -26,10 +33,28 @@ func TestPluginShouldHaveDefaultValues(t *testing.T) {
 	got, _ := initializePlugin(param)
 
 	expected := Plugin{
-		Diff:          "git diff --name-only HEAD~1",
-		Wait:          false,
-		LogLevel:      "info",
-		Interpolation: false,
+		Diff:                "git diff --name-only HEAD~1",
+		Wait:                false,
+		LogLevel:            "info",
+		LogFormat:           "text",
+		MatcherEngine:       "auto",
+		Interpolation:       false,
+		RedactedVars:        defaultRedactedVars,
+		MaxStepsPerUpload:   500,
+		UploadRetries:       2,
+		UploadMethod:        "agent",
+		Output:              "upload",
+		Format:              "buildkite",
+		Mode:                "trigger",
+		ResultsPolicy:       "all_passed",
+		ResultsTimeout:      time.Hour,
+		ResultsPollInterval: 30 * time.Second,
+		UploadRetryBackoff:  time.Second,
+		OnEmptyDiff:         "none",
+		DiffProvider:        "command",
+		DiffSourcesMerge:    "union",
+		DiffRetries:         2,
+		DiffRetryBackoff:    time.Second,
 	}
 
 	assert.Equal(t, expected, got)
@@ -50,9 +75,53 @@ func TestPluginShouldUnmarshallCorrectly(t *testing.T) {
 			"wait": true,
 			"log_level": "debug",
 			"interpolation": true,
+			"hooks_position": "after",
+			"replace": true,
+			"upload_args": ["--job", "job-id"],
+			"agent_binary": "/opt/buildkite/bin/buildkite-agent",
+			"agent_args": ["--debug"],
+			"upload_retries": 5,
+			"inherit_priority": true,
+			"priority_from_api": true,
+			"dedupe_by_content": true,
+			"validate_triggers": true,
+			"github_status": true,
+			"slack_webhook": "https://hooks.slack.com/services/T0/B0/x",
+			"shell": ["/bin/bash", "-e", "-c"],
+			"pipeline_env": ["DEPLOY=true"],
+			"pipeline_agents": { "queue": "deploy", "os": "linux" },
+			"templates": true,
+			"mode": "merge",
+			"meta_data_overrides": { "force": "force_pipelines", "skip": "skip_pipelines" },
+			"label_overrides": {
+				"ci:full": { "force": ["*"] },
+				"ci:skip-frontend": { "skip": ["frontend-*"] }
+			},
+			"results_policy": "any_passed",
+			"results_timeout": "10m",
+			"results_poll_interval": "5s",
+			"trigger_rate": 5,
+			"diff_retries": 3,
+			"on_empty_diff": "default",
+			"on_schedule": { "watches": ["service-*"] },
+			"diff_retry_backoff": "5s",
+			"stagger": "30s",
+			"upload_retry_backoff": "250ms",
+			"redacted_vars": ["*_TOKEN"],
+			"max_steps_per_upload": 100,
+			"max_triggered": 10,
+			"overflow": "trigger_all_step",
+			"overflow_step": { "trigger": "everything" },
 			"hooks": [
 				{ "command": "some-hook-command" },
-				{ "command": "another-hook-command" }
+				{ "command": "another-hook-command" },
+				{
+					"command": "aggregate",
+					"label": "Aggregate",
+					"key": "aggregate",
+					"agents": { "queue": "reports" },
+					"env": [ "FOO=bar" ]
+				}
 			],
 			"env": [
 				"env1=env-1",
@@ -62,15 +131,20 @@ func TestPluginShouldUnmarshallCorrectly(t *testing.T) {
 			"watch": [
 				{
 					"path": "watch-path-1",
+					"label": "Service 2",
+					"default": true,
 					"config": {
 						"trigger": "service-2",
+						"organization": "other-org",
 						"build": {
-							"message": "some message"
+							"message": "some message",
+							"meta_data": { "release": "true" }
 						}
 					}
 				},
 				{
 					"path": "watch-path-1",
+					"pipeline": "watch-path-1/.buildkite/pipeline.yml",
 					"config": {
 						"command": "echo hello-world"
 					}
@@ -110,13 +184,81 @@ func TestPluginShouldUnmarshallCorrectly(t *testing.T) {
 	got, _ := initializePlugin(param)
 
 	expected := Plugin{
-		Diff:          "cat ./hello.txt",
-		Wait:          true,
-		LogLevel:      "debug",
-		Interpolation: true,
+		Diff:             "cat ./hello.txt",
+		Wait:             true,
+		LogLevel:         "debug",
+		LogFormat:        "text",
+		MatcherEngine:    "auto",
+		Interpolation:    true,
+		HooksPosition:    "after",
+		Replace:          true,
+		UploadArgs:       []string{"--job", "job-id"},
+		AgentBinary:      "/opt/buildkite/bin/buildkite-agent",
+		AgentArgs:        []string{"--debug"},
+		UploadRetries:    5,
+		UploadMethod:     "agent",
+		Output:           "upload",
+		Format:           "buildkite",
+		InheritPriority:  true,
+		PriorityFromAPI:  true,
+		DedupeByContent:  true,
+		ValidateTriggers: true,
+		GithubStatus:     true,
+		SlackWebhook:     "https://hooks.slack.com/services/T0/B0/x",
+		LabelOverrides: map[string]LabelOverride{
+			"ci:full":          {Force: []string{"*"}},
+			"ci:skip-frontend": {Skip: []string{"frontend-*"}},
+		},
+		MetaDataOverrides:   &MetaDataOverrides{Force: "force_pipelines", Skip: "skip_pipelines"},
+		Shell:               []string{"/bin/bash", "-e", "-c"},
+		PipelineEnv:         map[string]string{"DEPLOY": "true"},
+		PipelineAgents:      map[string]string{"queue": "deploy", "os": "linux"},
+		Templates:           true,
+		Mode:                "merge",
+		ResultsPolicy:       "any_passed",
+		ResultsTimeout:      10 * time.Minute,
+		ResultsPollInterval: 5 * time.Second,
+		TriggerRate:         5,
+		Stagger:             30 * time.Second,
+		UploadRetryBackoff:  250 * time.Millisecond,
+		OnEmptyDiff:         "default",
+		DiffProvider:        "command",
+		DiffSourcesMerge:    "union",
+		OnSchedule:          &ScheduleRun{Watches: []string{"service-*"}},
+		DiffRetries:         3,
+		DiffRetryBackoff:    5 * time.Second,
+		RedactedVars:        []string{"*_TOKEN"},
+		MaxStepsPerUpload:   100,
+		MaxTriggered:        10,
+		Overflow:            "trigger_all_step",
+		OverflowStep: &Step{
+			Trigger: "everything",
+			Build: Build{
+				Message: "fix: temp file not correctly deleted",
+				Branch:  "go-rewrite",
+				Commit:  "123",
+				Env: map[string]string{
+					"env1": "env-1",
+					"env2": "env-2",
+					"env3": "env-3",
+				},
+			},
+			Env: map[string]string{
+				"env1": "env-1",
+				"env2": "env-2",
+				"env3": "env-3",
+			},
+		},
 		Hooks: []HookConfig{
-			{Command: "some-hook-command"},
-			{Command: "another-hook-command"},
+			{Step: Step{Command: "some-hook-command"}},
+			{Step: Step{Command: "another-hook-command"}},
+			{Step: Step{
+				Command: "aggregate",
+				Label:   "Aggregate",
+				Key:     "aggregate",
+				Agents:  Agent{Queue: "reports"},
+				Env:     map[string]string{"FOO": "bar"},
+			}},
 		},
 		Env: map[string]string{
 			"env1": "env-1",
@@ -125,18 +267,24 @@ func TestPluginShouldUnmarshallCorrectly(t *testing.T) {
 		},
 		Watch: []WatchConfig{
 			{
-				Paths: []string{"watch-path-1"},
+				Paths:   []string{"watch-path-1"},
+				Label:   "Service 2",
+				Default: true,
 				Step: Step{
-					Trigger: "service-2",
+					Trigger:      "service-2",
+					WatchLabel:   "Service 2",
+					Organization: "other-org",
 					Env: map[string]string{
 						"env1": "env-1",
 						"env2": "env-2",
 						"env3": "env-3",
 					},
 					Build: Build{
-						Message: "some message",
-						Branch:  "go-rewrite",
-						Commit:  "123",
+						Message:    "some message",
+						Branch:     "go-rewrite",
+						Commit:     "123",
+						MetaData:   map[string]string{"release": "true"},
+						configured: true,
 						Env: map[string]string{
 							"env1": "env-1",
 							"env2": "env-2",
@@ -146,7 +294,8 @@ func TestPluginShouldUnmarshallCorrectly(t *testing.T) {
 				},
 			},
 			{
-				Paths: []string{"watch-path-1"},
+				Paths:    []string{"watch-path-1"},
+				Pipeline: "watch-path-1/.buildkite/pipeline.yml",
 				Step: Step{
 					Command: "echo hello-world",
 					Env: map[string]string{
@@ -162,9 +311,10 @@ func TestPluginShouldUnmarshallCorrectly(t *testing.T) {
 					Trigger: "service-1",
 					Label:   "hello",
 					Build: Build{
-						Message: "build message",
-						Branch:  "current branch",
-						Commit:  "commit-hash",
+						Message:    "build message",
+						Branch:     "current branch",
+						Commit:     "commit-hash",
+						configured: true,
 						Env: map[string]string{
 							"foo":  "bar",
 							"bar":  "foo",
@@ -190,3 +340,851 @@ func TestPluginShouldUnmarshallCorrectly(t *testing.T) {
 
 	assert.Equal(t, expected, got)
 }
+
+func TestPluginWithInvalidHooksPosition(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"hooks_position": "sideways"
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+
+	assert.EqualError(t, err, "failed to parse plugin configuration: unknown hooks_position `sideways`")
+}
+
+func TestPluginWithInvalidOverflow(t *testing.T) {
+	testCases := map[string]string{
+		`"overflow": "explode"`:          "unknown overflow policy `explode`",
+		`"overflow": "trigger_all_step"`: "overflow `trigger_all_step` requires `overflow_step` to be configured",
+	}
+
+	for config, expected := range testCases {
+		param := `[{
+			"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+				"max_triggered": 10,
+				` + config + `
+			}
+		}]`
+
+		_, err := initializePlugin(param)
+
+		assert.EqualError(t, err, "failed to parse plugin configuration: "+expected, config)
+	}
+}
+
+func TestPluginWithInvalidHookPhase(t *testing.T) {
+	for _, phase := range []string{"post-upload", "prediff", "Before"} {
+		param := `[{
+			"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+				"hooks": [{ "command": "echo hello", "phase": "` + phase + `" }]
+			}
+		}]`
+
+		_, err := initializePlugin(param)
+
+		assert.EqualError(t, err, "failed to parse plugin configuration: unknown hook phase `"+phase+"`, expected one of before, after, pre_diff, post_upload", phase)
+	}
+}
+
+func TestPluginWithInvalidUploadRetryBackoff(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"upload_retry_backoff": "soon"
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+
+	assert.EqualError(t, err, "failed to parse plugin configuration: invalid upload_retry_backoff: time: invalid duration \"soon\"")
+}
+
+func TestParseShell(t *testing.T) {
+	testCases := map[string]struct {
+		Raw      interface{}
+		Expected []string
+		Error    string
+	}{
+		"unset": {
+			Raw:      nil,
+			Expected: nil,
+		},
+		"string": {
+			Raw:      "bash -c",
+			Expected: []string{"bash", "-c"},
+		},
+		"none": {
+			Raw:      "none",
+			Expected: []string{"none"},
+		},
+		"array": {
+			Raw:      []interface{}{"/bin/bash", "-e", "-c"},
+			Expected: []string{"/bin/bash", "-e", "-c"},
+		},
+		"empty": {
+			Raw:   []interface{}{},
+			Error: "invalid shell: []",
+		},
+		"not a string": {
+			Raw:   []interface{}{"bash", 1},
+			Error: "invalid shell: 1 is not a string",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseShell(tc.Raw)
+
+			if tc.Error != "" {
+				assert.EqualError(t, err, tc.Error)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Expected, got)
+		})
+	}
+}
+
+func TestParseEnv(t *testing.T) {
+	os.Setenv("FROM_BUILD", "build value")
+	defer os.Unsetenv("FROM_BUILD")
+
+	testCases := map[string]struct {
+		Raw      interface{}
+		Expected map[string]string
+		Error    string
+	}{
+		"unset": {
+			Raw:      nil,
+			Expected: nil,
+		},
+		"list": {
+			Raw:      []interface{}{"FOO=bar", " SPACED = value ", "FROM_BUILD", "EMPTY="},
+			Expected: map[string]string{"FOO": "bar", "SPACED": "value", "FROM_BUILD": "build value", "EMPTY": ""},
+		},
+		"value with equals": {
+			Raw:      []interface{}{"QUERY=a=1&b=2"},
+			Expected: map[string]string{"QUERY": "a=1&b=2"},
+		},
+		"map": {
+			Raw:      map[string]interface{}{"FOO": "bar", "COUNT": float64(3), "DEBUG": true, "FROM_BUILD": nil},
+			Expected: map[string]string{"FOO": "bar", "COUNT": "3", "DEBUG": "true", "FROM_BUILD": "build value"},
+		},
+		"empty key": {
+			Raw:   []interface{}{"=bar"},
+			Error: "invalid env `=bar`, expected KEY=value",
+		},
+		"not a string": {
+			Raw:   []interface{}{"FOO=bar", 1.0},
+			Error: "invalid env `1`, expected KEY=value",
+		},
+		"nested value": {
+			Raw:   map[string]interface{}{"FOO": []interface{}{"bar"}},
+			Error: "invalid value of env FOO, expected a string",
+		},
+		"string": {
+			Raw:   "FOO=bar",
+			Error: "invalid env `FOO=bar`, expected a list or a map",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseEnv(tc.Raw)
+
+			if tc.Error != "" {
+				assert.EqualError(t, err, tc.Error)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Expected, got)
+		})
+	}
+}
+
+// envVars are variables with names like those of a shell, and values that
+// can contain `=` and spaces
+type envVars map[string]string
+
+func (envVars) Generate(r *rand.Rand, size int) reflect.Value {
+	const first = "ABCDEFGHIJKLMNOPQRSTUVWXYZ_"
+	const rest = first + "0123456789"
+	const values = "abc XYZ019=_-/:.,"
+
+	vars := envVars{}
+	for i := r.Intn(size + 1); i > 0; i-- {
+		name := []byte{first[r.Intn(len(first))]}
+		for j := r.Intn(16); j > 0; j-- {
+			name = append(name, rest[r.Intn(len(rest))])
+		}
+
+		value := []byte{}
+		for j := r.Intn(32); j > 0; j-- {
+			value = append(value, values[r.Intn(len(values))])
+		}
+
+		vars[string(name)] = string(value)
+	}
+
+	return reflect.ValueOf(vars)
+}
+
+// envProperty checks that env given as a list or a map parses back to the same
+// variables, for any values that survive the trimming of the list form
+func envProperty(vars envVars, asMap bool) bool {
+	expected := map[string]string{}
+	for key, value := range vars {
+		expected[key] = strings.TrimSpace(value)
+	}
+
+	var raw interface{} = expected
+	if !asMap {
+		list := []string{}
+		for key, value := range expected {
+			list = append(list, key+"="+value)
+		}
+		raw = list
+	}
+
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return false
+	}
+
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return false
+	}
+
+	got, err := parseEnv(decoded)
+
+	return err == nil && reflect.DeepEqual(expected, got)
+}
+
+func TestParseEnvProperties(t *testing.T) {
+	list := func(vars envVars) bool { return envProperty(vars, false) }
+	object := func(vars envVars) bool { return envProperty(vars, true) }
+
+	assert.NoError(t, quick.Check(list, nil))
+	assert.NoError(t, quick.Check(object, nil))
+}
+
+func TestPluginWithInvalidEnv(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [{ "path": "services/", "config": { "command": "echo", "env": "FOO=bar" } }]
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+
+	assert.EqualError(t, err, "failed to parse plugin configuration: invalid env `FOO=bar`, expected a list or a map")
+}
+
+func TestPluginWithEnvMap(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"env": { "DEPLOY_ENV": "staging" },
+			"watch": [{
+				"path": "services/",
+				"config": { "trigger": "services", "build": { "env": { "RETRIES": 3, "TOKEN": "a=b" } } }
+			}]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"DEPLOY_ENV": "staging", "RETRIES": "3", "TOKEN": "a=b"}, got.Watch[0].Step.Build.Env)
+}
+
+func TestPluginWithDiffArgs(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"diff": ["git", "diff", "--name-only", "origin/main...$BUILDKITE_COMMIT"]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"git", "diff", "--name-only", "origin/main...$BUILDKITE_COMMIT"}, got.DiffArgs)
+	assert.Equal(t, "git diff --name-only origin/main...$BUILDKITE_COMMIT", got.Diff)
+	assert.Nil(t, got.RawDiff)
+}
+
+func TestPluginWithBranchMap(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"branch_map": ["go-* -> develop", "* -> main"],
+			"watch": [
+				{ "path": "foo/", "config": { "trigger": "foo" } },
+				{ "path": "bar/", "config": { "trigger": "bar", "build": { "branch": "stable" } } }
+			]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "develop", got.Watch[0].Step.Build.Branch)
+	assert.Equal(t, "stable", got.Watch[1].Step.Build.Branch)
+}
+
+func TestPluginWithInvalidBranchMap(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"branch_map": ["release"]
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+
+	assert.EqualError(t, err, "failed to parse plugin configuration: invalid branch_map rule `release`, expected `pattern -> branch`")
+}
+
+func TestPluginWithEnvPassthrough(t *testing.T) {
+	os.Setenv("MY_REGION", "ap-southeast-2")
+	os.Setenv("DEPLOY_ENV", "staging")
+	defer os.Unsetenv("MY_REGION")
+	defer os.Unsetenv("DEPLOY_ENV")
+
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"env_passthrough": ["BUILDKITE_COMMIT", "DEPLOY_ENV", "MY_*"],
+			"watch": [
+				{ "path": "foo/", "config": { "trigger": "foo", "build": { "env": ["DEPLOY_ENV=production"] } } },
+				{ "path": "bar/", "config": { "command": "echo bar" } }
+			]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"BUILDKITE_COMMIT": "123",
+		"DEPLOY_ENV":       "production",
+		"MY_REGION":        "ap-southeast-2",
+	}, got.Watch[0].Step.Build.Env)
+	assert.Nil(t, got.Watch[1].Step.Build.Env)
+}
+
+func TestPluginWithPropagatedBuildVars(t *testing.T) {
+	os.Setenv("BUILDKITE_TAG", "v1.2.0")
+	os.Setenv("BUILDKITE_BUILD_CREATOR", "Jane Doe")
+	os.Setenv("BUILDKITE_BUILD_AUTHOR_EMAIL", "jane@example.com")
+	defer os.Unsetenv("BUILDKITE_TAG")
+	defer os.Unsetenv("BUILDKITE_BUILD_CREATOR")
+	defer os.Unsetenv("BUILDKITE_BUILD_AUTHOR_EMAIL")
+
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"propagate_tag": true,
+			"propagate_creator": true,
+			"watch": [
+				{ "path": "foo/", "config": { "trigger": "foo", "build": { "meta_data": { "parent-buildkite-tag": "v1" } } } },
+				{ "path": "bar/", "config": { "command": "echo bar" } }
+			]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"PARENT_BUILDKITE_TAG":                "v1.2.0",
+		"PARENT_BUILDKITE_BUILD_CREATOR":      "Jane Doe",
+		"PARENT_BUILDKITE_BUILD_AUTHOR_EMAIL": "jane@example.com",
+	}, got.Watch[0].Step.Build.Env)
+	assert.Equal(t, map[string]string{
+		"parent-buildkite-tag":                "v1",
+		"parent-buildkite-build-creator":      "Jane Doe",
+		"parent-buildkite-build-author-email": "jane@example.com",
+	}, got.Watch[0].Step.Build.MetaData)
+	assert.Nil(t, got.Watch[1].Step.Build.Env)
+
+	param = `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"propagate_tag": true,
+			"watch": [{ "path": "foo/", "config": { "trigger": "foo" } }]
+		}
+	}]`
+
+	got, err = initializePlugin(param)
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"PARENT_BUILDKITE_TAG": "v1.2.0"}, got.Watch[0].Step.Build.Env)
+}
+
+func TestPluginWithUnknownFanOut(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [{ "path": "services/", "fan_out": "file", "config": { "command": "echo" } }]
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+
+	assert.EqualError(t, err, "failed to parse plugin configuration: unknown fan_out `file`")
+}
+
+func TestPluginWithUnknownMode(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"mode": "inline",
+			"watch": [{ "path": "services/", "config": { "command": "echo" } }]
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+
+	assert.EqualError(t, err, "failed to parse plugin configuration: unknown mode `inline`")
+}
+
+func TestPluginWithUnknownDedupeRunning(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"dedupe_running": "cancel",
+			"watch": [{ "path": "services/", "config": { "trigger": "foo" } }]
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+
+	assert.EqualError(t, err, "failed to parse plugin configuration: unknown dedupe_running `cancel`")
+}
+
+func TestPluginWithUploadArgsAndAPIUpload(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"upload_method": "api",
+			"upload_args": ["--job", "job-id"],
+			"watch": [{ "path": "services/", "config": { "trigger": "foo" } }]
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+
+	assert.EqualError(t, err, "failed to parse plugin configuration: upload_args can't be used with upload_method `api`")
+}
+
+func TestPluginWithUpload(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [
+				{ "path": "services/foo/", "config": { "upload": "services/foo/.buildkite/pipeline.yml" } },
+				{ "path": "services/bar/", "config": { "upload": "services/bar/pipeline.yml", "label": "bar" } }
+			]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "buildkite-agent pipeline upload services/foo/.buildkite/pipeline.yml", got.Watch[0].Step.Command)
+	assert.Equal(t, ":pipeline: Upload services/foo/.buildkite/pipeline.yml", got.Watch[0].Step.Label)
+	assert.Equal(t, "buildkite-agent pipeline upload services/bar/pipeline.yml", got.Watch[1].Step.Command)
+	assert.Equal(t, "bar", got.Watch[1].Step.Label)
+}
+
+func TestPluginWithUploadAndTrigger(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [{ "path": "services/foo/", "config": { "upload": "pipeline.yml", "trigger": "foo" } }]
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+
+	assert.EqualError(t, err, "failed to parse plugin configuration: `upload` can't be combined with `command` or `trigger`")
+}
+
+func TestPluginWithUnknownReportUnmatched(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"report_unmatched": "artifact",
+			"watch": [{ "path": "services/", "config": { "command": "echo" } }]
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+
+	assert.EqualError(t, err, "failed to parse plugin configuration: unknown report_unmatched `artifact`")
+}
+
+func TestPluginWithTags(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [
+				{ "tags": "v*", "config": { "trigger": "release" } },
+				{ "tags": ["docs-*", "v*"], "config": { "trigger": "docs" } }
+			]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"v*"}, got.Watch[0].Tags)
+	assert.Equal(t, []string{"docs-*", "v*"}, got.Watch[1].Tags)
+	assert.Nil(t, got.Watch[1].RawTags)
+}
+
+func TestPluginWithTriggerDefaults(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"trigger_defaults": {
+				"build": {
+					"branch": "${BUILDKITE_BRANCH}",
+					"message": "${BUILDKITE_MESSAGE}",
+					"meta_data": { "source": "monorepo" },
+					"env": ["BUILDKITE_PULL_REQUEST=${BUILDKITE_PULL_REQUEST}", "DEPLOY_ENV=staging"]
+				}
+			},
+			"watch": [
+				{ "path": "foo/", "config": { "trigger": "foo", "build": { "branch": "main", "env": ["DEPLOY_ENV=production"] } } },
+				{ "path": "bar/", "config": { "command": "echo bar" } }
+			]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+
+	assert.NoError(t, err)
+	assert.Equal(t, Build{
+		Branch:   "main",
+		Message:  "${BUILDKITE_MESSAGE}",
+		Commit:   "123",
+		MetaData: map[string]string{"source": "monorepo"},
+		Env: map[string]string{
+			"BUILDKITE_PULL_REQUEST": "${BUILDKITE_PULL_REQUEST}",
+			"DEPLOY_ENV":             "production",
+		},
+		configured: true,
+	}, got.Watch[0].Step.Build)
+	assert.Equal(t, Build{}, got.Watch[1].Step.Build)
+}
+
+func TestPluginWithWaitAttributes(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"wait": { "label": "Fan-in", "continue_on_failure": true },
+			"watch": [{ "path": "services/", "config": { "command": "echo" } }]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+
+	assert.NoError(t, err)
+	assert.True(t, got.Wait)
+	assert.Equal(t, map[string]interface{}{"label": "Fan-in", "continue_on_failure": true}, got.WaitAttributes)
+	assert.Nil(t, got.RawWait)
+}
+
+func TestPluginWithInvalidWait(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"wait": "yes",
+			"watch": [{ "path": "services/", "config": { "command": "echo" } }]
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+
+	assert.EqualError(t, err, "failed to parse plugin configuration: invalid wait `yes`")
+}
+
+func TestInitializePluginsWithMultipleInvocations(t *testing.T) {
+	param := `[
+		{ "github.com/chronotc/monorepo-diff-buildkite-plugin#commit": { "diff": "git diff --name-only HEAD~1" } },
+		{ "github.com/example/other-plugin#v1.0.0": {} },
+		{ "github.com/chronotc/monorepo-diff-buildkite-plugin#commit": { "diff": "cat changed.txt" } }
+	]`
+
+	got, err := initializePlugins(param)
+
+	assert.NoError(t, err)
+	assert.Len(t, got, 2)
+	assert.Equal(t, "git diff --name-only HEAD~1", got[0].Diff)
+	assert.Equal(t, "cat changed.txt", got[1].Diff)
+}
+
+func TestLoadPlugins(t *testing.T) {
+	invocation := `{ "github.com/chronotc/monorepo-diff-buildkite-plugin#commit": { "diff": "echo plugins" } }`
+
+	testCases := map[string]struct {
+		plugins       string
+		configuration string
+		expected      []string
+	}{
+		"plugins": {
+			plugins:  "[" + invocation + "]",
+			expected: []string{"echo plugins"},
+		},
+		"configuration": {
+			configuration: `{ "diff": "echo configuration" }`,
+			expected:      []string{"echo configuration"},
+		},
+		"configuration of one of the plugins": {
+			plugins:       "[" + invocation + "]",
+			configuration: `{ "diff": "echo configuration" }`,
+			expected:      []string{"echo configuration"},
+		},
+		"multiple invocations": {
+			plugins:       "[" + invocation + "," + invocation + "]",
+			configuration: `{ "diff": "echo configuration" }`,
+			expected:      []string{"echo plugins", "echo plugins"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			os.Setenv("BUILDKITE_PLUGINS", tc.plugins)
+			defer os.Unsetenv("BUILDKITE_PLUGINS")
+
+			if tc.configuration != "" {
+				os.Setenv("BUILDKITE_PLUGIN_CONFIGURATION", tc.configuration)
+				defer os.Unsetenv("BUILDKITE_PLUGIN_CONFIGURATION")
+			}
+
+			got, err := loadPlugins()
+			assert.NoError(t, err)
+
+			diffs := []string{}
+			for _, p := range got {
+				diffs = append(diffs, p.Diff)
+			}
+			assert.Equal(t, tc.expected, diffs)
+		})
+	}
+}
+
+func TestLoadPluginsWithInvalidConfiguration(t *testing.T) {
+	os.Setenv("BUILDKITE_PLUGIN_CONFIGURATION", `{ "diff": `)
+	defer os.Unsetenv("BUILDKITE_PLUGIN_CONFIGURATION")
+
+	_, err := loadPlugins()
+
+	assert.EqualError(t, err, "failed to parse plugin configuration: unexpected end of JSON input")
+}
+
+func TestPluginWithScriptMatcher(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [{ "matcher": "script", "script": "ext == \".sql\"", "config": { "trigger": "migrations" } }]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+
+	assert.NoError(t, err)
+	assert.NotNil(t, got.Watch[0].script)
+
+	for matcher, expected := range map[string]string{
+		`"matcher": "regex"`:                      "unknown matcher `regex`",
+		`"matcher": "script", "script": "ext =="`: "invalid script `ext ==`: unexpected end of script",
+		`"matcher": "command"`:                    "matcher `command` needs a script",
+	} {
+		param := `[{
+			"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+				"watch": [{ ` + matcher + `, "config": { "trigger": "migrations" } }]
+			}
+		}]`
+
+		_, err := initializePlugin(param)
+
+		assert.EqualError(t, err, "failed to parse plugin configuration: "+expected, matcher)
+	}
+}
+
+func TestPluginWithNotify(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [{
+				"path": "services/payments/",
+				"notify": [{ "slack": "#payments" }],
+				"config": { "command": "make deploy", "notify": [{ "github_commit_status": { "context": "deploy" } }] }
+			}]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"github_commit_status": map[string]interface{}{"context": "deploy"}},
+		map[string]interface{}{"slack": "#payments"},
+	}, got.Watch[0].Step.Notify)
+
+	for notify, expected := range map[string]string{
+		`[{ "email": "team@example.com" }]`: "notify `email` isn't supported on steps",
+		`["#payments"]`:                     "invalid notify `#payments`",
+	} {
+		param := `[{
+			"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+				"watch": [{ "path": "services/", "notify": ` + notify + `, "config": { "command": "make" } }]
+			}
+		}]`
+
+		_, err := initializePlugin(param)
+
+		assert.EqualError(t, err, "failed to parse plugin configuration: "+expected, notify)
+	}
+}
+
+func TestPluginWithOwnership(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [
+				{ "path": "services/payments/", "owner": "@jane", "team": "payments", "config": { "trigger": "deploy-payments" } },
+				{ "path": "docs/", "team": "docs", "config": { "command": "make docs", "env": ["A=1"] } },
+				{ "path": "tools/", "config": { "command": "make tools" } }
+			]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "@jane", got.Watch[0].Step.Owner)
+	assert.Equal(t, "payments", got.Watch[0].Step.Team)
+	assert.Equal(t, "@jane", got.Watch[0].Step.Build.Env[ownerEnv])
+	assert.Equal(t, "payments", got.Watch[0].Step.Build.Env[teamEnv])
+	assert.Equal(t, map[string]string{"A": "1", teamEnv: "docs"}, got.Watch[1].Step.Env)
+	assert.Empty(t, got.Watch[2].Step.Env)
+	assert.Empty(t, got.Watch[2].Step.Team)
+}
+
+func TestPluginWithTriggerConcurrencyGroup(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [
+				{ "path": "services/payments/", "trigger_concurrency_group": "deploy-payments", "config": { "trigger": "deploy-payments" } },
+				{ "path": "services/search/", "trigger_concurrency_group": "deploy", "trigger_concurrency": 2, "config": { "trigger": "deploy-search" } }
+			]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "deploy-payments", got.Watch[0].Step.ConcurrencyGroup)
+	assert.Equal(t, 1, got.Watch[0].Step.Concurrency)
+	assert.Equal(t, "deploy", got.Watch[1].Step.ConcurrencyGroup)
+	assert.Equal(t, 2, got.Watch[1].Step.Concurrency)
+
+	for watch, expected := range map[string]string{
+		`{ "path": "services/", "trigger_concurrency_group": "deploy", "config": { "command": "make" } }`: "trigger_concurrency_group `deploy` needs a trigger step",
+		`{ "path": "services/", "trigger_concurrency": 2, "config": { "trigger": "deploy" } }`:            "trigger_concurrency needs a trigger_concurrency_group",
+	} {
+		param := `[{
+			"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+				"watch": [` + watch + `]
+			}
+		}]`
+
+		_, err := initializePlugin(param)
+
+		assert.EqualError(t, err, "failed to parse plugin configuration: "+expected, watch)
+	}
+}
+
+func TestPluginPassesUnknownScalarAttributesThrough(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [
+				{
+					"path": "services/",
+					"config": {
+						"trigger": "deploy",
+						"skip_queue": true,
+						"Label": "Deploy",
+						"soft_fail": "maybe",
+						"retry": { "automatic": true },
+						"timeout_in_minutes": 10
+					}
+				},
+				{ "path": "docs/", "config": { "command": "make docs" } }
+			]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "Deploy", got.Watch[0].Step.Label)
+	assert.Equal(t, map[string]interface{}{
+		"skip_queue":         true,
+		"soft_fail":          "maybe",
+		"timeout_in_minutes": float64(10),
+	}, got.Watch[0].Step.Extra)
+	assert.Nil(t, got.Watch[1].Step.Extra)
+}
+
+func TestPluginWithUnknownDiffProvider(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"diff_provider": "svn",
+			"watch": [{ "path": "services/", "config": { "command": "echo" } }]
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+
+	assert.EqualError(t, err, "failed to parse plugin configuration: unknown diff_provider `svn`")
+}
+
+func TestPluginWithInvalidCapturePath(t *testing.T) {
+	param := `[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [{ "path": "services/(?P<svc>[^/]+/**", "config": { "command": "echo" } }]
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+
+	assert.EqualError(t, err, "failed to parse plugin configuration: invalid path `services/(?P<svc>[^/]+/**`: unclosed capture group")
+}
+
+func TestPluginWithStaleAfter(t *testing.T) {
+	for options, expected := range map[string]string{
+		`"diff_base": "origin/main...HEAD"`:                 "",
+		`"diff_provider": "git"`:                            "",
+		`"diff": "git diff --name-only origin/main...HEAD"`: "stale_after needs a diff_base or the git diff_provider",
+	} {
+		param := `[{
+			"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+				` + options + `,
+				"watch": [{ "path": "services/", "stale_after": "720h", "config": { "trigger": "deploy" } }]
+			}
+		}]`
+
+		got, err := initializePlugin(param)
+
+		if expected == "" {
+			assert.NoError(t, err, options)
+			assert.Equal(t, 720*time.Hour, got.Watch[0].StaleAfter, options)
+		} else {
+			assert.EqualError(t, err, "failed to parse plugin configuration: "+expected, options)
+		}
+	}
+}
+
+func TestPluginWithPrintedOutput(t *testing.T) {
+	for options, expected := range map[string]string{
+		`"output": "stdout", "wait_for_results": true`:                                 "wait_for_results can't be used with output `stdout`",
+		`"output": "stdout", "github_status": true`:                                    "github_status can't be used with output `stdout`",
+		`"output": "github_actions", "slack_webhook": "https://hooks"`:                 "slack_webhook can't be used with output `github_actions`",
+		`"output": "stdout", "hooks": [{ "command": "echo", "phase": "post_upload" }]`: "post_upload hooks can't be used with output `stdout`",
+	} {
+		_, err := initializePluginConfiguration(`{` + options + `, "watch": []}`)
+
+		assert.EqualError(t, err, "failed to parse plugin configuration: "+expected, options)
+	}
+
+	_, err := initializePluginConfiguration(`{"output": "stdout", "hooks": [{ "command": "echo" }], "watch": []}`)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// policyTriggers returns the patterns of the `allowed_triggers_policy` file
+func policyTriggers(plugin Plugin) ([]string, error) {
+	dir, file, err := policyLocation(plugin.AllowedTriggersPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := fetchSigned(dir, file, plugin.ConfigSignature)
+	if err != nil {
+		return nil, fmt.Errorf("could not load allowed_triggers_policy: %v", err)
+	}
+
+	var policy struct {
+		AllowedTriggers []string `yaml:"allowed_triggers"`
+	}
+	if err := yaml.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("invalid allowed_triggers_policy: %v", err)
+	}
+
+	// a policy allowing nothing still restricts the triggers
+	return append([]string{}, policy.AllowedTriggers...), nil
+}
+
+// policyLocation splits the location of a policy file into the registry it is
+// read from like a preset and the file. The file of a `git+` repository
+// follows `//`, e.g. `git+https://github.com/org/policies.git//ci/triggers.yml#main`,
+// since both branches and paths can contain slashes.
+func policyLocation(location string) (string, string, error) {
+	if !strings.HasPrefix(location, "git+") {
+		if i := strings.LastIndex(location, "/"); i >= 0 {
+			return location[:i], location[i+1:], nil
+		}
+		return ".", location, nil
+	}
+
+	branch := ""
+	if i := strings.LastIndex(location, "#"); i >= 0 {
+		location, branch = location[:i], location[i:]
+	}
+
+	start := len("git+")
+	if i := strings.Index(location, "://"); i >= 0 {
+		start = i + len("://")
+	}
+
+	i := strings.Index(location[start:], "//")
+	if i < 0 || start+i+2 == len(location) {
+		return "", "", fmt.Errorf("invalid allowed_triggers_policy `%s`, expected the file after `//`", location+branch)
+	}
+
+	return location[:start+i] + branch, location[start+i+2:], nil
+}
+
+// checkAllowedTriggers fails when a trigger step or hook triggers a pipeline
+// that isn't allowed. With a policy file, a trigger has to be allowed by the
+// policy, and by `allowed_triggers` when it is set, so a repository can only
+// narrow the policy of its organization. The triggers of merged steps, of the
+// groups written by the extension and of steps uploaded by a command step of
+// their own are checked too.
+func checkAllowedTriggers(plugin Plugin, steps []Step) error {
+	if len(plugin.AllowedTriggers) == 0 && plugin.AllowedTriggersPolicy == "" {
+		return nil
+	}
+
+	allowed := func(slug string) bool {
+		return len(plugin.AllowedTriggers) == 0 || matchesAny(plugin.AllowedTriggers, slug)
+	}
+
+	if plugin.AllowedTriggersPolicy != "" {
+		policy, err := policyTriggers(plugin)
+		if err != nil {
+			return err
+		}
+
+		local := allowed
+		allowed = func(slug string) bool {
+			return matchesAny(policy, slug) && local(slug)
+		}
+	}
+
+	all := append([]Step{}, steps...)
+	for _, h := range plugin.Hooks {
+		all = append(all, h.Step)
+	}
+
+	org := env("BUILDKITE_ORGANIZATION_SLUG", "")
+	denied := map[string]bool{}
+
+	for _, s := range all {
+		slugs, err := stepTriggers(s, org)
+		if err != nil {
+			return err
+		}
+
+		for _, slug := range slugs {
+			if !allowed(slug) {
+				denied[slug] = true
+			}
+		}
+	}
+
+	if len(denied) == 0 {
+		return nil
+	}
+
+	slugs := make([]string, 0, len(denied))
+	for slug := range denied {
+		slugs = append(slugs, slug)
+	}
+	sort.Strings(slugs)
+
+	return fmt.Errorf("%s not allowed by allowed_triggers: %s", pluralize(len(slugs), "trigger pipeline"), strings.Join(slugs, ", "))
+}
+
+// stepTriggers returns the pipelines a step triggers, including those of the
+// steps it holds as is or uploads with `MONOREPO_DIFF_PIPELINE`
+func stepTriggers(s Step, org string) ([]string, error) {
+	if s.Raw != nil {
+		return rawTriggers(s.Raw), nil
+	}
+
+	if deferred, ok := s.Env[deferredPipelineVar]; ok {
+		var pipeline yaml.MapSlice
+		if err := yaml.Unmarshal([]byte(deferred), &pipeline); err != nil {
+			return nil, fmt.Errorf("could not parse the pipeline of `%s`: %v", stepName(s), err)
+		}
+		return rawTriggers(pipeline), nil
+	}
+
+	if s.Trigger == "" {
+		return nil, nil
+	}
+
+	if s.Organization != "" && s.Organization != org {
+		return []string{s.Organization + "/" + s.Trigger}, nil
+	}
+
+	return []string{s.Trigger}, nil
+}
+
+// rawTriggers returns the `trigger` of a step kept as YAML and of the steps
+// nested in it, e.g. those of a group
+func rawTriggers(value interface{}) []string {
+	attributes, ok := value.(yaml.MapSlice)
+	if !ok {
+		return nil
+	}
+
+	triggers := []string{}
+	for _, item := range attributes {
+		switch item.Key {
+		case "trigger":
+			if slug, ok := item.Value.(string); ok && slug != "" {
+				triggers = append(triggers, slug)
+			}
+		case "steps":
+			nested, _ := item.Value.([]interface{})
+			for _, step := range nested {
+				triggers = append(triggers, rawTriggers(step)...)
+			}
+		}
+	}
+
+	return triggers
+}
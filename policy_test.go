@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckAllowedTriggers(t *testing.T) {
+	os.Setenv("BUILDKITE_ORGANIZATION_SLUG", "org")
+	defer os.Unsetenv("BUILDKITE_ORGANIZATION_SLUG")
+
+	steps := []Step{
+		{Trigger: "payments"},
+		{Trigger: "platform-deploy"},
+		{Command: "make test"},
+		{Trigger: "billing", Organization: "finance"},
+		{Trigger: "search", Organization: "org"},
+	}
+
+	testCases := map[string]struct {
+		allowed []string
+		hooks   []HookConfig
+		err     string
+	}{
+		"not restricted": {nil, nil, ""},
+		"all allowed":    {[]string{"payments", "platform-*", "finance/billing", "search"}, nil, ""},
+		"denied":         {[]string{"platform-*", "billing"}, nil, "trigger pipelines not allowed by allowed_triggers: finance/billing, payments, search"},
+		"denied hook": {
+			[]string{"payments", "platform-*", "finance/*", "search"},
+			[]HookConfig{{Step: Step{Trigger: "notify"}}},
+			"trigger pipeline not allowed by allowed_triggers: notify",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := checkAllowedTriggers(Plugin{AllowedTriggers: tc.allowed, Hooks: tc.hooks}, steps)
+
+			if tc.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tc.err)
+		})
+	}
+}
+
+func TestCheckAllowedTriggersNestedSteps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	pipeline := filepath.Join(dir, "pipeline.yml")
+	assert.NoError(t, ioutil.WriteFile(pipeline, []byte(`steps:
+  - trigger: merged
+  - group: deploy
+    steps:
+      - trigger: merged-group
+`), 0600))
+
+	merged, err := readPipelineSteps(pipeline, "")
+	assert.NoError(t, err)
+
+	group, err := extensionStep([]byte(`{"group": "extension", "steps": [{"trigger": "extension-group"}]}`))
+	assert.NoError(t, err)
+
+	deferred, err := deferUpload(Step{Trigger: "deferred"})
+	assert.NoError(t, err)
+
+	testCases := map[string]struct {
+		steps []Step
+		err   string
+	}{
+		"merge":     {merged, "trigger pipelines not allowed by allowed_triggers: merged, merged-group"},
+		"extension": {[]Step{group}, "trigger pipeline not allowed by allowed_triggers: extension-group"},
+		"deferred":  {[]Step{deferred}, "trigger pipeline not allowed by allowed_triggers: deferred"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := checkAllowedTriggers(Plugin{AllowedTriggers: []string{"payments"}}, tc.steps)
+			assert.EqualError(t, err, tc.err)
+
+			assert.NoError(t, checkAllowedTriggers(Plugin{AllowedTriggers: []string{"merged*", "extension-*", "deferred"}}, tc.steps))
+		})
+	}
+}
+
+func TestPolicyLocation(t *testing.T) {
+	testCases := map[string]struct {
+		location string
+		registry string
+		file     string
+	}{
+		"http":       {"https://policies.example.com/ci/triggers.yml", "https://policies.example.com/ci", "triggers.yml"},
+		"local":      {"triggers.yml", ".", "triggers.yml"},
+		"git":        {"git+https://github.com/org/policies.git//ci/triggers.yml#release/v2", "git+https://github.com/org/policies.git#release/v2", "ci/triggers.yml"},
+		"git ssh":    {"git+git@github.com:org/policies.git//triggers.yml", "git+git@github.com:org/policies.git", "triggers.yml"},
+		"git branch": {"git+https://github.com/org/policies.git//triggers.yml#main", "git+https://github.com/org/policies.git#main", "triggers.yml"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			registry, file, err := policyLocation(tc.location)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.registry, registry)
+			assert.Equal(t, tc.file, file)
+		})
+	}
+
+	_, _, err := policyLocation("git+https://github.com/org/policies.git#main")
+	assert.EqualError(t, err, "invalid allowed_triggers_policy `git+https://github.com/org/policies.git#main`, expected the file after `//`")
+}
+
+func TestCheckAllowedTriggersPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/policies/triggers.yml", r.URL.Path)
+		_, _ = w.Write([]byte("allowed_triggers:\n  - payments\n  - docs\n"))
+	}))
+	defer server.Close()
+
+	plugin := Plugin{AllowedTriggersPolicy: server.URL + "/policies/triggers.yml"}
+
+	assert.NoError(t, checkAllowedTriggers(plugin, []Step{{Trigger: "payments"}, {Trigger: "docs"}}))
+	assert.EqualError(
+		t,
+		checkAllowedTriggers(plugin, []Step{{Trigger: "ledger"}}),
+		"trigger pipeline not allowed by allowed_triggers: ledger",
+	)
+
+	// the repository can narrow the policy, but not widen it
+	plugin.AllowedTriggers = []string{"docs", "ledger"}
+	assert.NoError(t, checkAllowedTriggers(plugin, []Step{{Trigger: "docs"}}))
+	assert.EqualError(
+		t,
+		checkAllowedTriggers(plugin, []Step{{Trigger: "payments"}, {Trigger: "ledger"}}),
+		"trigger pipelines not allowed by allowed_triggers: ledger, payments",
+	)
+
+	plugin.AllowedTriggers = []string{"*"}
+	assert.Error(t, checkAllowedTriggers(plugin, []Step{{Trigger: "ledger"}}))
+
+	plugin.AllowedTriggersPolicy = server.URL + "/missing.yml"
+	server.Config.Handler = http.NotFoundHandler()
+	assert.EqualError(
+		t,
+		checkAllowedTriggers(plugin, []Step{{Trigger: "docs"}}),
+		"could not load allowed_triggers_policy: GET "+server.URL+"/missing.yml: 404 Not Found",
+	)
+}
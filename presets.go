@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// presetScheme prefixes the names of the presets of the registry in `extends`
+const presetScheme = "org://"
+
+// presetRegistryEnv is the registry used without `preset_registry`, so a
+// platform team can set it in the environment of the agents
+const presetRegistryEnv = "MONOREPO_DIFF_PRESET_REGISTRY"
+
+// presetTokenEnv is the token sent to an HTTP registry
+const presetTokenEnv = "MONOREPO_DIFF_PRESET_TOKEN"
+
+// extendPlugin prepends the watches of the presets listed in `extends` to the
+// watches of the configuration, and returns the resulting configuration.
+// Configurations without `extends` are returned as they are. It is run on the
+// raw configuration before it is parsed, so parsing doesn't read the registry.
+func extendPlugin(data []byte) ([]byte, error) {
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return data, nil
+	}
+
+	names, err := presetNames(config["extends"])
+	if err != nil || len(names) == 0 {
+		return data, err
+	}
+
+	registry, _ := config["preset_registry"].(string)
+	if registry == "" {
+		registry = env(presetRegistryEnv, "")
+	}
+	if registry == "" {
+		return nil, fmt.Errorf("extends needs a preset_registry")
+	}
+
+	sig, err := configSignature(config)
+	if err != nil {
+		return nil, err
+	}
+
+	watch := []interface{}{}
+	for _, name := range names {
+		preset, err := loadPreset(registry, name, sig)
+		if err != nil {
+			return nil, err
+		}
+		watch = append(watch, preset...)
+	}
+
+	if local, ok := config["watch"].([]interface{}); ok {
+		watch = append(watch, local...)
+	}
+	config["watch"] = watch
+
+	log.Debugf("Extended the configuration with %s", strings.Join(names, ", "))
+
+	return json.Marshal(config)
+}
+
+// presetNames returns the names of the presets of `extends`, a preset or a list of presets
+func presetNames(raw interface{}) ([]string, error) {
+	var refs []string
+
+	switch extends := raw.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		refs = []string{extends}
+	case []interface{}:
+		for _, e := range extends {
+			refs = append(refs, fmt.Sprint(e))
+		}
+	default:
+		return nil, fmt.Errorf("invalid extends, expected a preset or a list of presets")
+	}
+
+	names := []string{}
+	for _, ref := range refs {
+		name := strings.TrimPrefix(ref, presetScheme)
+		if name == ref || name == "" || strings.Contains(name, "..") {
+			return nil, fmt.Errorf("invalid preset `%s`, expected %s<name>", ref, presetScheme)
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// loadPreset returns the watches of the preset `<name>.yml` of the registry,
+// after verifying its signature when sig is set
+func loadPreset(registry string, name string, sig *ConfigSignature) ([]interface{}, error) {
+	data, err := fetchSigned(registry, name+".yml", sig)
+	if err != nil {
+		return nil, fmt.Errorf("could not load preset `%s`: %v", name, err)
+	}
+
+	var preset struct {
+		Watch []interface{} `yaml:"watch"`
+	}
+	if err := yaml.Unmarshal(data, &preset); err != nil {
+		return nil, fmt.Errorf("invalid preset `%s`: %v", name, err)
+	}
+
+	watch := jsonCompatible(preset.Watch).([]interface{})
+	if len(watch) == 0 {
+		return nil, fmt.Errorf("preset `%s` has no watch", name)
+	}
+
+	return watch, nil
+}
+
+// fetchPreset reads the file of the registry, an HTTP URL, an `s3://` bucket,
+// a `git+` repository or a local directory. It also reads policy files.
+func fetchPreset(registry string, file string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(registry, "https://") || strings.HasPrefix(registry, "http://"):
+		return fetchHTTPPreset(strings.TrimSuffix(registry, "/") + "/" + file)
+	case strings.HasPrefix(registry, "s3://"):
+		out, err := executeCommand("aws", []string{"s3", "cp", strings.TrimSuffix(registry, "/") + "/" + file, "-"})
+		return []byte(out), err
+	case strings.HasPrefix(registry, "git+"):
+		return readGitFile(strings.TrimPrefix(registry, "git+"), file)
+	default:
+		return ioutil.ReadFile(filepath.Join(strings.TrimPrefix(registry, "file://"), file))
+	}
+}
+
+func fetchHTTPPreset(url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(jobContext, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if token := env(presetTokenEnv, ""); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// readGitFile reads the file of the repository, e.g.
+// `https://github.com/org/presets.git#main`, from a shallow clone that is
+// removed once the file is read
+func readGitFile(repo string, file string) ([]byte, error) {
+	args := []string{"clone", "--quiet", "--depth", "1"}
+	url := repo
+	if i := strings.LastIndex(repo, "#"); i >= 0 {
+		url = repo[:i]
+		args = append(args, "--branch", repo[i+1:])
+	}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "monorepo-diff-presets")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := executeCommand("git", append(args, url, dir)); err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(filepath.Join(dir, file))
+}
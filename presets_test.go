@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const terraformPreset = `
+watch:
+  - path: "**/*.tf"
+    config:
+      trigger: terraform-plan
+`
+
+func TestPluginExtendsLocalRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "presets")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "terraform.yml"), []byte(terraformPreset), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "docs.yml"), []byte("watch:\n  - path: docs/\n    config:\n      command: make docs\n"), 0644))
+
+	plugin, err := initializePluginConfiguration(`{
+		"extends": ["org://terraform", "org://docs"],
+		"preset_registry": "` + dir + `",
+		"watch": [{"path": "services/foo/", "config": {"trigger": "foo"}}]
+	}`)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"terraform", "docs"}, plugin.Extends)
+	assert.Len(t, plugin.Watch, 3)
+	assert.Equal(t, []string{"**/*.tf"}, plugin.Watch[0].Paths)
+	assert.Equal(t, "terraform-plan", plugin.Watch[0].Step.Trigger)
+	assert.Equal(t, "make docs", plugin.Watch[1].Step.Command)
+	assert.Equal(t, "foo", plugin.Watch[2].Step.Trigger)
+}
+
+func TestPluginExtendsGitRegistry(t *testing.T) {
+	repo, err := ioutil.TempDir("", "presets")
+	assert.NoError(t, err)
+	defer os.RemoveAll(repo)
+
+	tmp, err := ioutil.TempDir("", "tmp")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(repo, "terraform.yml"), []byte(terraformPreset), 0644))
+	for _, args := range [][]string{
+		{"init", "--quiet", "--initial-branch", "main"},
+		{"add", "terraform.yml"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "presets"},
+	} {
+		_, err := executeCommand("git", append([]string{"-C", repo}, args...))
+		assert.NoError(t, err)
+	}
+
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmp)
+
+	plugin, err := initializePluginConfiguration(`{"extends": "org://terraform", "preset_registry": "git+` + repo + `#main"}`)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "terraform-plan", plugin.Watch[0].Step.Trigger)
+
+	// the clone is removed once the preset is read
+	left, _ := ioutil.ReadDir(tmp)
+	assert.Empty(t, left)
+}
+
+func TestPluginExtendsHTTPRegistry(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer preset-token", r.Header.Get("Authorization"))
+
+		if r.URL.Path != "/presets/terraform.yml" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(terraformPreset))
+	}))
+	defer server.Close()
+
+	os.Setenv(presetRegistryEnv, server.URL+"/presets/")
+	os.Setenv(presetTokenEnv, "preset-token")
+	defer os.Unsetenv(presetRegistryEnv)
+	defer os.Unsetenv(presetTokenEnv)
+
+	plugin, err := initializePluginConfiguration(`{"extends": "org://terraform"}`)
+
+	assert.NoError(t, err)
+	assert.Len(t, plugin.Watch, 1)
+	assert.Equal(t, "terraform-plan", plugin.Watch[0].Step.Trigger)
+
+	_, err = extendPlugin([]byte(`{"extends": "org://protos"}`))
+	assert.EqualError(t, err, "could not load preset `protos`: GET "+server.URL+"/presets/protos.yml: 404 Not Found")
+}
+
+func TestPresetNames(t *testing.T) {
+	testCases := map[string]struct {
+		raw      interface{}
+		expected []string
+		err      string
+	}{
+		"none":    {nil, nil, ""},
+		"single":  {"org://docs", []string{"docs"}, ""},
+		"list":    {[]interface{}{"org://docs", "org://protos"}, []string{"docs", "protos"}, ""},
+		"scheme":  {"docs", nil, "invalid preset `docs`, expected org://<name>"},
+		"parent":  {"org://../secrets", nil, "invalid preset `org://../secrets`, expected org://<name>"},
+		"invalid": {true, nil, "invalid extends, expected a preset or a list of presets"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := presetNames(tc.raw)
+
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, got)
+		})
+	}
+}
+
+func TestExtendPluginWithoutRegistry(t *testing.T) {
+	_, err := extendPlugin([]byte(`{"extends": "org://docs"}`))
+
+	assert.EqualError(t, err, "extends needs a preset_registry")
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// log formats
+const (
+	logFormatText   = "text"
+	logFormatPretty = "pretty"
+)
+
+// ANSI colors of the pretty log format
+const (
+	colorReset  = "\x1b[0m"
+	colorBold   = "\x1b[1m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorGray   = "\x1b[90m"
+)
+
+// prettyLogs is set with `log_format: pretty`
+var prettyLogs = false
+
+// colorize wraps s in the color, unless colors are disabled with NO_COLOR
+func colorize(color string, s string) string {
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return s
+	}
+
+	return color + s + colorReset
+}
+
+// prettyFormatter formats log entries for humans reading the build log, with
+// the level as a colored symbol instead of a timestamp and level fields
+type prettyFormatter struct{}
+
+func (prettyFormatter) Format(entry *log.Entry) ([]byte, error) {
+	var b bytes.Buffer
+
+	switch entry.Level {
+	case log.PanicLevel, log.FatalLevel, log.ErrorLevel:
+		b.WriteString(colorize(colorRed, "✖ "+entry.Message))
+	case log.WarnLevel:
+		b.WriteString(colorize(colorYellow, "⚠ "+entry.Message))
+	case log.DebugLevel, log.TraceLevel:
+		b.WriteString(colorize(colorGray, "  "+entry.Message))
+	default:
+		b.WriteString("  " + entry.Message)
+	}
+
+	b.WriteByte('\n')
+
+	return b.Bytes(), nil
+}
+
+// matchTable renders the generated steps as an aligned table with the watch
+// of each step and the number of files it matched, when they are known
+func matchTable(steps []Step, watches []watchReport) string {
+	files := map[string]int{}
+	for _, w := range watches {
+		if len(w.Files) > 0 {
+			files[w.Step] += len(w.Files)
+		}
+	}
+
+	rows := [][3]string{}
+	for _, s := range steps {
+		if s.Wait {
+			continue
+		}
+
+		watch := s.WatchLabel
+		if watch == "" {
+			watch = "-"
+		}
+
+		plain := s
+		plain.WatchLabel = ""
+
+		count := "-"
+		if n, ok := files[stepName(s)]; ok {
+			count = fmt.Sprint(n)
+		}
+
+		rows = append(rows, [3]string{watch, stepName(plain), count})
+	}
+
+	header := [3]string{"WATCH", "STEP", "FILES"}
+	widths := [2]int{}
+	for _, row := range append(rows, header) {
+		for i := range widths {
+			if n := utf8.RuneCountInString(row[i]); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	line := func(row [3]string) string {
+		return fmt.Sprintf("%s  %s  %s", pad(row[0], widths[0]), pad(row[1], widths[1]), row[2])
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "  %s\n", colorize(colorBold, line(header)))
+	for _, row := range rows {
+		fmt.Fprintf(&b, "%s %s\n", colorize(colorGreen, "✔"), line(row))
+	}
+
+	return b.String()
+}
+
+// pad pads s with spaces to the width in runes
+func pad(s string, width int) string {
+	return s + strings.Repeat(" ", width-utf8.RuneCountInString(s))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrettyFormatter(t *testing.T) {
+	os.Setenv("NO_COLOR", "1")
+	defer os.Unsetenv("NO_COLOR")
+
+	testCases := map[string]struct {
+		level    log.Level
+		expected string
+	}{
+		"info":  {log.InfoLevel, "  Read 3 changed files\n"},
+		"warn":  {log.WarnLevel, "⚠ Read 3 changed files\n"},
+		"error": {log.ErrorLevel, "✖ Read 3 changed files\n"},
+		"debug": {log.DebugLevel, "  Read 3 changed files\n"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := prettyFormatter{}.Format(&log.Entry{Level: tc.level, Message: "Read 3 changed files"})
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, string(got))
+		})
+	}
+}
+
+func TestPrettyFormatterColors(t *testing.T) {
+	got, _ := prettyFormatter{}.Format(&log.Entry{Level: log.WarnLevel, Message: "slow diff"})
+
+	assert.Equal(t, "\x1b[33m⚠ slow diff\x1b[0m\n", string(got))
+}
+
+func TestMatchTable(t *testing.T) {
+	os.Setenv("NO_COLOR", "1")
+	defer os.Unsetenv("NO_COLOR")
+
+	steps := []Step{
+		{Trigger: "payments", WatchLabel: "Payments"},
+		{Wait: true},
+		{Command: "make docs"},
+	}
+	watches := []watchReport{
+		{Label: "Payments", Step: "Payments (trigger: payments)", Files: []string{"a.go", "b.go"}},
+	}
+
+	want := "" +
+		"  WATCH     STEP                FILES\n" +
+		"✔ Payments  trigger: payments   2\n" +
+		"✔ -         command: make docs  -\n"
+
+	assert.Equal(t, want, matchTable(steps, watches))
+}
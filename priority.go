@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// priorityEnv is the priority inherited by the steps, set by the pipeline or
+// passed to triggered builds so their own steps inherit it in turn
+const priorityEnv = "MONOREPO_DIFF_PRIORITY"
+
+// parentPriority returns the priority of the running job: MONOREPO_DIFF_PRIORITY,
+// or with fromAPI the priority of the job read from the Buildkite API
+func parentPriority(fromAPI bool) int {
+	if value := env(priorityEnv, ""); value != "" {
+		priority, err := strconv.Atoi(value)
+		if err != nil {
+			log.Warnf("ignoring invalid %s `%s`", priorityEnv, value)
+			return 0
+		}
+		return priority
+	}
+
+	job := env("BUILDKITE_JOB_ID", "")
+	if !fromAPI || job == "" || env("BUILDKITE_API_TOKEN", "") == "" {
+		return 0
+	}
+
+	api, err := newBuildkiteAPI()
+	if err != nil {
+		return 0
+	}
+
+	build, err := api.build(env("BUILDKITE_ORGANIZATION_SLUG", ""), env("BUILDKITE_PIPELINE_SLUG", ""), env("BUILDKITE_BUILD_NUMBER", ""))
+	if err != nil {
+		log.Warnf("could not read the priority of the job: %v", err)
+		return 0
+	}
+
+	for _, j := range build.Jobs {
+		if j.ID == job {
+			return j.Priority.Number
+		}
+	}
+
+	return 0
+}
+
+// inheritPriority sets the priority on the command steps without one, and in
+// the env of the triggered builds, so high priority builds don't fan out into
+// low priority work. Only command steps have a priority.
+func inheritPriority(steps []Step, priority int) []Step {
+	if priority == 0 {
+		return steps
+	}
+
+	log.Infof("Inheriting priority %d", priority)
+
+	result := make([]Step, len(steps))
+	for i, s := range steps {
+		result[i] = s
+
+		if s.Command != "" && s.Priority == 0 {
+			result[i].Priority = priority
+		}
+
+		if s.Trigger != "" {
+			if _, ok := s.Build.Env[priorityEnv]; !ok {
+				result[i].Build.Env = mergeEnv(s.Build.Env, map[string]string{priorityEnv: strconv.Itoa(priority)})
+			}
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInheritPriority(t *testing.T) {
+	steps := []Step{
+		{Trigger: "foo"},
+		{Trigger: "bar", Priority: 1, Build: Build{Env: map[string]string{priorityEnv: "3"}}},
+		{Command: "make docs"},
+		{Block: "Release"},
+		{Wait: true},
+	}
+
+	assert.Equal(t, []Step{
+		{Trigger: "foo", Build: Build{Env: map[string]string{priorityEnv: "10"}}},
+		{Trigger: "bar", Priority: 1, Build: Build{Env: map[string]string{priorityEnv: "3"}}},
+		{Command: "make docs", Priority: 10},
+		{Block: "Release"},
+		{Wait: true},
+	}, inheritPriority(steps, 10))
+
+	assert.Equal(t, steps, inheritPriority(steps, 0))
+}
+
+func TestParentPriorityFromEnv(t *testing.T) {
+	os.Setenv(priorityEnv, "5")
+	defer os.Unsetenv(priorityEnv)
+
+	assert.Equal(t, 5, parentPriority(false))
+
+	os.Setenv(priorityEnv, "high")
+	assert.Equal(t, 0, parentPriority(false))
+}
+
+func TestParentPriorityFromAPI(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/organizations/acme/pipelines/monorepo/builds/42", r.URL.Path)
+		_, _ = w.Write([]byte(`{"jobs": [{"id": "job-0", "priority": {"number": 1}}, {"id": "job-1", "priority": {"number": 7}}]}`))
+	}))
+	defer server.Close()
+
+	vars := map[string]string{
+		"BUILDKITE_API_ENDPOINT":      server.URL,
+		"BUILDKITE_API_TOKEN":         "api-token",
+		"BUILDKITE_JOB_ID":            "job-1",
+		"BUILDKITE_ORGANIZATION_SLUG": "acme",
+		"BUILDKITE_PIPELINE_SLUG":     "monorepo",
+		"BUILDKITE_BUILD_NUMBER":      "42",
+	}
+	for name, value := range vars {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	assert.Equal(t, 7, parentPriority(true))
+
+	// the API is only used when it is enabled
+	assert.Equal(t, 0, parentPriority(false))
+
+	os.Setenv("BUILDKITE_JOB_ID", "job-2")
+	assert.Equal(t, 0, parentPriority(true))
+}
+
+func TestUploadPipelineInheritsPriority(t *testing.T) {
+	os.Setenv(priorityEnv, "10")
+	defer os.Unsetenv(priorityEnv)
+
+	var generated []Step
+	generator := func(steps []Step, plugin Plugin) (*os.File, error) {
+		generated = steps
+		return mockGeneratePipeline(steps, plugin)
+	}
+
+	plugin := Plugin{
+		Diff:            "echo services/foo/main.go",
+		InheritPriority: true,
+		Watch:           []WatchConfig{{Paths: []string{"services/foo/"}, Step: Step{Trigger: "foo"}}},
+	}
+
+	_, _, err := uploadPipeline(plugin, generator)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Step{{Trigger: "foo", Build: Build{Env: map[string]string{priorityEnv: "10"}}}}, generated)
+}
@@ -0,0 +1,11 @@
+package main
+
+import "os/exec"
+
+// setProcessGroup does nothing on Windows, the command is killed on its own
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the command
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// QueueRule routes the command step of a watch to the queue when the watch
+// matched at least MinFiles files and MinSize bytes of files
+type QueueRule struct {
+	MinFiles   int    `json:"min_files"`
+	RawMinSize string `json:"min_size"`
+	MinSize    int64
+	Queue      string `json:"queue"`
+}
+
+// parseQueueRules parses the `queue_rules` of the watch
+func parseQueueRules(w *WatchConfig) error {
+	if len(w.QueueRules) > 0 && w.Step.Trigger != "" {
+		return fmt.Errorf("queue_rules only apply to command steps")
+	}
+
+	for i := range w.QueueRules {
+		r := &w.QueueRules[i]
+
+		if r.Queue == "" {
+			return fmt.Errorf("queue_rules need a queue")
+		}
+
+		if r.RawMinSize != "" {
+			size, err := parseSize(r.RawMinSize)
+			if err != nil {
+				return fmt.Errorf("invalid queue_rules min_size: %v", err)
+			}
+			r.MinSize = size
+			r.RawMinSize = ""
+		}
+
+		if r.MinFiles <= 0 && r.MinSize <= 0 {
+			return fmt.Errorf("queue_rules need min_files or min_size")
+		}
+	}
+
+	return nil
+}
+
+// applyQueueRules sets the queue of the first rule of each watch reached by
+// the files it matched. The size of the files is read from the checkout,
+// deleted files have none.
+func applyQueueRules(watches []WatchConfig) []WatchConfig {
+	result := make([]WatchConfig, len(watches))
+
+	for i, w := range watches {
+		result[i] = w
+
+		if len(w.QueueRules) == 0 {
+			continue
+		}
+
+		size := int64(-1)
+		for _, r := range w.QueueRules {
+			if len(w.Files) < r.MinFiles {
+				continue
+			}
+
+			if r.MinSize > 0 {
+				if size < 0 {
+					size = filesSize(w.Files)
+				}
+				if size < r.MinSize {
+					continue
+				}
+			}
+
+			log.Infof("Routing %s to queue %s for %d matched %s", stepName(w.Step), r.Queue, len(w.Files), pluralize(len(w.Files), "file"))
+			result[i].Step.Agents.Queue = r.Queue
+			break
+		}
+	}
+
+	return result
+}
+
+// filesSize returns the total size in bytes of the files
+func filesSize(files []string) int64 {
+	var size int64
+
+	for _, f := range files {
+		if info, err := os.Stat(f); err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+	}
+
+	return size
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQueueRules(t *testing.T) {
+	testCases := map[string]struct {
+		watch    WatchConfig
+		expected []QueueRule
+		err      string
+	}{
+		"files": {
+			watch:    WatchConfig{QueueRules: []QueueRule{{MinFiles: 10, Queue: "large"}}, Step: Step{Command: "make"}},
+			expected: []QueueRule{{MinFiles: 10, Queue: "large"}},
+		},
+		"size": {
+			watch:    WatchConfig{QueueRules: []QueueRule{{RawMinSize: "2KB", Queue: "large"}}, Step: Step{Command: "make"}},
+			expected: []QueueRule{{MinSize: 2000, Queue: "large"}},
+		},
+		"trigger": {
+			watch: WatchConfig{QueueRules: []QueueRule{{MinFiles: 10, Queue: "large"}}, Step: Step{Trigger: "foo"}},
+			err:   "queue_rules only apply to command steps",
+		},
+		"no queue": {
+			watch: WatchConfig{QueueRules: []QueueRule{{MinFiles: 10}}, Step: Step{Command: "make"}},
+			err:   "queue_rules need a queue",
+		},
+		"no threshold": {
+			watch: WatchConfig{QueueRules: []QueueRule{{Queue: "large"}}, Step: Step{Command: "make"}},
+			err:   "queue_rules need min_files or min_size",
+		},
+		"invalid size": {
+			watch: WatchConfig{QueueRules: []QueueRule{{RawMinSize: "lots", Queue: "large"}}, Step: Step{Command: "make"}},
+			err:   "invalid queue_rules min_size",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := parseQueueRules(&tc.watch)
+			if tc.err != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, tc.watch.QueueRules)
+		})
+	}
+}
+
+func TestApplyQueueRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queues")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	big := filepath.Join(dir, "big.txt")
+	assert.NoError(t, ioutil.WriteFile(big, make([]byte, 4096), 0644))
+
+	rules := []QueueRule{{MinFiles: 3, Queue: "xlarge"}, {MinSize: 2000, Queue: "large"}}
+	step := Step{Command: "make test", Agents: Agent{Queue: "default"}}
+
+	testCases := map[string]struct {
+		files    []string
+		expected string
+	}{
+		"many files":   {[]string{"a", "b", "c"}, "xlarge"},
+		"large files":  {[]string{big}, "large"},
+		"small":        {[]string{"a"}, "default"},
+		"deleted file": {[]string{filepath.Join(dir, "gone.txt")}, "default"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			watches := applyQueueRules([]WatchConfig{{QueueRules: rules, Step: step, Files: tc.files}})
+			assert.Equal(t, tc.expected, watches[0].Step.Agents.Queue)
+		})
+	}
+}
+
+func TestQueueRulesNeedFiles(t *testing.T) {
+	assert.True(t, watchNeedsFiles(WatchConfig{QueueRules: []QueueRule{{MinFiles: 1, Queue: "large"}}}))
+}
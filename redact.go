@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const redacted = "[REDACTED]"
+
+// defaultRedactedVars mirrors the buildkite-agent defaults for `redacted-vars`
+var defaultRedactedVars = []string{"*_PASSWORD", "*_SECRET", "*_TOKEN", "*_ACCESS_KEY", "*_SECRET_KEY"}
+
+// Redactor replaces secret values with a placeholder
+type Redactor struct {
+	values []string
+}
+
+// secrets is the redactor used for log output and printed artifacts
+var secrets = &Redactor{}
+
+// newRedactor collects the values of env vars whose name matches any of the patterns,
+// from both the process environment and the env configured on the plugin.
+func newRedactor(patterns []string, plugin Plugin) *Redactor {
+	seen := map[string]bool{}
+	r := &Redactor{}
+
+	add := func(key, value string) {
+		if value == "" || seen[value] || !matchesAny(patterns, key) {
+			return
+		}
+		seen[value] = true
+		r.values = append(r.values, value)
+	}
+
+	for _, kv := range os.Environ() {
+		split := strings.SplitN(kv, "=", 2)
+		add(split[0], split[1])
+	}
+
+	envs := []map[string]string{plugin.Env}
+	for _, w := range plugin.Watch {
+		envs = append(envs, w.Step.Env, w.Step.Build.Env)
+	}
+
+	for _, h := range plugin.Hooks {
+		envs = append(envs, h.Env)
+	}
+
+	for _, e := range envs {
+		for key, value := range e {
+			add(key, value)
+		}
+	}
+
+	// replace longer values first so that a secret containing
+	// another secret is not partially redacted
+	sort.Slice(r.values, func(i, j int) bool {
+		return len(r.values[i]) > len(r.values[j])
+	})
+
+	return r
+}
+
+// redact replaces every known secret value in s
+func (r *Redactor) redact(s string) string {
+	for _, v := range r.values {
+		s = strings.ReplaceAll(s, v, redacted)
+	}
+
+	return s
+}
+
+// Levels implements logrus.Hook
+func (r *Redactor) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire implements logrus.Hook and redacts the log message before it is formatted
+func (r *Redactor) Fire(entry *log.Entry) error {
+	entry.Message = r.redact(entry.Message)
+	return nil
+}
+
+func setupRedaction(plugin Plugin) {
+	secrets = newRedactor(plugin.RedactedVars, plugin)
+	log.AddHook(secrets)
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if match, _ := path.Match(p, name); match {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactorRedactsMatchingEnvValues(t *testing.T) {
+	os.Setenv("GITHUB_TOKEN", "gh-secret-value")
+	defer os.Unsetenv("GITHUB_TOKEN")
+
+	plugin := Plugin{
+		Env: map[string]string{"DB_PASSWORD": "hunter2", "REGION": "ap-southeast-2"},
+		Watch: []WatchConfig{{
+			Step: Step{Build: Build{Env: map[string]string{"DEPLOY_SECRET": "s3cr3t"}}},
+		}},
+	}
+
+	r := newRedactor(defaultRedactedVars, plugin)
+
+	got := r.redact("token=gh-secret-value password=hunter2 secret=s3cr3t region=ap-southeast-2")
+
+	assert.Equal(t, "token=[REDACTED] password=[REDACTED] secret=[REDACTED] region=ap-southeast-2", got)
+}
+
+func TestRedactorPrefersLongestValue(t *testing.T) {
+	r := newRedactor([]string{"*_TOKEN"}, Plugin{
+		Env: map[string]string{"A_TOKEN": "abc", "B_TOKEN": "abcdef"},
+	})
+
+	assert.Equal(t, "[REDACTED]", r.redact("abcdef"))
+}
+
+func TestRedactorLogHook(t *testing.T) {
+	var out bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(&out)
+	logger.AddHook(newRedactor([]string{"*_TOKEN"}, Plugin{
+		Env: map[string]string{"API_TOKEN": "topsecret"},
+	}))
+
+	logger.Info("using topsecret")
+
+	assert.NotContains(t, out.String(), "topsecret")
+	assert.Contains(t, out.String(), "using [REDACTED]")
+}
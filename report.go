@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// routingReport is the machine readable record of the routing decisions of a run
+type routingReport struct {
+	ChangedFiles   []string       `json:"changed_files"`
+	UnmatchedFiles []string       `json:"unmatched_files"`
+	Watches        []watchReport  `json:"watches"`
+	Steps          []string       `json:"steps"`
+	Timings        []timingReport `json:"timings"`
+	timer          *Timer
+	// changed is the number of changed files, which are only kept when needed
+	changed int
+	// partial is whether the diff was stopped early, so changed is a lower bound
+	partial bool
+}
+
+// watchReport is a matched watch and the changed files it matched
+type watchReport struct {
+	Label string   `json:"label,omitempty"`
+	Owner string   `json:"owner,omitempty"`
+	Team  string   `json:"team,omitempty"`
+	Paths []string `json:"paths"`
+	Step  string   `json:"step"`
+	Files []string `json:"files,omitempty"`
+}
+
+// timingReport is the duration of a plugin phase
+type timingReport struct {
+	Phase      string `json:"phase"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// setWatches records the matched watches
+func (r *routingReport) setWatches(watches []WatchConfig) {
+	r.Watches = []watchReport{}
+
+	for _, w := range watches {
+		r.Watches = append(r.Watches, watchReport{Label: w.Label, Owner: w.Owner, Team: w.Team, Paths: w.Paths, Step: stepName(w.Step), Files: w.Files})
+	}
+}
+
+// setSteps records the generated steps
+func (r *routingReport) setSteps(steps []Step) {
+	r.Steps = []string{}
+
+	for _, s := range steps {
+		r.Steps = append(r.Steps, stepName(s))
+	}
+}
+
+// writeRoutingReport writes the report to the `routing_report` file, and uploads
+// it as an artifact of the build with `routing_report_artifact`
+func writeRoutingReport(report *routingReport, plugin Plugin) {
+	report.Timings = []timingReport{}
+	for _, p := range report.timer.phases {
+		report.Timings = append(report.Timings, timingReport{Phase: p.name, DurationMs: int64(p.duration / time.Millisecond)})
+	}
+
+	if report.ChangedFiles == nil {
+		report.ChangedFiles = []string{}
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Warnf("could not write the routing report: %v", err)
+		return
+	}
+
+	if err := ioutil.WriteFile(plugin.RoutingReport, append(data, '\n'), 0644); err != nil {
+		log.Warnf("could not write the routing report: %v", err)
+		return
+	}
+
+	log.Infof("Routing report written to %s", plugin.RoutingReport)
+
+	if !plugin.RoutingReportArtifact {
+		return
+	}
+
+	args := append(append([]string{}, plugin.AgentArgs...), "artifact", "upload", plugin.RoutingReport)
+	if _, err := executeCommand(agentBinary(plugin), args); err != nil {
+		log.Warn(fmt.Errorf("could not upload the routing report: %v", err))
+	}
+}
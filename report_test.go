@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadPipelineWritesRoutingReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "report")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "routing-report.json")
+	plugin := Plugin{
+		Diff:                  "printf services/foo/main.go\\ndocs/README.md\\n",
+		RoutingReport:         file,
+		RoutingReportArtifact: true,
+		Watch: []WatchConfig{
+			{Paths: []string{"services/foo/"}, Team: "payments", Step: Step{Trigger: "foo"}},
+			{Paths: []string{"services/bar/"}, Step: Step{Trigger: "bar"}},
+		},
+	}
+
+	_, _, err = uploadPipeline(plugin, mockGeneratePipeline)
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+
+	var report routingReport
+	assert.NoError(t, json.Unmarshal(data, &report))
+
+	assert.Equal(t, []string{"services/foo/main.go", "docs/README.md"}, report.ChangedFiles)
+	assert.Equal(t, []string{"docs/README.md"}, report.UnmatchedFiles)
+	assert.Equal(t, []watchReport{{
+		Team:  "payments",
+		Paths: []string{"services/foo/"},
+		Step:  "trigger: foo",
+		Files: []string{"services/foo/main.go"},
+	}}, report.Watches)
+	assert.Equal(t, []string{"trigger: foo"}, report.Steps)
+	assert.Equal(t, "diff", report.Timings[0].Phase)
+}
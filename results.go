@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// finishedStates are the build states that won't change anymore
+var finishedStates = map[string]bool{
+	"passed":   true,
+	"failed":   true,
+	"canceled": true,
+	"skipped":  true,
+	"not_run":  true,
+}
+
+// triggeredBuild is a downstream build started by a generated trigger step
+type triggeredBuild struct {
+	pipeline string
+	label    string
+	// owner is the team, or the owner, of the watch
+	owner  string
+	commit string
+	build  *apiBuild
+	// retries is the number of times the build was rebuilt after failing
+	retries int
+}
+
+// checkWaitForResults rejects the configurations adding a wait or block step
+// before the generated triggers. Those steps wait for the plugin step, which
+// waits for the triggered builds, so the triggers would never start.
+func checkWaitForResults(plugin Plugin) error {
+	if !plugin.WaitForResults {
+		return nil
+	}
+
+	if len(hooksInPhase(plugin.Hooks, hookPhaseBefore)) > 0 {
+		return fmt.Errorf("wait_for_results can't be used with hooks before the generated steps")
+	}
+
+	if plugin.TriggerRate > 0 {
+		return fmt.Errorf("wait_for_results can't be used with trigger_rate")
+	}
+
+	if plugin.Overflow == "block" || plugin.Overflow == "select" {
+		return fmt.Errorf("wait_for_results can't be used with overflow `%s`", plugin.Overflow)
+	}
+
+	return nil
+}
+
+// barrierStep returns whether the steps after the step wait for the steps
+// before it, including the plugin step
+func barrierStep(step Step) bool {
+	if step.Wait || step.Block != "" {
+		return true
+	}
+
+	switch raw := step.Raw.(type) {
+	case string:
+		return raw == "wait" || raw == "block" || raw == "input"
+	case yaml.MapSlice:
+		for _, item := range raw {
+			if item.Key == "wait" || item.Key == "block" || item.Key == "input" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// waitForResults polls the Buildkite API until every build triggered by the
+// steps has finished, annotates the build with their results and returns an
+// error if the results don't satisfy the configured policy. Triggers after a
+// wait or block step, e.g. of merged pipelines or `environments`, can't start
+// while the plugin step runs, so they aren't waited for.
+func waitForResults(plugin Plugin, steps []Step) error {
+	triggered := []*triggeredBuild{}
+	for i, s := range steps {
+		if barrierStep(s) {
+			if skipped := countTriggers(steps[i:]); skipped > 0 {
+				log.Warnf("Not waiting for %d %s after a wait or block step", skipped, pluralize(skipped, "trigger"))
+			}
+			break
+		}
+
+		if s.Trigger != "" {
+			owner := s.Team
+			if owner == "" {
+				owner = s.Owner
+			}
+			triggered = append(triggered, &triggeredBuild{pipeline: s.Trigger, label: s.WatchLabel, owner: owner, commit: s.Build.Commit})
+		}
+	}
+
+	if len(triggered) == 0 {
+		return nil
+	}
+
+	api, err := newBuildkiteAPI()
+	if err != nil {
+		return err
+	}
+
+	org := env("BUILDKITE_ORGANIZATION_SLUG", "")
+	parent := env("BUILDKITE_BUILD_ID", "")
+	deadline := time.Now().Add(plugin.ResultsTimeout)
+
+	for {
+		pending := 0
+
+		for _, t := range triggered {
+			if t.build != nil && finishedStates[t.build.State] {
+				continue
+			}
+
+			if err := refreshBuild(api, org, parent, t); err != nil {
+				return err
+			}
+
+			if t.build != nil && t.build.State == "failed" && t.retries < plugin.RetryFailedTriggers {
+				log.Infof("Rebuilding failed build #%d of %s", t.build.Number, t.pipeline)
+
+				rebuilt, err := api.rebuild(org, t.pipeline, t.build.Number)
+				if err != nil {
+					return err
+				}
+
+				t.build = rebuilt
+				t.retries++
+			}
+
+			if t.build == nil || !finishedStates[t.build.State] {
+				pending++
+			}
+		}
+
+		if pending == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			_ = annotate(plugin, "error", "monorepo-diff-results", resultsSummary(triggered))
+			return fmt.Errorf("timed out waiting for %d triggered %s", pending, pluralize(pending, "build"))
+		}
+
+		log.Infof("Waiting for %d triggered %s", pending, pluralize(pending, "build"))
+		sleep(plugin.ResultsPollInterval)
+	}
+
+	passed := 0
+	for _, t := range triggered {
+		if t.build.State == "passed" {
+			passed++
+		}
+	}
+
+	ok := passed == len(triggered)
+	if plugin.ResultsPolicy == "any_passed" {
+		ok = passed > 0
+	}
+
+	style := "success"
+	if !ok {
+		style = "error"
+	}
+
+	if err := annotate(plugin, style, "monorepo-diff-results", resultsSummary(triggered)); err != nil {
+		log.Warnf("could not annotate the build: %v", err)
+	}
+
+	if !ok {
+		return fmt.Errorf(
+			"%d of %d triggered builds passed which doesn't satisfy %s", passed, len(triggered), plugin.ResultsPolicy,
+		)
+	}
+
+	return nil
+}
+
+// countTriggers returns the number of trigger steps
+func countTriggers(steps []Step) int {
+	count := 0
+	for _, s := range steps {
+		if s.Trigger != "" {
+			count++
+		}
+	}
+
+	return count
+}
+
+// refreshBuild gets the current state of the triggered build. Until it is
+// known, the build is looked up among the builds of the commit by the build
+// that triggered it. Rebuilds aren't triggered by the parent, so they are
+// looked up by number.
+func refreshBuild(api *buildkiteAPI, org string, parent string, t *triggeredBuild) error {
+	if t.retries > 0 {
+		build, err := api.build(org, t.pipeline, strconv.Itoa(t.build.Number))
+		if err != nil {
+			return err
+		}
+
+		t.build = build
+		return nil
+	}
+
+	builds, err := api.builds(org, t.pipeline, url.Values{"commit": {t.commit}})
+	if err != nil {
+		return err
+	}
+
+	for i := range builds {
+		if builds[i].TriggeredFrom.BuildID == parent {
+			t.build = &builds[i]
+			break
+		}
+	}
+
+	return nil
+}
+
+// resultsSummary renders the triggered builds as a markdown list for the annotation
+func resultsSummary(triggered []*triggeredBuild) string {
+	var b strings.Builder
+
+	b.WriteString("**Triggered builds**\n\n")
+
+	for _, t := range triggered {
+		name := t.pipeline
+		if t.label != "" {
+			name = fmt.Sprintf("%s (%s)", t.label, t.pipeline)
+		}
+
+		owner := ""
+		if t.owner != "" {
+			owner = fmt.Sprintf(", owned by %s", t.owner)
+		}
+
+		if t.build == nil {
+			fmt.Fprintf(&b, "- %s: not started%s\n", name, owner)
+			continue
+		}
+
+		fmt.Fprintf(&b, "- [%s #%d](%s): %s", name, t.build.Number, t.build.WebURL, t.build.State)
+		if t.retries > 0 {
+			fmt.Fprintf(&b, " after %d %s", t.retries, pluralize(t.retries, "rebuild"))
+		}
+		b.WriteString(owner)
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
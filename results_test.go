@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+// mockBuildsAPI serves builds of triggered pipelines, returning the next
+// state from states on every request for a pipeline.
+func mockBuildsAPI(t *testing.T, states map[string][]string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(r.URL.Path, "/")
+		pipeline := parts[len(parts)-2]
+
+		assert.Equal(t, "Token api-token", r.Header.Get("Authorization"))
+		assert.Equal(t, "123", r.URL.Query().Get("commit"))
+
+		state := states[pipeline][0]
+		if len(states[pipeline]) > 1 {
+			states[pipeline] = states[pipeline][1:]
+		}
+
+		build := apiBuild{Number: 7, State: state, WebURL: "https://buildkite.com/org/" + pipeline + "/builds/7"}
+		build.TriggeredFrom.BuildID = "parent-build"
+		other := apiBuild{Number: 6, State: "failed"}
+		other.TriggeredFrom.BuildID = "another-build"
+
+		_ = json.NewEncoder(w).Encode([]apiBuild{other, build})
+	}))
+
+	os.Setenv("BUILDKITE_API_ENDPOINT", server.URL)
+	os.Setenv("BUILDKITE_API_TOKEN", "api-token")
+	os.Setenv("BUILDKITE_ORGANIZATION_SLUG", "org")
+	os.Setenv("BUILDKITE_BUILD_ID", "parent-build")
+
+	return server
+}
+
+func unsetBuildsAPI(server *httptest.Server) {
+	server.Close()
+	os.Unsetenv("BUILDKITE_API_ENDPOINT")
+	os.Unsetenv("BUILDKITE_API_TOKEN")
+	os.Unsetenv("BUILDKITE_ORGANIZATION_SLUG")
+	os.Unsetenv("BUILDKITE_BUILD_ID")
+}
+
+func TestWaitForResultsAllPassed(t *testing.T) {
+	server := mockBuildsAPI(t, map[string][]string{
+		"foo": {"running", "passed"},
+		"bar": {"scheduled", "running", "passed"},
+	})
+	defer unsetBuildsAPI(server)
+
+	plugin := Plugin{ResultsPolicy: "all_passed", ResultsTimeout: time.Hour}
+	steps := []Step{
+		{Trigger: "foo", Build: Build{Commit: "123"}},
+		{Command: "echo not a trigger"},
+		{Trigger: "bar", Build: Build{Commit: "123"}},
+	}
+
+	assert.NoError(t, waitForResults(plugin, steps))
+}
+
+func TestWaitForResultsOnlyWaitsForTriggersThatCanStart(t *testing.T) {
+	server := mockBuildsAPI(t, map[string][]string{
+		"foo": {"running", "passed"},
+	})
+	defer unsetBuildsAPI(server)
+
+	plugin := Plugin{ResultsPolicy: "all_passed", ResultsTimeout: time.Millisecond}
+	steps := []Step{
+		{Trigger: "foo", Build: Build{Commit: "123"}},
+		{Block: "Deploy to production?"},
+		{Trigger: "bar", Build: Build{Commit: "123"}},
+	}
+
+	assert.NoError(t, waitForResults(plugin, steps))
+
+	steps = []Step{
+		{Trigger: "foo", Build: Build{Commit: "123"}},
+		{Raw: yaml.MapSlice{{Key: "wait", Value: nil}}},
+		{Trigger: "bar", Build: Build{Commit: "123"}},
+	}
+
+	assert.NoError(t, waitForResults(plugin, steps))
+}
+
+func TestPluginWithWaitForResultsBehindWait(t *testing.T) {
+	for config, expected := range map[string]string{
+		`"hooks": [{"command": "setup"}], "hooks_position": "before"`: "wait_for_results can't be used with hooks before the generated steps",
+		`"trigger_rate": 5`:                        "wait_for_results can't be used with trigger_rate",
+		`"max_triggered": 5, "overflow": "block"`:  "wait_for_results can't be used with overflow `block`",
+		`"max_triggered": 5, "overflow": "select"`: "wait_for_results can't be used with overflow `select`",
+	} {
+		_, err := initializePluginConfiguration(`{"wait_for_results": true, ` + config + `, "watch": [{"path": "services/", "config": {"trigger": "foo"}}]}`)
+
+		assert.EqualError(t, err, "failed to parse plugin configuration: "+expected, config)
+	}
+}
+
+func TestWaitForResultsFailsPolicy(t *testing.T) {
+	server := mockBuildsAPI(t, map[string][]string{
+		"foo": {"passed"},
+		"bar": {"failed"},
+	})
+	defer unsetBuildsAPI(server)
+
+	steps := []Step{
+		{Trigger: "foo", Build: Build{Commit: "123"}},
+		{Trigger: "bar", Build: Build{Commit: "123"}},
+	}
+
+	err := waitForResults(Plugin{ResultsPolicy: "all_passed", ResultsTimeout: time.Hour}, steps)
+	assert.EqualError(t, err, "1 of 2 triggered builds passed which doesn't satisfy all_passed")
+
+	server.Close()
+	server = mockBuildsAPI(t, map[string][]string{
+		"foo": {"passed"},
+		"bar": {"failed"},
+	})
+
+	assert.NoError(t, waitForResults(Plugin{ResultsPolicy: "any_passed", ResultsTimeout: time.Hour}, steps))
+}
+
+func TestWaitForResultsTimeout(t *testing.T) {
+	server := mockBuildsAPI(t, map[string][]string{"foo": {"running"}})
+	defer unsetBuildsAPI(server)
+
+	steps := []Step{{Trigger: "foo", Build: Build{Commit: "123"}}}
+
+	err := waitForResults(Plugin{ResultsPolicy: "all_passed"}, steps)
+
+	assert.EqualError(t, err, "timed out waiting for 1 triggered build")
+}
+
+func TestWaitForResultsRetriesFailedTriggers(t *testing.T) {
+	rebuilds := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		build := apiBuild{Number: 7, State: "failed"}
+
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/organizations/org/pipelines/foo/builds/7/rebuild":
+			rebuilds++
+			build = apiBuild{Number: 8, State: "scheduled"}
+		case r.Method == http.MethodPut && r.URL.Path == "/organizations/org/pipelines/foo/builds/8/rebuild":
+			rebuilds++
+			build = apiBuild{Number: 9, State: "scheduled"}
+		case r.URL.Path == "/organizations/org/pipelines/foo/builds/8":
+			build = apiBuild{Number: 8, State: "failed"}
+		case r.URL.Path == "/organizations/org/pipelines/foo/builds/9":
+			build = apiBuild{Number: 9, State: "passed"}
+		default:
+			build.TriggeredFrom.BuildID = "parent-build"
+			_ = json.NewEncoder(w).Encode([]apiBuild{build})
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(build)
+	}))
+	defer server.Close()
+
+	os.Setenv("BUILDKITE_API_ENDPOINT", server.URL)
+	os.Setenv("BUILDKITE_API_TOKEN", "api-token")
+	os.Setenv("BUILDKITE_ORGANIZATION_SLUG", "org")
+	os.Setenv("BUILDKITE_BUILD_ID", "parent-build")
+	defer unsetBuildsAPI(server)
+
+	steps := []Step{{Trigger: "foo", Build: Build{Commit: "123"}}}
+
+	plugin := Plugin{ResultsPolicy: "all_passed", ResultsTimeout: time.Hour, RetryFailedTriggers: 1}
+	err := waitForResults(plugin, steps)
+	assert.EqualError(t, err, "0 of 1 triggered builds passed which doesn't satisfy all_passed")
+	assert.Equal(t, 1, rebuilds)
+
+	rebuilds = 0
+	plugin.RetryFailedTriggers = 2
+	assert.NoError(t, waitForResults(plugin, steps))
+	assert.Equal(t, 2, rebuilds)
+}
+
+func TestResultsSummary(t *testing.T) {
+	triggered := []*triggeredBuild{
+		{pipeline: "foo", build: &apiBuild{Number: 3, State: "passed", WebURL: "https://buildkite.com/org/foo/builds/3"}},
+		{pipeline: "bar"},
+		{pipeline: "baz", label: "Baz API", owner: "search"},
+		{pipeline: "qux", retries: 2, owner: "platform", build: &apiBuild{Number: 5, State: "failed", WebURL: "https://buildkite.com/org/qux/builds/5"}},
+	}
+
+	want := "**Triggered builds**\n\n" +
+		"- [foo #3](https://buildkite.com/org/foo/builds/3): passed\n" +
+		"- bar: not started\n" +
+		"- Baz API (baz): not started, owned by search\n" +
+		"- [qux #5](https://buildkite.com/org/qux/builds/5): failed after 2 rebuilds, owned by platform\n"
+
+	assert.Equal(t, want, resultsSummary(triggered))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Rollout introduces a watch gradually: it only triggers for a percentage of
+// the commits, or when the flag env var is set to a true value
+type Rollout struct {
+	Percentage *int   `json:"percentage"`
+	Flag       string `json:"flag"`
+}
+
+func (r *Rollout) validate() error {
+	if r.Percentage == nil && r.Flag == "" {
+		return fmt.Errorf("rollout needs a percentage or a flag")
+	}
+
+	if r.Percentage != nil && (*r.Percentage < 0 || *r.Percentage > 100) {
+		return fmt.Errorf("invalid rollout percentage `%d`", *r.Percentage)
+	}
+
+	return nil
+}
+
+// enabled reports whether the watch triggers for the commit: when its flag is
+// set, or when the commit falls within the percentage. The same watch and
+// commit always get the same answer, so rebuilds trigger the same pipelines.
+func (r *Rollout) enabled(watch string, commit string) bool {
+	if r.Flag != "" {
+		if on, err := strconv.ParseBool(env(r.Flag, "")); err == nil && on {
+			return true
+		}
+	}
+
+	if r.Percentage == nil {
+		return false
+	}
+
+	return rolloutBucket(watch, commit) < *r.Percentage
+}
+
+// rolloutBucket returns the stable bucket of the watch for the commit, from 0
+// to 99. The watch is hashed with the commit, so watches rolled out to the same
+// percentage don't all trigger for the same commits.
+func rolloutBucket(watch string, commit string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(watch + "\x00" + commit))
+
+	return int(h.Sum32() % 100)
+}
+
+// rolloutName identifies the watch in its rollout bucket: its label, or
+// otherwise the key or name of its step
+func rolloutName(w WatchConfig) string {
+	if w.Label != "" {
+		return w.Label
+	}
+
+	if w.Step.Key != "" {
+		return w.Step.Key
+	}
+
+	return stepName(w.Step)
+}
+
+// applyRollouts removes the watches whose rollout doesn't include the commit of the build
+func applyRollouts(watches []WatchConfig) []WatchConfig {
+	commit := env("BUILDKITE_COMMIT", "")
+	result := []WatchConfig{}
+	warned := false
+
+	for _, w := range watches {
+		if w.Rollout != nil && w.Rollout.Percentage != nil && commit == "" && !warned {
+			log.Warnf("BUILDKITE_COMMIT isn't set, every build falls in the same rollout bucket")
+			warned = true
+		}
+
+		if w.Rollout != nil && !w.Rollout.enabled(rolloutName(w), commit) {
+			log.Infof("Skipping %s, commit %s isn't in its rollout", stepName(w.Step), commit)
+			continue
+		}
+
+		result = append(result, w)
+	}
+
+	return result
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func percentage(p int) *int {
+	return &p
+}
+
+func TestRolloutEnabled(t *testing.T) {
+	os.Setenv("NEW_ROUTES", "true")
+	defer os.Unsetenv("NEW_ROUTES")
+
+	bucket := rolloutBucket("foo", "abc123")
+
+	testCases := map[string]struct {
+		rollout  Rollout
+		expected bool
+	}{
+		"none":          {Rollout{Percentage: percentage(0)}, false},
+		"all":           {Rollout{Percentage: percentage(100)}, true},
+		"within":        {Rollout{Percentage: percentage(bucket + 1)}, true},
+		"outside":       {Rollout{Percentage: percentage(bucket)}, false},
+		"flag":          {Rollout{Flag: "NEW_ROUTES"}, true},
+		"flag unset":    {Rollout{Flag: "OTHER_ROUTES"}, false},
+		"flag or share": {Rollout{Flag: "OTHER_ROUTES", Percentage: percentage(100)}, true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.rollout.enabled("foo", "abc123"))
+		})
+	}
+}
+
+func TestRolloutBucketIsStable(t *testing.T) {
+	assert.Equal(t, rolloutBucket("foo", "abc123"), rolloutBucket("foo", "abc123"))
+
+	counts := 0
+	for _, commit := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		if rolloutBucket("foo", commit) < 50 {
+			counts++
+		}
+		assert.True(t, rolloutBucket("foo", commit) >= 0 && rolloutBucket("foo", commit) < 100)
+	}
+	assert.True(t, counts > 0 && counts < 8, "commits are spread over the buckets")
+
+	buckets := map[int]bool{}
+	for _, watch := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		buckets[rolloutBucket(watch, "abc123")] = true
+	}
+	assert.True(t, len(buckets) > 1, "watches are spread over the buckets for the same commit")
+}
+
+func TestApplyRolloutsWarnsWithoutCommit(t *testing.T) {
+	commit := os.Getenv("BUILDKITE_COMMIT")
+	os.Unsetenv("BUILDKITE_COMMIT")
+	defer os.Setenv("BUILDKITE_COMMIT", commit)
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(ioutil.Discard)
+
+	watches := []WatchConfig{
+		{Step: Step{Trigger: "foo"}, Rollout: &Rollout{Percentage: percentage(100)}},
+		{Step: Step{Trigger: "bar"}, Rollout: &Rollout{Percentage: percentage(100)}},
+	}
+
+	assert.Equal(t, watches, applyRollouts(watches))
+	assert.Equal(t, 1, strings.Count(out.String(), "BUILDKITE_COMMIT isn't set, every build falls in the same rollout bucket"))
+}
+
+func TestUploadPipelineWithRollout(t *testing.T) {
+	var generated []Step
+	generator := func(steps []Step, plugin Plugin) (*os.File, error) {
+		generated = steps
+		return mockGeneratePipeline(steps, plugin)
+	}
+
+	plugin := Plugin{
+		Diff: "echo services/foo/main.go",
+		Watch: []WatchConfig{
+			{Paths: []string{"services/"}, Step: Step{Trigger: "foo"}},
+			{Paths: []string{"services/"}, Step: Step{Trigger: "foo-v2"}, Rollout: &Rollout{Percentage: percentage(0)}},
+			{Paths: []string{"services/"}, Step: Step{Trigger: "foo-v3"}, Rollout: &Rollout{Percentage: percentage(100)}},
+		},
+	}
+
+	_, _, err := uploadPipeline(plugin, generator)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Step{{Trigger: "foo"}, {Trigger: "foo-v3"}}, generated)
+}
+
+func TestPluginWithInvalidRollout(t *testing.T) {
+	for rollout, expected := range map[string]string{
+		`{}`:                  "rollout needs a percentage or a flag",
+		`{"percentage": 101}`: "invalid rollout percentage `101`",
+		`{"percentage": -1}`:  "invalid rollout percentage `-1`",
+	} {
+		_, err := initializePluginConfiguration(`{"watch": [{"path": "services/", "rollout": ` + rollout + `, "config": {"trigger": "foo"}}]}`)
+
+		assert.EqualError(t, err, "failed to parse plugin configuration: "+expected, rollout)
+	}
+
+	assert.EqualError(t, (&Rollout{}).validate(), "rollout needs a percentage or a flag")
+	assert.EqualError(t, (&Rollout{Percentage: percentage(101)}).validate(), "invalid rollout percentage `101`")
+}
@@ -0,0 +1,42 @@
+package main
+
+import "fmt"
+
+// ScheduleRun is the `on_schedule` configuration, the watches run by
+// scheduled builds regardless of the diff
+type ScheduleRun struct {
+	All bool
+	// Watches are referred to by their trigger pipeline, or label for command steps
+	Watches []string
+}
+
+// parseOnSchedule parses `on_schedule: all` or `on_schedule: { watches: [...] }`
+func parseOnSchedule(raw interface{}) (*ScheduleRun, error) {
+	switch value := raw.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if value == "all" {
+			return &ScheduleRun{All: true}, nil
+		}
+	case map[string]interface{}:
+		if watches, ok := value["watches"].([]interface{}); ok && len(value) == 1 {
+			run := &ScheduleRun{}
+			for _, w := range watches {
+				run.Watches = append(run.Watches, fmt.Sprint(w))
+			}
+			return run, nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid on_schedule `%v`", raw)
+}
+
+// scheduledWatches returns the watches run by scheduled builds
+func scheduledWatches(watches []WatchConfig, run *ScheduleRun) []WatchConfig {
+	if run.All {
+		return append([]WatchConfig{}, watches...)
+	}
+
+	return forceWatches(watches, nil, run.Watches)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOnSchedule(t *testing.T) {
+	testCases := map[string]struct {
+		raw      interface{}
+		expected *ScheduleRun
+		err      string
+	}{
+		"unset":   {nil, nil, ""},
+		"all":     {"all", &ScheduleRun{All: true}, ""},
+		"watches": {map[string]interface{}{"watches": []interface{}{"foo", "bar-*"}}, &ScheduleRun{Watches: []string{"foo", "bar-*"}}, ""},
+		"invalid": {"nightly", nil, "invalid on_schedule `nightly`"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseOnSchedule(tc.raw)
+
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, got)
+		})
+	}
+}
+
+func TestUploadPipelineRunsScheduledWatches(t *testing.T) {
+	os.Setenv("BUILDKITE_SOURCE", "schedule")
+	defer os.Unsetenv("BUILDKITE_SOURCE")
+
+	var generated []Step
+	generator := func(steps []Step, plugin Plugin) (*os.File, error) {
+		generated = steps
+		return mockGeneratePipeline(steps, plugin)
+	}
+
+	plugin := Plugin{
+		Diff:       "echo",
+		OnSchedule: &ScheduleRun{Watches: []string{"bar-*"}},
+		Watch: []WatchConfig{
+			{Paths: []string{"services/foo/"}, Step: Step{Trigger: "foo"}},
+			{Paths: []string{"services/bar/"}, Step: Step{Trigger: "bar-nightly"}},
+		},
+	}
+
+	_, _, err := uploadPipeline(plugin, generator)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Step{{Trigger: "bar-nightly"}}, generated)
+}
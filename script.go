@@ -0,0 +1,452 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/bmatcuk/doublestar/v2"
+)
+
+// matcherScript is the `matcher` of watches matched by a script instead of paths
+const matcherScript = "script"
+
+// fileContext is what a script knows of a changed file
+type fileContext struct {
+	path   string
+	status string
+}
+
+// script is a compiled `script` of a watch. It is a boolean expression
+// evaluated for every changed file, e.g.
+//
+//	glob("services/*/migrations/**") && status != "D" || env.FORCE == "true"
+//
+// with the variables `path`, `dir`, `base`, `ext`, `status` and `env.NAME`,
+// the operators `==`, `!=`, `=~` (regexp match), `&&`, `||` and `!`, and the
+// functions `glob`, `startsWith`, `endsWith` and `contains`.
+type script struct {
+	source string
+	eval   scriptNode
+}
+
+// scriptNode evaluates a part of a script to a string or a bool
+type scriptNode func(f fileContext) (interface{}, error)
+
+// compileScript parses the script of a watch
+func compileScript(source string) (*script, error) {
+	tokens, err := tokenizeScript(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid script `%s`: %v", source, err)
+	}
+
+	p := &scriptParser{tokens: tokens}
+
+	node, err := p.parseOr()
+	if err == nil && !p.done() {
+		err = fmt.Errorf("unexpected %s", p.peek())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid script `%s`: %v", source, err)
+	}
+
+	return &script{source: source, eval: node}, nil
+}
+
+// match evaluates the script for a changed file
+func (s *script) match(f fileContext) (bool, error) {
+	value, err := s.eval(f)
+	if err != nil {
+		return false, fmt.Errorf("script `%s` failed for %s: %v", s.source, f.path, err)
+	}
+
+	result, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("script `%s` returned %q instead of a boolean", s.source, value)
+	}
+
+	return result, nil
+}
+
+// scriptToken is a string literal, an identifier or an operator
+type scriptToken struct {
+	text    string
+	literal bool
+}
+
+func (t scriptToken) String() string {
+	if t.literal {
+		return fmt.Sprintf("%q", t.text)
+	}
+	return "`" + t.text + "`"
+}
+
+var scriptOperators = []string{"==", "!=", "=~", "&&", "||", "!", "(", ")", ","}
+
+func tokenizeScript(source string) ([]scriptToken, error) {
+	tokens := []scriptToken{}
+	rest := source
+
+	for {
+		rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+		if rest == "" {
+			return tokens, nil
+		}
+
+		if rest[0] == '"' || rest[0] == '\'' {
+			quote := rest[0]
+			var b strings.Builder
+			i := 1
+
+			for ; i < len(rest) && rest[i] != quote; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+
+			if i == len(rest) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+
+			tokens = append(tokens, scriptToken{text: b.String(), literal: true})
+			rest = rest[i+1:]
+			continue
+		}
+
+		operator := ""
+		for _, op := range scriptOperators {
+			if strings.HasPrefix(rest, op) {
+				operator = op
+				break
+			}
+		}
+
+		if operator != "" {
+			tokens = append(tokens, scriptToken{text: operator})
+			rest = rest[len(operator):]
+			continue
+		}
+
+		end := strings.IndexFunc(rest, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '.'
+		})
+		if end == 0 {
+			return nil, fmt.Errorf("unexpected character %q", rest[0])
+		}
+		if end < 0 {
+			end = len(rest)
+		}
+
+		tokens = append(tokens, scriptToken{text: rest[:end]})
+		rest = rest[end:]
+	}
+}
+
+// scriptParser is a recursive descent parser of scripts
+type scriptParser struct {
+	tokens []scriptToken
+	pos    int
+}
+
+func (p *scriptParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *scriptParser) peek() scriptToken {
+	if p.done() {
+		return scriptToken{text: "end of script"}
+	}
+	return p.tokens[p.pos]
+}
+
+// accept consumes the next token if it is the operator
+func (p *scriptParser) accept(operator string) bool {
+	if !p.done() && !p.tokens[p.pos].literal && p.tokens[p.pos].text == operator {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *scriptParser) expect(operator string) error {
+	if !p.accept(operator) {
+		return fmt.Errorf("expected `%s` instead of %s", operator, p.peek())
+	}
+	return nil
+}
+
+func (p *scriptParser) parseOr() (scriptNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logical(left, right, true)
+	}
+
+	return left, nil
+}
+
+func (p *scriptParser) parseAnd() (scriptNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = logical(left, right, false)
+	}
+
+	return left, nil
+}
+
+// logical returns a short-circuit `||` or `&&` of the nodes
+func logical(left, right scriptNode, or bool) scriptNode {
+	return func(f fileContext) (interface{}, error) {
+		l, err := boolValue(left(f))
+		if err != nil || l == or {
+			return l, err
+		}
+		return boolValue(right(f))
+	}
+}
+
+func (p *scriptParser) parseUnary() (scriptNode, error) {
+	if p.accept("!") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return func(f fileContext) (interface{}, error) {
+			value, err := boolValue(operand(f))
+			return !value, err
+		}, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *scriptParser) parseComparison() (scriptNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case p.accept("=="), p.accept("!="):
+		negate := p.tokens[p.pos-1].text == "!="
+
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+
+		return func(f fileContext) (interface{}, error) {
+			l, err := left(f)
+			if err != nil {
+				return nil, err
+			}
+			r, err := right(f)
+			if err != nil {
+				return nil, err
+			}
+			return (l == r) != negate, nil
+		}, nil
+	case p.accept("=~"):
+		if p.done() || !p.peek().literal {
+			return nil, fmt.Errorf("`=~` needs a regexp string instead of %s", p.peek())
+		}
+
+		re, err := regexp.Compile(p.tokens[p.pos].text)
+		if err != nil {
+			return nil, err
+		}
+		p.pos++
+
+		return func(f fileContext) (interface{}, error) {
+			s, err := stringValue(left(f))
+			return err == nil && re.MatchString(s), err
+		}, nil
+	}
+
+	return left, nil
+}
+
+// scriptFunctions are the functions scripts can call with string arguments
+var scriptFunctions = map[string]struct {
+	args int
+	call func(f fileContext, args []string) (bool, error)
+}{
+	"glob": {1, func(f fileContext, args []string) (bool, error) {
+		return doublestar.Match(args[0], f.path)
+	}},
+	"startsWith": {2, func(f fileContext, args []string) (bool, error) {
+		return strings.HasPrefix(args[0], args[1]), nil
+	}},
+	"endsWith": {2, func(f fileContext, args []string) (bool, error) {
+		return strings.HasSuffix(args[0], args[1]), nil
+	}},
+	"contains": {2, func(f fileContext, args []string) (bool, error) {
+		return strings.Contains(args[0], args[1]), nil
+	}},
+}
+
+func (p *scriptParser) parsePrimary() (scriptNode, error) {
+	if p.done() {
+		return nil, fmt.Errorf("unexpected end of script")
+	}
+
+	token := p.tokens[p.pos]
+	p.pos++
+
+	if token.literal {
+		return func(fileContext) (interface{}, error) { return token.text, nil }, nil
+	}
+
+	if token.text == "(" {
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(")")
+	}
+
+	for _, op := range scriptOperators {
+		if token.text == op {
+			return nil, fmt.Errorf("unexpected %s", token)
+		}
+	}
+
+	if fn, ok := scriptFunctions[token.text]; ok {
+		return p.parseCall(token.text, fn.args, fn.call)
+	}
+
+	switch token.text {
+	case "true", "false":
+		value := token.text == "true"
+		return func(fileContext) (interface{}, error) { return value, nil }, nil
+	case "path":
+		return func(f fileContext) (interface{}, error) { return f.path, nil }, nil
+	case "dir":
+		return func(f fileContext) (interface{}, error) { return path.Dir(f.path), nil }, nil
+	case "base":
+		return func(f fileContext) (interface{}, error) { return path.Base(f.path), nil }, nil
+	case "ext":
+		return func(f fileContext) (interface{}, error) { return path.Ext(f.path), nil }, nil
+	case "status":
+		return func(f fileContext) (interface{}, error) { return f.status, nil }, nil
+	}
+
+	if name := strings.TrimPrefix(token.text, "env."); name != token.text && name != "" {
+		return func(fileContext) (interface{}, error) { return os.Getenv(name), nil }, nil
+	}
+
+	return nil, fmt.Errorf("unknown %s", token)
+}
+
+func (p *scriptParser) parseCall(name string, count int, call func(fileContext, []string) (bool, error)) (scriptNode, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	args := []scriptNode{}
+	for !p.accept(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+
+	if len(args) != count {
+		return nil, fmt.Errorf("%s takes %d %s", name, count, pluralize(count, "argument"))
+	}
+
+	return func(f fileContext) (interface{}, error) {
+		values := make([]string, len(args))
+		for i, arg := range args {
+			value, err := stringValue(arg(f))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			values[i] = value
+		}
+		return call(f, values)
+	}, nil
+}
+
+func boolValue(value interface{}, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("%q is not a boolean", value)
+	}
+
+	return b, nil
+}
+
+func stringValue(value interface{}, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%v is not a string", value)
+	}
+
+	return s, nil
+}
+
+// nameStatus matches a line of `git diff --name-status`, e.g. `M\tpath` or
+// `R100\told\tnew`
+var nameStatus = regexp.MustCompile(`^([ACDMRTUXB])[0-9]*\t(?:([^\t]*)\t)?([^\t]+)$`)
+
+// splitStatuses replaces the `--name-status` lines of the diff output with
+// the changed paths, passing the status of each path to record. Both paths of
+// a rename are kept, since the file changed in both places, while a copy only
+// changes its new path. Other lines are kept as they are.
+func splitStatuses(lines []string, record func(f string, status string)) []string {
+	files := make([]string, 0, len(lines))
+
+	for _, line := range lines {
+		m := nameStatus.FindStringSubmatch(line)
+		if m == nil {
+			files = append(files, line)
+			continue
+		}
+
+		if m[1] == "R" && m[2] != "" {
+			files = append(files, m[2])
+			record(m[2], m[1])
+		}
+
+		files = append(files, m[3])
+		record(m[3], m[1])
+	}
+
+	return files
+}
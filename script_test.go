@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScriptMatch(t *testing.T) {
+	os.Setenv("FORCE_DEPLOY", "true")
+	defer os.Unsetenv("FORCE_DEPLOY")
+
+	file := fileContext{path: "services/foo/migrations/001_init.sql", status: "A"}
+
+	testCases := map[string]bool{
+		`glob("services/*/migrations/**")`:                        true,
+		`glob("services/*/migrations/**") && status == "D"`:       false,
+		`status != "D" && ext == ".sql"`:                          true,
+		`base =~ "^[0-9]+_"`:                                      true,
+		`dir == 'services/foo/migrations'`:                        true,
+		`startsWith(path, "services/") && !endsWith(path, ".go")`: true,
+		`contains(path, "bar") || env.FORCE_DEPLOY == "true"`:     true,
+		`env.UNSET_VARIABLE == ""`:                                true,
+		`!(ext == ".sql" || ext == ".go")`:                        false,
+		`true && false`:                                           false,
+		`"a \"quoted\" value" == 'a "quoted" value'`:              true,
+	}
+
+	for source, want := range testCases {
+		t.Run(source, func(t *testing.T) {
+			s, err := compileScript(source)
+			assert.NoError(t, err)
+
+			got, err := s.match(file)
+			assert.NoError(t, err)
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+func TestScriptErrors(t *testing.T) {
+	testCases := map[string]string{
+		`path ==`:           "invalid script `path ==`: unexpected end of script",
+		`glob("a", "b")`:    "invalid script `glob(\"a\", \"b\")`: glob takes 1 argument",
+		`owner == "me"`:     "invalid script `owner == \"me\"`: unknown `owner`",
+		`path == "a" path`:  "invalid script `path == \"a\" path`: unexpected `path`",
+		`path =~ ext`:       "invalid script `path =~ ext`: `=~` needs a regexp string instead of `ext`",
+		`path == "a`:        "invalid script `path == \"a`: unterminated string",
+		`path & "a"`:        "invalid script `path & \"a\"`: unexpected character '&'",
+		`(path == "a"`:      "invalid script `(path == \"a\"`: expected `)` instead of `end of script`",
+		`startsWith(path,)`: "invalid script `startsWith(path,)`: unexpected `)`",
+	}
+
+	for source, want := range testCases {
+		t.Run(source, func(t *testing.T) {
+			_, err := compileScript(source)
+			assert.EqualError(t, err, want)
+		})
+	}
+}
+
+func TestScriptRuntimeErrors(t *testing.T) {
+	file := fileContext{path: "services/foo/main.go"}
+
+	s, _ := compileScript(`path`)
+	_, err := s.match(file)
+	assert.EqualError(t, err, "script `path` returned \"services/foo/main.go\" instead of a boolean")
+
+	s, _ = compileScript(`path && true`)
+	_, err = s.match(file)
+	assert.EqualError(t, err, "script `path && true` failed for services/foo/main.go: \"services/foo/main.go\" is not a boolean")
+
+	s, _ = compileScript(`contains(true, "a")`)
+	_, err = s.match(file)
+	assert.EqualError(t, err, "script `contains(true, \"a\")` failed for services/foo/main.go: contains: true is not a string")
+}
+
+func TestSplitStatuses(t *testing.T) {
+	statuses := map[string]string{}
+
+	got := splitStatuses([]string{
+		"M\tservices/foo/main.go",
+		"R100\tservices/old.go\tservices/new.go",
+		"C75\tlibs/base.go\tlibs/copy.go",
+		"docs/README.md",
+	}, func(f string, status string) { statuses[f] = status })
+
+	assert.Equal(t, []string{"services/foo/main.go", "services/old.go", "services/new.go", "libs/copy.go", "docs/README.md"}, got)
+	assert.Equal(t, map[string]string{
+		"services/foo/main.go": "M",
+		"services/old.go":      "R",
+		"services/new.go":      "R",
+		"libs/copy.go":         "C",
+	}, statuses)
+}
+
+func TestUploadPipelineWithScriptMatcher(t *testing.T) {
+	deleted, _ := compileScript(`glob("services/**") && status == "D"`)
+
+	var generated []Step
+	generator := func(steps []Step, plugin Plugin) (*os.File, error) {
+		generated = steps
+		return mockGeneratePipeline(steps, plugin)
+	}
+
+	plugin := Plugin{
+		Diff:  `printf "M\tservices/foo/main.go\nD\tservices/bar/main.go\n"`,
+		Shell: []string{"sh", "-c"},
+		Watch: []WatchConfig{
+			{Paths: []string{"services/foo/"}, Step: Step{Trigger: "foo"}},
+			{Matcher: matcherScript, script: deleted, Step: Step{Trigger: "cleanup"}},
+			{Paths: []string{"services/baz/"}, Step: Step{Trigger: "baz"}},
+		},
+	}
+
+	_, _, err := uploadPipeline(plugin, generator)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Step{{Trigger: "foo"}, {Trigger: "cleanup"}}, generated)
+}
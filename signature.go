@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// signature tools
+const (
+	signatureCosign   = "cosign"
+	signatureMinisign = "minisign"
+)
+
+// signatureSuffix is appended to the location of a remote configuration file
+// to get its detached signature
+const signatureSuffix = ".sig"
+
+// ConfigSignature verifies the detached signatures of the remote configuration
+// files, presets and policies, with cosign or minisign and a public key file
+type ConfigSignature struct {
+	Tool string `json:"tool"`
+	Key  string `json:"key"`
+}
+
+// configSignature returns the `config_signature` of a raw configuration
+func configSignature(config map[string]interface{}) (*ConfigSignature, error) {
+	raw, ok := config["config_signature"]
+	if !ok {
+		return nil, nil
+	}
+
+	data, _ := json.Marshal(raw)
+
+	var sig ConfigSignature
+	if err := json.Unmarshal(data, &sig); err != nil {
+		return nil, fmt.Errorf("invalid config_signature: %v", err)
+	}
+
+	return &sig, sig.validate()
+}
+
+func (sig *ConfigSignature) validate() error {
+	if sig.Tool != signatureCosign && sig.Tool != signatureMinisign {
+		return fmt.Errorf("unknown config_signature tool `%s`", sig.Tool)
+	}
+
+	if sig.Key == "" {
+		return fmt.Errorf("config_signature needs a key")
+	}
+
+	return nil
+}
+
+// fetchSigned reads the file of the registry like fetchPreset, and verifies
+// its detached signature `<file>.sig` when the signature is configured
+func fetchSigned(registry string, file string, sig *ConfigSignature) ([]byte, error) {
+	data, err := fetchPreset(registry, file)
+	if err != nil || sig == nil {
+		return data, err
+	}
+
+	signature, err := fetchPreset(registry, file+signatureSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the signature of %s: %v", file, err)
+	}
+
+	if err := sig.verify(data, signature); err != nil {
+		return nil, fmt.Errorf("the signature of %s could not be verified: %v", file, err)
+	}
+
+	return data, nil
+}
+
+// verify checks the signature of the data with the tool
+func (sig *ConfigSignature) verify(data []byte, signature []byte) error {
+	dir, err := ioutil.TempDir(os.TempDir(), "monorepo-diff-signature")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	file := dir + "/config"
+	sigFile := file + signatureSuffix
+
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(sigFile, signature, 0600); err != nil {
+		return err
+	}
+
+	var args []string
+	switch sig.Tool {
+	case signatureCosign:
+		args = []string{"verify-blob", "--key", sig.Key, "--signature", sigFile, file}
+	case signatureMinisign:
+		args = []string{"-V", "-p", sig.Key, "-m", file, "-x", sigFile}
+	}
+
+	_, err = executeCommand(sig.Tool, args)
+
+	return err
+}
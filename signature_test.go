@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stubSignatureTools puts cosign and minisign stubs on the PATH, accepting the
+// signature `valid-signature`
+func stubSignatureTools(t *testing.T) func() {
+	bin, err := ioutil.TempDir("", "signature-bin")
+	assert.NoError(t, err)
+
+	stubs := map[string]string{
+		// cosign verify-blob --key <key> --signature <signature> <file>
+		"cosign": "#!/bin/sh\n[ \"$(cat \"$5\")\" = valid-signature ]\n",
+		// minisign -V -p <key> -m <file> -x <signature>
+		"minisign": "#!/bin/sh\n[ \"$(cat \"$7\")\" = valid-signature ]\n",
+	}
+	for name, script := range stubs {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(bin, name), []byte(script), 0755))
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+
+	return func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(bin)
+	}
+}
+
+func TestFetchSigned(t *testing.T) {
+	defer stubSignatureTools(t)()
+
+	dir, err := ioutil.TempDir("", "signed")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	write := func(name string, content string) {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	write("docs.yml", "watch: []\n")
+	write("docs.yml.sig", "valid-signature")
+	write("tampered.yml", "watch: []\n")
+	write("tampered.yml.sig", "other-signature")
+	write("unsigned.yml", "watch: []\n")
+
+	for _, tool := range []string{signatureCosign, signatureMinisign} {
+		t.Run(tool, func(t *testing.T) {
+			sig := &ConfigSignature{Tool: tool, Key: "key.pub"}
+
+			data, err := fetchSigned(dir, "docs.yml", sig)
+			assert.NoError(t, err)
+			assert.Equal(t, "watch: []\n", string(data))
+
+			_, err = fetchSigned(dir, "tampered.yml", sig)
+			assert.EqualError(t, err, "the signature of tampered.yml could not be verified: command `"+tool+"` failed: exit status 1")
+
+			_, err = fetchSigned(dir, "unsigned.yml", sig)
+			assert.Contains(t, err.Error(), "could not read the signature of unsigned.yml: ")
+		})
+	}
+
+	data, err := fetchSigned(dir, "unsigned.yml", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "watch: []\n", string(data))
+}
+
+func TestPluginExtendsSignedPreset(t *testing.T) {
+	defer stubSignatureTools(t)()
+
+	dir, err := ioutil.TempDir("", "presets")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "terraform.yml"), []byte(terraformPreset), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "terraform.yml.sig"), []byte("other-signature"), 0644))
+
+	_, err = extendPlugin([]byte(`{
+		"extends": "org://terraform",
+		"preset_registry": "` + dir + `",
+		"config_signature": {"tool": "cosign", "key": "platform.pub"}
+	}`))
+
+	assert.EqualError(t, err, "could not load preset `terraform`: the signature of terraform.yml could not be verified: command `cosign` failed: exit status 1")
+}
+
+func TestConfigSignatureValidate(t *testing.T) {
+	assert.NoError(t, (&ConfigSignature{Tool: "minisign", Key: "key.pub"}).validate())
+	assert.EqualError(t, (&ConfigSignature{Tool: "gpg", Key: "key.pub"}).validate(), "unknown config_signature tool `gpg`")
+	assert.EqualError(t, (&ConfigSignature{Tool: "cosign"}).validate(), "config_signature needs a key")
+}
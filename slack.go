@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// slackMessage is the payload of a Slack incoming webhook
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+// notifySlack posts the pipelines triggered by the build to the Slack webhook.
+// Failures are only logged since the notification is informational.
+func notifySlack(plugin Plugin, steps []Step) {
+	message := slackMessage{Text: slackText(steps)}
+
+	if err := sendJSON(http.MethodPost, plugin.SlackWebhook, "", message, nil); err != nil {
+		log.Warnf("could not notify Slack: %v", err)
+	}
+}
+
+// slackText describes the pipelines triggered by the build in Slack markup
+func slackText(steps []Step) string {
+	org := env("BUILDKITE_ORGANIZATION_SLUG", "")
+	triggered := []string{}
+
+	for _, s := range steps {
+		if s.Trigger != "" {
+			name := s.Trigger
+			if s.WatchLabel != "" {
+				name = s.WatchLabel
+			}
+
+			triggered = append(triggered, fmt.Sprintf(
+				"• <https://buildkite.com/%s/%s|%s>", stepOrganization(s, org), s.Trigger, name,
+			))
+		}
+	}
+
+	build := fmt.Sprintf(
+		"<%s|%s #%s> on `%s`",
+		env("BUILDKITE_BUILD_URL", ""),
+		env("BUILDKITE_PIPELINE_SLUG", ""),
+		env("BUILDKITE_BUILD_NUMBER", ""),
+		env("BUILDKITE_BRANCH", ""),
+	)
+
+	if len(triggered) == 0 {
+		return build + " triggered no pipelines"
+	}
+
+	return fmt.Sprintf(
+		"%s triggered %d %s:\n%s",
+		build, len(triggered), pluralize(len(triggered), "pipeline"), strings.Join(triggered, "\n"),
+	)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlackText(t *testing.T) {
+	os.Setenv("BUILDKITE_ORGANIZATION_SLUG", "org")
+	os.Setenv("BUILDKITE_PIPELINE_SLUG", "monorepo")
+	os.Setenv("BUILDKITE_BUILD_NUMBER", "42")
+	os.Setenv("BUILDKITE_BUILD_URL", "https://buildkite.com/org/monorepo/builds/42")
+	defer os.Unsetenv("BUILDKITE_ORGANIZATION_SLUG")
+	defer os.Unsetenv("BUILDKITE_PIPELINE_SLUG")
+	defer os.Unsetenv("BUILDKITE_BUILD_NUMBER")
+	defer os.Unsetenv("BUILDKITE_BUILD_URL")
+
+	build := "<https://buildkite.com/org/monorepo/builds/42|monorepo #42> on `go-rewrite`"
+
+	assert.Equal(t, build+" triggered no pipelines", slackText(nil))
+	assert.Equal(t,
+		build+" triggered 2 pipelines:\n"+
+			"• <https://buildkite.com/org/foo-service|Foo service>\n"+
+			"• <https://buildkite.com/other-org/bar-service|bar-service>",
+		slackText([]Step{
+			{Trigger: "foo-service", WatchLabel: "Foo service"},
+			{Command: "echo hello"},
+			{Trigger: "bar-service", Organization: "other-org"},
+		}),
+	)
+}
+
+func TestNotifySlack(t *testing.T) {
+	var got slackMessage
+	var auth string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		_ = json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer server.Close()
+
+	notifySlack(Plugin{SlackWebhook: server.URL + "/services/T0/B0/x"}, []Step{{Trigger: "foo-service"}})
+
+	assert.Empty(t, auth)
+	assert.Contains(t, got.Text, "triggered 1 pipeline:\n")
+}
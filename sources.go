@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ways of merging the changed files of `diff_sources`
+const (
+	sourcesUnion        = "union"
+	sourcesIntersection = "intersection"
+)
+
+// sourcesDiff merges the changed files of several diff providers. The union
+// streams the files of every source in turn, and only fails when every source
+// fails, so missing history on one source doesn't hide changes. The
+// intersection needs every file of every source, and fails with any of them.
+type sourcesDiff struct {
+	names     []string
+	providers []DiffProvider
+	merge     string
+}
+
+func newSourcesDiff(plugin Plugin) (DiffProvider, error) {
+	d := &sourcesDiff{names: plugin.DiffSources, merge: plugin.DiffSourcesMerge}
+
+	for _, name := range plugin.DiffSources {
+		source := plugin
+		source.DiffSources = nil
+		source.DiffProvider = name
+
+		provider, err := newDiffProvider(source)
+		if err != nil {
+			return nil, fmt.Errorf("diff source `%s`: %v", name, err)
+		}
+		d.providers = append(d.providers, provider)
+	}
+
+	return d, nil
+}
+
+func (d *sourcesDiff) Stream(fn func(files []string) bool) (int, error) {
+	if d.merge == sourcesIntersection {
+		return d.intersect(fn)
+	}
+
+	count := 0
+	failed := []string{}
+	stopped := false
+
+	for i, provider := range d.providers {
+		n, err := provider.Stream(func(files []string) bool {
+			stopped = !fn(files)
+			return !stopped
+		})
+		count += n
+
+		if err != nil {
+			log.Warnf("Diff source `%s` failed: %v", d.names[i], err)
+			failed = append(failed, fmt.Sprintf("%s: %v", d.names[i], err))
+		}
+
+		if stopped {
+			break
+		}
+	}
+
+	if len(failed) == len(d.providers) {
+		return count, fmt.Errorf("every diff source failed: %s", strings.Join(failed, "; "))
+	}
+
+	return count, nil
+}
+
+// intersect passes the files listed by every source to fn
+func (d *sourcesDiff) intersect(fn func(files []string) bool) (int, error) {
+	var result []string
+
+	for i, provider := range d.providers {
+		seen := map[string]bool{}
+		source := []string{}
+
+		_, err := provider.Stream(func(files []string) bool {
+			for _, f := range files {
+				seen[changedName(f)] = true
+				source = append(source, f)
+			}
+			return true
+		})
+		if err != nil {
+			return 0, fmt.Errorf("diff source `%s` failed: %v", d.names[i], err)
+		}
+
+		if i == 0 {
+			result = source
+			continue
+		}
+
+		kept := []string{}
+		for _, f := range result {
+			if seen[changedName(f)] {
+				kept = append(kept, f)
+			}
+		}
+		result = kept
+	}
+
+	return streamFiles(result, fn), nil
+}
+
+// changedName returns the normalized file of a line of the diff, without its
+// `--name-status` status
+func changedName(line string) string {
+	if m := nameStatus.FindStringSubmatch(line); m != nil {
+		line = m[2]
+	}
+
+	return cleanFile(line)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func streamAll(provider DiffProvider) ([]string, error) {
+	files := []string{}
+	_, err := provider.Stream(func(chunk []string) bool {
+		files = append(files, chunk...)
+		return true
+	})
+
+	return files, err
+}
+
+func TestSourcesDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sources")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "changed.txt")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("services/bar/main.go\n./services/foo/main.go\n"), 0644))
+
+	testCases := map[string]struct {
+		merge    string
+		diffFile string
+		expected []string
+		err      string
+	}{
+		"union": {
+			merge:    sourcesUnion,
+			diffFile: path,
+			expected: []string{"services/foo/main.go", "docs/README.md", "services/bar/main.go", "./services/foo/main.go"},
+		},
+		"union with a failed source": {
+			merge:    sourcesUnion,
+			diffFile: filepath.Join(dir, "missing.txt"),
+			expected: []string{"services/foo/main.go", "docs/README.md"},
+		},
+		"intersection": {
+			merge:    sourcesIntersection,
+			diffFile: path,
+			expected: []string{"services/foo/main.go"},
+		},
+		"intersection with a failed source": {
+			merge:    sourcesIntersection,
+			diffFile: filepath.Join(dir, "missing.txt"),
+			err:      "diff source `file` failed: could not read diff_file: open " + filepath.Join(dir, "missing.txt") + ": no such file or directory",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			provider, err := newDiffProvider(Plugin{
+				Diff:             "printf 'services/foo/main.go\\ndocs/README.md\\n'",
+				Shell:            []string{"sh", "-c"},
+				DiffFile:         tc.diffFile,
+				DiffSources:      []string{"command", "file"},
+				DiffSourcesMerge: tc.merge,
+			})
+			assert.NoError(t, err)
+
+			files, err := streamAll(provider)
+
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, files)
+		})
+	}
+}
+
+func TestSourcesDiffEverySourceFailed(t *testing.T) {
+	provider, err := newDiffProvider(Plugin{
+		Diff:             "exit 1",
+		Shell:            []string{"sh", "-c"},
+		DiffFile:         "missing.txt",
+		DiffSources:      []string{"command", "file"},
+		DiffSourcesMerge: sourcesUnion,
+	})
+	assert.NoError(t, err)
+
+	_, err = streamAll(provider)
+
+	assert.Contains(t, err.Error(), "every diff source failed: command: ")
+}
+
+func TestSourcesDiffInvalidSource(t *testing.T) {
+	_, err := newDiffProvider(Plugin{DiffSources: []string{"command", "file"}})
+
+	assert.EqualError(t, err, "diff source `file`: the file diff_provider needs a diff_file")
+}
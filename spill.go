@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sizeUnits are the units of memory sizes, e.g. "256MB"
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"GiB", 1 << 30},
+	{"MiB", 1 << 20},
+	{"KiB", 1 << 10},
+	{"GB", 1000 * 1000 * 1000},
+	{"MB", 1000 * 1000},
+	{"KB", 1000},
+	{"B", 1},
+}
+
+// parseSize parses a memory size in bytes, or with a unit, e.g. "256MB"
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	unit := int64(1)
+
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			unit = u.bytes
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size `%s`", s)
+	}
+
+	return n * unit, nil
+}
+
+// memoryBudget bounds the bytes of the file lists held in memory. Once it is
+// exceeded, every list spills its files to a temporary file.
+// A zero limit keeps every list in memory.
+type memoryBudget struct {
+	limit int64
+	mu    sync.Mutex
+	used  int64
+	lists []*spillList
+	err   error
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	return &memoryBudget{limit: limit}
+}
+
+// list returns a new file list held within the budget
+func (b *memoryBudget) list() *spillList {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	l := &spillList{budget: b}
+	b.lists = append(b.lists, l)
+
+	return l
+}
+
+// spill writes the files of every list to disk. It is called with the lock held.
+func (b *memoryBudget) spill() {
+	for _, l := range b.lists {
+		if err := l.flush(); err != nil && b.err == nil {
+			b.err = err
+		}
+	}
+
+	b.used = 0
+}
+
+// close removes the spilled files
+func (b *memoryBudget) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, l := range b.lists {
+		if l.file != nil {
+			l.file.Close()
+			os.Remove(l.file.Name())
+			l.file = nil
+		}
+	}
+}
+
+// spillList is a list of files kept in memory until its budget is exceeded,
+// then appended to a temporary file
+type spillList struct {
+	budget  *memoryBudget
+	files   []string
+	file    *os.File
+	spilled int
+}
+
+// add appends files to the list
+func (l *spillList) add(files ...string) {
+	b := l.budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	l.files = append(l.files, files...)
+
+	if b.limit == 0 {
+		return
+	}
+
+	for _, f := range files {
+		b.used += int64(len(f)) + 1
+	}
+
+	if b.used > b.limit {
+		b.spill()
+	}
+}
+
+// flush appends the files in memory to the temporary file of the list
+func (l *spillList) flush() error {
+	if len(l.files) == 0 {
+		return nil
+	}
+
+	if l.file == nil {
+		file, err := ioutil.TempFile(os.TempDir(), "monorepo-diff-files-*")
+		if err != nil {
+			return fmt.Errorf("could not spill matched files to disk: %v", err)
+		}
+		l.file = file
+	}
+
+	w := bufio.NewWriter(l.file)
+	for _, f := range l.files {
+		fmt.Fprintln(w, f)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("could not spill matched files to disk: %v", err)
+	}
+
+	l.spilled += len(l.files)
+	l.files = nil
+
+	return nil
+}
+
+// fileSource calls fn with every file of a list in order, until it returns false
+type fileSource func(fn func(file string) bool) error
+
+// sliceSource returns the source of the files of a slice
+func sliceSource(files []string) fileSource {
+	return func(fn func(file string) bool) error {
+		for _, f := range files {
+			if !fn(f) {
+				return nil
+			}
+		}
+		return nil
+	}
+}
+
+// each calls fn with every file of the list in order, streaming the spilled
+// files from disk, until fn returns false. The spilled files are read with a
+// handle of their own, so a complete list can be read concurrently.
+func (l *spillList) each(fn func(file string) bool) error {
+	b := l.budget
+	b.mu.Lock()
+	err, files, name := b.err, l.files, ""
+	if l.file != nil {
+		name = l.file.Name()
+	}
+	b.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if name != "" {
+		f, err := os.Open(name)
+		if err != nil {
+			return fmt.Errorf("could not read spilled matched files: %v", err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			if !fn(scanner.Text()) {
+				return nil
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("could not read spilled matched files: %v", err)
+		}
+	}
+
+	return sliceSource(files)(fn)
+}
+
+// all returns every file of the list, reading back the spilled files. Lists
+// that can be large are streamed with each instead.
+func (l *spillList) all() ([]string, error) {
+	files := []string{}
+	err := l.each(func(f string) bool {
+		files = append(files, f)
+		return true
+	})
+
+	return files, err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSize(t *testing.T) {
+	testCases := map[string]struct {
+		input    string
+		expected int64
+		err      string
+	}{
+		"bytes":    {"1024", 1024, ""},
+		"B":        {"512B", 512, ""},
+		"MB":       {"64MB", 64 * 1000 * 1000, ""},
+		"MiB":      {"64MiB", 64 << 20, ""},
+		"GB space": {"1 GB", 1000 * 1000 * 1000, ""},
+		"invalid":  {"lots", 0, "invalid size `lots`"},
+		"negative": {"-1MB", 0, "invalid size `-1`"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseSize(tc.input)
+
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, got)
+		})
+	}
+}
+
+func TestSpillList(t *testing.T) {
+	budget := newMemoryBudget(40)
+	defer budget.close()
+
+	first := budget.list()
+	second := budget.list()
+
+	first.add("services/foo/a.go")
+	second.add("docs/README.md")
+	assert.Nil(t, first.file)
+
+	first.add("services/foo/b.go")
+	assert.NotNil(t, first.file)
+	assert.NotNil(t, second.file)
+	assert.Empty(t, first.files)
+
+	first.add("services/foo/c.go")
+
+	files, err := first.all()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"services/foo/a.go", "services/foo/b.go", "services/foo/c.go"}, files)
+
+	files, err = second.all()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"docs/README.md"}, files)
+}
+
+func TestSpillListEach(t *testing.T) {
+	budget := newMemoryBudget(40)
+	defer budget.close()
+
+	list := budget.list()
+	for _, f := range []string{"services/foo/a.go", "services/foo/b.go", "services/foo/c.go"} {
+		list.add(f)
+	}
+
+	var files []string
+	err := list.each(func(f string) bool {
+		files = append(files, f)
+		return len(files) < 2
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"services/foo/a.go", "services/foo/b.go"}, files)
+
+	// every read opens the spilled file again
+	files = nil
+	assert.NoError(t, list.each(func(f string) bool { files = append(files, f); return true }))
+	assert.Len(t, files, 3)
+}
+
+func TestSpillListUnbounded(t *testing.T) {
+	budget := newMemoryBudget(0)
+	list := budget.list()
+
+	for i := 0; i < 1000; i++ {
+		list.add("services/foo/main.go")
+	}
+
+	files, err := list.all()
+	assert.NoError(t, err)
+	assert.Len(t, files, 1000)
+	assert.Nil(t, list.file)
+}
+
+func TestUploadPipelineWithMemoryBudget(t *testing.T) {
+	var generated []Step
+	generator := func(steps []Step, plugin Plugin) (*os.File, error) {
+		generated = steps
+		return mockGeneratePipeline(steps, plugin)
+	}
+
+	plugin := Plugin{
+		Diff:         "printf 'services/foo/main.go\\nservices/bar/main.go\\nservices/foo/util.go\\n'",
+		Shell:        []string{"sh", "-c"},
+		MemoryBudget: 10,
+		Templates:    true,
+		Watch: []WatchConfig{
+			{
+				Paths: []string{"services/(?P<svc>[^/]+)/**"},
+				Step:  Step{Label: "Deploy {{ .Captures.svc }} ({{ len .Files }})", Command: "make deploy"},
+			},
+		},
+	}
+
+	_, _, err := uploadPipeline(plugin, generator)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Step{
+		{Label: "Deploy bar (1)", Command: "make deploy", Env: map[string]string{"SVC": "bar"}},
+		{Label: "Deploy foo (2)", Command: "make deploy", Env: map[string]string{"SVC": "foo"}},
+	}, generated)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+)
+
+// staggerSteps splits the steps into batches of `trigger_rate` separated by
+// wait steps, so that a change touching every service doesn't start all builds
+// at once. The waits continue on failure, so a failed build of a batch doesn't
+// stop the later batches from being triggered. With `stagger`, the batches are
+// uploaded apart instead, see staggerBatches.
+func staggerSteps(steps []Step, plugin Plugin) []Step {
+	if plugin.Stagger > 0 {
+		return steps
+	}
+
+	batches := triggerBatches(steps, plugin.TriggerRate)
+	result := append([]Step{}, batches[0]...)
+
+	for _, batch := range batches[1:] {
+		result = append(result, Step{Wait: true, WaitAttributes: map[string]interface{}{"continue_on_failure": true}})
+		result = append(result, batch...)
+	}
+
+	return result
+}
+
+// staggerBatches returns the steps uploaded with the pipeline, and the batches
+// of `trigger_rate` steps uploaded `stagger` apart after it by the plugin step,
+// so the delay doesn't need an agent of its own
+func staggerBatches(steps []Step, plugin Plugin) ([]Step, [][]Step) {
+	if plugin.Stagger <= 0 {
+		return steps, nil
+	}
+
+	batches := triggerBatches(steps, plugin.TriggerRate)
+
+	return batches[0], batches[1:]
+}
+
+// triggerBatches splits the steps into batches of size, or a single batch
+func triggerBatches(steps []Step, size int) [][]Step {
+	if size <= 0 || len(steps) <= size {
+		return [][]Step{steps}
+	}
+
+	batches := [][]Step{}
+	for i := 0; i < len(steps); i += size {
+		end := i + size
+		if end > len(steps) {
+			end = len(steps)
+		}
+
+		batches = append(batches, steps[i:end])
+	}
+
+	return batches
+}
+
+// checkStagger fails when `stagger` can't be applied: every batch after the
+// first is inserted directly after the plugin step, before the hooks placed
+// before the generated steps
+func checkStagger(plugin Plugin) error {
+	if plugin.Stagger <= 0 {
+		return nil
+	}
+
+	if plugin.TriggerRate <= 0 {
+		return fmt.Errorf("stagger needs trigger_rate")
+	}
+
+	if len(hooksInPhase(plugin.Hooks, hookPhaseBefore)) > 0 {
+		return fmt.Errorf("stagger can't be used with hooks before the generated steps")
+	}
+
+	return nil
+}
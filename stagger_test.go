@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestStaggerSteps(t *testing.T) {
+	steps := []Step{{Trigger: "a"}, {Trigger: "b"}, {Trigger: "c"}}
+	wait := Step{Wait: true, WaitAttributes: map[string]interface{}{"continue_on_failure": true}}
+
+	testCases := map[string]struct {
+		Plugin   Plugin
+		Expected []Step
+	}{
+		"disabled": {
+			Plugin:   Plugin{},
+			Expected: steps,
+		},
+		"single batch": {
+			Plugin:   Plugin{TriggerRate: 3},
+			Expected: steps,
+		},
+		"batches": {
+			Plugin:   Plugin{TriggerRate: 2},
+			Expected: []Step{{Trigger: "a"}, {Trigger: "b"}, wait, {Trigger: "c"}},
+		},
+		"stagger": {
+			Plugin:   Plugin{TriggerRate: 1, Stagger: 30 * time.Second},
+			Expected: steps,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.Expected, staggerSteps(steps, tc.Plugin))
+			assert.Equal(t, []Step{{Trigger: "a"}, {Trigger: "b"}, {Trigger: "c"}}, steps)
+		})
+	}
+}
+
+func TestMarshalBatchWait(t *testing.T) {
+	data, err := yaml.Marshal(staggerSteps([]Step{{Trigger: "a"}, {Trigger: "b"}}, Plugin{TriggerRate: 1}))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "- trigger: a\n- wait: null\n  continue_on_failure: true\n- trigger: b\n", string(data))
+}
+
+func TestUploadPipelineStaggersBatches(t *testing.T) {
+	var delays []time.Duration
+	sleep = func(d time.Duration) { delays = append(delays, d) }
+	defer func() { sleep = func(time.Duration) {} }()
+
+	var generated [][]Step
+	var hooks [][]HookConfig
+
+	generator := func(steps []Step, plugin Plugin) (*os.File, error) {
+		generated = append(generated, steps)
+		hooks = append(hooks, plugin.Hooks)
+		return mockGeneratePipeline(steps, plugin)
+	}
+
+	plugin := Plugin{
+		Diff:        "echo foo-service/",
+		TriggerRate: 2,
+		Stagger:     30 * time.Second,
+		Hooks:       []HookConfig{{Step: Step{Command: "echo done"}}},
+		Watch: []WatchConfig{
+			{Paths: []string{"foo-service/"}, Step: Step{Trigger: "foo-1"}},
+			{Paths: []string{"foo-service/"}, Step: Step{Trigger: "foo-2"}},
+			{Paths: []string{"foo-service/"}, Step: Step{Trigger: "foo-3"}},
+		},
+	}
+
+	_, _, err := uploadPipeline(plugin, generator)
+
+	assert.NoError(t, err)
+	assert.Equal(t, [][]Step{
+		{{Trigger: "foo-1"}, {Trigger: "foo-2"}},
+		{{Trigger: "foo-3"}},
+	}, generated)
+	assert.Equal(t, [][]HookConfig{{{Step: Step{Command: "echo done"}}}, {}}, hooks)
+	assert.Equal(t, []time.Duration{30 * time.Second}, delays)
+}
+
+func TestCheckStagger(t *testing.T) {
+	testCases := map[string]struct {
+		plugin Plugin
+		err    string
+	}{
+		"disabled":     {Plugin{TriggerRate: 2}, ""},
+		"stagger":      {Plugin{TriggerRate: 2, Stagger: time.Minute}, ""},
+		"without rate": {Plugin{Stagger: time.Minute}, "stagger needs trigger_rate"},
+		"before hooks": {
+			Plugin{TriggerRate: 2, Stagger: time.Minute, Hooks: []HookConfig{{Step: Step{Command: "setup"}, Phase: hookPhaseBefore}}},
+			"stagger can't be used with hooks before the generated steps",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := checkStagger(tc.plugin)
+
+			if tc.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tc.err)
+		})
+	}
+}
+
+func TestMarshalWaitStep(t *testing.T) {
+	data, err := yaml.Marshal([]Step{{Trigger: "a"}, {Wait: true}, {Trigger: "b"}})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "- trigger: a\n- wait\n- trigger: b\n", string(data))
+}
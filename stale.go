@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// staleContext is the annotation context of the watches skipped for a stale diff base
+const staleContext = "monorepo-diff-stale"
+
+// now is replaced in tests to fix the age of the diff base
+var now = time.Now
+
+// skipStaleWatches skips the steps of the watches with a `stale_after` older
+// than the diff base, since the diff of an ancient branch would only trigger
+// part of what changed since, and annotates the build with the skipped steps
+func skipStaleWatches(plugin Plugin, watches []WatchConfig) ([]WatchConfig, error) {
+	budgeted := false
+	for _, w := range watches {
+		budgeted = budgeted || w.StaleAfter > 0
+	}
+
+	if !budgeted {
+		return watches, nil
+	}
+
+	base := knownDiffBase(plugin)
+	if base == "" {
+		return nil, fmt.Errorf("stale_after needs a diff_base or the git diff_provider")
+	}
+
+	committed, err := commitTime(base)
+	if err != nil {
+		return nil, err
+	}
+
+	age := now().Sub(committed)
+	result := make([]WatchConfig, len(watches))
+	skipped := []string{}
+
+	for i, w := range watches {
+		result[i] = w
+
+		if w.StaleAfter > 0 && age > w.StaleAfter {
+			result[i].Step.Skip = fmt.Sprintf("the diff base is older than %s, rebase or run a full build", w.StaleAfter)
+			skipped = append(skipped, stepName(w.Step))
+		}
+	}
+
+	if len(skipped) == 0 {
+		return result, nil
+	}
+
+	log.Warnf("Skipping %d %s, the diff base %s is %s old", len(skipped), pluralize(len(skipped), "step"), base, age.Round(time.Hour))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "The diff base `%s` is %s old, so these steps were skipped as stale:\n\n", base, age.Round(time.Hour))
+	for _, name := range skipped {
+		fmt.Fprintf(&b, "- %s\n", name)
+	}
+	b.WriteString("\nRebase the branch, or run a full build.\n")
+
+	if err := annotate(plugin, "warning", staleContext, b.String()); err != nil {
+		log.Warnf("could not annotate the build: %v", err)
+	}
+
+	return result, nil
+}
+
+// mergeBase returns the merge base of a `base...head` range, or the revision
+func mergeBase(revision string) (string, error) {
+	split := strings.SplitN(revision, "...", 2)
+	if len(split) != 2 {
+		return revision, nil
+	}
+
+	head := split[1]
+	if head == "" {
+		head = "HEAD"
+	}
+
+	output, err := executeCommand("git", []string{"merge-base", split[0], head})
+	if err != nil {
+		return "", fmt.Errorf("could not find the merge base of %s: %v", revision, err)
+	}
+
+	return strings.TrimSpace(output), nil
+}
+
+// commitTime returns the commit time of a revision, or of the merge base of a
+// `base...head` range
+func commitTime(revision string) (time.Time, error) {
+	revision, err := mergeBase(revision)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	output, err := executeCommand("git", []string{"log", "-1", "--format=%ct", revision})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not get the commit time of %s: %v", revision, err)
+	}
+
+	seconds, err := strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid commit time of %s: %v", revision, err)
+	}
+
+	return time.Unix(seconds, 0), nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommitTime(t *testing.T) {
+	head, err := commitTime("HEAD")
+	assert.NoError(t, err)
+	assert.False(t, head.IsZero())
+
+	base, err := commitTime("HEAD...HEAD")
+	assert.NoError(t, err)
+	assert.Equal(t, head, base)
+
+	_, err = commitTime("no-such-revision")
+	assert.Error(t, err)
+}
+
+func TestSkipStaleWatches(t *testing.T) {
+	head, err := commitTime("HEAD")
+	assert.NoError(t, err)
+
+	now = func() time.Time { return head.Add(48 * time.Hour) }
+	defer func() { now = time.Now }()
+
+	watches := []WatchConfig{
+		{Step: Step{Trigger: "foo"}, StaleAfter: 24 * time.Hour},
+		{Step: Step{Trigger: "bar"}, StaleAfter: 72 * time.Hour},
+		{Step: Step{Trigger: "baz"}},
+	}
+
+	got, err := skipStaleWatches(Plugin{DiffBase: "HEAD"}, watches)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "the diff base is older than 24h0m0s, rebase or run a full build", got[0].Step.Skip)
+	assert.Equal(t, "", got[1].Step.Skip)
+	assert.Equal(t, "", got[2].Step.Skip)
+	assert.Equal(t, "", watches[0].Step.Skip)
+}
+
+func TestSkipStaleWatchesWithoutBase(t *testing.T) {
+	watches := []WatchConfig{{Step: Step{Trigger: "foo"}, StaleAfter: 24 * time.Hour}}
+
+	_, err := skipStaleWatches(Plugin{Diff: "git diff --name-only origin/main...HEAD"}, watches)
+	assert.EqualError(t, err, "stale_after needs a diff_base or the git diff_provider")
+
+	_, err = skipStaleWatches(Plugin{DiffProvider: "git", DiffBase: "no-such-revision"}, watches)
+	assert.Error(t, err)
+}
+
+func TestSkipStaleWatchesWithoutBudget(t *testing.T) {
+	watches := []WatchConfig{{Step: Step{Trigger: "foo"}}}
+
+	got, err := skipStaleWatches(Plugin{DiffBase: "no-such-revision"}, watches)
+
+	assert.NoError(t, err)
+	assert.Equal(t, watches, got)
+}
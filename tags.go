@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/bmatcuk/doublestar/v2"
+)
+
+// hasTagWatches reports whether any watch routes tag builds
+func hasTagWatches(watches []WatchConfig) bool {
+	for _, w := range watches {
+		if len(w.Tags) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tagWatches returns the watches with a `tags` glob matching the tag
+func tagWatches(watches []WatchConfig, tag string) ([]WatchConfig, error) {
+	matched := []WatchConfig{}
+
+	for _, w := range watches {
+		for _, pattern := range w.Tags {
+			match, err := doublestar.Match(pattern, tag)
+			if err != nil {
+				return nil, fmt.Errorf("tag matching failed: %v", err)
+			}
+
+			if match {
+				matched = append(matched, w)
+				break
+			}
+		}
+	}
+
+	return matched, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTagWatches(t *testing.T) {
+	watches := []WatchConfig{
+		{Tags: []string{"v*"}, Step: Step{Trigger: "release"}},
+		{Tags: []string{"docs-*", "v*.*.*"}, Step: Step{Trigger: "docs"}},
+		{Paths: []string{"services/"}, Step: Step{Trigger: "services"}},
+	}
+
+	assert.True(t, hasTagWatches(watches))
+	assert.False(t, hasTagWatches(watches[2:]))
+
+	got, err := tagWatches(watches, "v1.2.3")
+	assert.NoError(t, err)
+	assert.Equal(t, watches[:2], got)
+
+	got, err = tagWatches(watches, "docs-2021")
+	assert.NoError(t, err)
+	assert.Equal(t, watches[1:2], got)
+
+	_, err = tagWatches([]WatchConfig{{Tags: []string{"[v"}}}, "v1")
+	assert.EqualError(t, err, "tag matching failed: syntax error in pattern")
+}
+
+func TestUploadPipelineRoutesTagBuilds(t *testing.T) {
+	os.Setenv("BUILDKITE_TAG", "v1.2.3")
+	defer os.Unsetenv("BUILDKITE_TAG")
+
+	var generated []Step
+	generator := func(steps []Step, plugin Plugin) (*os.File, error) {
+		generated = steps
+		return mockGeneratePipeline(steps, plugin)
+	}
+
+	plugin := Plugin{
+		Diff: "echo services/foo/main.go",
+		Watch: []WatchConfig{
+			{Tags: []string{"v*"}, Step: Step{Trigger: "release"}},
+			{Paths: []string{"services/foo/"}, Step: Step{Trigger: "foo"}},
+		},
+	}
+
+	_, _, err := uploadPipeline(plugin, generator)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Step{{Trigger: "release"}}, generated)
+}
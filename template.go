@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// templateFuncs are the helpers available in step templates
+var templateFuncs = template.FuncMap{
+	"dirname":    path.Dir,
+	"basename":   path.Base,
+	"ext":        path.Ext,
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"join":       func(sep string, items []string) string { return strings.Join(items, sep) },
+	"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"dirs":       dirs,
+	"uniq":       uniq,
+	"env":        func(key string) string { return env(key, "") },
+}
+
+// templateData is available to the templates of a watch
+type templateData struct {
+	// Files are the changed files matched by the watch
+	Files []string
+	// Dir and Name are the directory and its name for watches generated by fan out
+	Dir  string
+	Name string
+	// Captures are the values captured by the capture groups of the paths
+	Captures map[string]string
+	// Environment is the environment of watches expanded by `environments`
+	Environment string
+}
+
+// renderWatches renders the templates in the step fields of the watches.
+// Fan out and environment watches are always rendered, the others only with
+// `templates`. The env of environment watches is rendered as well.
+func renderWatches(watches []WatchConfig, templates bool) ([]WatchConfig, error) {
+	result := make([]WatchConfig, len(watches))
+
+	for i, w := range watches {
+		if !templates && w.FanOut == "" && w.Environment == "" {
+			result[i] = w
+			continue
+		}
+
+		data := watchData(w)
+		step, err := renderStep(w.Step, data)
+		if err != nil {
+			return nil, err
+		}
+
+		if w.Environment != "" {
+			if step.Env, err = renderEnv(step, step.Env, data); err != nil {
+				return nil, err
+			}
+			if step.Build.Env, err = renderEnv(step, step.Build.Env, data); err != nil {
+				return nil, err
+			}
+		}
+
+		w.Step = step
+		result[i] = w
+	}
+
+	return result, nil
+}
+
+// watchData returns the template data of the watch
+func watchData(w WatchConfig) templateData {
+	data := templateData{Files: w.Files, Captures: w.Captures, Environment: w.Environment}
+	if w.Dir != "" {
+		data.Dir = w.Dir
+		data.Name = path.Base(w.Dir)
+	}
+
+	return data
+}
+
+// renderStep renders the label, key, command, trigger, block and concurrency
+// group of the step, and its build message when it is configured rather than
+// the message of the commit, which isn't a template.
+func renderStep(step Step, data templateData) (Step, error) {
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{"label", &step.Label},
+		{"key", &step.Key},
+		{"command", &step.Command},
+		{"trigger", &step.Trigger},
+		{"block", &step.Block},
+		{"concurrency_group", &step.ConcurrencyGroup},
+	}
+
+	if step.Build.configured {
+		fields = append(fields, struct {
+			name  string
+			value *string
+		}{"build message", &step.Build.Message})
+	}
+
+	for _, f := range fields {
+		rendered, err := render(*f.value, data)
+		if err != nil {
+			return step, fmt.Errorf("could not render the %s of %s: %v", f.name, stepName(step), err)
+		}
+		*f.value = rendered
+	}
+
+	return step, nil
+}
+
+// renderEnv returns a copy of the env of the step with its values rendered
+func renderEnv(step Step, env map[string]string, data templateData) (map[string]string, error) {
+	if env == nil {
+		return nil, nil
+	}
+
+	result := make(map[string]string, len(env))
+	for key, value := range env {
+		rendered, err := render(value, data)
+		if err != nil {
+			return nil, fmt.Errorf("could not render the env %s of %s: %v", key, stepName(step), err)
+		}
+		result[key] = rendered
+	}
+
+	return result, nil
+}
+
+func render(text string, data templateData) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	tmpl, err := template.New("step").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+
+	return out.String(), nil
+}
+
+// dirs returns the sorted unique directories of the files
+func dirs(files []string) []string {
+	result := make([]string, len(files))
+	for i, f := range files {
+		result[i] = path.Dir(f)
+	}
+
+	return uniq(result)
+}
+
+// uniq returns the sorted unique items
+func uniq(items []string) []string {
+	sorted := append([]string{}, items...)
+	sort.Strings(sorted)
+
+	result := []string{}
+	for i, item := range sorted {
+		if i == 0 || item != sorted[i-1] {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderWatches(t *testing.T) {
+	watches := []WatchConfig{
+		{
+			Files: []string{"services/foo/main.go", "services/foo/api/handler.go", "services/bar/main.go"},
+			Step: Step{
+				Label:   `:go: {{ join ", " (dirs .Files) }}`,
+				Command: `make test DIRS="{{ range dirs .Files }}{{ basename . }} {{ end }}"`,
+				Build:   Build{Message: "fix: {{ len .Files }} files", configured: true},
+				Env:     map[string]string{"DIRS": "{{ .Files }}"},
+			},
+		},
+		{
+			Files: []string{"apps/web/index.ts"},
+			Step: Step{
+				Trigger: `{{ index .Files 0 | dirname | replace "apps/" "" }}-deploy`,
+				Key:     `{{ upper "deploy" }}`,
+			},
+		},
+	}
+
+	got, err := renderWatches(watches, true)
+
+	assert.NoError(t, err)
+	assert.Equal(t, ":go: services/bar, services/foo, services/foo/api", got[0].Step.Label)
+	assert.Equal(t, `make test DIRS="bar foo api "`, got[0].Step.Command)
+	assert.Equal(t, "fix: 3 files", got[0].Step.Build.Message)
+	assert.Equal(t, "{{ .Files }}", got[0].Step.Env["DIRS"])
+	assert.Equal(t, "web-deploy", got[1].Step.Trigger)
+	assert.Equal(t, "DEPLOY", got[1].Step.Key)
+
+	// capture watches are only rendered with templates
+	captured := []WatchConfig{{Captures: map[string]string{"svc": "foo"}, Step: Step{Trigger: "{{ .Captures.svc }}-deploy"}}}
+	rendered, err := renderWatches(captured, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "{{ .Captures.svc }}-deploy", rendered[0].Step.Trigger)
+
+	// the watches themselves are left untouched
+	assert.Equal(t, "{{ upper \"deploy\" }}", watches[1].Step.Key)
+}
+
+func TestRenderWatchesBuildMessage(t *testing.T) {
+	os.Setenv("BUILDKITE_MESSAGE", "Bump {{ .Version }}")
+	defer os.Unsetenv("BUILDKITE_MESSAGE")
+
+	plugin, err := initializePlugin(`[{
+		"github.com/chronotc/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [
+				{ "path": "services/", "config": { "trigger": "deploy", "build": { "message": "Deploy {{ join \", \" .Files }}" } } },
+				{ "path": "services/", "config": { "trigger": "test" } }
+			]
+		}
+	}]`)
+	assert.NoError(t, err)
+
+	plugin.Watch[0].Files = []string{"services/foo/main.go"}
+	got, err := renderWatches(plugin.Watch, true)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "Deploy services/foo/main.go", got[0].Step.Build.Message)
+	// the message of the commit isn't a template
+	assert.Equal(t, "Bump {{ .Version }}", got[1].Step.Build.Message)
+}
+
+func TestRenderWatchesFailure(t *testing.T) {
+	_, err := renderWatches([]WatchConfig{{Step: Step{Command: "echo {{ .Nope }}"}}}, true)
+
+	assert.EqualError(t, err, "could not render the command of command: echo {{ .Nope }}: template: step:1:8: executing \"step\" at <.Nope>: can't evaluate field Nope in type main.templateData")
+}
+
+func TestUniq(t *testing.T) {
+	assert.Equal(t, []string{"a", "b", "c"}, uniq([]string{"c", "a", "b", "a"}))
+	assert.Equal(t, []string{}, uniq(nil))
+}
+
+func TestRenderWatchesOnlyFanOut(t *testing.T) {
+	watches := []WatchConfig{
+		{Step: Step{Command: "docker inspect -f '{{.Id}}' app"}},
+		{FanOut: "directory", Dir: "services/foo", Step: Step{Label: "{{ .Name }} in {{ .Dir }}"}},
+	}
+
+	got, err := renderWatches(watches, false)
+
+	assert.NoError(t, err)
+	assert.Equal(t, watches[0], got[0])
+	assert.Equal(t, "foo in services/foo", got[1].Step.Label)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// logWriter is where Buildkite log group headers and summaries are written.
+var logWriter io.Writer = os.Stdout
+
+// Timer records the duration of each plugin phase
+type Timer struct {
+	phases []phase
+}
+
+type phase struct {
+	name     string
+	duration time.Duration
+}
+
+// track records the time elapsed since start against the named phase.
+// Intended to be used as `defer timer.track("diff", time.Now())`.
+func (t *Timer) track(name string, start time.Time) {
+	t.phases = append(t.phases, phase{name: name, duration: time.Since(start)})
+}
+
+// summary returns a human readable table of phase durations
+func (t *Timer) summary() string {
+	width := len("total")
+	var total time.Duration
+
+	for _, p := range t.phases {
+		if len(p.name) > width {
+			width = len(p.name)
+		}
+		total += p.duration
+	}
+
+	var b strings.Builder
+	for _, p := range t.phases {
+		fmt.Fprintf(&b, "%-*s  %s\n", width, p.name, p.duration.Round(time.Millisecond))
+	}
+	fmt.Fprintf(&b, "%-*s  %s\n", width, "total", total.Round(time.Millisecond))
+
+	return b.String()
+}
+
+// logGroup prints a collapsed Buildkite log group header.
+func logGroup(format string, args ...interface{}) {
+	fmt.Fprintf(logWriter, "--- "+format+"\n", args...)
+}
+
+// logExpandedGroup prints a Buildkite log group header that is expanded by default.
+func logExpandedGroup(format string, args ...interface{}) {
+	fmt.Fprintf(logWriter, "+++ "+format+"\n", args...)
+}
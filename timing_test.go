@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimerSummary(t *testing.T) {
+	timer := &Timer{
+		phases: []phase{
+			{name: "diff", duration: 1500 * time.Millisecond},
+			{name: "generate", duration: 20 * time.Millisecond},
+		},
+	}
+
+	want := "diff      1.5s\n" +
+		"generate  20ms\n" +
+		"total     1.52s\n"
+
+	assert.Equal(t, want, timer.summary())
+}
+
+func TestTimerTrack(t *testing.T) {
+	timer := &Timer{}
+	timer.track("diff", time.Now().Add(-time.Second))
+
+	assert.Len(t, timer.phases, 1)
+	assert.Equal(t, "diff", timer.phases[0].name)
+	assert.True(t, timer.phases[0].duration >= time.Second)
+}
+
+func TestLogGroups(t *testing.T) {
+	var out bytes.Buffer
+	logWriter = &out
+	defer func() { logWriter = ioutil.Discard }()
+
+	logGroup("Computing diff")
+	logExpandedGroup("Matched %d pipelines", 4)
+
+	assert.Equal(t, "--- Computing diff\n+++ Matched 4 pipelines\n", out.String())
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// transientGitErrors are the git failures that are expected to go away on
+// their own, network errors while fetching and another git process holding a
+// lock on the repository. Failures with the same wording for permanent
+// errors, like `Could not read from remote repository` after an
+// authentication failure, aren't retried.
+var transientGitErrors = []string{
+	"could not resolve host",
+	"connection timed out",
+	"connection reset",
+	"connection refused",
+	"operation timed out",
+	"the remote end hung up unexpectedly",
+	"early eof",
+	"rpc failed",
+	"index.lock': file exists",
+	"cannot lock ref",
+	"shallow file has changed",
+}
+
+// diffError is a failure of the diff command with what it wrote to stderr
+type diffError struct {
+	err    error
+	stderr string
+}
+
+func (e *diffError) Error() string {
+	return e.err.Error()
+}
+
+// transientDiffError reports whether err is a diff failure worth retrying
+func transientDiffError(err error) bool {
+	var d *diffError
+	if !errors.As(err, &d) {
+		return false
+	}
+
+	stderr := strings.ToLower(d.stderr)
+	for _, e := range transientGitErrors {
+		if strings.Contains(stderr, e) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryDiffAndMatch runs the diff and matches its output, running both again
+// when the diff fails with a transient git error
+func retryDiffAndMatch(plugin Plugin) (int, bool, []string, []WatchConfig, error) {
+	var count int
+	var partial bool
+	var changed []string
+	var watches []WatchConfig
+
+	err := retryIf(plugin.DiffRetries, plugin.DiffRetryBackoff, transientDiffError, func() error {
+		var err error
+		count, partial, changed, watches, err = diffAndMatch(plugin)
+		return err
+	})
+
+	return count, partial, changed, watches, err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransientDiffError(t *testing.T) {
+	testCases := map[string]struct {
+		err      error
+		expected bool
+	}{
+		"network": {&diffError{err: errors.New("diff command failed"), stderr: "fatal: unable to access 'https://github.com/org/repo/': Could not resolve host: github.com"}, true},
+		"lock":    {&diffError{err: errors.New("diff command failed"), stderr: "fatal: Unable to create '/repo/.git/index.lock': File exists."}, true},
+		"auth":    {&diffError{err: errors.New("diff command failed"), stderr: "git@github.com: Permission denied (publickey).\nfatal: Could not read from remote repository."}, false},
+		"create":  {&diffError{err: errors.New("diff command failed"), stderr: "fatal: Unable to create temporary file '/repo/.git/objects/pack/tmp_pack_XXXXXX': Permission denied"}, false},
+		"ref":     {&diffError{err: errors.New("diff command failed"), stderr: "fatal: ambiguous argument 'HEAD~1': unknown revision"}, false},
+		"other":   {errors.New("path matching failed"), false},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, transientDiffError(tc.err))
+		})
+	}
+}
+
+func TestRetryDiffAndMatchRetriesTransientErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diff")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	marker := filepath.Join(dir, "attempted")
+	plugin := Plugin{
+		DiffArgs:    []string{"sh", "-c", `if [ ! -f "$0" ]; then touch "$0"; echo "fatal: the remote end hung up unexpectedly" >&2; exit 128; fi; echo services/foo/main.go`, marker},
+		DiffRetries: 2,
+		Watch:       []WatchConfig{{Paths: []string{"services/foo/"}, Step: Step{Trigger: "foo"}}},
+	}
+
+	count, _, _, watches, err := retryDiffAndMatch(plugin)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, plugin.Watch, watches)
+}
+
+func TestRetryDiffAndMatchFailsOnOtherErrors(t *testing.T) {
+	plugin := Plugin{
+		DiffArgs:    []string{"sh", "-c", `echo "fatal: bad revision" >&2; exit 128`},
+		DiffRetries: 2,
+	}
+
+	_, _, _, _, err := retryDiffAndMatch(plugin)
+
+	assert.EqualError(t, err, "diff command failed: command `sh` failed: exit status 128")
+}
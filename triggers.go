@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// validateTriggers checks that the pipelines of the trigger steps exist and
+// aren't archived, and with permissions that the creator of the build can
+// build them, so that a mistyped slug or a missing permission fails the
+// plugin instead of the triggered step.
+func validateTriggers(steps []Step, permissions bool) error {
+	api, err := newBuildkiteAPI()
+	if err != nil {
+		return err
+	}
+
+	org := env("BUILDKITE_ORGANIZATION_SLUG", "")
+	creator := env("BUILDKITE_BUILD_CREATOR_EMAIL", "")
+	checked := map[string]bool{}
+	members := map[string]*orgMember{}
+	unknown := []string{}
+	archived := []string{}
+	denied := []string{}
+
+	if permissions && creator == "" {
+		log.Warn("The build has no creator, the permissions of the trigger pipelines aren't validated")
+		permissions = false
+	}
+
+	for _, s := range steps {
+		if s.Trigger == "" {
+			continue
+		}
+
+		slug := s.Trigger
+		if s.Organization != "" && s.Organization != org {
+			slug = s.Organization + "/" + s.Trigger
+		}
+
+		if checked[slug] {
+			continue
+		}
+		checked[slug] = true
+
+		pipeline, err := api.pipeline(stepOrganization(s, org), s.Trigger)
+		if err != nil {
+			return err
+		}
+
+		if pipeline == nil {
+			unknown = append(unknown, slug)
+			continue
+		}
+
+		if pipeline.ArchivedAt != nil {
+			archived = append(archived, slug)
+			continue
+		}
+
+		if permissions {
+			organization := stepOrganization(s, org)
+
+			member, ok := members[organization]
+			if !ok {
+				if member, err = api.member(organization, creator); err != nil {
+					return err
+				}
+				members[organization] = member
+			}
+
+			allowed, err := api.canBuild(organization, s.Trigger, member)
+			if err != nil {
+				return err
+			}
+
+			if !allowed {
+				denied = append(denied, slug)
+			}
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf(
+			"%s not found in organization %s: %s",
+			pluralize(len(unknown), "trigger pipeline"), org, strings.Join(unknown, ", "),
+		)
+	}
+
+	if len(archived) > 0 {
+		sort.Strings(archived)
+		return fmt.Errorf("archived %s can't be triggered: %s", pluralize(len(archived), "pipeline"), strings.Join(archived, ", "))
+	}
+
+	if len(denied) > 0 {
+		sort.Strings(denied)
+		return fmt.Errorf(
+			"%s isn't a member of a team allowed to build the %s: %s",
+			creator, pluralize(len(denied), "trigger pipeline"), strings.Join(denied, ", "),
+		)
+	}
+
+	log.Debugf("Validated %d trigger %s", len(checked), pluralize(len(checked), "pipeline"))
+
+	return nil
+}
+
+// memberQuery finds the members of the organization matching the email, with
+// their role and teams
+const memberQuery = `query($org: ID!, $email: String, $after: String) {
+  organization(slug: $org) {
+    members(first: 100, search: $email, after: $after) {
+      pageInfo { hasNextPage endCursor }
+      edges { node { role user { email } teams(first: 100) { edges { node { team { slug } } } } } }
+    }
+  }
+}`
+
+// pipelineTeamsQuery lists the teams of a pipeline with their access level
+const pipelineTeamsQuery = `query($slug: ID!, $after: String) {
+  pipeline(slug: $slug) {
+    teams(first: 100, after: $after) {
+      pageInfo { hasNextPage endCursor }
+      edges { node { accessLevel team { slug } } }
+    }
+  }
+}`
+
+// buildAccessLevels are the team access levels allowed to build a pipeline
+var buildAccessLevels = map[string]bool{"BUILD_AND_READ": true, "MANAGE_BUILD_AND_READ": true}
+
+// pageInfo is the page of a GraphQL connection
+type pageInfo struct {
+	HasNextPage bool   `json:"hasNextPage"`
+	EndCursor   string `json:"endCursor"`
+}
+
+// orgMember is the role and the teams of a member of an organization
+type orgMember struct {
+	admin bool
+	teams map[string]bool
+}
+
+// graphql runs the query with the Buildkite GraphQL API and decodes its data
+func (api *buildkiteAPI) graphql(query string, variables map[string]string, data interface{}) error {
+	var response struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+
+	body := map[string]interface{}{"query": query, "variables": variables}
+
+	endpoint := env("BUILDKITE_GRAPHQL_ENDPOINT", "https://graphql.buildkite.com/v1")
+	if err := sendJSON(http.MethodPost, endpoint, api.token, body, &response); err != nil {
+		return err
+	}
+
+	if len(response.Errors) > 0 {
+		return errors.New(response.Errors[0].Message)
+	}
+
+	return json.Unmarshal(response.Data, data)
+}
+
+// member returns the member of the organization with the email, or nil. The
+// search of the API also matches other members, so the email is compared
+// exactly on every page of the results.
+func (api *buildkiteAPI) member(org string, email string) (*orgMember, error) {
+	after := ""
+
+	for {
+		var data struct {
+			Organization *struct {
+				Members struct {
+					PageInfo pageInfo `json:"pageInfo"`
+					Edges    []struct {
+						Node struct {
+							Role string `json:"role"`
+							User struct {
+								Email string `json:"email"`
+							} `json:"user"`
+							Teams struct {
+								Edges []struct {
+									Node struct {
+										Team struct {
+											Slug string `json:"slug"`
+										} `json:"team"`
+									} `json:"node"`
+								} `json:"edges"`
+							} `json:"teams"`
+						} `json:"node"`
+					} `json:"edges"`
+				} `json:"members"`
+			} `json:"organization"`
+		}
+
+		variables := map[string]string{"org": org, "email": email}
+		if after != "" {
+			variables["after"] = after
+		}
+
+		if err := api.graphql(memberQuery, variables, &data); err != nil {
+			return nil, fmt.Errorf("could not get the member %s of organization %s: %v", email, org, err)
+		}
+
+		if data.Organization == nil {
+			return nil, nil
+		}
+
+		for _, edge := range data.Organization.Members.Edges {
+			if !strings.EqualFold(edge.Node.User.Email, email) {
+				continue
+			}
+
+			member := &orgMember{admin: edge.Node.Role == "ADMIN", teams: map[string]bool{}}
+			for _, team := range edge.Node.Teams.Edges {
+				member.teams[team.Node.Team.Slug] = true
+			}
+			return member, nil
+		}
+
+		if !data.Organization.Members.PageInfo.HasNextPage {
+			return nil, nil
+		}
+		after = data.Organization.Members.PageInfo.EndCursor
+	}
+}
+
+// canBuild returns whether the member can build the pipeline, either as an
+// admin of the organization, as member of one of its teams with build access,
+// or because it has no teams.
+func (api *buildkiteAPI) canBuild(org string, pipeline string, member *orgMember) (bool, error) {
+	if member != nil && member.admin {
+		return true, nil
+	}
+
+	after := ""
+	teams := 0
+
+	for {
+		var data struct {
+			Pipeline *struct {
+				Teams struct {
+					PageInfo pageInfo `json:"pageInfo"`
+					Edges    []struct {
+						Node struct {
+							AccessLevel string `json:"accessLevel"`
+							Team        struct {
+								Slug string `json:"slug"`
+							} `json:"team"`
+						} `json:"node"`
+					} `json:"edges"`
+				} `json:"teams"`
+			} `json:"pipeline"`
+		}
+
+		variables := map[string]string{"slug": org + "/" + pipeline}
+		if after != "" {
+			variables["after"] = after
+		}
+
+		if err := api.graphql(pipelineTeamsQuery, variables, &data); err != nil {
+			return false, fmt.Errorf("could not get the teams of pipeline %s: %v", pipeline, err)
+		}
+
+		if data.Pipeline == nil {
+			break
+		}
+
+		for _, edge := range data.Pipeline.Teams.Edges {
+			teams++
+			if member != nil && buildAccessLevels[edge.Node.AccessLevel] && member.teams[edge.Node.Team.Slug] {
+				return true, nil
+			}
+		}
+
+		if !data.Pipeline.Teams.PageInfo.HasNextPage {
+			break
+		}
+		after = data.Pipeline.Teams.PageInfo.EndCursor
+	}
+
+	return teams == 0, nil
+}
+
+// stepOrganization returns the organization of the pipeline triggered by the step
+func stepOrganization(step Step, org string) string {
+	if step.Organization != "" {
+		return step.Organization
+	}
+
+	return org
+}
+
+// splitCrossOrgTriggers separates the trigger steps for pipelines of other
+// organizations, which can't be triggered by a trigger step, from the steps to upload.
+func splitCrossOrgTriggers(steps []Step) ([]Step, []Step) {
+	org := env("BUILDKITE_ORGANIZATION_SLUG", "")
+	upload := []Step{}
+	crossOrg := []Step{}
+
+	for _, s := range steps {
+		if s.Trigger != "" && stepOrganization(s, org) != org {
+			crossOrg = append(crossOrg, s)
+			continue
+		}
+
+		upload = append(upload, s)
+	}
+
+	return upload, crossOrg
+}
+
+// triggerCrossOrg creates the builds of the trigger steps with the Buildkite API
+func triggerCrossOrg(steps []Step) error {
+	api, err := newBuildkiteAPI()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range steps {
+		build, err := api.createBuild(s.Organization, s.Trigger, s.Build)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Triggered %s/%s build #%d: %s", s.Organization, s.Trigger, build.Number, build.WebURL)
+	}
+
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mockPipelinesAPI serves the pipelines of the organization `org`
+func mockPipelinesAPI(t *testing.T, pipelines ...string) (*httptest.Server, *int) {
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "Token api-token", r.Header.Get("Authorization"))
+
+		for _, p := range pipelines {
+			if r.URL.Path == "/organizations/org/pipelines/"+p {
+				_, _ = w.Write([]byte(`{"slug":"` + p + `"}`))
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"message":"No pipeline found"}`))
+	}))
+
+	os.Setenv("BUILDKITE_API_ENDPOINT", server.URL)
+	os.Setenv("BUILDKITE_API_TOKEN", "api-token")
+	os.Setenv("BUILDKITE_ORGANIZATION_SLUG", "org")
+
+	return server, &requests
+}
+
+func TestValidateTriggers(t *testing.T) {
+	server, requests := mockPipelinesAPI(t, "foo", "bar")
+	defer unsetBuildsAPI(server)
+
+	err := validateTriggers([]Step{
+		{Trigger: "foo"},
+		{Command: "echo hello"},
+		{Trigger: "bar"},
+		{Trigger: "foo", Label: "again"},
+	}, false)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, *requests)
+}
+
+func TestValidateTriggersUnknown(t *testing.T) {
+	server, _ := mockPipelinesAPI(t, "foo")
+	defer unsetBuildsAPI(server)
+
+	err := validateTriggers([]Step{{Trigger: "foo"}, {Trigger: "qux"}, {Trigger: "baz"}}, false)
+
+	assert.EqualError(t, err, "trigger pipelines not found in organization org: baz, qux")
+}
+
+func TestValidateTriggersAPIError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"message":"Authentication required"}`))
+	}))
+	defer unsetBuildsAPI(server)
+
+	os.Setenv("BUILDKITE_API_ENDPOINT", server.URL)
+	os.Setenv("BUILDKITE_API_TOKEN", "api-token")
+	os.Setenv("BUILDKITE_ORGANIZATION_SLUG", "org")
+
+	err := validateTriggers([]Step{{Trigger: "foo"}}, false)
+
+	assert.EqualError(t, err, `could not get pipeline foo: 401 Unauthorized: {"message":"Authentication required"}`)
+}
+
+func TestValidateTriggersArchived(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/organizations/org/pipelines/old" {
+			_, _ = w.Write([]byte(`{"slug":"old","archived_at":"2024-01-01T00:00:00Z"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"slug":"foo","archived_at":null}`))
+	}))
+	defer unsetBuildsAPI(server)
+
+	os.Setenv("BUILDKITE_API_ENDPOINT", server.URL)
+	os.Setenv("BUILDKITE_API_TOKEN", "api-token")
+	os.Setenv("BUILDKITE_ORGANIZATION_SLUG", "org")
+
+	err := validateTriggers([]Step{{Trigger: "foo"}, {Trigger: "old"}}, false)
+
+	assert.EqualError(t, err, "archived pipeline can't be triggered: old")
+}
+
+// mockTeamsAPI serves the pipelines of the organization `org` and their teams
+// by access level, and the members of the organization with their role and
+// teams, with the GraphQL API. The member search returns every member on
+// pages of one, like a search that also matches other members.
+func mockTeamsAPI(t *testing.T, teams map[string]map[string]string, members map[string][]string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/graphql" {
+			_, _ = w.Write([]byte(`{"slug":"pipeline"}`))
+			return
+		}
+
+		var request struct {
+			Query     string            `json:"query"`
+			Variables map[string]string `json:"variables"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+
+		if strings.Contains(request.Query, "organization(") {
+			emails := []string{}
+			for email := range members {
+				emails = append(emails, email)
+			}
+			sort.Strings(emails)
+
+			page, _ := strconv.Atoi(request.Variables["after"])
+			email := emails[page]
+
+			role, memberTeams := "MEMBER", []interface{}{}
+			for _, team := range members[email] {
+				if team == "admin" {
+					role = "ADMIN"
+					continue
+				}
+				memberTeams = append(memberTeams, map[string]interface{}{"node": map[string]interface{}{"team": map[string]string{"slug": team}}})
+			}
+
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{"organization": map[string]interface{}{"members": map[string]interface{}{
+					"pageInfo": map[string]interface{}{"hasNextPage": page+1 < len(emails), "endCursor": strconv.Itoa(page + 1)},
+					"edges": []interface{}{map[string]interface{}{"node": map[string]interface{}{
+						"role":  role,
+						"user":  map[string]string{"email": email},
+						"teams": map[string]interface{}{"edges": memberTeams},
+					}}},
+				}}},
+			})
+			return
+		}
+
+		edges := []interface{}{}
+		for team, level := range teams[request.Variables["slug"]] {
+			edges = append(edges, map[string]interface{}{"node": map[string]interface{}{
+				"accessLevel": level,
+				"team":        map[string]string{"slug": team},
+			}})
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"pipeline": map[string]interface{}{"teams": map[string]interface{}{
+				"pageInfo": map[string]interface{}{"hasNextPage": false},
+				"edges":    edges,
+			}}},
+		})
+	}))
+
+	os.Setenv("BUILDKITE_API_ENDPOINT", server.URL)
+	os.Setenv("BUILDKITE_GRAPHQL_ENDPOINT", server.URL+"/graphql")
+	os.Setenv("BUILDKITE_API_TOKEN", "api-token")
+	os.Setenv("BUILDKITE_ORGANIZATION_SLUG", "org")
+	os.Setenv("BUILDKITE_BUILD_CREATOR_EMAIL", "dev@example.com")
+
+	return server
+}
+
+func TestValidateTriggerPermissions(t *testing.T) {
+	server := mockTeamsAPI(t, map[string]map[string]string{
+		"org/payments": {"payments": "BUILD_AND_READ"},
+		"org/ledger":   {"payments": "READ_ONLY", "ledger": "MANAGE_BUILD_AND_READ"},
+		"org/infra":    {"ops": "BUILD_AND_READ"},
+	}, map[string][]string{
+		"a-dev@example.com": {"ops"},
+		"dev@example.com":   {"payments"},
+		"lead@example.com":  {"ledger"},
+		"ops@example.com":   {"admin"},
+	})
+	defer unsetBuildsAPI(server)
+	defer os.Unsetenv("BUILDKITE_GRAPHQL_ENDPOINT")
+	defer os.Unsetenv("BUILDKITE_BUILD_CREATOR_EMAIL")
+
+	err := validateTriggers([]Step{{Trigger: "payments"}, {Trigger: "docs"}}, true)
+	assert.NoError(t, err)
+
+	// a-dev@example.com is also found by the search, but isn't the creator
+	err = validateTriggers([]Step{{Trigger: "payments"}, {Trigger: "ledger"}, {Trigger: "infra"}}, true)
+	assert.EqualError(t, err, "dev@example.com isn't a member of a team allowed to build the trigger pipelines: infra, ledger")
+
+	// admins can build every pipeline
+	os.Setenv("BUILDKITE_BUILD_CREATOR_EMAIL", "ops@example.com")
+	err = validateTriggers([]Step{{Trigger: "payments"}, {Trigger: "ledger"}}, true)
+	assert.NoError(t, err)
+
+	os.Unsetenv("BUILDKITE_BUILD_CREATOR_EMAIL")
+	err = validateTriggers([]Step{{Trigger: "infra"}}, true)
+	assert.NoError(t, err)
+}
+
+func TestSplitCrossOrgTriggers(t *testing.T) {
+	os.Setenv("BUILDKITE_ORGANIZATION_SLUG", "org")
+	defer os.Unsetenv("BUILDKITE_ORGANIZATION_SLUG")
+
+	upload, crossOrg := splitCrossOrgTriggers([]Step{
+		{Trigger: "foo"},
+		{Trigger: "bar", Organization: "other-org"},
+		{Trigger: "baz", Organization: "org"},
+		{Command: "echo hello", Organization: "other-org"},
+	})
+
+	assert.Equal(t, []Step{
+		{Trigger: "foo"},
+		{Trigger: "baz", Organization: "org"},
+		{Command: "echo hello", Organization: "other-org"},
+	}, upload)
+	assert.Equal(t, []Step{{Trigger: "bar", Organization: "other-org"}}, crossOrg)
+}
+
+func TestTriggerCrossOrg(t *testing.T) {
+	var got apiCreateBuild
+	var path string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"number":3,"web_url":"https://buildkite.com/other-org/bar/builds/3"}`))
+	}))
+	defer unsetBuildsAPI(server)
+
+	os.Setenv("BUILDKITE_API_ENDPOINT", server.URL)
+	os.Setenv("BUILDKITE_API_TOKEN", "api-token")
+
+	err := triggerCrossOrg([]Step{{
+		Trigger:      "bar",
+		Organization: "other-org",
+		Build: Build{
+			Commit:   "123",
+			Branch:   "main",
+			Message:  "fix: bar",
+			Env:      map[string]string{"FOO": "bar"},
+			MetaData: map[string]string{"release": "true"},
+		},
+	}})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "/organizations/other-org/pipelines/bar/builds", path)
+	assert.Equal(t, apiCreateBuild{
+		Commit:   "123",
+		Branch:   "main",
+		Message:  "fix: bar",
+		Env:      map[string]string{"FOO": "bar"},
+		MetaData: map[string]string{"release": "true"},
+	}, got)
+}
+
+func TestTriggerCrossOrgFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"message":"Forbidden"}`))
+	}))
+	defer unsetBuildsAPI(server)
+
+	os.Setenv("BUILDKITE_API_ENDPOINT", server.URL)
+	os.Setenv("BUILDKITE_API_TOKEN", "api-token")
+
+	err := triggerCrossOrg([]Step{{Trigger: "bar", Organization: "other-org"}})
+
+	assert.EqualError(t, err, `could not create a build of other-org/bar: 403 Forbidden: {"message":"Forbidden"}`)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// tuiCommand is the argument of the binary running the route debugger
+const tuiCommand = "tui"
+
+// tuiDefaultConfig is the pipeline read by the route debugger without an argument
+const tuiDefaultConfig = ".buildkite/pipeline.yml"
+
+// tuiHelp lists the commands of the route debugger
+const tuiHelp = `Type or paste changed file paths, one per line, to see the watches they match
+and the steps that would be generated. Commands:
+  :files         list the changed files
+  :rm <path>     remove a changed file
+  :clear         remove every changed file
+  :yaml          toggle printing the generated pipeline
+  :help          show this help
+  :quit          exit
+`
+
+// routeSession is the state of the route debugger: the configuration and the
+// changed files typed so far
+type routeSession struct {
+	plugin Plugin
+	files  []string
+	yaml   bool
+}
+
+// runTUI runs the route debugger on the configuration of the pipeline file of
+// args, reading changed files and commands from in until it is closed
+func runTUI(args []string, in io.Reader, out io.Writer) error {
+	file := tuiDefaultConfig
+	if len(args) > 0 {
+		file = args[0]
+	}
+
+	plugin, err := loadTUIConfig(file)
+	if err != nil {
+		return err
+	}
+	matcherEngine = plugin.MatcherEngine
+
+	session := &routeSession{plugin: plugin}
+
+	fmt.Fprintf(out, "%s\n", colorize(colorBold, fmt.Sprintf("monorepo-diff %s: %d watches in %s", Version, len(plugin.Watch), file)))
+	fmt.Fprint(out, tuiHelp)
+
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, colorize(colorGray, "> "))
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return scanner.Err()
+		}
+
+		if !session.handle(strings.TrimSpace(scanner.Text()), out) {
+			return nil
+		}
+	}
+}
+
+// handle runs a command or adds a changed file and prints the routing of the
+// changed files. It returns false to exit.
+func (s *routeSession) handle(line string, out io.Writer) bool {
+	switch {
+	case line == "":
+		return true
+	case line == ":quit" || line == ":q":
+		return false
+	case line == ":help":
+		fmt.Fprint(out, tuiHelp)
+		return true
+	case line == ":files":
+		for _, f := range s.files {
+			fmt.Fprintf(out, "  %s\n", f)
+		}
+		return true
+	case line == ":clear":
+		s.files = nil
+		fmt.Fprintln(out, "No changed files")
+		return true
+	case line == ":yaml":
+		s.yaml = !s.yaml
+	case strings.HasPrefix(line, ":rm "):
+		removed := cleanFile(strings.TrimSpace(strings.TrimPrefix(line, ":rm ")))
+		files := []string{}
+		for _, f := range s.files {
+			if f != removed {
+				files = append(files, f)
+			}
+		}
+		s.files = files
+	case strings.HasPrefix(line, ":"):
+		fmt.Fprintf(out, "%s\n", colorize(colorRed, fmt.Sprintf("unknown command `%s`, see :help", line)))
+		return true
+	default:
+		s.add(cleanFile(line))
+	}
+
+	s.print(out)
+
+	return true
+}
+
+// add adds a changed file, once
+func (s *routeSession) add(file string) {
+	if file == "" {
+		return
+	}
+
+	for _, f := range s.files {
+		if f == file {
+			return
+		}
+	}
+
+	s.files = append(s.files, file)
+}
+
+// print prints the watches matched by the changed files and their steps
+func (s *routeSession) print(out io.Writer) {
+	watches, err := routeFiles(s.plugin, s.files)
+	if err != nil {
+		fmt.Fprintf(out, "%s\n", colorize(colorRed, err.Error()))
+		return
+	}
+
+	steps, err := mergeSteps(watches, s.plugin.Mode)
+	if err != nil {
+		fmt.Fprintf(out, "%s\n", colorize(colorRed, err.Error()))
+		return
+	}
+
+	fmt.Fprintf(out, "%d changed %s matched %d of %d watches\n", len(s.files), pluralize(len(s.files), "file"), len(watches), len(s.plugin.Watch))
+	if len(steps) == 0 {
+		return
+	}
+
+	report := &routingReport{}
+	report.setWatches(watches)
+	fmt.Fprint(out, matchTable(steps, report.Watches))
+
+	if !s.yaml {
+		return
+	}
+
+	data, err := marshalPipeline(steps, s.plugin)
+	if err != nil {
+		fmt.Fprintf(out, "%s\n", colorize(colorRed, err.Error()))
+		return
+	}
+	fmt.Fprint(out, string(data))
+}
+
+// routeFiles returns the watches matched by the files, with their fan out,
+// captures and templates applied like in a build
+func routeFiles(plugin Plugin, files []string) ([]WatchConfig, error) {
+	collect := make([]bool, len(plugin.Watch))
+	for i := range collect {
+		collect[i] = true
+	}
+
+	engine := newMatchEngine(plugin.Watch, 1, collect, newMemoryBudget(0))
+	engine.feed(files)
+
+	matched, err := engine.wait()
+	if err != nil {
+		return nil, err
+	}
+
+	matchedFiles, err := engine.matchedFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	watch := append([]WatchConfig{}, plugin.Watch...)
+	for i := range watch {
+		watch[i].Files = matchedFiles[i]
+	}
+
+	watch, err = matchCommands(plugin, watch, matched, sliceSource(files))
+	if err != nil {
+		return nil, err
+	}
+
+	return renderWatches(captureWatches(fanOutWatches(matchedWatches(watch, matched))), plugin.Templates)
+}
+
+// loadTUIConfig returns the configuration of the plugin in the pipeline file,
+// or of the file itself when it is the configuration of the plugin
+func loadTUIConfig(file string) (Plugin, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return Plugin{}, err
+	}
+
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return Plugin{}, fmt.Errorf("invalid pipeline %s: %v", file, err)
+	}
+
+	config := findPluginConfig(jsonCompatible(raw))
+	if config == nil {
+		return Plugin{}, fmt.Errorf("no monorepo-diff configuration in %s", file)
+	}
+
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return Plugin{}, err
+	}
+
+	return initializePluginConfiguration(string(encoded))
+}
+
+// findPluginConfig returns the configuration of the first invocation of the
+// plugin in the steps of the pipeline, or the pipeline itself when it has watches
+func findPluginConfig(pipeline interface{}) map[string]interface{} {
+	doc, ok := pipeline.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	if _, ok := doc["watch"]; ok {
+		return doc
+	}
+
+	steps, _ := doc["steps"].([]interface{})
+	for _, s := range steps {
+		step, _ := s.(map[string]interface{})
+
+		var plugins []interface{}
+		switch p := step["plugins"].(type) {
+		case []interface{}:
+			plugins = p
+		case map[string]interface{}:
+			plugins = []interface{}{p}
+		}
+
+		for _, p := range plugins {
+			entries, _ := p.(map[string]interface{})
+
+			names := make([]string, 0, len(entries))
+			for name := range entries {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			for _, name := range names {
+				if config, ok := entries[name].(map[string]interface{}); ok && strings.Contains(name, "monorepo-diff") {
+					return config
+				}
+			}
+		}
+	}
+
+	return nil
+}
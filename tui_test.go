@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const tuiPipeline = `
+steps:
+  - label: Triggering pipelines
+    plugins:
+      - docker#v3.0.0:
+          image: alpine
+      - chronotc/monorepo-diff#v2.0.0:
+          templates: true
+          watch:
+            - path: services/(?P<svc>[^/]+)/**
+              label: Services
+              config:
+                trigger: deploy-{{ .Captures.svc }}
+            - path: docs/
+              config:
+                command: make docs
+`
+
+func TestRunTUI(t *testing.T) {
+	os.Setenv("NO_COLOR", "1")
+	defer os.Unsetenv("NO_COLOR")
+
+	dir, err := ioutil.TempDir("", "tui")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "pipeline.yml")
+	assert.NoError(t, ioutil.WriteFile(file, []byte(tuiPipeline), 0644))
+
+	in := strings.NewReader("services/foo/main.go\n./services/foo/main.go\ndocs/README.md\n:files\n:rm docs/README.md\n:yaml\n:nope\n:clear\n:quit\nREADME.md\n")
+	var out bytes.Buffer
+
+	assert.NoError(t, runTUI([]string{file}, in, &out))
+
+	output := out.String()
+	assert.Contains(t, output, "2 watches in "+file)
+	assert.Contains(t, output, "1 changed file matched 1 of 2 watches\n")
+	assert.Contains(t, output, "Services  trigger: deploy-foo  1\n")
+	assert.Contains(t, output, "2 changed files matched 2 of 2 watches\n")
+	assert.Contains(t, output, "-         command: make docs   1\n")
+	assert.Contains(t, output, "  services/foo/main.go\n  docs/README.md\n")
+	assert.Contains(t, output, "- trigger: deploy-foo\n")
+	assert.Contains(t, output, "unknown command `:nope`, see :help\n")
+	assert.Contains(t, output, "No changed files\n")
+	assert.True(t, strings.HasSuffix(output, "No changed files\n> "), "stops reading at :quit")
+}
+
+func TestLoadTUIConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tui")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := filepath.Join(dir, "config.yml")
+	assert.NoError(t, ioutil.WriteFile(config, []byte("watch:\n  - path: docs/\n    config:\n      command: make docs\n"), 0644))
+
+	plugin, err := loadTUIConfig(config)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"docs/"}, plugin.Watch[0].Paths)
+
+	empty := filepath.Join(dir, "pipeline.yml")
+	assert.NoError(t, ioutil.WriteFile(empty, []byte("steps:\n  - command: make\n"), 0644))
+
+	_, err = loadTUIConfig(empty)
+	assert.EqualError(t, err, "no monorepo-diff configuration in "+empty)
+}
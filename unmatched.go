@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// unmatchedFiles returns the changed files that matched none of the watches
+func unmatchedFiles(changed []string, watches []WatchConfig) []string {
+	matched := map[string]bool{}
+	for _, w := range watches {
+		for _, f := range w.Files {
+			matched[f] = true
+		}
+	}
+
+	unmatched := []string{}
+	for _, f := range changed {
+		if !matched[f] {
+			unmatched = append(unmatched, f)
+		}
+	}
+
+	return unmatched
+}
+
+// reportUnmatched logs the changed files that matched no watch, with their share
+// of the changed files, and with `report_unmatched: annotate` adds them to the
+// build as an annotation too.
+func reportUnmatched(plugin Plugin, changed []string, watches []WatchConfig) {
+	unmatched := unmatchedFiles(changed, watches)
+	if len(unmatched) == 0 {
+		log.Info("Every changed file matched a watch")
+		return
+	}
+
+	summary := fmt.Sprintf(
+		"%d of %d changed %s (%.1f%%) matched no watch",
+		len(unmatched), len(changed), pluralize(len(changed), "file"),
+		float64(len(unmatched))*100/float64(len(changed)),
+	)
+
+	log.Warn(summary)
+	for _, f := range unmatched {
+		log.Warn(f)
+	}
+
+	if plugin.ReportUnmatched != "annotate" {
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "**%s**\n\n", summary)
+	for _, f := range unmatched {
+		fmt.Fprintf(&b, "- `%s`\n", f)
+	}
+
+	if err := annotate(plugin, "warning", "monorepo-diff-unmatched", b.String()); err != nil {
+		log.Warnf("could not annotate the build: %v", err)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnmatchedFiles(t *testing.T) {
+	changed := []string{"services/foo/main.go", "docs/README.md", "services/bar/main.go", "Makefile"}
+	watches := []WatchConfig{
+		{Paths: []string{"services/foo/"}, Files: []string{"services/foo/main.go"}},
+		{Paths: []string{"services/bar/"}, Files: []string{"services/bar/main.go"}},
+	}
+
+	assert.Equal(t, []string{"docs/README.md", "Makefile"}, unmatchedFiles(changed, watches))
+	assert.Equal(t, []string{}, unmatchedFiles(changed[:1], watches))
+}
+
+func TestReportUnmatchedLogsShareOfFiles(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(ioutil.Discard)
+
+	changed := []string{"services/foo/main.go", "docs/README.md", "Makefile"}
+	watches := []WatchConfig{{Files: []string{"services/foo/main.go"}}}
+
+	reportUnmatched(Plugin{ReportUnmatched: "annotate"}, changed, watches)
+
+	assert.Contains(t, out.String(), "2 of 3 changed files (66.7%) matched no watch")
+	assert.Contains(t, out.String(), "Makefile")
+	assert.NotContains(t, out.String(), "could not annotate")
+}
@@ -2,15 +2,92 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"math/rand"
 	"os"
 	"os/exec"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// jobContext is cancelled when the agent cancels the job. Commands and API
+// requests run with it, so they are stopped as soon as the job is cancelled.
+var jobContext = context.Background()
+
+// setupCancellation cancels jobContext when the agent sends SIGTERM, or on SIGINT
+func setupCancellation() context.CancelFunc {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	jobContext = ctx
+
+	return stop
+}
+
+// cancelled returns whether the job has been cancelled
+func cancelled() bool {
+	return jobContext.Err() != nil
+}
+
+// process is a command started in a process group of its own. Killing only
+// the command would leave the processes it started, e.g. `git` under `sh -c`,
+// running with its output open, so waiting for it would block until they exit.
+type process struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+// startProcess starts the command in a process group of its own, which is
+// killed when the job is cancelled
+func startProcess(cmd *exec.Cmd) (*process, error) {
+	setProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	p := &process{cmd: cmd, done: make(chan struct{})}
+
+	go func() {
+		select {
+		case <-jobContext.Done():
+			p.kill()
+		case <-p.done:
+		}
+	}()
+
+	return p, nil
+}
+
+// kill kills the process group of the command
+func (p *process) kill() {
+	_ = killProcessGroup(p.cmd)
+}
+
+// wait waits for the command to exit
+func (p *process) wait() error {
+	err := p.cmd.Wait()
+	close(p.done)
+
+	return err
+}
+
+// runProcess runs the command in a process group of its own
+func runProcess(cmd *exec.Cmd) error {
+	p, err := startProcess(cmd)
+	if err != nil {
+		return err
+	}
+
+	return p.wait()
+}
+
 func executeCommand(command string, args []string) (string, error) {
-	cmd := exec.Command(command, args...)
+	cmd := exec.CommandContext(jobContext, command, args...)
 
 	var out bytes.Buffer
 	var stderr bytes.Buffer
@@ -18,7 +95,7 @@ func executeCommand(command string, args []string) (string, error) {
 	cmd.Stdout = &out
 	cmd.Stderr = &stderr
 
-	if err := cmd.Run(); err != nil {
+	if err := runProcess(cmd); err != nil {
 		log.Debugf(
 			"\ncommand = '%s', \nargs = '%s', \nerror = '%s'",
 			command, args, stderr.String(),
@@ -30,6 +107,45 @@ func executeCommand(command string, args []string) (string, error) {
 	return out.String(), nil
 }
 
+// goos is the operating system of the agent, replaced in tests
+var goos = runtime.GOOS
+
+// shellNone is the `shell` that runs commands directly, split on whitespace
+const shellNone = "none"
+
+// shellCommand returns a command running the script with the configured shell.
+// Without one it uses the shell of the agent, `cmd` on Windows and `sh`
+// everywhere else.
+func shellCommand(shell []string, script string) *exec.Cmd {
+	if len(shell) == 1 && shell[0] == shellNone {
+		args := strings.Fields(script)
+		if len(args) == 0 {
+			args = []string{""}
+		}
+		return exec.CommandContext(jobContext, args[0], args[1:]...)
+	}
+
+	if len(shell) > 0 {
+		return exec.CommandContext(jobContext, shell[0], append(shell[1:], script)...)
+	}
+
+	if goos == "windows" {
+		return exec.CommandContext(jobContext, "cmd", "/C", script)
+	}
+
+	return exec.CommandContext(jobContext, "sh", "-c", script)
+}
+
+// normalizePath converts the path separators of Windows paths to `/`,
+// which is what watch paths and globs are written with.
+func normalizePath(p string) string {
+	if goos == "windows" {
+		return strings.ReplaceAll(p, `\`, "/")
+	}
+
+	return p
+}
+
 func env(key, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
 		return value
@@ -37,3 +153,49 @@ func env(key, fallback string) string {
 
 	return fallback
 }
+
+// pluralize appends an "s" to word unless count is one
+func pluralize(count int, word string) string {
+	if count == 1 {
+		return word
+	}
+
+	return word + "s"
+}
+
+// sleep waits for the duration, or until the job is cancelled.
+// It is replaced in tests to avoid waiting between retries.
+var sleep = func(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-jobContext.Done():
+	}
+}
+
+// retry calls fn until it succeeds or has been retried `retries` times. The delay
+// between attempts grows exponentially from backoff, with up to 50% random jitter.
+func retry(retries int, backoff time.Duration, fn func() error) error {
+	return retryIf(retries, backoff, func(error) bool { return true }, fn)
+}
+
+// retryIf is retry for the errors that retryable accepts, other errors are returned immediately
+func retryIf(retries int, backoff time.Duration, retryable func(error) bool, fn func() error) error {
+	err := fn()
+
+	for attempt := 0; err != nil && attempt < retries && retryable(err) && !cancelled(); attempt++ {
+		delay := backoff << uint(attempt)
+		if delay > 0 {
+			delay += time.Duration(rand.Int63n(int64(delay)/2 + 1))
+		}
+
+		log.Warnf("%v, retrying in %s (%d/%d)", err, delay.Round(time.Millisecond), attempt+1, retries)
+		sleep(delay)
+
+		err = fn()
+	}
+
+	return err
+}
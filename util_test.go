@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetrySucceedsAfterFailures(t *testing.T) {
+	var delays []time.Duration
+	sleep = func(d time.Duration) { delays = append(delays, d) }
+	defer func() { sleep = func(time.Duration) {} }()
+
+	calls := 0
+	err := retry(3, time.Second, func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("agent unavailable")
+		}
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Len(t, delays, 2)
+	assert.True(t, delays[0] >= time.Second && delays[0] <= 1500*time.Millisecond)
+	assert.True(t, delays[1] >= 2*time.Second && delays[1] <= 3*time.Second)
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	calls := 0
+	err := retry(2, time.Second, func() error {
+		calls++
+		return errors.New("agent unavailable")
+	})
+
+	assert.EqualError(t, err, "agent unavailable")
+	assert.Equal(t, 3, calls)
+}
+
+func TestPluralize(t *testing.T) {
+	assert.Equal(t, "pipeline", pluralize(1, "pipeline"))
+	assert.Equal(t, "pipelines", pluralize(0, "pipeline"))
+	assert.Equal(t, "pipelines", pluralize(4, "pipeline"))
+}
+
+func TestShellCommand(t *testing.T) {
+	assert.Equal(t, []string{"sh", "-c", "echo hello"}, shellCommand(nil, "echo hello").Args)
+	assert.Equal(t, []string{"/bin/bash", "-e", "-c", "echo hello"}, shellCommand([]string{"/bin/bash", "-e", "-c"}, "echo hello").Args)
+	assert.Equal(t, []string{"echo", "hello"}, shellCommand([]string{"none"}, " echo  hello").Args)
+
+	goos = "windows"
+	defer func() { goos = runtime.GOOS }()
+
+	assert.Equal(t, []string{"cmd", "/C", "echo hello"}, shellCommand(nil, "echo hello").Args)
+}
+
+func TestNormalizePath(t *testing.T) {
+	assert.Equal(t, `services\foo/main.go`, normalizePath(`services\foo/main.go`))
+
+	goos = "windows"
+	defer func() { goos = runtime.GOOS }()
+
+	assert.Equal(t, "services/foo/main.go", normalizePath(`services\foo\main.go`))
+}
+
+func TestCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	jobContext = ctx
+	defer func() { jobContext = context.Background() }()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err := executeCommand("sleep", []string{"10"})
+
+	assert.EqualError(t, err, "command `sleep` failed: signal: killed")
+	assert.True(t, cancelled())
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	calls := 0
+	err = retry(5, time.Second, func() error {
+		calls++
+		return errors.New("agent unavailable")
+	})
+
+	assert.EqualError(t, err, "agent unavailable")
+	assert.Equal(t, 1, calls)
+}
+
+func TestCancellationKillsChildProcesses(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("process groups are only killed on unix")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	jobContext = ctx
+	defer func() { jobContext = context.Background() }()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	// the sleep started by the shell keeps the output open unless it is killed too
+	start := time.Now()
+	_, err := executeCommand("sh", []string{"-c", "sleep 10 & wait"})
+
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	// agents don't always have the timezone database
+	_ "time/tzdata"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cronFields are the names and bounds of the fields of a cron expression
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	// 7 is also Sunday
+	{"day of week", 0, 7},
+}
+
+// ActiveHours is the time window a watch is triggered in, the minutes matched
+// by a cron expression in a timezone, e.g. `* 8-17 * * 1-5` for working hours
+type ActiveHours struct {
+	Cron     string
+	Location *time.Location
+	// fields are the values allowed by each field of the expression
+	fields [5][]bool
+	// anyDay reports whether the day of month and day of week are `*`
+	anyDay [2]bool
+}
+
+// parseActiveHours parses `active_hours: <cron>` or `active_hours: { cron: <cron>, timezone: <tz> }`
+func parseActiveHours(raw interface{}) (*ActiveHours, error) {
+	cron, timezone := "", "UTC"
+
+	switch value := raw.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		cron = value
+	case map[string]interface{}:
+		cron, _ = value["cron"].(string)
+		if tz, ok := value["timezone"].(string); ok {
+			timezone = tz
+		}
+	}
+
+	if cron == "" {
+		return nil, fmt.Errorf("invalid active_hours `%v`", raw)
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid active_hours timezone `%s`", timezone)
+	}
+
+	a := &ActiveHours{Cron: cron, Location: location}
+
+	parts := strings.Fields(cron)
+	if len(parts) != len(cronFields) {
+		return nil, fmt.Errorf("invalid active_hours `%s`, expected 5 fields", cron)
+	}
+
+	for i, part := range parts {
+		if a.fields[i], err = parseCronField(part, cronFields[i].min, cronFields[i].max); err != nil {
+			return nil, fmt.Errorf("invalid active_hours %s `%s`", cronFields[i].name, part)
+		}
+	}
+	a.anyDay = [2]bool{parts[2] == "*", parts[4] == "*"}
+	a.fields[4][0] = a.fields[4][0] || a.fields[4][7]
+
+	return a, nil
+}
+
+// parseCronField returns the values allowed by a field of a cron expression:
+// `*`, values, ranges and steps, separated by commas, e.g. `1-5` or `*/15`.
+// Like in cron, a step from a value, e.g. `5/15`, runs up to the maximum.
+func parseCronField(field string, min int, max int) ([]bool, error) {
+	allowed := make([]bool, max+1)
+
+	for _, item := range strings.Split(field, ",") {
+		step, stepped := 1, false
+		if i := strings.Index(item, "/"); i >= 0 {
+			s, err := strconv.Atoi(item[i+1:])
+			if err != nil || s < 1 {
+				return nil, fmt.Errorf("invalid step")
+			}
+			step, stepped = s, true
+			item = item[:i]
+		}
+
+		from, to := min, max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, err
+			}
+			to = from
+			if stepped {
+				to = max
+			}
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("out of range")
+		}
+
+		for v := from; v <= to; v += step {
+			allowed[v] = true
+		}
+	}
+
+	return allowed, nil
+}
+
+// active reports whether the time is within the window. Like in cron, when
+// both the day of month and the day of week are restricted, either can match.
+func (a *ActiveHours) active(t time.Time) bool {
+	t = t.In(a.Location)
+
+	if !a.fields[0][t.Minute()] || !a.fields[1][t.Hour()] || !a.fields[3][int(t.Month())] {
+		return false
+	}
+
+	dom, dow := a.fields[2][t.Day()], a.fields[4][int(t.Weekday())]
+	switch {
+	case a.anyDay[0] && a.anyDay[1]:
+		return true
+	case a.anyDay[0]:
+		return dow
+	case a.anyDay[1]:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// skipInactiveWatches skips the steps of the watches outside of their
+// `active_hours`, so expensive pipelines only run automatically in the window
+func skipInactiveWatches(watches []WatchConfig) []WatchConfig {
+	current := now()
+	result := make([]WatchConfig, len(watches))
+
+	for i, w := range watches {
+		result[i] = w
+
+		if w.ActiveHours != nil && !w.ActiveHours.active(current) {
+			result[i].Step.Skip = fmt.Sprintf("outside of the active hours `%s` (%s)", w.ActiveHours.Cron, w.ActiveHours.Location)
+			log.Infof("Skipping %s, outside of its active hours", stepName(w.Step))
+		}
+	}
+
+	return result
+}
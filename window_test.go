@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActiveHours(t *testing.T) {
+	// 2026-10-15 is a Thursday
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2026, 10, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	testCases := map[string]struct {
+		raw      interface{}
+		time     time.Time
+		expected bool
+	}{
+		"working hours":       {"* 8-17 * * 1-5", at(15, 9, 30), true},
+		"after hours":         {"* 8-17 * * 1-5", at(15, 18, 0), false},
+		"weekend":             {"* 8-17 * * 1-5", at(17, 9, 30), false},
+		"steps":               {"*/15 * * * *", at(15, 9, 30), true},
+		"off step":            {"*/15 * * * *", at(15, 9, 31), false},
+		"step from value":     {"5/15 * * * *", at(15, 9, 50), true},
+		"off step from value": {"5/15 * * * *", at(15, 9, 0), false},
+		"sunday as 7":         {"* * * * 7", at(18, 9, 0), true},
+		"range to sunday":     {"* * * * 5-7", at(18, 9, 0), true},
+		"list":                {"* 1,9 * * *", at(15, 9, 0), true},
+		"day of month or":     {"* * 1 * 4", at(15, 9, 0), true},
+		"day of month only":   {"* * 1 * *", at(15, 9, 0), false},
+		"month":               {"* * * 1-6 *", at(15, 9, 0), false},
+		"timezone":            {map[string]interface{}{"cron": "* 8-17 * * *", "timezone": "Australia/Sydney"}, at(15, 0, 0), true},
+		"timezone after":      {map[string]interface{}{"cron": "* 8-17 * * *", "timezone": "Australia/Sydney"}, at(15, 12, 0), false},
+		"timezone next day":   {map[string]interface{}{"cron": "* * * * 5", "timezone": "Australia/Sydney"}, at(15, 20, 0), true},
+		"utc default object":  {map[string]interface{}{"cron": "* 20 * * *"}, at(15, 20, 0), true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			a, err := parseActiveHours(tc.raw)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, a.active(tc.time))
+		})
+	}
+}
+
+func TestParseActiveHoursErrors(t *testing.T) {
+	testCases := map[string]struct {
+		raw interface{}
+		err string
+	}{
+		"fields":   {"* 8-17 * *", "invalid active_hours `* 8-17 * *`, expected 5 fields"},
+		"range":    {"* 8-24 * * *", "invalid active_hours hour `8-24`"},
+		"reversed": {"* 17-8 * * *", "invalid active_hours hour `17-8`"},
+		"step":     {"*/0 * * * *", "invalid active_hours minute `*/0`"},
+		"value":    {"* * * * mon", "invalid active_hours day of week `mon`"},
+		"weekday":  {"* * * * 8", "invalid active_hours day of week `8`"},
+		"timezone": {map[string]interface{}{"cron": "* * * * *", "timezone": "Mars/Olympus"}, "invalid active_hours timezone `Mars/Olympus`"},
+		"type":     {42.0, "invalid active_hours `42`"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseActiveHours(tc.raw)
+
+			assert.EqualError(t, err, tc.err)
+		})
+	}
+}
+
+func TestUploadPipelineSkipsInactiveWatches(t *testing.T) {
+	now = func() time.Time { return time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC) }
+	defer func() { now = time.Now }()
+
+	var generated []Step
+	generator := func(steps []Step, plugin Plugin) (*os.File, error) {
+		generated = steps
+		return mockGeneratePipeline(steps, plugin)
+	}
+
+	weekdays, err := parseActiveHours("* * * * 1-5")
+	assert.NoError(t, err)
+
+	plugin := Plugin{
+		Diff: "echo services/foo/main.go",
+		Watch: []WatchConfig{
+			{Paths: []string{"services/"}, Step: Step{Trigger: "foo"}},
+			{Paths: []string{"services/"}, Step: Step{Trigger: "e2e"}, ActiveHours: weekdays},
+		},
+	}
+
+	_, _, err = uploadPipeline(plugin, generator)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Step{
+		{Trigger: "foo"},
+		{Trigger: "e2e", Skip: "outside of the active hours `* * * * 1-5` (UTC)"},
+	}, generated)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// enterWorkdir changes to the workdir, then to the root of the git repository
+// containing it, so watch paths, diffs and `git ls-files` are always relative
+// to the repository root, even when the step runs from a subdirectory.
+// Outside of a git repository the plugin runs from the workdir.
+func enterWorkdir(workdir string) (string, error) {
+	if workdir != "" {
+		if err := os.Chdir(workdir); err != nil {
+			return "", fmt.Errorf("invalid workdir: %v", err)
+		}
+	}
+
+	root, err := gitRoot()
+	if err != nil {
+		log.Debugf("Not in a git repository, running from the working directory: %v", err)
+		return os.Getwd()
+	}
+
+	if err := os.Chdir(root); err != nil {
+		return "", fmt.Errorf("could not change to the repository root: %v", err)
+	}
+
+	return root, nil
+}
+
+// gitRoot returns the root of the git repository of the working directory
+func gitRoot() (string, error) {
+	out, err := executeCommand("git", []string{"rev-parse", "--show-toplevel"})
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(out), nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnterWorkdir(t *testing.T) {
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+
+	dir, _ := ioutil.TempDir("", "monorepo-diff-workdir")
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+
+	repo := filepath.Join(dir, "checkout")
+	assert.NoError(t, os.MkdirAll(filepath.Join(repo, "services", "foo"), 0755))
+	assert.NoError(t, exec.Command("git", "init", "-q", repo).Run())
+
+	testCases := map[string]struct {
+		cwd      string
+		workdir  string
+		expected string
+	}{
+		"subdirectory":    {filepath.Join(repo, "services", "foo"), "", repo},
+		"nested checkout": {dir, "checkout/services", repo},
+		"no repository":   {dir, "", dir},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, os.Chdir(tc.cwd))
+
+			root, err := enterWorkdir(tc.workdir)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, root)
+
+			wd, _ := os.Getwd()
+			assert.Equal(t, tc.expected, wd)
+		})
+	}
+}
+
+func TestEnterWorkdirInvalid(t *testing.T) {
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+
+	_, err := enterWorkdir("does/not/exist")
+
+	assert.EqualError(t, err, "invalid workdir: chdir does/not/exist: no such file or directory")
+}